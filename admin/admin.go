@@ -1,14 +1,23 @@
 package admin
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
 
 	"github.com/imgk/caddy-trojan/app"
+	"github.com/imgk/caddy-trojan/trojan"
 )
 
 func init() {
@@ -19,6 +28,17 @@ func init() {
 type Admin struct {
 	// Upstream is ...
 	Upstream app.Upstream
+	// Connections is ...
+	Connections *app.Connections
+	// Metrics is ...
+	Metrics *app.Metrics
+	// Relays is ...
+	Relays *app.Relays
+	// Tenants is ...
+	Tenants *app.Tenants
+
+	ctx caddy.Context
+	lg  *zap.Logger
 }
 
 // CaddyModule returns the Caddy module information.
@@ -31,6 +51,7 @@ func (Admin) CaddyModule() caddy.ModuleInfo {
 
 // Provision is ...
 func (al *Admin) Provision(ctx caddy.Context) error {
+	al.ctx, al.lg = ctx, ctx.Logger(al)
 	if !ctx.AppIsConfigured(app.CaddyAppID) {
 		return errors.New("trojan is not configured")
 	}
@@ -40,6 +61,10 @@ func (al *Admin) Provision(ctx caddy.Context) error {
 	}
 	app := mod.(*app.App)
 	al.Upstream = app.Upstream()
+	al.Connections = app.Connections()
+	al.Metrics = app.Metrics()
+	al.Relays = app.Relays()
+	al.Tenants = app.Tenants()
 	return nil
 }
 
@@ -48,39 +73,388 @@ func (al *Admin) Routes() []caddy.AdminRoute {
 	return []caddy.AdminRoute{
 		{
 			Pattern: "/trojan/users",
-			Handler: caddy.AdminHandlerFunc(al.GetUsers),
+			Handler: caddy.AdminHandlerFunc(al.tenant((*Admin).Users)),
+		},
+		{
+			Pattern: "/trojan/users/",
+			Handler: caddy.AdminHandlerFunc(al.tenant((*Admin).User)),
 		},
 		{
 			Pattern: "/trojan/users/add",
-			Handler: caddy.AdminHandlerFunc(al.AddUser),
+			Handler: caddy.AdminHandlerFunc(al.tenant((*Admin).AddUser)),
 		},
 		{
 			Pattern: "/trojan/users/del",
-			Handler: caddy.AdminHandlerFunc(al.DelUser),
+			Handler: caddy.AdminHandlerFunc(al.tenant((*Admin).DelUser)),
+		},
+		{
+			Pattern: "/trojan/metrics",
+			Handler: caddy.AdminHandlerFunc(al.GetMetrics),
+		},
+		{
+			Pattern: "/trojan/health",
+			Handler: caddy.AdminHandlerFunc(al.GetHealth),
+		},
+		{
+			Pattern: "/trojan/test",
+			Handler: caddy.AdminHandlerFunc(al.tenant((*Admin).TestUpstream)),
+		},
+		{
+			Pattern: "/trojan/migrate",
+			Handler: caddy.AdminHandlerFunc(al.Migrate),
+		},
+		{
+			Pattern: "/trojan/kick",
+			Handler: caddy.AdminHandlerFunc(al.Kick),
+		},
+		{
+			Pattern: "/trojan/traffic",
+			Handler: caddy.AdminHandlerFunc(al.tenant((*Admin).GetTotalTraffic)),
 		},
+		{
+			Pattern: "/trojan/events",
+			Handler: caddy.AdminHandlerFunc(al.GetEvents),
+		},
+	}
+}
+
+// tenant returns a handler of the upstream of the tenant of the server name
+// of the tenant query, or of the default upstream without the query.
+func (al *Admin) tenant(fn func(*Admin, http.ResponseWriter, *http.Request) error) caddy.AdminHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		name := r.URL.Query().Get("tenant")
+		if name == "" {
+			return fn(al, w, r)
+		}
+		t, _ := al.Tenants.Get(name)
+		if t.Upstream == nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusNotFound,
+				Err:        fmt.Errorf("tenant %v not found", name),
+			}
+		}
+		m := *al
+		m.Upstream = t.Upstream
+		return fn(&m, w, r)
+	}
+}
+
+// Users handles GET /trojan/users to list users and
+// POST /trojan/users to add a user.
+func (al *Admin) Users(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		return al.GetUsers(w, r)
+	case http.MethodPost:
+		return al.CreateUser(w, r)
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method %v not allowed", r.Method),
+		}
 	}
 }
 
-// GetUsers is ...
+// User handles DELETE /trojan/users/{key} to delete a user,
+// PUT /trojan/users/{key} to set labels and expiry of a user and
+// HEAD /trojan/users/{key} to check a user exists, key is the
+// hex key or the base64 key listed by GET /trojan/users.
+func (al *Admin) User(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodDelete && r.Method != http.MethodPut && r.Method != http.MethodHead {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method %v not allowed", r.Method),
+		}
+	}
+
+	// padding of base64 key may be escaped by clients
+	k, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/trojan/users/"))
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+	}
+	key, err := parseKey(k)
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+	}
+	if r.Method == http.MethodPut {
+		return al.SetUser(w, r, key)
+	}
+	if r.Method == http.MethodHead {
+		// a disabled or expired user still exists
+		ok, err := al.Upstream.Has(r.Context(), key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: app.ErrUserNotFound}
+		}
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	if err := al.Upstream.DelKey(r.Context(), key); err != nil {
+		return err
+	}
+	al.Relays.Revoke(key)
+
+	return writeJSON(w, http.StatusOK, map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(key))})
+}
+
+// SetUser updates the user with the fields in the body, fields which are
+// not in the body are kept. labels replaces labels of the user,
+// expires_at sets the time the user expires, null for never,
+// source_ip sets the address connections of the user are dialed from,
+// null for the default route, allowed_cidrs sets the networks clients of
+// the user must connect from, null for all, rate_limit sets the rate
+// limit of the user in bytes per second, 0 for the default of the app,
+// and enabled enables or disables the user.
+func (al *Admin) SetUser(w http.ResponseWriter, r *http.Request, key string) error {
+	fields := map[string]json.RawMessage{}
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+	}
+
+	update := []func() error{}
+	if b, ok := fields["labels"]; ok {
+		labels := map[string]string(nil)
+		if err := json.Unmarshal(b, &labels); err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("parse labels error: %w", err)}
+		}
+		update = append(update, func() error {
+			return al.Upstream.SetLabels(r.Context(), key, labels)
+		})
+	}
+	if b, ok := fields["source_ip"]; ok {
+		// null or empty is the default route
+		s := ""
+		if err := json.Unmarshal(b, &s); err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("parse source_ip error: %w", err)}
+		}
+		ip := net.ParseIP(s)
+		if s != "" && ip == nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("invalid source_ip: %v", s)}
+		}
+		update = append(update, func() error {
+			return al.Upstream.SetSourceIP(r.Context(), key, ip)
+		})
+	}
+	if b, ok := fields["allowed_cidrs"]; ok {
+		cidrs := []string(nil)
+		if err := json.Unmarshal(b, &cidrs); err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("parse allowed_cidrs error: %w", err)}
+		}
+		update = append(update, func() error {
+			return al.Upstream.SetAllowedCIDRs(r.Context(), key, cidrs)
+		})
+	}
+	if b, ok := fields["rate_limit"]; ok {
+		n := int64(0)
+		if err := json.Unmarshal(b, &n); err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("parse rate_limit error: %w", err)}
+		}
+		if n < 0 {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("negative rate_limit: %v", n)}
+		}
+		update = append(update, func() error {
+			return al.Upstream.SetRateLimit(r.Context(), key, n)
+		})
+	}
+	if b, ok := fields["expires_at"]; ok {
+		// null is the zero time
+		t := time.Time{}
+		if err := json.Unmarshal(b, &t); err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("parse expires_at error: %w", err)}
+		}
+		update = append(update, func() error {
+			return al.Upstream.SetExpiry(r.Context(), key, t)
+		})
+	}
+	disabled := false
+	if b, ok := fields["enabled"]; ok {
+		enabled := false
+		if err := json.Unmarshal(b, &enabled); err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("parse enabled error: %w", err)}
+		}
+		disabled = !enabled
+		update = append(update, func() error {
+			return al.Upstream.SetEnabled(r.Context(), key, enabled)
+		})
+	}
+	for _, fn := range update {
+		if err := fn(); err != nil {
+			if errors.Is(err, app.ErrUserNotFound) {
+				return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: err}
+			}
+			if errors.Is(err, app.ErrSourceIPNotBound) || errors.Is(err, app.ErrInvalidCIDR) {
+				return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+			}
+			return err
+		}
+	}
+	if disabled {
+		al.Relays.Revoke(key)
+	}
+
+	return writeJSON(w, http.StatusOK, map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(key))})
+}
+
+// CreateUser is ...
+func (al *Admin) CreateUser(w http.ResponseWriter, r *http.Request) error {
+	type User struct {
+		Password  string            `json:"password,omitempty"`
+		Key       string            `json:"key,omitempty"`
+		Labels    map[string]string `json:"labels,omitempty"`
+		ExpiresAt *time.Time        `json:"expires_at,omitempty"`
+	}
+
+	user := User{}
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+	}
+
+	key := ""
+	switch {
+	case user.Key != "":
+		k, err := parseKey(user.Key)
+		if err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+		}
+		key = k
+	case user.Password != "":
+		b := [trojan.HeaderLen]byte{}
+		app.GenKey(al.Upstream, user.Password, b[:])
+		key = string(b[:])
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        errors.New("password or key is required"),
+		}
+	}
+	if err := al.Upstream.AddKey(r.Context(), key); err != nil {
+		return err
+	}
+	if user.Labels != nil {
+		if err := al.Upstream.SetLabels(r.Context(), key, user.Labels); err != nil {
+			return err
+		}
+	}
+	if user.ExpiresAt != nil {
+		if err := al.Upstream.SetExpiry(r.Context(), key, *user.ExpiresAt); err != nil {
+			return err
+		}
+	}
+
+	return writeJSON(w, http.StatusCreated, map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(key))})
+}
+
+// parseKey returns the hex key from a hex key or a base64 key.
+func parseKey(k string) (string, error) {
+	// base64.StdEncoding.EncodeToString(hex.Encode(sha256.Sum224([]byte("Test1234"))))
+	const AuthLen = 76
+
+	switch len(k) {
+	case trojan.HeaderLen:
+	case AuthLen:
+		b, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			return "", fmt.Errorf("invalid key: %w", err)
+		}
+		k = string(b)
+	default:
+		return "", errors.New("invalid key length")
+	}
+	key := [trojan.HeaderLen]byte{}
+	if err := trojan.ParseHexKey(k, key[:]); err != nil {
+		return "", err
+	}
+	return string(key[:]), nil
+}
+
+// writeJSON is ...
+func writeJSON(w http.ResponseWriter, code int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	return json.NewEncoder(w).Encode(v)
+}
+
+// GetUsers lists users with their traffic, or only their keys with
+// ?traffic=false, which does not load the traffic of users.
 func (al *Admin) GetUsers(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != http.MethodGet {
 		return errors.New("get trojan user method error")
 	}
+	if v := r.URL.Query().Get("traffic"); v != "" {
+		traffic, err := strconv.ParseBool(v)
+		if err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("parse traffic error: %w", err)}
+		}
+		if !traffic {
+			return al.getKeys(w, r)
+		}
+	}
 
 	type User struct {
-		Key  string `json:"key"`
-		Up   int64  `json:"up"`
-		Down int64  `json:"down"`
+		Key          string            `json:"key"`
+		Up           int64             `json:"up"`
+		Down         int64             `json:"down"`
+		UpTCP        int64             `json:"up_tcp"`
+		DownTCP      int64             `json:"down_tcp"`
+		UpUDP        int64             `json:"up_udp"`
+		DownUDP      int64             `json:"down_udp"`
+		Connections  int32             `json:"connections"`
+		LastSeen     *time.Time        `json:"last_seen,omitempty"`
+		ExpiresAt    *time.Time        `json:"expires_at,omitempty"`
+		Labels       map[string]string `json:"labels,omitempty"`
+		SourceIP     string            `json:"source_ip,omitempty"`
+		AllowedCIDRs []string          `json:"allowed_cidrs,omitempty"`
+		RateLimit    int64             `json:"rate_limit,omitempty"`
 	}
 
 	users := make([]User, 0)
-	al.Upstream.Range(func(key string, up, down int64) {
-		users = append(users, User{Key: key, Up: up, Down: down})
+	err := al.Upstream.Range(r.Context(), func(key string, traffic app.Traffic) {
+		user := User{
+			Key:          key,
+			Up:           traffic.Up,
+			Down:         traffic.Down,
+			UpTCP:        traffic.UpTCP(),
+			DownTCP:      traffic.DownTCP(),
+			UpUDP:        traffic.UpUDP,
+			DownUDP:      traffic.DownUDP,
+			Connections:  al.Connections.Count(key),
+			Labels:       traffic.Labels,
+			SourceIP:     traffic.SourceIP,
+			AllowedCIDRs: traffic.AllowedCIDRs,
+			RateLimit:    traffic.RateLimit,
+		}
+		if t := traffic.LastSeen; !t.IsZero() {
+			user.LastSeen = &t
+		}
+		if t := traffic.ExpiresAt; !t.IsZero() {
+			user.ExpiresAt = &t
+		}
+		users = append(users, user)
 	})
+	if err != nil {
+		return err
+	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(users)
-	return nil
+	return writeJSON(w, http.StatusOK, users)
+}
+
+// getKeys lists the keys of users by ListKeys of the upstream.
+func (al *Admin) getKeys(w http.ResponseWriter, r *http.Request) error {
+	type User struct {
+		Key string `json:"key"`
+	}
+
+	keys, err := al.Upstream.ListKeys(r.Context())
+	if err != nil {
+		return err
+	}
+	users := make([]User, 0, len(keys))
+	for _, k := range keys {
+		users = append(users, User{Key: k})
+	}
+	return writeJSON(w, http.StatusOK, users)
 }
 
 // AddUser is ...
@@ -103,13 +477,13 @@ func (al *Admin) AddUser(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 	if user.Key != "" {
-		al.Upstream.AddKey(user.Key)
+		al.Upstream.AddKey(r.Context(), user.Key)
 
 		w.WriteHeader(http.StatusOK)
 		return nil
 	}
 	if user.Password != "" {
-		al.Upstream.Add(user.Password)
+		al.Upstream.Add(r.Context(), user.Password)
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -136,19 +510,346 @@ func (al *Admin) DelUser(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 	if user.Key != "" {
-		al.Upstream.DelKey(user.Key)
+		if al.Upstream.DelKey(r.Context(), user.Key) == nil {
+			al.Relays.Revoke(user.Key)
+		}
 
 		w.WriteHeader(http.StatusOK)
 		return nil
 	}
 	if user.Password != "" {
-		al.Upstream.Del(user.Password)
+		if al.Upstream.Del(r.Context(), user.Password) == nil {
+			key := [trojan.HeaderLen]byte{}
+			app.GenKey(al.Upstream, user.Password, key[:])
+			al.Relays.Revoke(string(key[:]))
+		}
 	}
 
 	w.WriteHeader(http.StatusOK)
 	return nil
 }
 
+// GetMetrics is ...
+func (al *Admin) GetMetrics(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return errors.New("get trojan metrics method error")
+	}
+	if al.Metrics == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        errors.New("trojan metrics is not enabled"),
+		}
+	}
+
+	al.Metrics.ServeHTTP(w, r)
+	return nil
+}
+
+// GetHealth handles GET /trojan/health for readiness probes, it fails with
+// 503 if the backing store of the upstream is not reachable.
+func (al *Admin) GetHealth(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method %v not allowed", r.Method),
+		}
+	}
+	if err := al.Upstream.Ping(r.Context()); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusServiceUnavailable,
+			Err:        fmt.Errorf("ping upstream error: %w", err),
+		}
+	}
+
+	return writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// eventsBuffer is the number of events buffered for a client of
+// GET /trojan/events, events are dropped once it is full.
+const eventsBuffer = 1024
+
+// eventsKeepAlive is the interval of comments written to a client of
+// GET /trojan/events without events, so proxies do not close it as idle.
+const eventsKeepAlive = 15 * time.Second
+
+// GetEvents handles GET /trojan/events to stream events of trojan as
+// server-sent events, of which the event is the name of the event and the
+// data is the JSON of app.Event, for live views without polling. Events of
+// connections of app.LiveEvents are fired only while there is a client.
+// Events which a slow client does not receive in time are dropped, and
+// trojan.events_dropped is sent with the number of them.
+func (al *Admin) GetEvents(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method %v not allowed", r.Method),
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        errors.New("streaming is not supported"),
+		}
+	}
+	// the admin server has a read timeout, which would end the stream,
+	// as http.ResponseController of go1.20 does
+	if rd, ok := w.(interface{ SetReadDeadline(time.Time) error }); ok {
+		rd.SetReadDeadline(time.Time{})
+	}
+	// the stream ends when the config is unloaded
+	var unloaded <-chan struct{}
+	if al.ctx.Context != nil {
+		unloaded = al.ctx.Done()
+	}
+
+	live, global := app.LiveEvents.Subscribe(eventsBuffer), app.GlobalEvents.Subscribe(eventsBuffer)
+	defer live.Close()
+	defer global.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		ev := app.Event{}
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-unloaded:
+			return nil
+		case ev = <-live.C:
+		case ev = <-global.C:
+		case now := <-ticker.C:
+			if n := live.Dropped() + global.Dropped(); n > 0 {
+				ev = app.Event{Name: "trojan.events_dropped", Time: now, Data: map[string]interface{}{"dropped": n}}
+				break
+			}
+			if now.Sub(last) < eventsKeepAlive {
+				continue
+			}
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return nil
+			}
+			flusher.Flush()
+			last = now
+			continue
+		}
+
+		b, err := json.Marshal(&ev)
+		if err != nil {
+			al.lg.Error(fmt.Sprintf("marshal event error: %v", err))
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Name, b); err != nil {
+			// the client is gone
+			return nil
+		}
+		flusher.Flush()
+		last = time.Now()
+	}
+}
+
+// Migrate handles POST /trojan/migrate to copy users of another upstream to
+// the upstream of the app, or users of the upstream of the app to another
+// upstream. The body is {"from": upstream} or {"to": upstream}, where
+// upstream is the JSON config of the upstream of the trojan app, which is
+// provisioned for the migration and cleaned up after it. It replies the
+// app.MigrateResult, and is safe to be called again after a failure.
+func (al *Admin) Migrate(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method %v not allowed", r.Method),
+		}
+	}
+
+	type Body struct {
+		From json.RawMessage `json:"from,omitempty"`
+		To   json.RawMessage `json:"to,omitempty"`
+	}
+
+	body := Body{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+	}
+	if (body.From == nil) == (body.To == nil) {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        errors.New("one of from and to is required"),
+		}
+	}
+
+	// the other upstream is cleaned up when ctx is cancelled
+	ctx, cancel := caddy.NewContext(al.ctx)
+	defer cancel()
+
+	raw := body.From
+	if body.To != nil {
+		raw = body.To
+	}
+	mod, err := loadUpstream(ctx, raw)
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("load upstream error: %w", err)}
+	}
+	dst, src := al.Upstream, mod
+	if body.To != nil {
+		dst, src = src, dst
+	}
+
+	res, err := app.Migrate(r.Context(), dst, src, al.lg)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, res)
+}
+
+// loadUpstream loads and provisions the upstream of raw, of which the module
+// name is the upstream key, as the upstream of the trojan app.
+func loadUpstream(ctx caddy.Context, raw json.RawMessage) (app.Upstream, error) {
+	config := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	name := ""
+	if err := json.Unmarshal(config["upstream"], &name); err != nil || name == "" {
+		return nil, errors.New("upstream is not specified")
+	}
+	delete(config, "upstream")
+	b, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	mod, err := ctx.LoadModuleByID("trojan.upstreams."+name, b)
+	if err != nil {
+		return nil, err
+	}
+	up, ok := mod.(app.Upstream)
+	if !ok {
+		return nil, fmt.Errorf("module %v is not an upstream", name)
+	}
+	return up, nil
+}
+
+// Kick handles POST /trojan/kick to close active relays of the user of the
+// password or the key of the body at once, which is the hex key or the
+// base64 key. It does not delete or disable the user, so the user may
+// connect again.
+func (al *Admin) Kick(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method %v not allowed", r.Method),
+		}
+	}
+
+	type User struct {
+		Password string `json:"password,omitempty"`
+		Key      string `json:"key,omitempty"`
+	}
+
+	user := User{}
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+	}
+	key := ""
+	switch {
+	case user.Key != "":
+		k, err := parseKey(user.Key)
+		if err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+		}
+		key = k
+	case user.Password != "":
+		b := [trojan.HeaderLen]byte{}
+		app.GenKey(al.Upstream, user.Password, b[:])
+		key = string(b[:])
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        errors.New("password or key is required"),
+		}
+	}
+
+	type Result struct {
+		Key    string `json:"key"`
+		Relays int    `json:"relays"`
+	}
+
+	n := al.Relays.Kick(key)
+	return writeJSON(w, http.StatusOK, Result{Key: base64.StdEncoding.EncodeToString([]byte(key)), Relays: n})
+}
+
+// GetTotalTraffic handles GET /trojan/traffic to get the traffic of all
+// users, which is kept after users are reset or deleted.
+func (al *Admin) GetTotalTraffic(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method %v not allowed", r.Method),
+		}
+	}
+
+	type Total struct {
+		Up   int64 `json:"up"`
+		Down int64 `json:"down"`
+	}
+
+	up, down, err := al.Upstream.TotalTraffic(r.Context())
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("get total traffic error: %w", err),
+		}
+	}
+	return writeJSON(w, http.StatusOK, Total{Up: up, Down: down})
+}
+
+// TestUpstream handles POST /trojan/test to check the upstream works by
+// app.TestUpstream, with the password of the body if set. It returns the
+// steps with their time, and fails with 503 if a step fails.
+func (al *Admin) TestUpstream(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method %v not allowed", r.Method),
+		}
+	}
+
+	type Test struct {
+		Password string `json:"password,omitempty"`
+	}
+
+	test := Test{}
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &test); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("decode test error: %w", err),
+			}
+		}
+	}
+
+	type Result struct {
+		Steps []app.UpstreamStep `json:"steps"`
+		Error string             `json:"error,omitempty"`
+	}
+
+	steps, err := app.TestUpstream(r.Context(), al.Upstream, test.Password)
+	if err != nil {
+		return writeJSON(w, http.StatusServiceUnavailable, Result{Steps: steps, Error: err.Error()})
+	}
+	return writeJSON(w, http.StatusOK, Result{Steps: steps})
+}
+
 // Interface guards
 var (
 	_ caddy.AdminRouter = (*Admin)(nil)
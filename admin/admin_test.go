@@ -0,0 +1,632 @@
+package admin
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/app"
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+func TestParseKey(t *testing.T) {
+	// hex of sha224 of "abc"
+	const hexKey = "23097d223405d8228642a477bda255b32aadbce4bda0b3f7e36c9da7"
+
+	for _, k := range []string{
+		hexKey,
+		strings.ToUpper(hexKey),
+		base64.StdEncoding.EncodeToString([]byte(hexKey)),
+	} {
+		key, err := parseKey(k)
+		if err != nil {
+			t.Errorf("parse key %v error: %v", k, err)
+			continue
+		}
+		if key != hexKey {
+			t.Errorf("parse key %v error: got %v", k, key)
+		}
+	}
+
+	for _, k := range []string{"", "abc", strings.Repeat("g", trojan.HeaderLen), strings.Repeat("!", 76)} {
+		if _, err := parseKey(k); err == nil {
+			t.Errorf("parse invalid key %v", k)
+		}
+	}
+}
+
+// statusOf returns the http status of an error of admin handlers.
+func statusOf(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	apiErr := caddy.APIError{}
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatus
+	}
+	return http.StatusInternalServerError
+}
+
+func TestCreateUser(t *testing.T) {
+	al := &Admin{Upstream: &app.MemoryUpstream{}}
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+
+	for _, body := range []string{
+		`{"password":"test1234"}`,
+		fmt.Sprintf(`{"key":"%s"}`, key[:]),
+		fmt.Sprintf(`{"key":"%s"}`, base64.StdEncoding.EncodeToString(key[:])),
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/trojan/users", strings.NewReader(body))
+		if err := al.Users(w, r); err != nil {
+			t.Fatalf("create user %v error: %v", body, err)
+		}
+		if w.Code != http.StatusCreated {
+			t.Errorf("create user %v error: status %v", body, w.Code)
+		}
+		v := map[string]string{}
+		if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil || v["key"] != base64.StdEncoding.EncodeToString(key[:]) {
+			t.Errorf("create user %v error: response %s", body, w.Body.Bytes())
+		}
+	}
+	if ok, err := al.Upstream.Validate(context.Background(), utils.ByteSliceToString(key[:])); err != nil || !ok {
+		t.Errorf("validate created user error")
+	}
+
+	for _, body := range []string{`{}`, `{"key":"abc"}`, `not json`} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/trojan/users", strings.NewReader(body))
+		if code := statusOf(al.Users(w, r)); code != http.StatusBadRequest {
+			t.Errorf("create user %v error: status %v", body, code)
+		}
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	al := &Admin{Upstream: &app.MemoryUpstream{}}
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	if err := al.Upstream.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+
+	// padding of base64 key is escaped by clients
+	escaped := strings.ReplaceAll(base64.StdEncoding.EncodeToString(key[:]), "=", "%3D")
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodDelete, "/trojan/users/"+escaped, nil)
+	if err := al.User(w, r); err != nil {
+		t.Fatalf("delete user error: %v", err)
+	}
+	if w.Code != http.StatusOK {
+		t.Errorf("delete user error: status %v", w.Code)
+	}
+	if ok, err := al.Upstream.Validate(context.Background(), utils.ByteSliceToString(key[:])); err != nil || ok {
+		t.Errorf("validate deleted user")
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodDelete, "/trojan/users/abc", nil)
+	if code := statusOf(al.User(w, r)); code != http.StatusBadRequest {
+		t.Errorf("delete user with invalid key error: status %v", code)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	al := &Admin{Upstream: &app.MemoryUpstream{}}
+
+	for _, v := range []struct {
+		Method  string
+		Target  string
+		Handler func(http.ResponseWriter, *http.Request) error
+	}{
+		{Method: http.MethodPut, Target: "/trojan/users", Handler: al.Users},
+		{Method: http.MethodGet, Target: "/trojan/users/abc", Handler: al.User},
+		{Method: http.MethodPost, Target: "/trojan/users/abc", Handler: al.User},
+		{Method: http.MethodPost, Target: "/trojan/health", Handler: al.GetHealth},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(v.Method, v.Target, nil)
+		if code := statusOf(v.Handler(w, r)); code != http.StatusMethodNotAllowed {
+			t.Errorf("%v %v error: status %v", v.Method, v.Target, code)
+		}
+	}
+}
+
+func TestUserLabels(t *testing.T) {
+	al := &Admin{Upstream: &app.MemoryUpstream{}, Connections: &app.Connections{}}
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := base64.StdEncoding.EncodeToString(key[:])
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/trojan/users", strings.NewReader(`{"password":"test1234","labels":{"name":"test"}}`))
+	if err := al.Users(w, r); err != nil {
+		t.Fatalf("create user error: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPut, "/trojan/users/"+k, strings.NewReader(`{"labels":{"name":"test","email":"test@example.com"}}`))
+	if err := al.User(w, r); err != nil {
+		t.Fatalf("set labels error: %v", err)
+	}
+
+	type User struct {
+		Key    string            `json:"key"`
+		Labels map[string]string `json:"labels"`
+	}
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/trojan/users", nil)
+	if err := al.Users(w, r); err != nil {
+		t.Fatalf("list users error: %v", err)
+	}
+	users := []User{}
+	if err := json.Unmarshal(w.Body.Bytes(), &users); err != nil {
+		t.Fatalf("list users error: %v", err)
+	}
+	if len(users) != 1 || users[0].Key != k || users[0].Labels["name"] != "test" || users[0].Labels["email"] != "test@example.com" {
+		t.Errorf("list users error: %s", w.Body.Bytes())
+	}
+
+	// a disabled user still exists
+	al.Upstream.SetEnabled(context.Background(), string(key[:]), false)
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodHead, "/trojan/users/"+k, nil)
+	if err := al.User(w, r); err != nil || w.Code != http.StatusOK {
+		t.Errorf("check user error: %v, status %v", err, w.Code)
+	}
+
+	trojan.GenKey("unknown", key[:])
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodHead, "/trojan/users/"+string(key[:]), nil)
+	if code := statusOf(al.User(w, r)); code != http.StatusNotFound {
+		t.Errorf("check unknown user error: status %v", code)
+	}
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPut, "/trojan/users/"+string(key[:]), strings.NewReader(`{"labels":{}}`))
+	if code := statusOf(al.User(w, r)); code != http.StatusNotFound {
+		t.Errorf("set labels of unknown user error: status %v", code)
+	}
+}
+
+func TestGetUsersKeys(t *testing.T) {
+	up := &app.MemoryUpstream{}
+	al := &Admin{Upstream: up, Connections: &app.Connections{}}
+	for _, v := range []string{"test1234", "test5678"} {
+		if err := up.Add(context.Background(), v); err != nil {
+			t.Fatalf("add user error: %v", err)
+		}
+	}
+	want := map[string]bool{}
+	up.Range(context.Background(), func(k string, _ app.Traffic) { want[k] = true })
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/trojan/users?traffic=false", nil)
+	if err := al.Users(w, r); err != nil {
+		t.Fatalf("list keys error: %v", err)
+	}
+	users := []map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &users); err != nil {
+		t.Fatalf("list keys error: %v", err)
+	}
+	if len(users) != len(want) {
+		t.Fatalf("list keys error: %s", w.Body.Bytes())
+	}
+	for _, user := range users {
+		if k, _ := user["key"].(string); !want[k] || len(user) != 1 {
+			t.Errorf("list keys error: %v", user)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/trojan/users?traffic=maybe", nil)
+	if code := statusOf(al.Users(w, r)); code != http.StatusBadRequest {
+		t.Errorf("list users of invalid traffic error: status %v", code)
+	}
+}
+
+func TestGetEvents(t *testing.T) {
+	up := &app.MemoryUpstream{}
+	if err := up.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := utils.ByteSliceToString(key[:])
+
+	al := &Admin{Upstream: up, lg: zap.NewNop()}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := al.GetEvents(w, r); err != nil {
+			t.Errorf("get events error: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	resp, err := srv.Client().Do(r)
+	if err != nil {
+		t.Fatalf("get events error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("get events error: %v, %v", resp.StatusCode, resp.Header)
+	}
+
+	sc := bufio.NewScanner(resp.Body)
+	// next checks the next event is of name
+	next := func(name string) {
+		t.Helper()
+		if !sc.Scan() || sc.Text() != "event: "+name {
+			t.Fatalf("event error: %q, want %v", sc.Text(), name)
+		}
+		if !sc.Scan() || !strings.HasPrefix(sc.Text(), "data: ") {
+			t.Fatalf("data of %v error: %q", name, sc.Text())
+		}
+		ev := app.Event{}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(sc.Text(), "data: ")), &ev); err != nil {
+			t.Fatalf("unmarshal %v error: %v", name, err)
+		}
+		if ev.Name != name || ev.Data["key"] != base64.StdEncoding.EncodeToString(key[:]) {
+			t.Errorf("event of %v error: %+v", name, ev)
+		}
+		if !sc.Scan() || sc.Text() != "" {
+			t.Fatalf("end of %v error: %q", name, sc.Text())
+		}
+	}
+
+	// events of connections and of upstreams are streamed
+	m := (*app.Accounting)(nil).Start(up, k)
+	m.Close(app.ProtocolTCP, 1, 2)
+	next(app.EventConnectionOpened)
+	next(app.EventConnectionClosed)
+	app.GlobalEvents.Emit(app.EventQuotaExceeded, map[string]interface{}{"key": base64.StdEncoding.EncodeToString(key[:])})
+	next(app.EventQuotaExceeded)
+}
+
+func TestUserExpiry(t *testing.T) {
+	al := &Admin{Upstream: &app.MemoryUpstream{}, Connections: &app.Connections{}}
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := base64.StdEncoding.EncodeToString(key[:])
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/trojan/users", strings.NewReader(`{"password":"test1234","labels":{"name":"test"},"expires_at":"2100-01-01T00:00:00Z"}`))
+	if err := al.Users(w, r); err != nil {
+		t.Fatalf("create user error: %v", err)
+	}
+
+	type User struct {
+		Key       string            `json:"key"`
+		ExpiresAt *time.Time        `json:"expires_at"`
+		Labels    map[string]string `json:"labels"`
+	}
+	list := func() []User {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/trojan/users", nil)
+		if err := al.Users(w, r); err != nil {
+			t.Fatalf("list users error: %v", err)
+		}
+		users := []User{}
+		if err := json.Unmarshal(w.Body.Bytes(), &users); err != nil {
+			t.Fatalf("list users error: %v", err)
+		}
+		return users
+	}
+	if users := list(); len(users) != 1 || users[0].ExpiresAt == nil || users[0].ExpiresAt.Year() != 2100 {
+		t.Errorf("list users error: %+v", users)
+	}
+
+	// labels are kept when only expires_at is set
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPut, "/trojan/users/"+k, strings.NewReader(`{"expires_at":"2000-01-01T00:00:00Z"}`))
+	if err := al.User(w, r); err != nil {
+		t.Fatalf("set expiry error: %v", err)
+	}
+	if users := list(); len(users) != 1 || users[0].ExpiresAt == nil || users[0].ExpiresAt.Year() != 2000 || users[0].Labels["name"] != "test" {
+		t.Errorf("list users error: %+v", users)
+	}
+	if ok, _ := al.Upstream.Validate(context.Background(), string(key[:])); ok {
+		t.Errorf("expired user is valid")
+	}
+
+	// null never expires
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPut, "/trojan/users/"+k, strings.NewReader(`{"expires_at":null}`))
+	if err := al.User(w, r); err != nil {
+		t.Fatalf("clear expiry error: %v", err)
+	}
+	if users := list(); len(users) != 1 || users[0].ExpiresAt != nil {
+		t.Errorf("list users error: %+v", users)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPut, "/trojan/users/"+k, strings.NewReader(`{"expires_at":"tomorrow"}`))
+	if code := statusOf(al.User(w, r)); code != http.StatusBadRequest {
+		t.Errorf("set invalid expiry error: status %v", code)
+	}
+}
+
+func TestUserSourceIP(t *testing.T) {
+	al := &Admin{Upstream: &app.MemoryUpstream{}, Connections: &app.Connections{}}
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := base64.StdEncoding.EncodeToString(key[:])
+	if err := al.Upstream.AddKey(context.Background(), string(key[:])); err != nil {
+		t.Fatalf("add key error: %v", err)
+	}
+
+	for _, v := range []struct {
+		Body string
+		Code int
+		IP   net.IP
+	}{
+		{Body: `{"source_ip":"127.0.0.1"}`, Code: http.StatusOK, IP: net.IPv4(127, 0, 0, 1)},
+		// TEST-NET-1 is not bound to the host
+		{Body: `{"source_ip":"192.0.2.1"}`, Code: http.StatusBadRequest, IP: net.IPv4(127, 0, 0, 1)},
+		{Body: `{"source_ip":"localhost"}`, Code: http.StatusBadRequest, IP: net.IPv4(127, 0, 0, 1)},
+		{Body: `{"source_ip":null}`, Code: http.StatusOK, IP: nil},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPut, "/trojan/users/"+k, strings.NewReader(v.Body))
+		if code := statusOf(al.User(w, r)); code != v.Code {
+			t.Errorf("set %v error: status %v", v.Body, code)
+		}
+		if ip, err := al.Upstream.GetSourceIP(context.Background(), k); err != nil || !ip.Equal(v.IP) {
+			t.Errorf("source ip of %v error: %v, %v", v.Body, ip, err)
+		}
+	}
+}
+
+func TestUserRateLimit(t *testing.T) {
+	al := &Admin{Upstream: &app.MemoryUpstream{}, Connections: &app.Connections{}}
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := base64.StdEncoding.EncodeToString(key[:])
+	if err := al.Upstream.AddKey(context.Background(), string(key[:])); err != nil {
+		t.Fatalf("add key error: %v", err)
+	}
+
+	for _, v := range []struct {
+		Body string
+		Code int
+		Rate int64
+	}{
+		{Body: `{"rate_limit":1048576}`, Code: http.StatusOK, Rate: 1048576},
+		{Body: `{"rate_limit":-1}`, Code: http.StatusBadRequest, Rate: 1048576},
+		{Body: `{"rate_limit":"1m"}`, Code: http.StatusBadRequest, Rate: 1048576},
+		{Body: `{"rate_limit":0}`, Code: http.StatusOK, Rate: 0},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPut, "/trojan/users/"+k, strings.NewReader(v.Body))
+		if code := statusOf(al.User(w, r)); code != v.Code {
+			t.Errorf("set %v error: status %v", v.Body, code)
+		}
+		if n, err := al.Upstream.GetRateLimit(context.Background(), k); err != nil || n != v.Rate {
+			t.Errorf("rate limit of %v error: %v, %v", v.Body, n, err)
+		}
+	}
+
+	if err := al.Upstream.SetRateLimit(context.Background(), k, 4096); err != nil {
+		t.Fatalf("set rate limit error: %v", err)
+	}
+	w := httptest.NewRecorder()
+	if err := al.GetUsers(w, httptest.NewRequest(http.MethodGet, "/trojan/users", nil)); err != nil {
+		t.Fatalf("get users error: %v", err)
+	}
+	if !strings.Contains(w.Body.String(), `"rate_limit":4096`) {
+		t.Errorf("rate limit is not listed: %v", w.Body)
+	}
+}
+
+// unreachable is an app.Upstream of which the backing store is down.
+type unreachable struct {
+	*app.MemoryUpstream
+}
+
+// Ping is ...
+func (unreachable) Ping(ctx context.Context) error {
+	return errors.New("connection refused")
+}
+
+func TestGetHealth(t *testing.T) {
+	for _, v := range []struct {
+		Name     string
+		Upstream app.Upstream
+		Status   int
+	}{
+		{Name: "reachable", Upstream: &app.MemoryUpstream{}, Status: http.StatusOK},
+		{Name: "unreachable", Upstream: unreachable{MemoryUpstream: &app.MemoryUpstream{}}, Status: http.StatusServiceUnavailable},
+	} {
+		al := &Admin{Upstream: v.Upstream}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/trojan/health", nil)
+		if code := statusOf(al.GetHealth(w, r)); code != v.Status {
+			t.Errorf("health of %v upstream error: status %v, want %v", v.Name, code, v.Status)
+		}
+	}
+}
+
+func TestGetTotalTraffic(t *testing.T) {
+	up := &app.MemoryUpstream{}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	if err := up.AddKey(context.Background(), string(key[:])); err != nil {
+		t.Fatalf("add key error: %v", err)
+	}
+	up.Consume(context.Background(), string(key[:]), app.ProtocolTCP, 1, 2)
+	if err := up.DelKey(context.Background(), string(key[:])); err != nil {
+		t.Fatalf("del key error: %v", err)
+	}
+
+	al := &Admin{Upstream: up}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/trojan/traffic", nil)
+	if err := al.GetTotalTraffic(w, r); err != nil {
+		t.Fatalf("get total traffic error: %v", err)
+	}
+	if body := strings.TrimSpace(w.Body.String()); body != `{"up":1,"down":2}` {
+		t.Errorf("total traffic error: %v", body)
+	}
+}
+
+func TestTestUpstream(t *testing.T) {
+	for _, v := range []struct {
+		Name     string
+		Upstream app.Upstream
+		Body     string
+		Status   int
+	}{
+		{Name: "throwaway", Upstream: &app.MemoryUpstream{}, Status: http.StatusOK},
+		{Name: "password", Upstream: &app.MemoryUpstream{}, Body: `{"password":"test1234"}`, Status: http.StatusOK},
+		{Name: "unreachable", Upstream: unreachable{MemoryUpstream: &app.MemoryUpstream{}}, Status: http.StatusServiceUnavailable},
+	} {
+		al := &Admin{Upstream: v.Upstream}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/trojan/test", strings.NewReader(v.Body))
+		if code := statusOf(al.TestUpstream(w, r)); code != http.StatusOK {
+			t.Fatalf("test %v upstream error: status %v", v.Name, code)
+		}
+		if w.Code != v.Status {
+			t.Errorf("test %v upstream error: status %v, want %v", v.Name, w.Code, v.Status)
+		}
+		result := struct {
+			Steps []app.UpstreamStep `json:"steps"`
+		}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || len(result.Steps) == 0 || result.Steps[0].Took == "" {
+			t.Errorf("test %v upstream error: %v, %v", v.Name, w.Body, err)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/trojan/test", strings.NewReader("{"))
+	if code := statusOf((&Admin{Upstream: &app.MemoryUpstream{}}).TestUpstream(httptest.NewRecorder(), r)); code != http.StatusBadRequest {
+		t.Errorf("test with invalid body error: status %v", code)
+	}
+}
+
+// closer records whether it is closed.
+type closer chan struct{}
+
+// Close is ...
+func (c closer) Close() error {
+	close(c)
+	return nil
+}
+
+// closed reports whether c is closed.
+func (c closer) closed() bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestKick(t *testing.T) {
+	al := &Admin{Upstream: &app.MemoryUpstream{}, Relays: &app.Relays{KickUsers: true}}
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := base64.StdEncoding.EncodeToString(key[:])
+	if err := al.Upstream.AddKey(context.Background(), string(key[:])); err != nil {
+		t.Fatalf("add key error: %v", err)
+	}
+
+	c := make(closer)
+	done, _ := al.Relays.Add(string(key[:]), c)
+	for _, v := range []struct {
+		Body string
+		Code int
+	}{
+		{Body: `{}`, Code: http.StatusBadRequest},
+		{Body: `{"key":"abc"}`, Code: http.StatusBadRequest},
+		{Body: `{"password":"test1234"}`, Code: http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/trojan/kick", strings.NewReader(v.Body))
+		if code := statusOf(al.Kick(w, r)); code != v.Code {
+			t.Errorf("kick %v error: status %v", v.Body, code)
+		}
+		if v.Code == http.StatusOK && !strings.Contains(w.Body.String(), `"relays":1`) {
+			t.Errorf("kick %v error: %v", v.Body, w.Body)
+		}
+	}
+	if !c.closed() {
+		t.Errorf("relay of kicked user is not closed")
+	}
+	done()
+	// a kicked user is not deleted
+	if ok, err := al.Upstream.Validate(context.Background(), string(key[:])); !ok || err != nil {
+		t.Errorf("validate kicked user error: %v, %v", ok, err)
+	}
+
+	// users are kicked when they are disabled or deleted
+	for _, v := range []struct {
+		Method string
+		Body   string
+	}{
+		{Method: http.MethodPut, Body: `{"enabled":false}`},
+		{Method: http.MethodDelete},
+	} {
+		c := make(closer)
+		done, _ := al.Relays.Add(k, c)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(v.Method, "/trojan/users/"+k, strings.NewReader(v.Body))
+		if err := al.User(w, r); err != nil {
+			t.Fatalf("%v user error: %v", v.Method, err)
+		}
+		if !c.closed() {
+			t.Errorf("relay of user is not closed by %v", v.Method)
+		}
+		done()
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	al := &Admin{Upstream: &app.MemoryUpstream{}, ctx: caddy.Context{Context: context.Background()}, lg: zap.NewNop()}
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	for _, v := range []struct {
+		Body string
+		Code int
+	}{
+		{Body: `{}`, Code: http.StatusBadRequest},
+		{Body: `{"from":{"upstream":"unknown"}}`, Code: http.StatusBadRequest},
+		{Body: `{"from":{"upstream":"memory","users":["test1234"]}}`, Code: http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/trojan/migrate", strings.NewReader(v.Body))
+		if code := statusOf(al.Migrate(w, r)); code != v.Code {
+			t.Errorf("migrate %v error: status %v", v.Body, code)
+		}
+		if v.Code == http.StatusOK && strings.TrimSpace(w.Body.String()) != `{"users":1,"migrated":1,"skipped":0}` {
+			t.Errorf("migrate %v error: %v", v.Body, w.Body)
+		}
+	}
+	if ok, err := al.Upstream.Has(context.Background(), string(key[:])); !ok || err != nil {
+		t.Errorf("user is not migrated: %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,74 @@
+package app
+
+import (
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+// AccessLog logs a trojan connection when it is closed.
+type AccessLog struct {
+	// KeyLabel is how a user key is logged,
+	// raw | hash | truncate | none, default is hash.
+	KeyLabel string `json:"key_label,omitempty"`
+	// DestinationLevel is the log level which the destination is logged at,
+	// debug | info | none, default is info. With debug, the destination is
+	// only logged when the logger is at debug level, and none never logs it.
+	DestinationLevel string `json:"destination_level,omitempty"`
+
+	level       zapcore.Level
+	destination bool
+}
+
+// Provision is ...
+func (l *AccessLog) Provision() error {
+	switch l.KeyLabel {
+	case "":
+		l.KeyLabel = "hash"
+	case "raw", "hash", "truncate", "none":
+	default:
+		return fmt.Errorf("unknown key_label: %v", l.KeyLabel)
+	}
+
+	l.destination = true
+	switch l.DestinationLevel {
+	case "", "info":
+		l.level = zapcore.InfoLevel
+	case "debug":
+		l.level = zapcore.DebugLevel
+	case "none":
+		l.destination = false
+	default:
+		return fmt.Errorf("unknown destination_level: %v", l.DestinationLevel)
+	}
+	return nil
+}
+
+// Log writes the entry of a closed connection of user k, err is the
+// error of relaying the connection.
+func (l *AccessLog) Log(lg *zap.Logger, k string, req *trojan.Request, nr, nw int64, start time.Time, err error) {
+	if l == nil {
+		return
+	}
+
+	reason := "closed"
+	if err != nil {
+		reason = err.Error()
+	}
+	fields := []zap.Field{
+		zap.String("key", keyLabel(l.KeyLabel, k)),
+		zap.String("command", req.CommandName()),
+		zap.Int64("up", nr),
+		zap.Int64("down", nw),
+		zap.Duration("duration", time.Since(start)),
+		zap.String("reason", reason),
+	}
+	if l.destination && req.Addr != nil && lg.Core().Enabled(l.level) {
+		fields = append(fields, zap.String("destination", req.Addr.String()))
+	}
+	lg.Info("trojan connection closed", fields...)
+}
@@ -0,0 +1,55 @@
+package app
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+func TestAccessLog(t *testing.T) {
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	req := &trojan.Request{Command: trojan.CmdConnect, Addr: &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 443}}
+
+	for _, v := range []struct {
+		Level       string
+		LoggerLevel zapcore.Level
+		Destination bool
+	}{
+		{Level: "", LoggerLevel: zapcore.InfoLevel, Destination: true},
+		{Level: "debug", LoggerLevel: zapcore.InfoLevel, Destination: false},
+		{Level: "debug", LoggerLevel: zapcore.DebugLevel, Destination: true},
+		{Level: "none", LoggerLevel: zapcore.DebugLevel, Destination: false},
+	} {
+		l := &AccessLog{DestinationLevel: v.Level}
+		if err := l.Provision(); err != nil {
+			t.Fatalf("provision access log error: %v", err)
+		}
+		core, logs := observer.New(v.LoggerLevel)
+		l.Log(zap.New(core), string(key[:]), req, 1, 2, time.Now(), errors.New("eof"))
+
+		entries := logs.All()
+		if len(entries) != 1 {
+			t.Fatalf("log entries error: got %v, want 1", len(entries))
+		}
+		fields := entries[0].ContextMap()
+		if _, ok := fields["destination"]; ok != v.Destination {
+			t.Errorf("destination with level %q error: got %v", v.Level, fields["destination"])
+		}
+		if fields["key"] == string(key[:]) || fields["command"] != "CONNECT" || fields["up"] != int64(1) || fields["reason"] != "eof" {
+			t.Errorf("access log fields error: %v", fields)
+		}
+	}
+
+	if err := (&AccessLog{DestinationLevel: "warn"}).Provision(); err == nil {
+		t.Errorf("provision unknown destination_level")
+	}
+	(*AccessLog)(nil).Log(zap.NewNop(), string(key[:]), req, 1, 2, time.Now(), nil)
+}
@@ -0,0 +1,226 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+// Accounting consumes the traffic of a relay as it is relayed, every
+// Interval or once Bytes are relayed, and the rest when the relay is done,
+// so the traffic of a long relay is recorded before it is closed, and a
+// crash loses at most one interval of it.
+type Accounting struct {
+	// Interval is the interval of consuming the traffic of a relay,
+	// default is 30s.
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// Bytes consumes the traffic of a relay once it reaches Bytes before
+	// the interval, 0 means no limit.
+	Bytes int64 `json:"bytes,omitempty"`
+
+	// off consumes no traffic
+	off bool
+}
+
+// AccountingOff returns an Accounting which consumes no traffic, for relays
+// of which traffic of users is not recorded, so users have zero traffic,
+// and no quota.
+func AccountingOff() *Accounting {
+	return &Accounting{off: true}
+}
+
+// Off reports whether a is AccountingOff.
+func (a *Accounting) Off() bool {
+	return a != nil && a.off
+}
+
+// Provision is ...
+func (a *Accounting) Provision() error {
+	if a.Interval < 0 || a.Bytes < 0 {
+		return errors.New("accounting must not be negative")
+	}
+	if a.Interval == 0 {
+		a.Interval = caddy.Duration(30 * time.Second)
+	}
+	return nil
+}
+
+// connectionID is the id of the last relay of events of LiveEvents.
+var connectionID uint64
+
+// Start returns the meter of a relay of the user of key of up. The meter
+// of a nil Accounting consumes the traffic when the relay is done only.
+// The relay is published to LiveEvents, unless a is AccountingOff.
+func (a *Accounting) Start(up Upstream, key string) *Meter {
+	if a.Off() {
+		return &Meter{}
+	}
+	m := &Meter{up: up, key: key, id: atomic.AddUint64(&connectionID, 1), live: time.Now()}
+	if LiveEvents.Listening() {
+		LiveEvents.Emit(EventConnectionOpened, m.event(0, 0))
+	}
+	if a == nil {
+		return m
+	}
+	m.bytes = a.Bytes
+	m.flush = make(chan struct{}, 1)
+	m.done = make(chan struct{})
+	m.wg.Add(1)
+	go m.loop(time.Duration(a.Interval))
+	return m
+}
+
+// Meter accumulates the traffic of a relay, and consumes it to the
+// upstream of the user.
+type Meter struct {
+	up    Upstream
+	key   string
+	bytes int64
+
+	mu sync.Mutex
+	// protocol of the relay, set by Add
+	proto Protocol
+	// traffic added but not consumed
+	nr, nw int64
+	// traffic consumed
+	cr, cw int64
+
+	// id of events of LiveEvents
+	id uint64
+	// base64 key of events of LiveEvents
+	liveKey string
+	// traffic added since the last event at time live
+	lr, lw int64
+	live   time.Time
+
+	flush chan struct{}
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// Add adds the traffic relayed of proto, which is consumed at the next
+// interval, or at once if it reaches the bytes of Accounting. It is
+// called as trojan.Request.Progress.
+func (m *Meter) Add(proto Protocol, nr, nw int64) {
+	if m.up == nil {
+		return
+	}
+	m.mu.Lock()
+	m.proto = proto
+	m.nr, m.nw = m.nr+nr, m.nw+nw
+	full := m.bytes > 0 && m.nr+m.nw >= m.bytes
+	var ev map[string]interface{}
+	if LiveEvents.Listening() {
+		m.lr, m.lw = m.lr+nr, m.lw+nw
+		if now := time.Now(); now.Sub(m.live) >= liveInterval {
+			ev = m.event(m.lr, m.lw)
+			m.lr, m.lw, m.live = 0, 0, now
+		}
+	}
+	m.mu.Unlock()
+
+	if ev != nil {
+		LiveEvents.Emit(EventConnectionTraffic, ev)
+	}
+
+	if full && m.flush != nil {
+		select {
+		case m.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close stops the meter, and consumes the rest of the traffic nr and nw of
+// the relay of proto, which are the traffic of the whole relay, whether
+// it is added or not.
+func (m *Meter) Close(proto Protocol, nr, nw int64) {
+	if m.up == nil {
+		return
+	}
+	if m.done != nil {
+		close(m.done)
+		m.wg.Wait()
+	}
+
+	m.mu.Lock()
+	var ev map[string]interface{}
+	if LiveEvents.Listening() {
+		ev = m.event(nr, nw)
+	}
+	nr, nw = nr-m.cr, nw-m.cw
+	m.mu.Unlock()
+	if ev != nil {
+		LiveEvents.Emit(EventConnectionClosed, ev)
+	}
+	if nr < 0 {
+		nr = 0
+	}
+	if nw < 0 {
+		nw = 0
+	}
+	if nr > 0 || nw > 0 {
+		// record traffic even if the server is closed meanwhile
+		m.up.Consume(context.Background(), m.key, proto, nr, nw)
+	}
+}
+
+// event returns the data of an event of LiveEvents of up and down.
+// It must be called with mu held, or before the meter is returned.
+func (m *Meter) event(up, down int64) map[string]interface{} {
+	if m.liveKey == "" {
+		// the key may share memory with a read buffer
+		m.liveKey = string(utils.StringToByteSlice(normalizeKey(m.key)))
+	}
+	return map[string]interface{}{
+		"id":   m.id,
+		"key":  m.liveKey,
+		"up":   up,
+		"down": down,
+	}
+}
+
+// loop consumes the traffic added at the interval, or once it is full.
+func (m *Meter) loop(interval time.Duration) {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+		case <-m.flush:
+		}
+		m.consume()
+	}
+}
+
+// consume consumes the traffic added, which is added back if it fails, to
+// be consumed with the next one.
+func (m *Meter) consume() {
+	m.mu.Lock()
+	proto, nr, nw := m.proto, m.nr, m.nw
+	m.nr, m.nw = 0, 0
+	m.mu.Unlock()
+	if nr == 0 && nw == 0 {
+		return
+	}
+
+	err := m.up.Consume(context.Background(), m.key, proto, nr, nw)
+
+	m.mu.Lock()
+	if err != nil {
+		m.nr, m.nw = m.nr+nr, m.nw+nw
+	} else {
+		m.cr, m.cw = m.cr+nr, m.cw+nw
+	}
+	m.mu.Unlock()
+}
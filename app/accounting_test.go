@@ -0,0 +1,144 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+func TestMeter(t *testing.T) {
+	up := &MemoryUpstream{}
+	if err := up.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := utils.ByteSliceToString(key[:])
+
+	// traffic returns the traffic of the user consumed to up
+	traffic := func() Traffic {
+		t.Helper()
+		mm := users(t, up)
+		if len(mm) != 1 {
+			t.Fatalf("users error: %v", mm)
+		}
+		for _, v := range mm {
+			return v
+		}
+		return Traffic{}
+	}
+
+	a := &Accounting{Interval: caddy.Duration(50 * time.Millisecond)}
+	if err := a.Provision(); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	m := a.Start(up, k)
+	m.Add(ProtocolTCP, 100, 200)
+	// the relay is still going on, and the traffic is consumed at the interval
+	deadline := time.Now().Add(time.Second)
+	for traffic().Up != 100 {
+		if time.Now().After(deadline) {
+			t.Fatalf("traffic is not consumed at the interval: %+v", traffic())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	m.Add(ProtocolTCP, 10, 20)
+	// the relay is done with 10 bytes more of each direction which are not added
+	m.Close(ProtocolTCP, 120, 230)
+	if tr := traffic(); tr.Up != 120 || tr.Down != 230 {
+		t.Errorf("traffic after close error: %+v", tr)
+	}
+
+	// bytes consumes the traffic before the interval
+	a = &Accounting{Interval: caddy.Duration(time.Hour), Bytes: 1000}
+	if err := a.Provision(); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	m = a.Start(up, k)
+	m.Add(ProtocolUDP, 600, 600)
+	deadline = time.Now().Add(time.Second)
+	for traffic().UpUDP != 600 {
+		if time.Now().After(deadline) {
+			t.Fatalf("traffic is not consumed at bytes: %+v", traffic())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	m.Close(ProtocolUDP, 600, 600)
+	if tr := traffic(); tr.Up != 720 || tr.DownUDP != 600 {
+		t.Errorf("traffic after close error: %+v", tr)
+	}
+
+	// a nil Accounting consumes when the relay is done
+	m = (*Accounting)(nil).Start(up, k)
+	m.Add(ProtocolTCP, 1, 1)
+	if tr := traffic(); tr.Up != 720 {
+		t.Errorf("nil accounting consumes before close: %+v", tr)
+	}
+	m.Close(ProtocolTCP, 1, 1)
+	if tr := traffic(); tr.Up != 721 {
+		t.Errorf("nil accounting does not consume at close: %+v", tr)
+	}
+
+	// AccountingOff consumes nothing
+	if (*Accounting)(nil).Off() || a.Off() || !AccountingOff().Off() {
+		t.Errorf("accounting off error")
+	}
+	m = AccountingOff().Start(up, k)
+	m.Add(ProtocolTCP, 1, 1)
+	m.Close(ProtocolTCP, 1, 1)
+	if tr := traffic(); tr.Up != 721 || tr.Down != 831 {
+		t.Errorf("accounting off consumes: %+v", tr)
+	}
+
+	if err := (&Accounting{Bytes: -1}).Provision(); err == nil {
+		t.Errorf("provision negative bytes")
+	}
+}
+
+func TestMeterLiveEvents(t *testing.T) {
+	up := &MemoryUpstream{}
+	if err := up.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := utils.ByteSliceToString(key[:])
+
+	s := LiveEvents.Subscribe(16)
+	defer s.Close()
+
+	m := (*Accounting)(nil).Start(up, k)
+	m.Add(ProtocolTCP, 1, 2)
+	// traffic is coalesced in liveInterval
+	m.live = m.live.Add(-liveInterval)
+	m.Add(ProtocolTCP, 3, 4)
+	m.Add(ProtocolTCP, 5, 6)
+	m.Close(ProtocolTCP, 9, 12)
+	// a meter of AccountingOff fires no event
+	m = AccountingOff().Start(up, k)
+	m.Add(ProtocolTCP, 1, 1)
+	m.Close(ProtocolTCP, 1, 1)
+
+	for _, v := range []struct {
+		Name     string
+		Up, Down int64
+	}{
+		{Name: EventConnectionOpened},
+		{Name: EventConnectionTraffic, Up: 4, Down: 6},
+		{Name: EventConnectionClosed, Up: 9, Down: 12},
+	} {
+		ev := <-s.C
+		if ev.Name != v.Name || ev.Data["key"] != normalizeKey(k) || ev.Data["up"] != v.Up || ev.Data["down"] != v.Down {
+			t.Errorf("event error: %+v, want %+v", ev, v)
+		}
+	}
+	select {
+	case ev := <-s.C:
+		t.Errorf("unexpected event: %+v", ev)
+	default:
+	}
+}
@@ -1,10 +1,16 @@
 package app
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/trojan"
 )
 
 func init() {
@@ -14,18 +20,71 @@ func init() {
 // CaddyAppID is ...
 const CaddyAppID = "trojan"
 
+// pingTimeout is the timeout of checking the upstream in Provision.
+const pingTimeout = 10 * time.Second
+
 // App is ...
 type App struct {
 	// UpstreamRaw is ...
 	UpstreamRaw json.RawMessage `json:"upstream" caddy:"namespace=trojan.upstreams inline_key=upstream"`
+	// TenantsRaw is the upstreams of tenants by the server name of
+	// connections, like example.com, or *.example.com for all subdomains.
+	// Connections of a server name of no tenant use UpstreamRaw.
+	TenantsRaw map[string]json.RawMessage `json:"tenants,omitempty" caddy:"namespace=trojan.upstreams inline_key=upstream"`
+	// StrictTenants rejects connections of a server name of no tenant, which
+	// are handed to the fallback as unknown users, instead of using UpstreamRaw.
+	StrictTenants bool `json:"strict_tenants,omitempty"`
 	// ProxyRaw is ...
 	ProxyRaw json.RawMessage `json:"proxy" caddy:"namespace=trojan.proxies inline_key=proxy"`
 	// Users is ...
 	Users []string `json:"users,omitempty"`
+	// RateLimit is the default rate limit in bytes per second of each user,
+	// 0 means no limit.
+	RateLimit int64 `json:"rate_limit,omitempty"`
+	// GracePeriod is the time for active relays to finish when the config is
+	// reloaded or caddy is stopped, before they are closed. Default is 30s.
+	GracePeriod caddy.Duration `json:"grace_period,omitempty"`
+	// KickUsers closes active relays of a user at once when the user is
+	// deleted or disabled by the admin api or grpc, or deleted as expired,
+	// rather than letting them run until they close.
+	KickUsers bool `json:"kick_users,omitempty"`
+	// CopyBufferSize is the size of buffers of TCP relays, which are pooled
+	// and shared by relays. Default is 32KiB.
+	CopyBufferSize int `json:"copy_buffer_size,omitempty"`
+	// AccountingConfig consumes traffic of relays as they are relayed,
+	// rather than only when they are closed.
+	AccountingConfig *Accounting `json:"accounting,omitempty"`
+	// MetricsConfig enables prometheus metrics served at /trojan/metrics of admin api.
+	MetricsConfig *Metrics `json:"metrics,omitempty"`
+	// AccessLogConfig logs every trojan connection when it is closed.
+	AccessLogConfig *AccessLog `json:"access_log,omitempty"`
+	// AuthFailureLogConfig logs failed authentications with the source ip,
+	// sampled at the interval.
+	AuthFailureLogConfig *AuthFailureLog `json:"auth_failure_log,omitempty"`
+	// ResetScheduleConfig resets traffic of all users at the start of each billing period.
+	ResetScheduleConfig *ResetSchedule `json:"reset_schedule,omitempty"`
+	// GRPCConfig serves the gRPC management service of users.
+	GRPCConfig *GRPC `json:"grpc,omitempty"`
+	// ExpiryInterval is the interval of deleting expired users. Default is 10m.
+	ExpiryInterval caddy.Duration `json:"expiry_interval,omitempty"`
+	// ReplayWindow rejects a trojan header from another source address within
+	// the window as a replay, which is best-effort. Default is 0, disabled.
+	ReplayWindow caddy.Duration `json:"replay_window,omitempty"`
+	// AuthLimitConfig bans source addresses of too many failed validations.
+	AuthLimitConfig *AuthLimiter `json:"auth_limit,omitempty"`
 
 	lg *zap.Logger
 	up Upstream
 	px Proxy
+	lm *Limiters
+	ts *Tenants
+	cn *Connections
+	rp *Replays
+	rs *Relays
+	bp *trojan.BufferPool
+	ej *expiryJanitor
+	// unbinds the logger of events
+	off func()
 }
 
 // CaddyModule is ...
@@ -43,6 +102,13 @@ func (app *App) Provision(ctx caddy.Context) error {
 		return err
 	}
 	app.up = mod.(Upstream)
+	// fail fast on a misconfigured storage, rather than at the first connection
+	pingCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+	err = app.up.Ping(pingCtx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("ping upstream error: %w", err)
+	}
 
 	mod, err = ctx.LoadModule(app, "ProxyRaw")
 	if err != nil {
@@ -51,21 +117,133 @@ func (app *App) Provision(ctx caddy.Context) error {
 	app.px = mod.(Proxy)
 
 	for _, v := range app.Users {
-		app.up.Add(v)
+		app.up.Add(ctx, v)
+	}
+
+	app.lm = &Limiters{Default: app.RateLimit, up: app.up}
+	app.ts = &Tenants{Strict: app.StrictTenants}
+	if app.TenantsRaw != nil {
+		mods, err := ctx.LoadModule(app, "TenantsRaw")
+		if err != nil {
+			return err
+		}
+		for name, mod := range mods.(map[string]interface{}) {
+			up := mod.(Upstream)
+			pingCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+			err = up.Ping(pingCtx)
+			cancel()
+			if err != nil {
+				return fmt.Errorf("ping upstream of tenant %v error: %w", name, err)
+			}
+			app.ts.Add(name, up, app.RateLimit)
+		}
+	}
+	app.cn = &Connections{}
+	if app.ReplayWindow < 0 {
+		return errors.New("replay_window must not be negative")
+	}
+	app.rp = &Replays{Window: time.Duration(app.ReplayWindow)}
+	if app.AuthLimitConfig != nil {
+		if err := app.AuthLimitConfig.Provision(); err != nil {
+			return err
+		}
+	}
+	app.rs = &Relays{KickUsers: app.KickUsers}
+	if app.GracePeriod == 0 {
+		app.GracePeriod = caddy.Duration(defaultGracePeriod)
+	}
+	if app.CopyBufferSize < 0 {
+		return errors.New("copy_buffer_size must not be negative")
+	}
+	if app.CopyBufferSize == 0 {
+		app.CopyBufferSize = trojan.DefaultBufferSize
+	}
+	app.bp = trojan.NewBufferPool(app.CopyBufferSize)
+
+	if app.MetricsConfig != nil {
+		if err := app.MetricsConfig.Provision(); err != nil {
+			return err
+		}
+		if err := app.MetricsConfig.registerUpstream(app.up); err != nil {
+			return err
+		}
+	}
+	if app.AccessLogConfig != nil {
+		if err := app.AccessLogConfig.Provision(); err != nil {
+			return err
+		}
+	}
+	if app.AccountingConfig == nil {
+		app.AccountingConfig = &Accounting{}
+	}
+	if err := app.AccountingConfig.Provision(); err != nil {
+		return err
+	}
+	if app.AuthFailureLogConfig != nil {
+		if err := app.AuthFailureLogConfig.Provision(); err != nil {
+			return err
+		}
 	}
 
 	app.lg = ctx.Logger(app)
 
+	if app.ResetScheduleConfig != nil {
+		if err := app.ResetScheduleConfig.Provision(app.up, ctx.Storage(), app.lg); err != nil {
+			return err
+		}
+	}
+
+	if app.GRPCConfig != nil {
+		app.GRPCConfig.rs = app.rs
+		if err := app.GRPCConfig.Provision(app.up, app.lg); err != nil {
+			return err
+		}
+	}
+
+	if app.ExpiryInterval < 0 {
+		return errors.New("expiry_interval must not be negative")
+	}
+	if app.ExpiryInterval == 0 {
+		app.ExpiryInterval = caddy.Duration(defaultExpiryInterval)
+	}
+	app.ej = &expiryJanitor{up: app.up, rs: app.rs, interval: time.Duration(app.ExpiryInterval), lg: app.lg}
+
 	return nil
 }
 
 // Start is ...
 func (app *App) Start() error {
+	if app.ResetScheduleConfig != nil {
+		app.ResetScheduleConfig.Start()
+	}
+	app.ej.Start()
+	if app.GRPCConfig != nil {
+		if err := app.GRPCConfig.Start(); err != nil {
+			return err
+		}
+	}
+	// events are logged, so operators can react to them by logs
+	app.off = GlobalEvents.On(func(ev Event) {
+		app.lg.Info("trojan event", zap.String("name", ev.Name), zap.Any("data", ev.Data))
+	})
 	return nil
 }
 
 // Stop is ...
+// Relays are drained in the background, so the new config is not blocked
+// by connections of the old one.
 func (app *App) Stop() error {
+	if app.ResetScheduleConfig != nil {
+		app.ResetScheduleConfig.Stop()
+	}
+	app.ej.Stop()
+	if app.GRPCConfig != nil {
+		app.GRPCConfig.Stop()
+	}
+	if app.off != nil {
+		app.off()
+	}
+	go app.rs.Drain(time.Duration(app.GracePeriod))
 	return app.px.Close()
 }
 
@@ -74,11 +252,66 @@ func (app *App) Upstream() Upstream {
 	return app.up
 }
 
+// Tenants is ...
+func (app *App) Tenants() *Tenants {
+	return app.ts
+}
+
 // Proxy is ...
 func (app *App) Proxy() Proxy {
 	return app.px
 }
 
+// Limiters is ...
+func (app *App) Limiters() *Limiters {
+	return app.lm
+}
+
+// Connections is ...
+func (app *App) Connections() *Connections {
+	return app.cn
+}
+
+// Replays is ...
+func (app *App) Replays() *Replays {
+	return app.rp
+}
+
+// AuthLimiter returns the limiter of failed validations, or nil if not enabled.
+func (app *App) AuthLimiter() *AuthLimiter {
+	return app.AuthLimitConfig
+}
+
+// Metrics returns the metrics of trojan app, or nil if not enabled.
+func (app *App) Metrics() *Metrics {
+	return app.MetricsConfig
+}
+
+// AccessLog is ...
+func (app *App) AccessLog() *AccessLog {
+	return app.AccessLogConfig
+}
+
+// Accounting is ...
+func (app *App) Accounting() *Accounting {
+	return app.AccountingConfig
+}
+
+// AuthFailureLog is ...
+func (app *App) AuthFailureLog() *AuthFailureLog {
+	return app.AuthFailureLogConfig
+}
+
+// Relays is ...
+func (app *App) Relays() *Relays {
+	return app.rs
+}
+
+// Buffers returns the pool of buffers of TCP relays.
+func (app *App) Buffers() *trojan.BufferPool {
+	return app.bp
+}
+
 var (
 	_ caddy.App         = (*App)(nil)
 	_ caddy.Provisioner = (*App)(nil)
@@ -0,0 +1,134 @@
+package app
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+const (
+	// defaultMaxFailures is ...
+	defaultMaxFailures = 10
+	// defaultFailureWindow is ...
+	defaultFailureWindow = time.Minute
+	// defaultBanDuration is ...
+	defaultBanDuration = 10 * time.Minute
+)
+
+// AuthLimiter bans a source address after MaxFailures failed validations
+// within Window, so scanners guessing keys do not cost the upstream.
+// Connections of a banned address are not validated, and are handed to
+// fallback as unknown users, including valid users behind the same address.
+// It is shared by all handlers and listeners of trojan app.
+type AuthLimiter struct {
+	// MaxFailures is the number of failed validations to ban an address, default is 10.
+	MaxFailures int `json:"max_failures,omitempty"`
+	// Window is the time failed validations are counted in, default is 1m.
+	Window caddy.Duration `json:"window,omitempty"`
+	// Ban is the time an address is banned, default is 10m.
+	Ban caddy.Duration `json:"ban,omitempty"`
+
+	mu sync.Mutex
+	mm map[string]*authRecord
+	// the time expired records were last swept
+	swept time.Time
+}
+
+// authRecord is the failed validations of an address.
+type authRecord struct {
+	failures int
+	// the start of the window of failures
+	start time.Time
+	// the end of the ban, zero if not banned
+	until time.Time
+}
+
+// Provision is ...
+func (l *AuthLimiter) Provision() error {
+	if l.MaxFailures < 0 || l.Window < 0 || l.Ban < 0 {
+		return errors.New("max_failures, window and ban of auth_limit must not be negative")
+	}
+	if l.MaxFailures == 0 {
+		l.MaxFailures = defaultMaxFailures
+	}
+	if l.Window == 0 {
+		l.Window = caddy.Duration(defaultFailureWindow)
+	}
+	if l.Ban == 0 {
+		l.Ban = caddy.Duration(defaultBanDuration)
+	}
+	return nil
+}
+
+// Allow returns false if the address is banned. A nil *AuthLimiter allows all.
+func (l *AuthLimiter) Allow(addr string) bool {
+	if l == nil {
+		return true
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r, ok := l.mm[hostOf(addr)]
+	return !ok || !now.Before(r.until)
+}
+
+// Fail records a failed validation of the address, and bans it after
+// MaxFailures failures within Window.
+func (l *AuthLimiter) Fail(addr string) {
+	if l == nil {
+		return
+	}
+	host, now := hostOf(addr), time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.mm == nil {
+		l.mm = make(map[string]*authRecord)
+	}
+	if now.Sub(l.swept) >= time.Duration(l.Window) {
+		l.sweep(now)
+	}
+	r, ok := l.mm[host]
+	if !ok || now.Sub(r.start) >= time.Duration(l.Window) {
+		r = &authRecord{start: now}
+		l.mm[host] = r
+	}
+	r.failures++
+	if r.failures >= l.MaxFailures {
+		r.until = now.Add(time.Duration(l.Ban))
+	}
+}
+
+// Succeed forgets failed validations of the address.
+func (l *AuthLimiter) Succeed(addr string) {
+	if l == nil {
+		return
+	}
+	host := hostOf(addr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if r, ok := l.mm[host]; ok && r.until.IsZero() {
+		delete(l.mm, host)
+	}
+}
+
+// sweep deletes records which are neither counting nor banned.
+func (l *AuthLimiter) sweep(now time.Time) {
+	for k, r := range l.mm {
+		if now.Sub(r.start) >= time.Duration(l.Window) && !now.Before(r.until) {
+			delete(l.mm, k)
+		}
+	}
+	l.swept = now
+}
+
+// hostOf returns the host of the address of a client.
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
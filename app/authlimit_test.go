@@ -0,0 +1,70 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestAuthLimiter(t *testing.T) {
+	l := &AuthLimiter{MaxFailures: 2}
+	if err := l.Provision(); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	if l.Window != caddy.Duration(defaultFailureWindow) || l.Ban != caddy.Duration(defaultBanDuration) {
+		t.Errorf("default error: %v, %v", l.Window, l.Ban)
+	}
+
+	l.Fail("192.0.2.1:1000")
+	// a successful validation forgets failures
+	l.Succeed("192.0.2.1:1001")
+	l.Fail("192.0.2.1:1002")
+	if !l.Allow("192.0.2.1:1003") {
+		t.Errorf("ban an address of one failure")
+	}
+	l.Fail("192.0.2.1:1004")
+	if l.Allow("192.0.2.1:1005") {
+		t.Errorf("allow a banned address")
+	}
+	// a ban is not lifted by a successful validation
+	l.Succeed("192.0.2.1:1006")
+	if l.Allow("192.0.2.1:1007") {
+		t.Errorf("allow a banned address after success")
+	}
+	if !l.Allow("198.51.100.1:1000") {
+		t.Errorf("ban another address")
+	}
+
+	// failures out of the window are not counted
+	l.mm["198.51.100.1"] = &authRecord{failures: 1, start: time.Now().Add(-time.Hour)}
+	l.Fail("198.51.100.1:1000")
+	if !l.Allow("198.51.100.1:1001") {
+		t.Errorf("ban an address of failures out of the window")
+	}
+
+	// the ban is lifted after Ban
+	l.mm["192.0.2.1"].until = time.Now()
+	if !l.Allow("192.0.2.1:1000") {
+		t.Errorf("ban an address after the ban")
+	}
+
+	// expired records are swept
+	l.swept = time.Now().Add(-time.Hour)
+	l.mm["192.0.2.1"].start = time.Now().Add(-time.Hour)
+	l.Fail("203.0.113.1:1000")
+	if _, ok := l.mm["192.0.2.1"]; ok {
+		t.Errorf("expired record is not swept")
+	}
+
+	// disabled
+	var nl *AuthLimiter
+	nl.Fail("192.0.2.1:1000")
+	if !nl.Allow("192.0.2.1:1000") {
+		t.Errorf("nil auth limiter bans an address")
+	}
+
+	if err := (&AuthLimiter{Ban: -1}).Provision(); err == nil {
+		t.Errorf("provision negative ban")
+	}
+}
@@ -0,0 +1,79 @@
+package app
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Reasons of AuthFailureLogger, which are logged as they are.
+const (
+	// AuthFailureBadHeader is a prefix which is not a trojan header.
+	AuthFailureBadHeader = "bad_header"
+	// AuthFailureUnknownKey is a trojan header of a key which is not a
+	// valid user.
+	AuthFailureUnknownKey = "unknown_key"
+	// AuthFailureSourceNotAllowed is a valid user connecting from a network
+	// which is not allowed for the user, like a leaked key.
+	AuthFailureSourceNotAllowed = "source_not_allowed"
+)
+
+// AuthFailureLog logs every failed authentication at warn level, with the
+// source ip and the reason, for tools like fail2ban. The log is sampled,
+// so a scan does not flood it.
+type AuthFailureLog struct {
+	// Interval is the interval of sampling, default is 1s.
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// First is the number of failures logged in each interval, default is 10.
+	First int `json:"first,omitempty"`
+	// Thereafter logs every Thereafter-th failure after First in each
+	// interval, 0 logs none of them.
+	Thereafter int `json:"thereafter,omitempty"`
+}
+
+// Provision is ...
+func (l *AuthFailureLog) Provision() error {
+	if l.Interval < 0 || l.First < 0 || l.Thereafter < 0 {
+		return errors.New("auth_failure_log must not be negative")
+	}
+	if l.Interval == 0 {
+		l.Interval = caddy.Duration(time.Second)
+	}
+	if l.First == 0 {
+		l.First = 10
+	}
+	return nil
+}
+
+// Logger returns a logger of failures sampled from lg, which is nil if l
+// is nil. Failures of each returned logger are sampled on their own.
+func (l *AuthFailureLog) Logger(lg *zap.Logger) *AuthFailureLogger {
+	if l == nil {
+		return nil
+	}
+	return &AuthFailureLogger{lg: lg.WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return zapcore.NewSamplerWithOptions(c, time.Duration(l.Interval), l.First, l.Thereafter)
+	}))}
+}
+
+// AuthFailureLogger is ...
+type AuthFailureLogger struct {
+	lg *zap.Logger
+}
+
+// Log logs a failure of the client of addr, which is host:port or an ip,
+// as a message of "trojan auth failed" with fields of source_ip and reason.
+func (l *AuthFailureLogger) Log(addr, reason string) {
+	if l == nil {
+		return
+	}
+	ip := addr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		ip = host
+	}
+	l.lg.Warn("trojan auth failed", zap.String("source_ip", ip), zap.String("reason", reason))
+}
@@ -0,0 +1,45 @@
+package app
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestAuthFailureLog(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	l := &AuthFailureLog{First: 2}
+	if err := l.Provision(); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+
+	// failures after first in the interval are dropped
+	lg := l.Logger(zap.New(core))
+	for i := 0; i < 5; i++ {
+		lg.Log("192.0.2.1:1234", AuthFailureUnknownKey)
+	}
+	entries := logs.AllUntimed()
+	if len(entries) != 2 {
+		t.Fatalf("sampled %v entries, want 2", len(entries))
+	}
+	e := entries[0]
+	if e.Level != zapcore.WarnLevel || e.Message != "trojan auth failed" {
+		t.Errorf("log entry error: %v %v", e.Level, e.Message)
+	}
+	fields := e.ContextMap()
+	if fields["source_ip"] != "192.0.2.1" || fields["reason"] != AuthFailureUnknownKey {
+		t.Errorf("log fields error: %v", fields)
+	}
+
+	// nil logs nothing
+	(*AuthFailureLog)(nil).Logger(zap.New(core)).Log("192.0.2.1:1234", AuthFailureBadHeader)
+	if n := logs.Len(); n != 2 {
+		t.Errorf("nil logger logs %v entries", n)
+	}
+
+	if err := (&AuthFailureLog{First: -1}).Provision(); err == nil {
+		t.Errorf("provision negative first")
+	}
+}
@@ -0,0 +1,117 @@
+package app
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// validationCache is a LRU cache of valid user keys, which expire after ttl.
+// A nil *validationCache caches nothing.
+type validationCache struct {
+	size int
+	ttl  time.Duration
+
+	mu sync.Mutex
+	ll *list.List
+	mm map[string]*list.Element
+
+	hits   uint64
+	misses uint64
+}
+
+// cacheEntry is ...
+type cacheEntry struct {
+	key     string
+	expires time.Time
+}
+
+// newValidationCache is ...
+func newValidationCache(size int, ttl time.Duration) *validationCache {
+	return &validationCache{
+		size: size,
+		ttl:  ttl,
+		ll:   list.New(),
+		mm:   make(map[string]*list.Element, size),
+	}
+}
+
+// get reports whether the key is cached as valid.
+func (c *validationCache) get(k string) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.mm[k]
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return false
+	}
+	if time.Now().After(e.Value.(*cacheEntry).expires) {
+		c.ll.Remove(e)
+		delete(c.mm, k)
+		atomic.AddUint64(&c.misses, 1)
+		return false
+	}
+	c.ll.MoveToFront(e)
+	atomic.AddUint64(&c.hits, 1)
+	return true
+}
+
+// set caches the key as valid.
+func (c *validationCache) set(k string) {
+	c.setUntil(k, time.Time{})
+}
+
+// setUntil caches the key as valid, but not after t unless t is zero.
+func (c *validationCache) setUntil(k string, t time.Time) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := time.Now().Add(c.ttl)
+	if !t.IsZero() && t.Before(expires) {
+		expires = t
+	}
+	if e, ok := c.mm[k]; ok {
+		e.Value.(*cacheEntry).expires = expires
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.mm[k] = c.ll.PushFront(&cacheEntry{key: k, expires: expires})
+	for c.ll.Len() > c.size {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.mm, e.Value.(*cacheEntry).key)
+	}
+}
+
+// del removes the key from cache.
+func (c *validationCache) del(k string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.mm[k]; ok {
+		c.ll.Remove(e)
+		delete(c.mm, k)
+	}
+}
+
+// stats returns the number of hits and misses.
+func (c *validationCache) stats() (uint64, uint64) {
+	if c == nil {
+		return 0, 0
+	}
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
@@ -0,0 +1,56 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidationCache(t *testing.T) {
+	c := newValidationCache(2, time.Hour)
+	c.set("a")
+	c.set("b")
+	if !c.get("a") {
+		t.Errorf("get cached key error")
+	}
+	// b is the least recently used
+	c.set("c")
+	if c.get("b") {
+		t.Errorf("get evicted key")
+	}
+	if !c.get("a") || !c.get("c") {
+		t.Errorf("get cached key error")
+	}
+	c.del("a")
+	if c.get("a") {
+		t.Errorf("get deleted key")
+	}
+	if hits, misses := c.stats(); hits != 3 || misses != 2 {
+		t.Errorf("stats error: hits %v, misses %v", hits, misses)
+	}
+
+	c = newValidationCache(2, time.Millisecond)
+	c.set("a")
+	time.Sleep(5 * time.Millisecond)
+	if c.get("a") {
+		t.Errorf("get expired key")
+	}
+
+	// nil cache caches nothing
+	c = nil
+	c.set("a")
+	if c.get("a") {
+		t.Errorf("get key of nil cache")
+	}
+}
+
+func TestValidationCacheSetUntil(t *testing.T) {
+	c := newValidationCache(16, time.Hour)
+	c.setUntil("a", time.Now().Add(-time.Second))
+	if c.get("a") {
+		t.Errorf("get key cached after it expires")
+	}
+	c.setUntil("b", time.Now().Add(time.Minute))
+	if !c.get("b") {
+		t.Errorf("get key cached until it expires error")
+	}
+}
@@ -0,0 +1,281 @@
+package app
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+func TestParseCaddyfile(t *testing.T) {
+	for _, v := range []struct {
+		Input    string
+		Upstream string
+	}{
+		{
+			Input: `trojan {
+				upstream caddy {
+					prefix users/
+				}
+			}`,
+			Upstream: `{"prefix":"users/","upstream":"caddy"}`,
+		},
+		{
+			Input: `trojan {
+				sqlite /path/to/trojan.db {
+				}
+			}`,
+			Upstream: `{"path":"/path/to/trojan.db","upstream":"sqlite"}`,
+		},
+		{
+			Input: `trojan {
+				sqlite /path/to/trojan.db
+			}`,
+			Upstream: `{"path":"/path/to/trojan.db","upstream":"sqlite"}`,
+		},
+		{
+			Input: `trojan {
+				redis {
+					key_scheme sha224
+				}
+			}`,
+			Upstream: `{"key_scheme":"sha224","upstream":"redis"}`,
+		},
+		{
+			Input: `trojan {
+				memory
+			}`,
+			Upstream: `{"upstream":"memory"}`,
+		},
+		{
+			Input: `trojan {
+				null {
+					allow_any_key
+				}
+			}`,
+			Upstream: `{"allow_any_key":true,"upstream":"null"}`,
+		},
+		{
+			Input: `trojan {
+				http https://auth.example.com/trojan {
+					secret pass1234
+				}
+			}`,
+			Upstream: `{"endpoint":"https://auth.example.com/trojan","secret":"pass1234","upstream":"http"}`,
+		},
+		{
+			Input: `trojan {
+				multi {
+					upstream redis {
+						address 10.0.0.1:6379
+					}
+					upstream memory
+					validators 0
+					accounting 1
+				}
+			}`,
+			Upstream: `{"accounting":1,"upstream":"multi","upstreams":[{"address":"10.0.0.1:6379","upstream":"redis"},{"upstream":"memory"}],"validators":[0]}`,
+		},
+	} {
+		v1, err := parseCaddyfile(caddyfile.NewTestDispenser(v.Input), nil)
+		if err != nil {
+			t.Errorf("parse caddyfile %v error: %v", v.Input, err)
+			continue
+		}
+		app := App{}
+		if err := json.Unmarshal(v1.(httpcaddyfile.App).Value, &app); err != nil {
+			t.Fatalf("unmarshal app error: %v", err)
+		}
+		if string(app.UpstreamRaw) != v.Upstream {
+			t.Errorf("parse caddyfile %v error: got upstream %s, want %s", v.Input, app.UpstreamRaw, v.Upstream)
+		}
+	}
+}
+
+func TestParseCaddyfileKickUsers(t *testing.T) {
+	v, err := parseCaddyfile(caddyfile.NewTestDispenser(`trojan {
+		kick_users
+	}`), nil)
+	if err != nil {
+		t.Fatalf("parse caddyfile error: %v", err)
+	}
+	app := App{}
+	if err := json.Unmarshal(v.(httpcaddyfile.App).Value, &app); err != nil {
+		t.Fatalf("unmarshal app error: %v", err)
+	}
+	if !app.KickUsers {
+		t.Errorf("parse kick_users error")
+	}
+}
+
+func TestParseCaddyfileTenants(t *testing.T) {
+	v, err := parseCaddyfile(caddyfile.NewTestDispenser(`trojan {
+		tenants {
+			example.com memory {
+				users pass1234
+			}
+			*.example.org null
+		}
+		strict_tenants
+	}`), nil)
+	if err != nil {
+		t.Fatalf("parse caddyfile error: %v", err)
+	}
+	app := App{}
+	if err := json.Unmarshal(v.(httpcaddyfile.App).Value, &app); err != nil {
+		t.Fatalf("unmarshal app error: %v", err)
+	}
+	if !app.StrictTenants {
+		t.Errorf("parse strict_tenants error")
+	}
+	for name, want := range map[string]string{
+		"example.com":   `{"upstream":"memory","users":["pass1234"]}`,
+		"*.example.org": `{"upstream":"null"}`,
+	} {
+		if got := string(app.TenantsRaw[name]); got != want {
+			t.Errorf("parse tenant %v error: got %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestParseCaddyfileAccounting(t *testing.T) {
+	v, err := parseCaddyfile(caddyfile.NewTestDispenser(`trojan {
+		accounting {
+			interval 10s
+			bytes 1048576
+		}
+	}`), nil)
+	if err != nil {
+		t.Fatalf("parse caddyfile error: %v", err)
+	}
+	app := App{}
+	if err := json.Unmarshal(v.(httpcaddyfile.App).Value, &app); err != nil {
+		t.Fatalf("unmarshal app error: %v", err)
+	}
+	if a := app.AccountingConfig; a == nil || a.Interval != caddy.Duration(10*time.Second) || a.Bytes != 1<<20 {
+		t.Errorf("parse accounting error: %+v", a)
+	}
+}
+
+func TestParseCaddyfileError(t *testing.T) {
+	for _, input := range []string{
+		`trojan {
+			upstream caddy {
+				unknown
+			}
+		}`,
+		`trojan {
+			sqlite {
+			}
+		}`,
+		`trojan {
+			upstream memory {
+				snapshot_path
+			}
+		}`,
+		`trojan {
+			memory
+			caddy
+		}`,
+		`trojan {
+			metrics {
+				unknown
+			}
+		}`,
+		`trojan {
+			upstream unknown
+		}`,
+		`trojan {
+			reset_schedule 32
+		}`,
+		`trojan {
+			expiry_interval 0s
+		}`,
+		`trojan {
+			replay_window 0s
+		}`,
+		`trojan {
+			auth_limit {
+				max_failures 0
+			}
+		}`,
+		`trojan {
+			auth_limit {
+				ban 0s
+			}
+		}`,
+		`trojan {
+			auth_limit {
+				unknown
+			}
+		}`,
+		`trojan {
+			grpc
+		}`,
+		`trojan {
+			grpc 127.0.0.1:9090 {
+				stats_interval 1ms
+			}
+		}`,
+		`trojan {
+			null {
+				allow_any_key true
+			}
+		}`,
+		`trojan {
+			multi {
+				upstream memory
+				primary first
+			}
+		}`,
+		`trojan {
+			multi {
+				upstream unknown
+			}
+		}`,
+		`trojan {
+			kick_users true
+		}`,
+		`trojan {
+			auth_failure_log {
+				first many
+			}
+		}`,
+		`trojan {
+			auth_failure_log {
+				unknown
+			}
+		}`,
+		`trojan {
+			tenants {
+				example.com memory
+				example.com null
+			}
+		}`,
+		`trojan {
+			tenants {
+				example.com
+			}
+		}`,
+		`trojan {
+			strict_tenants true
+		}`,
+		`trojan {
+			accounting {
+				bytes many
+			}
+		}`,
+		`trojan {
+			accounting {
+				unknown
+			}
+		}`,
+	} {
+		if _, err := parseCaddyfile(caddyfile.NewTestDispenser(input), nil); err == nil {
+			t.Errorf("parse invalid caddyfile %v", input)
+		}
+	}
+}
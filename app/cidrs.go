@@ -0,0 +1,102 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// ErrInvalidCIDR is ...
+var ErrInvalidCIDR = errors.New("invalid allowed cidr")
+
+// parseAllowedCIDRs parses the allowed source networks of a user, where an
+// address is the network of itself, and returns them in the canonical form,
+// nil if there is none.
+func parseAllowedCIDRs(cidrs []string) ([]string, error) {
+	if len(cidrs) == 0 {
+		return nil, nil
+	}
+	ss := make([]string, 0, len(cidrs))
+	for _, v := range cidrs {
+		prefix, err := parsePrefix(v)
+		if err != nil {
+			return nil, err
+		}
+		ss = append(ss, prefix.String())
+	}
+	return ss, nil
+}
+
+// parsePrefix parses a CIDR or an address, of which IPv4-mapped IPv6 is
+// unmapped to IPv4.
+func parsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("%w: %v", ErrInvalidCIDR, err)
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%w: %v", ErrInvalidCIDR, err)
+	}
+	if addr := prefix.Addr(); addr.Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked(), nil
+}
+
+// SourceAllowed reports whether the client of addr, which is host:port or
+// an ip, may connect as the user of k of up, by the allowed networks of
+// the user.
+func SourceAllowed(ctx context.Context, up Upstream, k, addr string) (bool, error) {
+	cidrs, err := up.GetAllowedCIDRs(ctx, k)
+	if err != nil {
+		return false, err
+	}
+	return allowedSource(cidrs, addr), nil
+}
+
+// allowedSource reports whether the client of addr is in cidrs. No network
+// allows all, and an invalid network or address allows none.
+func allowedSource(cidrs []string, addr string) bool {
+	if len(cidrs) == 0 {
+		return true
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	// a zone of a link-local address is not of the network
+	ip = ip.Unmap().WithZone("")
+	for _, v := range cidrs {
+		prefix, err := parsePrefix(v)
+		if err == nil && prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedCIDRsString is the stored form of cidrs, which are separated by
+// commas, empty for none.
+func allowedCIDRsString(cidrs []string) string {
+	return strings.Join(cidrs, ",")
+}
+
+// splitAllowedCIDRs returns the cidrs of the stored form s, nil if empty.
+func splitAllowedCIDRs(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
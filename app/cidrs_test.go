@@ -0,0 +1,42 @@
+package app
+
+import (
+	"testing"
+)
+
+func TestAllowedSource(t *testing.T) {
+	cidrs, err := parseAllowedCIDRs([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32", "::ffff:198.51.100.0/120", "fe80::1"})
+	if err != nil {
+		t.Fatalf("parse allowed cidrs error: %v", err)
+	}
+	for _, v := range []struct {
+		Addr    string
+		Allowed bool
+	}{
+		{Addr: "10.1.2.3:443", Allowed: true},
+		{Addr: "192.0.2.1:443", Allowed: true},
+		{Addr: "192.0.2.2:443"},
+		{Addr: "[2001:db8::1]:443", Allowed: true},
+		{Addr: "[2001:db9::1]:443"},
+		// an IPv4 client of a dual-stack socket
+		{Addr: "[::ffff:10.0.0.1]:443", Allowed: true},
+		// a mapped network is of IPv4 clients
+		{Addr: "198.51.100.7:443", Allowed: true},
+		{Addr: "[fe80::1%eth0]:443", Allowed: true},
+		{Addr: "172.16.0.1"},
+		{Addr: "2001:db8::2", Allowed: true},
+		{Addr: "invalid:443"},
+	} {
+		if got := allowedSource(cidrs, v.Addr); got != v.Allowed {
+			t.Errorf("allowed source of %v error: %v", v.Addr, got)
+		}
+	}
+	if !allowedSource(nil, "203.0.113.1:443") {
+		t.Errorf("reject source without allowed cidrs")
+	}
+	for _, v := range []string{"10.0.0.0/33", "example.com", "10.0.0.1/8/8"} {
+		if _, err := parseAllowedCIDRs([]string{v}); err == nil {
+			t.Errorf("parse invalid allowed cidr %v", v)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+)
+
+// goroutines returns the stacks of the goroutines, by their ids.
+func goroutines() map[int]string {
+	b := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(b, true)
+		if n < len(b) {
+			b = b[:n]
+			break
+		}
+		b = make([]byte, len(b)*2)
+	}
+	m := map[int]string{}
+	for _, v := range bytes.Split(b, []byte("\n\n")) {
+		s := string(v)
+		if !strings.HasPrefix(s, "goroutine ") {
+			continue
+		}
+		f := strings.Fields(s)
+		id, err := strconv.Atoi(f[1])
+		if err != nil {
+			continue
+		}
+		m[id] = s
+	}
+	return m
+}
+
+// checkGoroutines fails t if there are goroutines other than those of
+// before, as goleak does, once they have had some time to return. The
+// ever-running goroutine of os/signal is ignored.
+func checkGoroutines(t *testing.T, before map[int]string) {
+	t.Helper()
+	leaked := []string{}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		leaked = leaked[:0]
+		for id, s := range goroutines() {
+			if _, ok := before[id]; ok {
+				continue
+			}
+			if strings.Contains(s, "os/signal.signal_recv") {
+				continue
+			}
+			leaked = append(leaked, s)
+		}
+		if len(leaked) == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, s := range leaked {
+		t.Errorf("leaked goroutine: %v", s)
+	}
+}
+
+func TestUpstreamCleanup(t *testing.T) {
+	dir := t.TempDir()
+	users := filepath.Join(dir, "users")
+	if err := os.WriteFile(users, []byte("test1234\n"), 0o600); err != nil {
+		t.Fatalf("write users file error: %v", err)
+	}
+	srv := httptest.NewServer(&authService{})
+	defer srv.Close()
+
+	for _, v := range []struct {
+		Name string
+		New  func() Upstream
+	}{
+		{Name: "memory", New: func() Upstream {
+			return &MemoryUpstream{
+				SnapshotPath:     filepath.Join(dir, "snapshot.json"),
+				SnapshotInterval: caddy.Duration(time.Millisecond),
+				UsersFile:        users,
+			}
+		}},
+		{Name: "caddy", New: func() Upstream {
+			return &CaddyUpstream{Storage: &certmagic.FileStorage{Path: filepath.Join(dir, "caddy")}}
+		}},
+		{Name: "sqlite", New: func() Upstream { return &SQLiteUpstream{Path: filepath.Join(dir, "users.db")} }},
+		{Name: "file", New: func() Upstream { return &FileUpstream{Path: filepath.Join(dir, "users.json")} }},
+		{Name: "http", New: func() Upstream { return &HTTPUpstream{Endpoint: srv.URL + "/trojan/", Secret: "secret"} }},
+		{Name: "redis", New: func() Upstream { return &RedisUpstream{Address: "127.0.0.1:1"} }},
+	} {
+		t.Run(v.Name, func(t *testing.T) {
+			before := goroutines()
+			for i := 0; i < 10; i++ {
+				u := v.New()
+				if err := u.(caddy.Provisioner).Provision(caddy.Context{Context: context.Background()}); err != nil {
+					t.Fatalf("provision error: %v", err)
+				}
+				// a request, of which connections are kept alive
+				u.Validate(context.Background(), "test1234")
+				if err := u.(caddy.CleanerUpper).Cleanup(); err != nil {
+					t.Fatalf("cleanup error: %v", err)
+				}
+			}
+			checkGoroutines(t, before)
+		})
+	}
+
+	// caddy cleans up upstreams of which Provision fails
+	u := &RedisUpstream{KeyScheme: KeyScheme{Scheme: "unknown"}}
+	if err := u.Provision(caddy.Context{Context: context.Background()}); err == nil {
+		t.Fatalf("provision of unknown key scheme")
+	}
+	if err := u.Cleanup(); err != nil {
+		t.Errorf("cleanup of failed provision error: %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+package app
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+// CertPassword returns the password of the user of a client certificate,
+// which is the hex of the SHA256 fingerprint of the certificate, so users
+// of certificates are added and deleted as users of passwords.
+func CertPassword(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// CertKey returns the trojan header of the user of the leaf certificate
+// presented by the client of the TLS connection, by the scheme of the
+// upstream. It returns false if the client presents no certificate.
+func CertKey(up Upstream, cs *tls.ConnectionState) (string, bool) {
+	if cs == nil || len(cs.PeerCertificates) == 0 {
+		return "", false
+	}
+	key := make([]byte, trojan.HeaderLen)
+	GenKey(up, CertPassword(cs.PeerCertificates[0]), key)
+	return utils.ByteSliceToString(key), true
+}
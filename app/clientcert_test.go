@@ -0,0 +1,32 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+func TestCertKey(t *testing.T) {
+	up := &MemoryUpstream{}
+	if _, ok := CertKey(up, nil); ok {
+		t.Errorf("cert key of a connection without TLS")
+	}
+	if _, ok := CertKey(up, &tls.ConnectionState{}); ok {
+		t.Errorf("cert key of a client without certificate")
+	}
+
+	cert := &x509.Certificate{Raw: []byte("certificate")}
+	// sha256 of the raw certificate
+	if s := CertPassword(cert); s != "03d66dd08835c1ca3f128cceacd1f31ac94163096b20f445ae84285bc0832d72" {
+		t.Errorf("cert password error: %v", s)
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey(CertPassword(cert), key[:])
+	k, ok := CertKey(up, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
+	if !ok || k != utils.ByteSliceToString(key[:]) {
+		t.Errorf("cert key error: %q, %v", k, ok)
+	}
+}
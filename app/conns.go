@@ -0,0 +1,62 @@
+package app
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+// Connections counts live connections of each user, shared by
+// all handlers and listeners of trojan app.
+type Connections struct {
+	mm sync.Map
+}
+
+// counter returns the counter of the user.
+func (c *Connections) counter(k string) *int32 {
+	k = normalizeKey(k)
+
+	if v, ok := c.mm.Load(k); ok {
+		return v.(*int32)
+	}
+	// k may share memory with a read buffer
+	v, _ := c.mm.LoadOrStore(string(utils.StringToByteSlice(k)), new(int32))
+	return v.(*int32)
+}
+
+// Acquire adds a connection of the user, and returns false if the
+// user already has max connections, 0 means no limit. A successful
+// Acquire must be paired with a Release.
+func (c *Connections) Acquire(k string, max int32) bool {
+	if c == nil {
+		return true
+	}
+	p := c.counter(k)
+	if n := atomic.AddInt32(p, 1); max > 0 && n > max {
+		atomic.AddInt32(p, -1)
+		return false
+	}
+	return true
+}
+
+// Release removes a connection of the user.
+func (c *Connections) Release(k string) {
+	if c == nil {
+		return
+	}
+	atomic.AddInt32(c.counter(k), -1)
+}
+
+// Count returns the number of live connections of the user.
+func (c *Connections) Count(k string) int32 {
+	if c == nil {
+		return 0
+	}
+	k = normalizeKey(k)
+	v, ok := c.mm.Load(k)
+	if !ok {
+		return 0
+	}
+	return atomic.LoadInt32(v.(*int32))
+}
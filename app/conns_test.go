@@ -0,0 +1,44 @@
+package app
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestConnectionsAcquire(t *testing.T) {
+	c := &Connections{}
+
+	const Max = 4
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	ok := 0
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if c.Acquire("test1234", Max) {
+				mu.Lock()
+				ok++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ok != Max {
+		t.Errorf("acquire error: got %v, want %v", ok, Max)
+	}
+	if n := c.Count("test1234"); n != Max {
+		t.Errorf("count error: got %v, want %v", n, Max)
+	}
+
+	for i := 0; i < Max; i++ {
+		c.Release("test1234")
+	}
+	if n := c.Count("test1234"); n != 0 {
+		t.Errorf("count error: got %v, want 0", n)
+	}
+	if !c.Acquire("test1234", Max) {
+		t.Errorf("acquire after release error")
+	}
+}
@@ -0,0 +1,307 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrBlockedAddress is returned when a client connects to a blocked destination.
+var ErrBlockedAddress = errors.New("blocked address")
+
+// AddrFilter rejects destinations by IP address. The check is done on
+// the resolved IP address, so a domain resolving to a blocked address
+// is also rejected.
+type AddrFilter struct {
+	// BlockPrivate blocks private, loopback, link-local and unspecified addresses.
+	BlockPrivate bool `json:"block_private,omitempty"`
+	// BlockedCIDRs is a list of CIDRs to block.
+	BlockedCIDRs []string `json:"blocked_cidrs,omitempty"`
+
+	nets []*net.IPNet
+}
+
+// Provision parses BlockedCIDRs.
+func (f *AddrFilter) Provision() error {
+	f.nets = f.nets[:0]
+	for _, v := range f.BlockedCIDRs {
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			return fmt.Errorf("parse blocked cidr error: %w", err)
+		}
+		f.nets = append(f.nets, ipNet)
+	}
+	return nil
+}
+
+// Enabled is ...
+func (f *AddrFilter) Enabled() bool {
+	return f.BlockPrivate || len(f.nets) > 0
+}
+
+// Blocked returns true if ip is not allowed.
+func (f *AddrFilter) Blocked(ip net.IP) bool {
+	if f.BlockPrivate {
+		if ip.IsPrivate() || ip.IsLoopback() || ip.IsUnspecified() ||
+			ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+			return true
+		}
+	}
+	for _, v := range f.nets {
+		if v.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Control is used as net.Dialer.Control, which is called with the
+// resolved address right before connecting.
+func (f *AddrFilter) Control(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	// remove zone of ipv6 address
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("parse ip error: %v", host)
+	}
+	if f.Blocked(ip) {
+		return fmt.Errorf("%w: %v", ErrBlockedAddress, address)
+	}
+	return nil
+}
+
+// netDialer is the dialer of NoProxy.
+type netDialer struct {
+	net.Dialer
+	filter *AddrFilter
+	// lookup resolves domains instead of net.Dialer, if not nil
+	lookup func(context.Context, string) ([]net.IP, error)
+	// local is the address connections are dialed from, if not nil
+	local net.IP
+}
+
+// newNetDialer is ...
+func newNetDialer(f *AddrFilter) *netDialer {
+	d := &netDialer{filter: f}
+	if f.Enabled() {
+		d.Dialer.Control = f.Control
+	}
+	return d
+}
+
+// from returns a copy of the dialer, which dials from ip.
+func (d *netDialer) from(ip net.IP) *netDialer {
+	c := *d
+	c.LocalAddr = &net.TCPAddr{IP: ip}
+	c.local = ip
+	return &c
+}
+
+// Dial is ...
+func (d *netDialer) Dial(network, addr string) (net.Conn, error) {
+	if d.lookup == nil {
+		return d.Dialer.Dial(network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return d.Dialer.Dial(network, addr)
+	}
+
+	ctx := context.Background()
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	ips, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if d.local != nil {
+		// only addresses of the family of the source ip are reachable,
+		// which net.Dialer filters for domains it resolves
+		if ips = sameFamily(ips, d.local); len(ips) == 0 {
+			return nil, fmt.Errorf("no address of %v is reachable from %v", host, d.local)
+		}
+	}
+	return d.dialParallel(ctx, network, ips, port)
+}
+
+// sameFamily returns the addresses of the family of ip.
+func sameFamily(ips []net.IP, ip net.IP) []net.IP {
+	same := make([]net.IP, 0, len(ips))
+	for _, v := range ips {
+		if (v.To4() == nil) == (ip.To4() == nil) {
+			same = append(same, v)
+		}
+	}
+	return same
+}
+
+// dialParallel races the addresses of the first family with the other,
+// which starts after FallbackDelay, like net.Dialer does for a domain.
+func (d *netDialer) dialParallel(ctx context.Context, network string, ips []net.IP, port string) (net.Conn, error) {
+	primaries, fallbacks := []net.IP{}, []net.IP{}
+	for _, ip := range ips {
+		if (ip.To4() == nil) == (ips[0].To4() == nil) {
+			primaries = append(primaries, ip)
+		} else {
+			fallbacks = append(fallbacks, ip)
+		}
+	}
+	if len(fallbacks) == 0 || d.FallbackDelay < 0 {
+		return d.dialSerial(ctx, network, append(primaries, fallbacks...), port)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 2)
+	dial := func(ips []net.IP) {
+		conn, err := d.dialSerial(ctx, network, ips, port)
+		results <- result{conn: conn, err: err}
+	}
+
+	delay := d.FallbackDelay
+	if delay == 0 {
+		delay = defaultHappyEyeballsDelay
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	go dial(primaries)
+	pending, fallback := 1, false
+	err := error(nil)
+	for {
+		select {
+		case <-timer.C:
+			if !fallback {
+				go dial(fallbacks)
+				pending, fallback = pending+1, true
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if pending > 0 {
+					// close the other connection if it is also established
+					go func() {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}()
+				}
+				return r.conn, nil
+			}
+			if err == nil {
+				err = r.err
+			}
+			if !fallback {
+				go dial(fallbacks)
+				pending, fallback = pending+1, true
+				continue
+			}
+			if pending == 0 {
+				return nil, err
+			}
+		}
+	}
+}
+
+// dialSerial dials the addresses one by one.
+func (d *netDialer) dialSerial(ctx context.Context, network string, ips []net.IP, port string) (net.Conn, error) {
+	err := error(nil)
+	for _, ip := range ips {
+		conn, er := d.Dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if er == nil {
+			return conn, nil
+		}
+		if err == nil {
+			err = er
+		}
+	}
+	return nil, err
+}
+
+// ResolveUDPAddr is ...
+func (d *netDialer) ResolveUDPAddr(addr string) (*net.UDPAddr, error) {
+	if d.lookup == nil {
+		return net.ResolveUDPAddr("udp", addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	n, err := net.LookupPort("udp", port)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: n}, nil
+	}
+
+	ctx := context.Background()
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	ips, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	// prefer IPv4 as net.ResolveUDPAddr does
+	ip := ips[0]
+	for _, v := range ips {
+		if v.To4() != nil {
+			ip = v
+			break
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: n}, nil
+}
+
+// ListenPacket is ...
+func (d *netDialer) ListenPacket(network, addr string) (net.PacketConn, error) {
+	if d.local != nil && addr == "" {
+		addr = net.JoinHostPort(d.local.String(), "0")
+	}
+	pc, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if !d.filter.Enabled() {
+		return pc, nil
+	}
+	return &filterPacketConn{PacketConn: pc, filter: d.filter}, nil
+}
+
+// filterPacketConn checks the destination of every packet.
+type filterPacketConn struct {
+	net.PacketConn
+	filter *AddrFilter
+}
+
+// WriteTo is ...
+func (pc *filterPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if ua, ok := addr.(*net.UDPAddr); ok && pc.filter.Blocked(ua.IP) {
+		return 0, fmt.Errorf("%w: %v", ErrBlockedAddress, addr)
+	}
+	return pc.PacketConn.WriteTo(b, addr)
+}
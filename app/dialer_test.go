@@ -0,0 +1,139 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestNetDialerBlockPrivate(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	f := &AddrFilter{BlockPrivate: true}
+	if err := f.Provision(); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	d := newNetDialer(f)
+
+	// domain is checked after resolving
+	for _, addr := range []string{"127.0.0.1:" + port, "localhost:" + port} {
+		conn, err := d.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			t.Errorf("dial blocked address %v", addr)
+			continue
+		}
+		if !errors.Is(err, ErrBlockedAddress) {
+			t.Errorf("dial %v error: %v", addr, err)
+		}
+	}
+
+	pc, err := d.ListenPacket("udp", "")
+	if err != nil {
+		t.Fatalf("listen packet error: %v", err)
+	}
+	defer pc.Close()
+	if _, err := pc.WriteTo([]byte("hello"), &net.UDPAddr{IP: net.IPv4(169, 254, 169, 254), Port: 80}); !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("write to blocked address error: %v", err)
+	}
+}
+
+func TestAddrFilterBlockedCIDRs(t *testing.T) {
+	f := &AddrFilter{BlockedCIDRs: []string{"203.0.113.0/24"}}
+	if err := f.Provision(); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	if !f.Blocked(net.ParseIP("203.0.113.7")) {
+		t.Errorf("address in blocked cidr is not blocked")
+	}
+	if f.Blocked(net.ParseIP("198.51.100.7")) || f.Blocked(net.ParseIP("127.0.0.1")) {
+		t.Errorf("address not in blocked cidr is blocked")
+	}
+}
+
+func TestNoProxyHappyEyeballs(t *testing.T) {
+	for _, v := range []struct {
+		Input string
+		Delay time.Duration
+	}{
+		{Input: "no_proxy", Delay: defaultHappyEyeballsDelay},
+		{Input: "no_proxy {\n happy_eyeballs 100ms\n}", Delay: 100 * time.Millisecond},
+		{Input: "no_proxy {\n happy_eyeballs off\n}", Delay: -1},
+	} {
+		p := &NoProxy{}
+		if err := p.UnmarshalCaddyfile(caddyfile.NewTestDispenser(v.Input)); err != nil {
+			t.Fatalf("parse %q error: %v", v.Input, err)
+		}
+		if err := p.Provision(caddy.Context{Context: context.Background()}); err != nil {
+			t.Fatalf("provision error: %v", err)
+		}
+		if p.dialer.FallbackDelay != v.Delay {
+			t.Errorf("happy eyeballs delay of %q error: got %v, want %v", v.Input, p.dialer.FallbackDelay, v.Delay)
+		}
+	}
+
+	p := &NoProxy{}
+	if err := p.UnmarshalCaddyfile(caddyfile.NewTestDispenser("no_proxy {\n happy_eyeballs 0s\n}")); err == nil {
+		t.Errorf("parse zero happy_eyeballs")
+	}
+}
+
+func TestNetDialerFrom(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	d := newNetDialer(&AddrFilter{})
+	// only the IPv4 address of the domain is reachable from an IPv4 address
+	d.lookup = func(context.Context, string) ([]net.IP, error) {
+		return []net.IP{net.IPv6loopback, net.IPv4(127, 0, 0, 1)}, nil
+	}
+	from := d.from(net.IPv4(127, 0, 0, 2))
+	if d.LocalAddr != nil {
+		t.Errorf("source ip is set to the shared dialer")
+	}
+	for _, addr := range []string{"127.0.0.1:" + port, "localhost:" + port} {
+		conn, err := from.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial %v error: %v", addr, err)
+		}
+		conn.Close()
+		c, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("accept error: %v", err)
+		}
+		if ip := c.RemoteAddr().(*net.TCPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 2)) {
+			t.Errorf("dial %v from %v", addr, ip)
+		}
+		c.Close()
+	}
+
+	d.lookup = func(context.Context, string) ([]net.IP, error) {
+		return []net.IP{net.IPv6loopback}, nil
+	}
+	if _, err := d.from(net.IPv4(127, 0, 0, 2)).Dial("tcp", "localhost:"+port); err == nil {
+		t.Errorf("dial an IPv6 address from an IPv4 address")
+	}
+
+	pc, err := from.ListenPacket("udp", "")
+	if err != nil {
+		t.Fatalf("listen packet error: %v", err)
+	}
+	defer pc.Close()
+	if ip := pc.LocalAddr().(*net.UDPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Errorf("listen packet on %v", ip)
+	}
+}
@@ -0,0 +1,308 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/miekg/dns"
+)
+
+// errNoAddress is ...
+var errNoAddress = errors.New("no such host")
+
+// Resolver resolves destination domains with a name server, instead of the
+// resolver of the OS.
+type Resolver struct {
+	// Address is host:port of the name server, or the URL of DoH.
+	// Default is the name servers in /etc/resolv.conf.
+	Address string `json:"address,omitempty"`
+	// Protocol is udp | tcp | doh, default is udp.
+	Protocol string `json:"protocol,omitempty"`
+
+	servers []string
+	client  *dns.Client
+	http    *http.Client
+}
+
+// Provision is ...
+func (r *Resolver) Provision() error {
+	switch r.Protocol {
+	case "", "udp", "tcp":
+		if r.Address == "" {
+			conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+			if err != nil {
+				return fmt.Errorf("read name servers error: %w", err)
+			}
+			for _, v := range conf.Servers {
+				r.servers = append(r.servers, net.JoinHostPort(v, conf.Port))
+			}
+			if len(r.servers) == 0 {
+				return errors.New("no name server in /etc/resolv.conf")
+			}
+		} else if _, _, err := net.SplitHostPort(r.Address); err == nil {
+			r.servers = []string{r.Address}
+		} else {
+			r.servers = []string{net.JoinHostPort(r.Address, "53")}
+		}
+		r.client = &dns.Client{Net: r.Protocol}
+	case "doh":
+		u, err := url.Parse(r.Address)
+		if err != nil {
+			return fmt.Errorf("parse doh url error: %w", err)
+		}
+		if u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid doh url: %v", r.Address)
+		}
+		r.servers = []string{r.Address}
+		r.http = &http.Client{Timeout: 5 * time.Second}
+	default:
+		return fmt.Errorf("unknown resolver protocol: %v", r.Protocol)
+	}
+	return nil
+}
+
+// LookupIP returns the addresses of host, IPv6 addresses first.
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	ips, _, err := r.lookup(ctx, dns.Fqdn(normalizeDomain(host)))
+	if errors.Is(err, errNoAddress) {
+		return nil, &net.DNSError{Err: err.Error(), Name: host, IsNotFound: true}
+	}
+	return ips, err
+}
+
+// lookup queries AAAA and A records of host, and returns the addresses and
+// the min TTL. The error is errNoAddress if host has no address.
+func (r *Resolver) lookup(ctx context.Context, host string) ([]net.IP, uint32, error) {
+	type result struct {
+		ips []net.IP
+		ttl uint32
+		err error
+	}
+	results := [2]result{}
+	wg := sync.WaitGroup{}
+	for i, qtype := range [2]uint16{dns.TypeAAAA, dns.TypeA} {
+		wg.Add(1)
+		go func(res *result, qtype uint16) {
+			defer wg.Done()
+			res.ips, res.ttl, res.err = r.query(ctx, host, qtype)
+		}(&results[i], qtype)
+	}
+	wg.Wait()
+
+	ips, ttl, err := []net.IP(nil), ^uint32(0), error(nil)
+	for _, res := range results {
+		if res.err != nil {
+			if !errors.Is(res.err, errNoAddress) {
+				err = res.err
+			}
+			continue
+		}
+		if res.ttl < ttl {
+			ttl = res.ttl
+		}
+		// AAAA records are the first
+		ips = append(ips, res.ips...)
+	}
+	if len(ips) > 0 {
+		return ips, ttl, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return nil, 0, errNoAddress
+}
+
+// query asks name servers one by one for records of qtype, and returns
+// the addresses and the min TTL of the answer.
+func (r *Resolver) query(ctx context.Context, host string, qtype uint16) ([]net.IP, uint32, error) {
+	m := &dns.Msg{}
+	m.SetQuestion(host, qtype)
+
+	err := error(nil)
+	for _, server := range r.servers {
+		res, er := r.exchange(ctx, m, server)
+		if er != nil {
+			err = er
+			continue
+		}
+
+		switch res.Rcode {
+		case dns.RcodeSuccess:
+		case dns.RcodeNameError:
+			return nil, 0, errNoAddress
+		default:
+			err = fmt.Errorf("query %v error: %v", host, dns.RcodeToString[res.Rcode])
+			continue
+		}
+
+		ips, ttl := []net.IP(nil), ^uint32(0)
+		for _, rr := range res.Answer {
+			switch v := rr.(type) {
+			case *dns.A:
+				ips = append(ips, v.A)
+			case *dns.AAAA:
+				ips = append(ips, v.AAAA)
+			default:
+				// TTL of CNAME also counts
+			}
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+		if len(ips) == 0 {
+			return nil, 0, errNoAddress
+		}
+		return ips, ttl, nil
+	}
+	return nil, 0, err
+}
+
+// exchange sends the query to the name server.
+func (r *Resolver) exchange(ctx context.Context, m *dns.Msg, server string) (*dns.Msg, error) {
+	if r.http == nil {
+		res, _, err := r.client.ExchangeContext(ctx, m, server)
+		if err == nil && res.Truncated && r.client.Net != "tcp" {
+			res, _, err = (&dns.Client{Net: "tcp"}).ExchangeContext(ctx, m, server)
+		}
+		return res, err
+	}
+
+	// RFC 8484, id of the query should be 0 for caching of http
+	q := m.Copy()
+	q.Id = 0
+	b, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	res, err := r.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh query error: %v", res.Status)
+	}
+	b, err = io.ReadAll(io.LimitReader(res.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	msg := &dns.Msg{}
+	if err := msg.Unpack(b); err != nil {
+		return nil, fmt.Errorf("unpack doh response error: %w", err)
+	}
+	return msg, nil
+}
+
+// DNSCache caches addresses of destination domains for the TTLs of the
+// DNS records, clamped to [MinTTL, MaxTTL]. Domains which do not exist or
+// have no address are cached for NegativeTTL, and failed queries are not cached.
+type DNSCache struct {
+	// MinTTL is the min time an address is cached, default is 10s.
+	MinTTL caddy.Duration `json:"min_ttl,omitempty"`
+	// MaxTTL is the max time an address is cached, default is 1h.
+	MaxTTL caddy.Duration `json:"max_ttl,omitempty"`
+	// NegativeTTL is the time a domain without addresses is cached, default is 5s.
+	NegativeTTL caddy.Duration `json:"negative_ttl,omitempty"`
+
+	resolver *Resolver
+
+	mu sync.Mutex
+	mm map[string]*dnsEntry
+}
+
+// dnsEntry is ...
+type dnsEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// dnsCacheSweepSize is the number of entries after which expired entries
+// are removed when adding another.
+const dnsCacheSweepSize = 1024
+
+// Provision uses the name servers in /etc/resolv.conf if no resolver is set.
+func (c *DNSCache) Provision() error {
+	if c.MinTTL == 0 {
+		c.MinTTL = caddy.Duration(10 * time.Second)
+	}
+	if c.MaxTTL == 0 {
+		c.MaxTTL = caddy.Duration(time.Hour)
+	}
+	if c.NegativeTTL == 0 {
+		c.NegativeTTL = caddy.Duration(5 * time.Second)
+	}
+	if c.MinTTL > c.MaxTTL {
+		return fmt.Errorf("min_ttl %v is larger than max_ttl %v", time.Duration(c.MinTTL), time.Duration(c.MaxTTL))
+	}
+
+	if c.resolver == nil {
+		c.resolver = &Resolver{}
+		if err := c.resolver.Provision(); err != nil {
+			return err
+		}
+	}
+	c.mm = make(map[string]*dnsEntry)
+	return nil
+}
+
+// Lookup returns the addresses of host, IPv6 addresses first.
+func (c *DNSCache) Lookup(ctx context.Context, host string) ([]net.IP, error) {
+	host = dns.Fqdn(normalizeDomain(host))
+
+	c.mu.Lock()
+	e, ok := c.mm[host]
+	c.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.ips, e.err
+	}
+
+	ips, n, err := c.resolver.lookup(ctx, host)
+	if err != nil && !errors.Is(err, errNoAddress) {
+		// a failed query is not cached
+		return nil, err
+	}
+
+	e = &dnsEntry{ips: ips}
+	ttl := time.Duration(n) * time.Second
+	if ttl > time.Duration(c.MaxTTL) {
+		ttl = time.Duration(c.MaxTTL)
+	}
+	if ttl < time.Duration(c.MinTTL) {
+		ttl = time.Duration(c.MinTTL)
+	}
+	if err != nil {
+		e.err = &net.DNSError{Err: err.Error(), Name: host, IsNotFound: true}
+		ttl = time.Duration(c.NegativeTTL)
+	}
+	e.expires = time.Now().Add(ttl)
+
+	c.mu.Lock()
+	if len(c.mm) >= dnsCacheSweepSize {
+		now := time.Now()
+		for k, v := range c.mm {
+			if now.After(v.expires) {
+				delete(c.mm, k)
+			}
+		}
+	}
+	c.mm[host] = e
+	c.mu.Unlock()
+
+	return e.ips, e.err
+}
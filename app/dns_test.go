@@ -0,0 +1,230 @@
+package app
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/miekg/dns"
+)
+
+// serveDNS serves example.com with the addresses for ttl, and NXDOMAIN
+// for other domains. It returns the address and the number of queries.
+func serveDNS(t *testing.T, ttl uint32, ips ...net.IP) (string, *int32) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp error: %v", err)
+	}
+
+	n := int32(0)
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&n, 1)
+		m := &dns.Msg{}
+		m.SetReply(r)
+		q := r.Question[0]
+		if q.Name != "example.com." {
+			m.Rcode = dns.RcodeNameError
+			w.WriteMsg(m)
+			return
+		}
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: ttl}
+		for _, ip := range ips {
+			switch {
+			case q.Qtype == dns.TypeA && ip.To4() != nil:
+				m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip})
+			case q.Qtype == dns.TypeAAAA && ip.To4() == nil:
+				m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+		w.WriteMsg(m)
+	})}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String(), &n
+}
+
+// newResolver returns a Resolver of the name server at addr.
+func newResolver(t *testing.T, addr string) *Resolver {
+	r := &Resolver{Address: addr}
+	if err := r.Provision(); err != nil {
+		t.Fatalf("provision resolver error: %v", err)
+	}
+	return r
+}
+
+func TestDNSCache(t *testing.T) {
+	addr, n := serveDNS(t, 3600, net.ParseIP("127.0.0.1"), net.ParseIP("::1"))
+
+	c := &DNSCache{NegativeTTL: caddy.Duration(time.Nanosecond), resolver: newResolver(t, addr)}
+	if err := c.Provision(); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		ips, err := c.Lookup(context.Background(), "Example.com")
+		if err != nil {
+			t.Fatalf("lookup error: %v", err)
+		}
+		if len(ips) != 2 || !ips[0].Equal(net.ParseIP("::1")) || !ips[1].Equal(net.ParseIP("127.0.0.1")) {
+			t.Errorf("lookup error: %v", ips)
+		}
+	}
+	// A and AAAA, then cached
+	if v := atomic.LoadInt32(n); v != 2 {
+		t.Errorf("number of queries error: got %v, want 2", v)
+	}
+
+	// negative results expire after NegativeTTL
+	if _, err := c.Lookup(context.Background(), "unknown.com"); err == nil {
+		t.Errorf("lookup unknown domain without error")
+	}
+	time.Sleep(time.Millisecond)
+	if _, err := c.Lookup(context.Background(), "unknown.com"); err == nil {
+		t.Errorf("lookup unknown domain without error")
+	}
+	if v := atomic.LoadInt32(n); v != 6 {
+		t.Errorf("number of queries error: got %v, want 6", v)
+	}
+}
+
+func TestDNSCacheTTL(t *testing.T) {
+	addr, n := serveDNS(t, 1, net.ParseIP("127.0.0.1"))
+
+	// ttl of records is raised to min_ttl
+	c := &DNSCache{MinTTL: caddy.Duration(time.Hour), resolver: newResolver(t, addr)}
+	if err := c.Provision(); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	if _, err := c.Lookup(context.Background(), "example.com"); err != nil {
+		t.Fatalf("lookup error: %v", err)
+	}
+	if e := c.mm["example.com."]; e == nil || time.Until(e.expires) < 59*time.Minute {
+		t.Errorf("ttl is not raised to min_ttl")
+	}
+
+	// and lowered to max_ttl
+	c = &DNSCache{MinTTL: caddy.Duration(time.Nanosecond), MaxTTL: caddy.Duration(time.Nanosecond), resolver: newResolver(t, addr)}
+	if err := c.Provision(); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.Lookup(context.Background(), "example.com"); err != nil {
+			t.Fatalf("lookup error: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if v := atomic.LoadInt32(n); v != 6 {
+		t.Errorf("number of queries error: got %v, want 6", v)
+	}
+
+	c = &DNSCache{MinTTL: caddy.Duration(time.Minute), MaxTTL: caddy.Duration(time.Second), resolver: newResolver(t, addr)}
+	if err := c.Provision(); err == nil {
+		t.Errorf("provision min_ttl larger than max_ttl")
+	}
+}
+
+func TestNetDialerDNSCache(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	// ::1 is tried first, which is refused or unreachable
+	addr, _ := serveDNS(t, 3600, net.ParseIP("127.0.0.1"), net.ParseIP("::1"))
+	c := &DNSCache{resolver: newResolver(t, addr)}
+	if err := c.Provision(); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	d := newNetDialer(&AddrFilter{})
+	d.Timeout = time.Second
+	d.lookup = c.Lookup
+
+	conn, err := d.Dial("tcp", net.JoinHostPort("example.com", port))
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	conn.Close()
+}
+
+// answer replies example.com with 127.0.0.1.
+func answer(r *dns.Msg) *dns.Msg {
+	m := &dns.Msg{}
+	m.SetReply(r)
+	if q := r.Question[0]; q.Name == "example.com." && q.Qtype == dns.TypeA {
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(127, 0, 0, 1),
+		})
+	}
+	return m
+}
+
+func TestResolverTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	srv := &dns.Server{Listener: ln, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(answer(r))
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	r := &Resolver{Address: ln.Addr().String(), Protocol: "tcp"}
+	if err := r.Provision(); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	ips, err := r.LookupIP(context.Background(), "example.com")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("lookup error: %v, %v", ips, err)
+	}
+
+	// UDP destinations are also resolved by the resolver
+	d := newNetDialer(&AddrFilter{})
+	d.lookup = r.LookupIP
+	addr, err := d.ResolveUDPAddr("example.com:53")
+	if err != nil || !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) || addr.Port != 53 {
+		t.Errorf("resolve udp addr error: %v, %v", addr, err)
+	}
+}
+
+func TestResolverDoH(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		m := &dns.Msg{}
+		if r.Header.Get("Content-Type") != "application/dns-message" || m.Unpack(b) != nil || m.Id != 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		b, _ = answer(m).Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(b)
+	}))
+	defer srv.Close()
+
+	r := &Resolver{Address: srv.URL + "/dns-query", Protocol: "doh"}
+	if err := r.Provision(); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	r.http = srv.Client()
+	ips, err := r.LookupIP(context.Background(), "example.com")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("lookup error: %v, %v", ips, err)
+	}
+	if _, err := r.LookupIP(context.Background(), "unknown.com"); err == nil {
+		t.Errorf("lookup unknown domain without error")
+	}
+
+	for _, v := range []*Resolver{{Address: "http://127.0.0.1/dns-query", Protocol: "doh"}, {Protocol: "quic"}} {
+		if err := v.Provision(); err == nil {
+			t.Errorf("provision invalid resolver %+v", v)
+		}
+	}
+}
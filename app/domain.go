@@ -0,0 +1,127 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DefaultBlockedPorts is the ports blocked if BlockedPorts is not set, as
+// many providers terminate servers sending spam by SMTP.
+var DefaultBlockedPorts = []int{25}
+
+// DomainFilter rejects destinations by the host and the port requested by
+// the client, before it is dialed. A rule is a domain like example.com, or a
+// wildcard like *.example.com, which matches all subdomains but not
+// example.com itself. BlockDomains takes precedence over AllowDomains, and if
+// AllowDomains is not empty, only the destinations matching it are allowed,
+// including IP addresses. Port 0 is always blocked.
+type DomainFilter struct {
+	// AllowDomains is the list of domains which are allowed.
+	AllowDomains []string `json:"allow_domains,omitempty"`
+	// BlockDomains is the list of domains which are blocked.
+	BlockDomains []string `json:"block_domains,omitempty"`
+	// BlockedPorts is the list of destination ports which are blocked,
+	// DefaultBlockedPorts if empty. [0] blocks no other port.
+	BlockedPorts []int `json:"blocked_ports,omitempty"`
+
+	allow []string
+	block []string
+	ports map[int]struct{}
+}
+
+// Provision checks and normalizes the rules.
+func (f *DomainFilter) Provision() error {
+	allow, err := parseDomains(f.AllowDomains)
+	if err != nil {
+		return fmt.Errorf("parse allow_domains error: %w", err)
+	}
+	block, err := parseDomains(f.BlockDomains)
+	if err != nil {
+		return fmt.Errorf("parse block_domains error: %w", err)
+	}
+	ports := f.BlockedPorts
+	if len(ports) == 0 {
+		ports = DefaultBlockedPorts
+	}
+	f.ports = make(map[int]struct{}, len(ports))
+	for _, v := range ports {
+		if v < 0 || v > 65535 {
+			return fmt.Errorf("invalid blocked port: %v", v)
+		}
+		f.ports[v] = struct{}{}
+	}
+	f.allow, f.block = allow, block
+	return nil
+}
+
+// parseDomains is ...
+func parseDomains(ss []string) ([]string, error) {
+	domains := make([]string, 0, len(ss))
+	for _, v := range ss {
+		domain := normalizeDomain(v)
+		if domain == "" || domain == "*." || strings.Contains(strings.TrimPrefix(domain, "*."), "*") {
+			return nil, fmt.Errorf("invalid domain: %q", v)
+		}
+		domains = append(domains, domain)
+	}
+	return domains, nil
+}
+
+// normalizeDomain is ...
+func normalizeDomain(s string) string {
+	return strings.TrimSuffix(strings.ToLower(s), ".")
+}
+
+// matchDomain is ...
+func matchDomain(rules []string, host string) bool {
+	for _, v := range rules {
+		if strings.HasPrefix(v, "*.") {
+			if strings.HasSuffix(host, v[1:]) {
+				return true
+			}
+			continue
+		}
+		if host == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed returns true if host is allowed.
+func (f *DomainFilter) Allowed(host string) bool {
+	host = normalizeDomain(host)
+	if matchDomain(f.block, host) {
+		return false
+	}
+	return len(f.allow) == 0 || matchDomain(f.allow, host)
+}
+
+// PortAllowed returns true if port is neither 0 nor blocked.
+func (f *DomainFilter) PortAllowed(port int) bool {
+	if port == 0 {
+		return false
+	}
+	_, ok := f.ports[port]
+	return !ok
+}
+
+// Check is used as trojan.Request.Filter. A nil *DomainFilter allows all.
+func (f *DomainFilter) Check(addr net.Addr) error {
+	if f == nil {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || !f.PortAllowed(n) {
+		return fmt.Errorf("%w: blocked port of %v", ErrBlockedAddress, addr)
+	}
+	if len(f.allow)+len(f.block) > 0 && !f.Allowed(host) {
+		return fmt.Errorf("%w: %v", ErrBlockedAddress, addr)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package app
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestDomainFilter(t *testing.T) {
+	f := &DomainFilter{
+		AllowDomains: []string{"*.example.com", "example.org"},
+		BlockDomains: []string{"ads.example.com", "*.tracker.example.com"},
+	}
+	if err := f.Provision(); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+
+	for _, v := range []struct {
+		Host    string
+		Allowed bool
+	}{
+		{Host: "www.example.com", Allowed: true},
+		{Host: "WWW.Example.COM.", Allowed: true},
+		{Host: "a.b.example.com", Allowed: true},
+		{Host: "example.org", Allowed: true},
+		// the wildcard does not match the domain itself
+		{Host: "example.com", Allowed: false},
+		{Host: "www.example.org", Allowed: false},
+		{Host: "badexample.com", Allowed: false},
+		{Host: "127.0.0.1", Allowed: false},
+		// block overrides allow
+		{Host: "ads.example.com", Allowed: false},
+		{Host: "x.tracker.example.com", Allowed: false},
+		{Host: "tracker.example.com", Allowed: true},
+	} {
+		if f.Allowed(v.Host) != v.Allowed {
+			t.Errorf("check %v error: want allowed %v", v.Host, v.Allowed)
+		}
+	}
+
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}
+	if err := f.Check(addr); !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("check blocked address error: %v", err)
+	}
+
+	// block only
+	f = &DomainFilter{BlockDomains: []string{"example.com"}}
+	if err := f.Provision(); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	if f.Allowed("example.com") || !f.Allowed("www.example.com") || !f.Allowed("127.0.0.1") {
+		t.Errorf("check block only rules error")
+	}
+	if err := (*DomainFilter)(nil).Check(addr); err != nil {
+		t.Errorf("check of nil filter error: %v", err)
+	}
+
+	for _, v := range []string{"", "*.", "*", "www.*.com"} {
+		f := &DomainFilter{AllowDomains: []string{v}}
+		if err := f.Provision(); err == nil {
+			t.Errorf("provision invalid domain %q", v)
+		}
+	}
+}
+
+func TestBlockedPorts(t *testing.T) {
+	for _, v := range []struct {
+		Ports   []int
+		Port    int
+		Allowed bool
+	}{
+		{Port: 443, Allowed: true},
+		// DefaultBlockedPorts of no ports
+		{Port: 25, Allowed: false},
+		{Port: 0, Allowed: false},
+		{Ports: []int{465, 587}, Port: 25, Allowed: true},
+		{Ports: []int{465, 587}, Port: 587, Allowed: false},
+		{Ports: []int{0}, Port: 25, Allowed: true},
+		{Ports: []int{0}, Port: 0, Allowed: false},
+	} {
+		f := &DomainFilter{BlockedPorts: v.Ports}
+		if err := f.Provision(); err != nil {
+			t.Fatalf("provision error: %v", err)
+		}
+		addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: v.Port}
+		if err := f.Check(addr); (err == nil) != v.Allowed || (err != nil && !errors.Is(err, ErrBlockedAddress)) {
+			t.Errorf("check port %v of %v error: %v", v.Port, v.Ports, err)
+		}
+	}
+
+	for _, v := range []int{-1, 65536} {
+		if err := (&DomainFilter{BlockedPorts: []int{v}}).Provision(); err == nil {
+			t.Errorf("provision invalid port %v", v)
+		}
+	}
+}
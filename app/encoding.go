@@ -0,0 +1,212 @@
+package app
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Encodings of records of users of CaddyUpstream.
+const (
+	// EncodingJSON is JSON, which is readable with other tools.
+	EncodingJSON = "json"
+	// EncodingBinary is a compact binary encoding, which is much smaller and
+	// faster to marshal than JSON.
+	EncodingBinary = "binary"
+)
+
+// binaryMagic starts a record of EncodingBinary, with the version of the
+// format. A JSON record never starts with a zero byte.
+var binaryMagic = [2]byte{0x00, 0x01}
+
+// flags of a record of EncodingBinary
+const (
+	binaryEnabled byte = 1 << iota
+	binaryQuotaNotified
+)
+
+var errInvalidBinary = errors.New("invalid binary traffic")
+
+// checkEncoding checks the encoding is one of EncodingJSON and
+// EncodingBinary, or empty for EncodingJSON.
+func checkEncoding(encoding string) error {
+	switch encoding {
+	case "", EncodingJSON, EncodingBinary:
+		return nil
+	default:
+		return fmt.Errorf("unknown encoding: %v", encoding)
+	}
+}
+
+// marshalTraffic encodes traffic in the encoding.
+func marshalTraffic(encoding string, traffic *Traffic) ([]byte, error) {
+	if encoding == EncodingBinary {
+		return marshalBinaryTraffic(traffic), nil
+	}
+	return json.Marshal(traffic)
+}
+
+// unmarshalTraffic decodes traffic of either encoding, so records of one
+// encoding are read after the encoding is changed.
+func unmarshalTraffic(b []byte, traffic *Traffic) error {
+	if len(b) >= len(binaryMagic) && b[0] == binaryMagic[0] {
+		return unmarshalBinaryTraffic(b, traffic)
+	}
+	return json.Unmarshal(b, traffic)
+}
+
+// marshalBinaryTraffic encodes traffic as the magic, the flags, varints of
+// the numbers and times in unix nanoseconds, 0 for a zero time, and the
+// labels, source ip and allowed networks as length prefixed strings.
+func marshalBinaryTraffic(traffic *Traffic) []byte {
+	flags := byte(0)
+	if traffic.Enabled {
+		flags |= binaryEnabled
+	}
+	if traffic.QuotaNotified {
+		flags |= binaryQuotaNotified
+	}
+
+	b := make([]byte, 0, 32+len(traffic.SourceIP))
+	b = append(b, binaryMagic[:]...)
+	b = append(b, flags)
+	for _, v := range []int64{
+		traffic.Up, traffic.Down, traffic.UpUDP, traffic.DownUDP,
+		traffic.Quota, traffic.RateLimit,
+		unixNano(traffic.LastSeen), unixNano(traffic.ExpiresAt),
+	} {
+		b = appendVarint(b, v)
+	}
+	b = appendUvarint(b, uint64(len(traffic.Labels)))
+	for k, v := range traffic.Labels {
+		b = appendString(appendString(b, k), v)
+	}
+	b = appendString(b, traffic.SourceIP)
+	b = appendUvarint(b, uint64(len(traffic.AllowedCIDRs)))
+	for _, v := range traffic.AllowedCIDRs {
+		b = appendString(b, v)
+	}
+	return b
+}
+
+// unmarshalBinaryTraffic decodes traffic of marshalBinaryTraffic.
+func unmarshalBinaryTraffic(b []byte, traffic *Traffic) error {
+	if len(b) < len(binaryMagic)+1 || b[1] != binaryMagic[1] {
+		return errInvalidBinary
+	}
+	flags := b[2]
+	r := binaryReader{b: b[3:]}
+
+	t := Traffic{
+		Enabled:       flags&binaryEnabled != 0,
+		QuotaNotified: flags&binaryQuotaNotified != 0,
+	}
+	for _, v := range []*int64{
+		&t.Up, &t.Down, &t.UpUDP, &t.DownUDP,
+		&t.Quota, &t.RateLimit,
+	} {
+		*v = r.varint()
+	}
+	t.LastSeen, t.ExpiresAt = fromUnixNano(r.varint()), fromUnixNano(r.varint())
+	if n := r.length(); n > 0 {
+		t.Labels = make(map[string]string, n)
+		for i := 0; i < n; i++ {
+			k := r.string()
+			t.Labels[k] = r.string()
+		}
+	}
+	t.SourceIP = r.string()
+	if n := r.length(); n > 0 {
+		t.AllowedCIDRs = make([]string, n)
+		for i := range t.AllowedCIDRs {
+			t.AllowedCIDRs[i] = r.string()
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	*traffic = t
+	return nil
+}
+
+// unixNano is 0 for a zero time.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromUnixNano is a zero time for 0.
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// appendVarint is binary.AppendVarint, which needs Go 1.19.
+func appendVarint(b []byte, v int64) []byte {
+	buf := [binary.MaxVarintLen64]byte{}
+	return append(b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+// appendUvarint is binary.AppendUvarint, which needs Go 1.19.
+func appendUvarint(b []byte, v uint64) []byte {
+	buf := [binary.MaxVarintLen64]byte{}
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// appendString appends the length of s and s.
+func appendString(b []byte, s string) []byte {
+	return append(appendUvarint(b, uint64(len(s))), s...)
+}
+
+// binaryReader reads varints and strings of a record, and keeps the first
+// error, after which it reads zeros.
+type binaryReader struct {
+	b   []byte
+	err error
+}
+
+// varint is ...
+func (r *binaryReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = errInvalidBinary
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+// length reads a length, which is not greater than the rest of the record,
+// as each item of it takes at least one byte.
+func (r *binaryReader) length() int {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 || v > uint64(len(r.b)-n) {
+		r.err = errInvalidBinary
+		return 0
+	}
+	r.b = r.b[n:]
+	return int(v)
+}
+
+// string is ...
+func (r *binaryReader) string() string {
+	n := r.length()
+	if r.err != nil {
+		return ""
+	}
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s
+}
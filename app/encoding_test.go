@@ -0,0 +1,151 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+// testTraffic is a record of all fields.
+func testTraffic() Traffic {
+	return Traffic{
+		Up: 1 << 40, Down: 2, UpUDP: 1, DownUDP: 1,
+		Quota: 1 << 41, QuotaNotified: true, Enabled: true, RateLimit: 1 << 20,
+		LastSeen:     time.Unix(1700000000, 123),
+		ExpiresAt:    time.Unix(1800000000, 0),
+		Labels:       map[string]string{"name": "alice", "email": "alice@example.com"},
+		SourceIP:     "192.0.2.1",
+		AllowedCIDRs: []string{"198.51.100.0/24", "2001:db8::/32"},
+	}
+}
+
+func TestBinaryTraffic(t *testing.T) {
+	for _, v := range []Traffic{{}, {Enabled: true, Down: -1}, testTraffic()} {
+		b := marshalBinaryTraffic(&v)
+		traffic := Traffic{Up: 100}
+		if err := unmarshalTraffic(b, &traffic); err != nil {
+			t.Fatalf("unmarshal binary traffic error: %v", err)
+		}
+		if !reflect.DeepEqual(traffic, v) {
+			t.Errorf("binary traffic error: got %+v, want %+v", traffic, v)
+		}
+	}
+
+	// records less than half of JSON
+	v := testTraffic()
+	b, _ := json.Marshal(&v)
+	if n := len(marshalBinaryTraffic(&v)); n > len(b)/2 {
+		t.Errorf("binary traffic of %v bytes, json of %v bytes", n, len(b))
+	}
+
+	// truncated records are not decoded
+	b = marshalBinaryTraffic(&v)
+	for i := 1; i < len(b); i++ {
+		if err := unmarshalTraffic(b[:i], &Traffic{}); err == nil {
+			t.Errorf("unmarshal truncated binary traffic of %v bytes", i)
+		}
+	}
+}
+
+func TestCaddyUpstreamEncoding(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	u := &CaddyUpstream{Storage: storage, Logger: zap.NewNop()}
+	if err := u.normalizePrefix(); err != nil {
+		t.Fatalf("normalize prefix error: %v", err)
+	}
+	if err := u.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := utils.ByteSliceToString(key[:])
+	u.Consume(context.Background(), k, ProtocolTCP, 1, 2)
+	if err := u.Flush(); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+
+	// stored returns the record in storage, which must be of the encoding
+	stored := func(binary bool) Traffic {
+		b, err := storage.Load(context.Background(), u.Prefix+normalizeKey(k))
+		if err != nil {
+			t.Fatalf("load user error: %v", err)
+		}
+		if got := len(b) > 0 && b[0] == binaryMagic[0]; got != binary {
+			t.Fatalf("binary encoding of user: %v, want %v", got, binary)
+		}
+		traffic := Traffic{}
+		if err := unmarshalTraffic(b, &traffic); err != nil {
+			t.Fatalf("unmarshal user error: %v", err)
+		}
+		return traffic
+	}
+	if traffic := stored(false); traffic.Up != 1 || traffic.Down != 2 {
+		t.Errorf("json traffic error: %v, %v", traffic.Up, traffic.Down)
+	}
+
+	// a JSON record is read, and rewritten when it is updated
+	u.Encoding = EncodingBinary
+	if ok, err := u.Validate(context.Background(), k); !ok || err != nil {
+		t.Errorf("validate json user error: %v, %v", ok, err)
+	}
+	u.Consume(context.Background(), k, ProtocolTCP, 1, 2)
+	if err := u.Flush(); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+	if traffic := stored(true); traffic.Up != 2 || traffic.Down != 4 || !traffic.Enabled {
+		t.Errorf("binary traffic error: %+v", traffic)
+	}
+	if up, down, err := u.GetTraffic(context.Background(), k); up != 2 || down != 4 || err != nil {
+		t.Errorf("get traffic error: %v, %v, %v", up, down, err)
+	}
+	if up, down, err := u.TotalTraffic(context.Background()); up != 2 || down != 4 || err != nil {
+		t.Errorf("total traffic error: %v, %v, %v", up, down, err)
+	}
+
+	// and back to JSON
+	u.Encoding = EncodingJSON
+	if err := u.SetQuota(context.Background(), k, 100); err != nil {
+		t.Fatalf("set quota error: %v", err)
+	}
+	if traffic := stored(false); traffic.Up != 2 || traffic.Quota != 100 {
+		t.Errorf("json traffic error: %+v", traffic)
+	}
+}
+
+func BenchmarkMarshalTraffic(b *testing.B) {
+	v := testTraffic()
+	for _, encoding := range []string{EncodingJSON, EncodingBinary} {
+		b.Run(encoding, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := marshalTraffic(encoding, &v); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkUnmarshalTraffic(b *testing.B) {
+	v := testTraffic()
+	for _, encoding := range []string{EncodingJSON, EncodingBinary} {
+		bb, _ := marshalTraffic(encoding, &v)
+		b.Run(encoding, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				traffic := Traffic{}
+				if err := unmarshalTraffic(bb, &traffic); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package app
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventQuotaExceeded is fired once when the traffic of a user crosses its
+// quota, with the base64 key and the totals of the user.
+const EventQuotaExceeded = "trojan.quota_exceeded"
+
+// Events of connections of LiveEvents, with the id of the connection and
+// the base64 key of the user.
+const (
+	// EventConnectionOpened is fired when a relay of a user starts.
+	EventConnectionOpened = "trojan.connection_opened"
+	// EventConnectionTraffic is fired at most every liveInterval while a
+	// relay is relaying, with up and down of the bytes since the last one.
+	EventConnectionTraffic = "trojan.connection_traffic"
+	// EventConnectionClosed is fired when a relay is done, with up and down
+	// of the bytes of the whole relay.
+	EventConnectionClosed = "trojan.connection_closed"
+)
+
+// liveInterval is the min interval of EventConnectionTraffic of a relay, so
+// events are coalesced instead of fired for each read of a relay.
+const liveInterval = time.Second
+
+// Event is ...
+type Event struct {
+	// Name is ...
+	Name string `json:"name"`
+	// Time is ...
+	Time time.Time `json:"time"`
+	// Data is ...
+	Data map[string]interface{} `json:"data,omitempty"`
+}
+
+// Events dispatches events of trojan to handlers, as the events app of
+// caddy, which is not in the caddy of this version.
+type Events struct {
+	mu       sync.RWMutex
+	next     uint64
+	handlers map[uint64]func(Event)
+	// number of handlers
+	n int32
+}
+
+// GlobalEvents is the process-global events of trojan, so upstreams
+// fire events without a reference to trojan app.
+var GlobalEvents = &Events{}
+
+// LiveEvents is the process-global events of connections, which are too
+// many to be logged, for live views like GET /trojan/events. They are fired
+// only if there is a handler.
+var LiveEvents = &Events{}
+
+// On binds fn to all events, and returns a func which unbinds it.
+// Handlers are called synchronously and must not block.
+func (e *Events) On(fn func(Event)) (off func()) {
+	e.mu.Lock()
+	if e.handlers == nil {
+		e.handlers = make(map[uint64]func(Event))
+	}
+	id := e.next
+	e.next++
+	e.handlers[id] = fn
+	atomic.AddInt32(&e.n, 1)
+	e.mu.Unlock()
+
+	return func() {
+		e.mu.Lock()
+		if _, ok := e.handlers[id]; ok {
+			delete(e.handlers, id)
+			atomic.AddInt32(&e.n, -1)
+		}
+		e.mu.Unlock()
+	}
+}
+
+// Listening reports whether there is a handler, so events which are costly
+// to build are skipped if there is not.
+func (e *Events) Listening() bool {
+	return atomic.LoadInt32(&e.n) > 0
+}
+
+// Subscription is a channel of events of Subscribe.
+type Subscription struct {
+	// dropped is first for 64-bit alignment of atomic operations
+	dropped uint64
+	off     func()
+
+	// C is ...
+	C <-chan Event
+}
+
+// Subscribe returns a subscription of all events, of which events are
+// dropped if size events are not received yet, so a slow subscriber never
+// blocks Emit. Close must be called when it is done.
+func (e *Events) Subscribe(size int) *Subscription {
+	ch := make(chan Event, size)
+	s := &Subscription{C: ch}
+	s.off = e.On(func(ev Event) {
+		select {
+		case ch <- ev:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	})
+	return s
+}
+
+// Dropped returns the number of events dropped, and resets it.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.SwapUint64(&s.dropped, 0)
+}
+
+// Close stops the subscription, C is not closed.
+func (s *Subscription) Close() {
+	s.off()
+}
+
+// Emit fires the event to all handlers.
+func (e *Events) Emit(name string, data map[string]interface{}) {
+	ev := Event{Name: name, Time: time.Now(), Data: data}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, fn := range e.handlers {
+		fn(ev)
+	}
+}
+
+// emitQuotaExceeded fires EventQuotaExceeded of the user of base64 key k.
+func emitQuotaExceeded(k string, traffic Traffic) {
+	GlobalEvents.Emit(EventQuotaExceeded, map[string]interface{}{
+		"key":   k,
+		"up":    traffic.Up,
+		"down":  traffic.Down,
+		"quota": traffic.Quota,
+	})
+}
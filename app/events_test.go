@@ -0,0 +1,44 @@
+package app
+
+import (
+	"testing"
+)
+
+func TestSubscribe(t *testing.T) {
+	e := &Events{}
+	if e.Listening() {
+		t.Fatalf("listening without handlers")
+	}
+	s := e.Subscribe(2)
+	if !e.Listening() {
+		t.Fatalf("not listening with a subscription")
+	}
+	for _, v := range []string{"a", "b", "c", "d"} {
+		e.Emit(v, nil)
+	}
+	// events of a full subscription are dropped
+	if ev := <-s.C; ev.Name != "a" {
+		t.Errorf("first event error: %v", ev.Name)
+	}
+	if ev := <-s.C; ev.Name != "b" {
+		t.Errorf("second event error: %v", ev.Name)
+	}
+	if n := s.Dropped(); n != 2 {
+		t.Errorf("dropped events error: %v", n)
+	}
+	if n := s.Dropped(); n != 0 {
+		t.Errorf("dropped events are not reset: %v", n)
+	}
+
+	s.Close()
+	s.Close()
+	if e.Listening() {
+		t.Errorf("listening after close")
+	}
+	e.Emit("e", nil)
+	select {
+	case ev := <-s.C:
+		t.Errorf("event after close: %v", ev.Name)
+	default:
+	}
+}
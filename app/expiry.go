@@ -0,0 +1,97 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+// defaultExpiryInterval is the default interval of deleting expired users.
+const defaultExpiryInterval = 10 * time.Minute
+
+// expiryJanitor deletes expired users periodically to reclaim storage.
+// Expired users are not valid before they are deleted.
+type expiryJanitor struct {
+	up       Upstream
+	rs       *Relays
+	interval time.Duration
+	lg       *zap.Logger
+
+	closed chan struct{}
+	wg     *sync.WaitGroup
+}
+
+// Start is ...
+func (j *expiryJanitor) Start() {
+	j.closed = make(chan struct{})
+	j.wg = &sync.WaitGroup{}
+
+	j.wg.Add(1)
+	go j.loop()
+}
+
+// Stop is ...
+func (j *expiryJanitor) Stop() {
+	if j.closed == nil {
+		return
+	}
+	close(j.closed)
+	j.wg.Wait()
+}
+
+// loop is ...
+func (j *expiryJanitor) loop() {
+	defer j.wg.Done()
+
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-j.closed:
+			return
+		case <-ticker.C:
+		}
+
+		if err := j.sweep(context.Background(), time.Now()); err != nil {
+			j.lg.Error(fmt.Sprintf("delete expired users error: %v", err))
+		}
+	}
+}
+
+// sweep deletes users expired at now. Keys are collected first, as an
+// upstream may hold a lock while calling fn of Range.
+func (j *expiryJanitor) sweep(ctx context.Context, now time.Time) error {
+	keys := []string{}
+	if err := j.up.Range(ctx, func(k string, traffic Traffic) {
+		if traffic.Expired(now) {
+			keys = append(keys, k)
+		}
+	}); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		// Range lists base64 keys, while DelKey takes trojan headers
+		b, err := base64.StdEncoding.DecodeString(k)
+		if err != nil || len(b) != trojan.HeaderLen {
+			j.lg.Error(fmt.Sprintf("delete expired user error: invalid key %v", k))
+			continue
+		}
+		// deleted by another node sharing the storage
+		if err := j.up.DelKey(ctx, string(b)); err != nil && !errors.Is(err, ErrUserNotFound) {
+			return fmt.Errorf("delete expired user %v error: %w", k, err)
+		}
+		j.rs.Revoke(k)
+	}
+	if len(keys) > 0 {
+		j.lg.Info(fmt.Sprintf("delete %v expired users", len(keys)))
+	}
+	return nil
+}
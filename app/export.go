@@ -0,0 +1,98 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+)
+
+// exportedUsers is the JSON of Export, users are base64 keys.
+type exportedUsers struct {
+	// Users is ...
+	Users map[string]Traffic `json:"users"`
+}
+
+// Export writes all users and their traffic of the upstream to w as JSON,
+// which is read by Import, for backup and migration between upstreams.
+func Export(ctx context.Context, up Upstream, w io.Writer) error {
+	users := exportedUsers{Users: map[string]Traffic{}}
+	if err := up.Range(ctx, func(k string, traffic Traffic) {
+		users.Users[k] = traffic
+	}); err != nil {
+		return fmt.Errorf("range users error: %w", err)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(&users); err != nil {
+		return fmt.Errorf("encode users error: %w", err)
+	}
+	return nil
+}
+
+// Import adds the users of the JSON written by Export to the upstream, and
+// restores their traffic, quota, rate limit, labels, expiry and whether they
+// are enabled. The traffic of an existing user is replaced. LastSeen is the
+// time of the import, and the quota of a user is notified again.
+func Import(ctx context.Context, up Upstream, r io.Reader) error {
+	users := exportedUsers{}
+	if err := json.NewDecoder(r).Decode(&users); err != nil {
+		return fmt.Errorf("decode users error: %w", err)
+	}
+
+	keys := make([]string, 0, len(users.Users))
+	for k := range users.Users {
+		keys = append(keys, header(k))
+	}
+	if err := up.AddKeys(ctx, keys); err != nil {
+		return fmt.Errorf("add users error: %w", err)
+	}
+	for k, traffic := range users.Users {
+		if err := restore(ctx, up, k, traffic); err != nil {
+			return fmt.Errorf("restore user %v error: %w", k, err)
+		}
+	}
+	return nil
+}
+
+// restore sets the traffic of the user of base64 key k.
+func restore(ctx context.Context, up Upstream, k string, traffic Traffic) error {
+	if err := up.ResetTraffic(ctx, k); err != nil {
+		return err
+	}
+	// no quota is crossed by restoring traffic
+	if err := up.SetQuota(ctx, k, 0); err != nil {
+		return err
+	}
+	if n, w := traffic.UpTCP(), traffic.DownTCP(); n != 0 || w != 0 {
+		if err := up.Consume(ctx, k, ProtocolTCP, n, w); err != nil {
+			return err
+		}
+	}
+	if traffic.UpUDP != 0 || traffic.DownUDP != 0 {
+		if err := up.Consume(ctx, k, ProtocolUDP, traffic.UpUDP, traffic.DownUDP); err != nil {
+			return err
+		}
+	}
+	if err := up.SetQuota(ctx, k, traffic.Quota); err != nil {
+		return err
+	}
+	if err := up.SetRateLimit(ctx, k, traffic.RateLimit); err != nil {
+		return err
+	}
+	if err := up.SetLabels(ctx, k, traffic.Labels); err != nil {
+		return err
+	}
+	if err := up.SetExpiry(ctx, k, traffic.ExpiresAt); err != nil {
+		return err
+	}
+	if err := up.SetSourceIP(ctx, k, net.ParseIP(traffic.SourceIP)); err != nil {
+		return err
+	}
+	if err := up.SetAllowedCIDRs(ctx, k, traffic.AllowedCIDRs); err != nil {
+		return err
+	}
+	return up.SetEnabled(ctx, k, traffic.Enabled)
+}
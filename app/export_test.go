@@ -0,0 +1,98 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// users returns all users of u without LastSeen.
+func users(t *testing.T, u Upstream) map[string]Traffic {
+	t.Helper()
+
+	mm := map[string]Traffic{}
+	if err := u.Range(context.Background(), func(k string, traffic Traffic) {
+		traffic.LastSeen = time.Time{}
+		traffic.QuotaNotified = false
+		mm[k] = traffic
+	}); err != nil {
+		t.Fatalf("range error: %v", err)
+	}
+	return mm
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	src := &MemoryUpstream{}
+	for _, v := range []string{"test1234", "test5678", "disabled"} {
+		if err := src.Add(ctx, v); err != nil {
+			t.Fatalf("add user error: %v", err)
+		}
+	}
+	keys := []string{}
+	src.Range(ctx, func(k string, _ Traffic) { keys = append(keys, k) })
+	for i, k := range keys {
+		src.Consume(ctx, k, ProtocolTCP, int64(100*i+1), int64(200*i+2))
+		src.Consume(ctx, k, ProtocolUDP, int64(10*i+3), int64(20*i+4))
+	}
+	src.SetQuota(ctx, keys[0], 1<<20)
+	src.SetRateLimit(ctx, keys[0], 1<<10)
+	src.SetSourceIP(ctx, keys[0], net.IPv4(127, 0, 0, 1))
+	src.SetAllowedCIDRs(ctx, keys[0], []string{"10.0.0.0/8", "2001:db8::/32"})
+	src.SetLabels(ctx, keys[1], map[string]string{"name": "alice"})
+	src.SetExpiry(ctx, keys[1], time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	src.SetEnabled(ctx, keys[2], false)
+
+	buf := bytes.Buffer{}
+	if err := Export(ctx, src, &buf); err != nil {
+		t.Fatalf("export error: %v", err)
+	}
+	want := users(t, src)
+
+	file := &FileUpstream{Path: filepath.Join(t.TempDir(), "users.json")}
+	if err := file.Provision(caddy.Context{Context: ctx}); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	defer file.Cleanup()
+	storage := &CaddyUpstream{Storage: &certmagic.FileStorage{Path: t.TempDir()}, Logger: zap.NewNop()}
+	if err := storage.normalizePrefix(); err != nil {
+		t.Fatalf("normalize prefix error: %v", err)
+	}
+
+	// an existing user of dst is replaced
+	dst := &MemoryUpstream{}
+	dst.AddKey(ctx, header(keys[0]))
+	dst.Consume(ctx, keys[0], ProtocolTCP, 1000, 1000)
+	dst.SetQuota(ctx, keys[0], 1)
+
+	for _, v := range []struct {
+		Name string
+		Up   Upstream
+	}{
+		{Name: "memory", Up: dst},
+		{Name: "file", Up: file},
+		{Name: "caddy", Up: storage},
+	} {
+		if err := Import(ctx, v.Up, bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatalf("import to %v error: %v", v.Name, err)
+		}
+		if got := users(t, v.Up); !reflect.DeepEqual(got, want) {
+			t.Errorf("users of %v error:\ngot  %v\nwant %v", v.Name, got, want)
+		}
+		if v.Up.QuotaExceeded(ctx, keys[0]) {
+			t.Errorf("quota of %v is exceeded", v.Name)
+		}
+	}
+
+	if err := Import(ctx, dst, bytes.NewReader([]byte("{"))); err == nil {
+		t.Errorf("import invalid JSON")
+	}
+}
@@ -0,0 +1,657 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+func init() {
+	caddy.RegisterModule(FileUpstream{})
+}
+
+// fileUsers is the JSON file of FileUpstream, users are hex keys.
+type fileUsers struct {
+	// Keys is ...
+	Keys []string `json:"keys"`
+	// Traffic is ...
+	Traffic map[string]Traffic `json:"traffic,omitempty"`
+}
+
+// readFileUsers reads users from the file of name, a missing file has no users.
+func readFileUsers(name string) (*fileUsers, error) {
+	f := &fileUsers{}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return f, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, f); err != nil {
+		return nil, err
+	}
+
+	// trojan headers are lower case
+	for i, v := range f.Keys {
+		f.Keys[i] = strings.ToLower(v)
+	}
+	for k, v := range f.Traffic {
+		if lower := strings.ToLower(k); lower != k {
+			delete(f.Traffic, k)
+			f.Traffic[lower] = v
+		}
+	}
+	return f, nil
+}
+
+// find returns the index of the key, -1 if not found.
+func (f *fileUsers) find(k string) int {
+	for i, v := range f.Keys {
+		if v == k {
+			return i
+		}
+	}
+	return -1
+}
+
+// traffic returns the traffic of the key, users without traffic are enabled.
+func (f *fileUsers) traffic(k string) Traffic {
+	if traffic, ok := f.Traffic[k]; ok {
+		return traffic
+	}
+	return Traffic{Enabled: true}
+}
+
+// fileState is ...
+type fileState struct {
+	// traffic of all users, first for 64-bit alignment of atomic
+	up, down int64
+
+	// users loaded from the file
+	mu sync.RWMutex
+	mm map[string]Traffic
+
+	// pending traffic which is not flushed to the file
+	pt pendingTraffic
+}
+
+// FileUpstream is an upstream of users in a JSON file, which is reloaded
+// when changed by others. The file is
+//
+//	{
+//		"keys": ["hex key"],
+//		"traffic": {"hex key": {"up": 0, "down": 0}}
+//	}
+type FileUpstream struct {
+	// Path is the path of the JSON file.
+	Path string `json:"path,omitempty"`
+	// FlushInterval is the interval of writing accumulated traffic to the file, default is 30s.
+	FlushInterval caddy.Duration `json:"flush_interval,omitempty"`
+	KeyScheme
+
+	st      *fileState
+	watcher *fsnotify.Watcher
+	lg      *zap.Logger
+	closed  chan struct{}
+	wg      *sync.WaitGroup
+}
+
+// CaddyModule is ...
+func (FileUpstream) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "trojan.upstreams.file",
+		New: func() caddy.Module { return new(FileUpstream) },
+	}
+}
+
+// Provision is ...
+func (u *FileUpstream) Provision(ctx caddy.Context) error {
+	if err := u.KeyScheme.Provision(); err != nil {
+		return err
+	}
+	if u.Path == "" {
+		return errors.New("users file path is not configured")
+	}
+	path, err := filepath.Abs(u.Path)
+	if err != nil {
+		return err
+	}
+	u.Path = path
+	if u.FlushInterval == 0 {
+		u.FlushInterval = caddy.Duration(30 * time.Second)
+	}
+	u.lg = ctx.Logger(u)
+
+	u.st = &fileState{}
+	if err := u.load(); err != nil {
+		return fmt.Errorf("load users file error: %w", err)
+	}
+
+	// watch the directory, as the file is replaced by renaming
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(u.Path)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("watch users file error: %w", err)
+	}
+	u.watcher = watcher
+	u.closed = make(chan struct{})
+	u.wg = &sync.WaitGroup{}
+
+	u.wg.Add(1)
+	go u.loop()
+
+	return nil
+}
+
+// Cleanup is ...
+func (u *FileUpstream) Cleanup() error {
+	if u.closed == nil {
+		// provision failed
+		return nil
+	}
+	close(u.closed)
+	u.watcher.Close()
+	u.wg.Wait()
+	return u.Flush()
+}
+
+// loop is ...
+func (u *FileUpstream) loop() {
+	defer u.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(u.FlushInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-u.closed:
+			return
+		case <-ticker.C:
+			if err := u.Flush(); err != nil {
+				u.lg.Error(fmt.Sprintf("flush traffic error: %v", err))
+			}
+		case ev, ok := <-u.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(ev.Name) != u.Path {
+				continue
+			}
+			if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			if err := u.load(); err != nil {
+				u.lg.Error(fmt.Sprintf("reload users file error: %v", err))
+			}
+		case err, ok := <-u.watcher.Errors:
+			if !ok {
+				return
+			}
+			u.lg.Error(fmt.Sprintf("watch users file error: %v", err))
+		}
+	}
+}
+
+// load reads users from the file. Pending traffic is kept, so a reload
+// does not drop traffic which is not flushed yet.
+func (u *FileUpstream) load() error {
+	u.st.pt.flush.Lock()
+	defer u.st.pt.flush.Unlock()
+
+	f, err := readFileUsers(u.Path)
+	if err != nil {
+		return err
+	}
+	return u.set(f)
+}
+
+// set replaces users loaded from the file.
+func (u *FileUpstream) set(f *fileUsers) error {
+	mm := make(map[string]Traffic, len(f.Keys))
+	key := [trojan.HeaderLen]byte{}
+	for _, v := range f.Keys {
+		if err := trojan.ParseHexKey(v, key[:]); err != nil {
+			return err
+		}
+		mm[string(key[:])] = f.traffic(v)
+	}
+
+	u.st.mu.Lock()
+	u.st.mm = mm
+	u.st.mu.Unlock()
+	return nil
+}
+
+// Flush writes accumulated traffic to the file.
+func (u *FileUpstream) Flush() error {
+	return u.update(nil)
+}
+
+// update applies fn to the users of the file with pending traffic, and
+// writes the file back. The file is read again, so changes of others are kept.
+func (u *FileUpstream) update(fn func(*fileUsers) error) error {
+	u.st.pt.flush.Lock()
+	defer u.st.pt.flush.Unlock()
+
+	mm := u.st.pt.take()
+	if len(mm) == 0 && fn == nil {
+		return nil
+	}
+
+	crossed := map[string]Traffic{}
+	err := func() error {
+		f, err := readFileUsers(u.Path)
+		if err != nil {
+			return err
+		}
+		for k, v := range mm {
+			if f.find(k) < 0 {
+				// deleted by others
+				continue
+			}
+			traffic := f.traffic(k)
+			traffic.merge(v)
+			if traffic.crossQuota() {
+				crossed[k] = traffic
+			}
+			if f.Traffic == nil {
+				f.Traffic = make(map[string]Traffic)
+			}
+			f.Traffic[k] = traffic
+		}
+		if fn != nil {
+			if err := fn(f); err != nil {
+				return err
+			}
+		}
+
+		b, err := json.MarshalIndent(f, "", "\t")
+		if err != nil {
+			return err
+		}
+		if err := writeFile(u.Path, b); err != nil {
+			return err
+		}
+		return u.set(f)
+	}()
+	if err != nil {
+		// put traffic back and retry next time
+		for k, v := range mm {
+			u.st.pt.add(k, v)
+		}
+		return err
+	}
+	for k, v := range crossed {
+		emitQuotaExceeded(base64.StdEncoding.EncodeToString(utils.StringToByteSlice(k)), v)
+	}
+	return nil
+}
+
+// key returns the hex key of a 56-byte trojan header or a base64 key.
+func (u *FileUpstream) key(k string) string {
+	return header(k)
+}
+
+// get returns the user with pending traffic.
+func (u *FileUpstream) get(k string) (Traffic, bool) {
+	u.st.mu.RLock()
+	traffic, ok := u.st.mm[k]
+	u.st.mu.RUnlock()
+	if !ok {
+		return traffic, false
+	}
+	traffic.merge(u.st.pt.get(k))
+	return traffic, true
+}
+
+// modify applies fn to the traffic of an existing user.
+func (u *FileUpstream) modify(k string, fn func(*Traffic)) error {
+	return u.update(func(f *fileUsers) error {
+		if f.find(k) < 0 {
+			return ErrUserNotFound
+		}
+		traffic := f.traffic(k)
+		fn(&traffic)
+		if f.Traffic == nil {
+			f.Traffic = make(map[string]Traffic)
+		}
+		f.Traffic[k] = traffic
+		return nil
+	})
+}
+
+// AddKey is ...
+func (u *FileUpstream) AddKey(ctx context.Context, k string) error {
+	k = u.key(k)
+	return u.update(func(f *fileUsers) error {
+		if f.find(k) < 0 {
+			f.Keys = append(f.Keys, k)
+		}
+		return nil
+	})
+}
+
+// Add is ...
+func (u *FileUpstream) Add(ctx context.Context, s string) error {
+	b := [trojan.HeaderLen]byte{}
+	u.GenKey(s, b[:])
+	return u.AddKey(ctx, utils.ByteSliceToString(b[:]))
+}
+
+// AddKeys is ...
+func (u *FileUpstream) AddKeys(ctx context.Context, keys []string) error {
+	return u.update(func(f *fileUsers) error {
+		for _, k := range keys {
+			if k = u.key(k); f.find(k) < 0 {
+				f.Keys = append(f.Keys, k)
+			}
+		}
+		return nil
+	})
+}
+
+// DelKeys is ...
+func (u *FileUpstream) DelKeys(ctx context.Context, keys []string) error {
+	return u.update(func(f *fileUsers) error {
+		for _, k := range keys {
+			k = u.key(k)
+			if i := f.find(k); i >= 0 {
+				f.Keys = append(f.Keys[:i], f.Keys[i+1:]...)
+			}
+			delete(f.Traffic, k)
+		}
+		return nil
+	})
+}
+
+// DelKey is ...
+func (u *FileUpstream) DelKey(ctx context.Context, k string) error {
+	k = u.key(k)
+	return u.update(func(f *fileUsers) error {
+		if i := f.find(k); i >= 0 {
+			f.Keys = append(f.Keys[:i], f.Keys[i+1:]...)
+		}
+		delete(f.Traffic, k)
+		return nil
+	})
+}
+
+// Del is ...
+func (u *FileUpstream) Del(ctx context.Context, s string) error {
+	b := [trojan.HeaderLen]byte{}
+	u.GenKey(s, b[:])
+	return u.DelKey(ctx, utils.ByteSliceToString(b[:]))
+}
+
+// Range is ...
+func (u *FileUpstream) Range(ctx context.Context, fn func(k string, traffic Traffic)) error {
+	u.st.mu.RLock()
+	mm := make(map[string]Traffic, len(u.st.mm))
+	for k, v := range u.st.mm {
+		mm[k] = v
+	}
+	u.st.mu.RUnlock()
+
+	for k, v := range mm {
+		v.merge(u.st.pt.get(k))
+		fn(base64.StdEncoding.EncodeToString(utils.StringToByteSlice(k)), v)
+	}
+	return nil
+}
+
+// ListKeys is ...
+func (u *FileUpstream) ListKeys(ctx context.Context) ([]string, error) {
+	u.st.mu.RLock()
+	keys := make([]string, 0, len(u.st.mm))
+	for k := range u.st.mm {
+		keys = append(keys, base64.StdEncoding.EncodeToString(utils.StringToByteSlice(k)))
+	}
+	u.st.mu.RUnlock()
+	return keys, nil
+}
+
+// Validate is ...
+func (u *FileUpstream) Validate(ctx context.Context, k string) (bool, error) {
+	traffic, ok := u.get(u.key(k))
+	return ok && traffic.Enabled && !traffic.Expired(time.Now()), nil
+}
+
+// Has is ...
+func (u *FileUpstream) Has(ctx context.Context, k string) (bool, error) {
+	_, ok := u.get(u.key(k))
+	return ok, nil
+}
+
+// Consume is ...
+func (u *FileUpstream) Consume(ctx context.Context, k string, proto Protocol, nr, nw int64) error {
+	k = u.key(k)
+	if _, ok := u.get(k); !ok {
+		return nil
+	}
+	u.st.pt.add(k, consumed(proto, nr, nw))
+	atomic.AddInt64(&u.st.up, nr)
+	atomic.AddInt64(&u.st.down, nw)
+	return nil
+}
+
+// TotalTraffic is ...
+// The file has no total, so it is only counted since the file is loaded.
+func (u *FileUpstream) TotalTraffic(ctx context.Context) (int64, int64, error) {
+	return atomic.LoadInt64(&u.st.up), atomic.LoadInt64(&u.st.down), nil
+}
+
+// GetTraffic is ...
+func (u *FileUpstream) GetTraffic(ctx context.Context, k string) (int64, int64, error) {
+	traffic, ok := u.get(u.key(k))
+	if !ok {
+		return 0, 0, ErrUserNotFound
+	}
+	return traffic.Up, traffic.Down, nil
+}
+
+// ResetTraffic is ...
+func (u *FileUpstream) ResetTraffic(ctx context.Context, k string) error {
+	err := u.modify(u.key(k), func(traffic *Traffic) {
+		traffic.Up, traffic.UpUDP = 0, 0
+		traffic.Down, traffic.DownUDP = 0, 0
+		traffic.QuotaNotified = false
+	})
+	if errors.Is(err, ErrUserNotFound) {
+		return nil
+	}
+	return err
+}
+
+// SetQuota is ...
+func (u *FileUpstream) SetQuota(ctx context.Context, k string, n int64) error {
+	return u.modify(u.key(k), func(traffic *Traffic) {
+		traffic.Quota, traffic.QuotaNotified = n, false
+	})
+}
+
+// QuotaExceeded is ...
+func (u *FileUpstream) QuotaExceeded(ctx context.Context, k string) bool {
+	traffic, _ := u.get(u.key(k))
+	return traffic.QuotaExceeded()
+}
+
+// SetEnabled is ...
+func (u *FileUpstream) SetEnabled(ctx context.Context, k string, enabled bool) error {
+	return u.modify(u.key(k), func(traffic *Traffic) {
+		traffic.Enabled = enabled
+	})
+}
+
+// Count is ...
+func (u *FileUpstream) Count(ctx context.Context) (int, error) {
+	u.st.mu.RLock()
+	n := len(u.st.mm)
+	u.st.mu.RUnlock()
+	return n, nil
+}
+
+// SetRateLimit is ...
+func (u *FileUpstream) SetRateLimit(ctx context.Context, k string, n int64) error {
+	return u.modify(u.key(k), func(traffic *Traffic) {
+		traffic.RateLimit = n
+	})
+}
+
+// GetRateLimit is ...
+func (u *FileUpstream) GetRateLimit(ctx context.Context, k string) (int64, error) {
+	traffic, ok := u.get(u.key(k))
+	if !ok {
+		return 0, ErrUserNotFound
+	}
+	return traffic.RateLimit, nil
+}
+
+// GetLastSeen is ...
+func (u *FileUpstream) GetLastSeen(ctx context.Context, k string) (time.Time, error) {
+	traffic, ok := u.get(u.key(k))
+	if !ok {
+		return time.Time{}, ErrUserNotFound
+	}
+	return traffic.LastSeen, nil
+}
+
+// SetLabels is ...
+func (u *FileUpstream) SetLabels(ctx context.Context, k string, labels map[string]string) error {
+	return u.modify(u.key(k), func(traffic *Traffic) {
+		traffic.Labels = copyLabels(labels)
+	})
+}
+
+// GetLabels is ...
+func (u *FileUpstream) GetLabels(ctx context.Context, k string) (map[string]string, error) {
+	traffic, ok := u.get(u.key(k))
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return copyLabels(traffic.Labels), nil
+}
+
+// SetExpiry is ...
+func (u *FileUpstream) SetExpiry(ctx context.Context, k string, t time.Time) error {
+	return u.modify(u.key(k), func(traffic *Traffic) {
+		traffic.ExpiresAt = t
+	})
+}
+
+// SetSourceIP is ...
+func (u *FileUpstream) SetSourceIP(ctx context.Context, k string, ip net.IP) error {
+	if err := checkSourceIP(ip); err != nil {
+		return err
+	}
+	return u.modify(u.key(k), func(traffic *Traffic) {
+		traffic.SourceIP = sourceIPString(ip)
+	})
+}
+
+// GetSourceIP is ...
+func (u *FileUpstream) GetSourceIP(ctx context.Context, k string) (net.IP, error) {
+	traffic, ok := u.get(u.key(k))
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return net.ParseIP(traffic.SourceIP), nil
+}
+
+// SetAllowedCIDRs is ...
+func (u *FileUpstream) SetAllowedCIDRs(ctx context.Context, k string, cidrs []string) error {
+	cidrs, err := parseAllowedCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	return u.modify(u.key(k), func(traffic *Traffic) {
+		traffic.AllowedCIDRs = cidrs
+	})
+}
+
+// GetAllowedCIDRs is ...
+func (u *FileUpstream) GetAllowedCIDRs(ctx context.Context, k string) ([]string, error) {
+	traffic, ok := u.get(u.key(k))
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return traffic.AllowedCIDRs, nil
+}
+
+// Ping checks the directory of the file, where the file is written.
+func (u *FileUpstream) Ping(ctx context.Context) error {
+	_, err := os.Stat(filepath.Dir(u.Path))
+	return err
+}
+
+// UnmarshalCaddyfile is ...
+func (u *FileUpstream) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.Next() {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		u.Path = d.Val()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		subdirective := d.Val()
+		switch subdirective {
+		case "path":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.Path = d.Val()
+		case "flush_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parse flush_interval error: %v", err)
+			}
+			u.FlushInterval = caddy.Duration(dur)
+		case "key_scheme":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.Scheme = d.Val()
+		default:
+			return d.Errf("unknown file subdirective: %v", subdirective)
+		}
+	}
+	if u.Path == "" {
+		return d.Err("users file path is required")
+	}
+	return nil
+}
+
+var (
+	_ Upstream              = (*FileUpstream)(nil)
+	_ KeyGenerator          = (*FileUpstream)(nil)
+	_ caddy.Provisioner     = (*FileUpstream)(nil)
+	_ caddy.CleanerUpper    = (*FileUpstream)(nil)
+	_ caddyfile.Unmarshaler = (*FileUpstream)(nil)
+)
@@ -0,0 +1,196 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+func TestFileUpstream(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := utils.ByteSliceToString(key[:])
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(`{"keys":["%s"]}`, key[:])), 0o644); err != nil {
+		t.Fatalf("write users file error: %v", err)
+	}
+
+	u := &FileUpstream{Path: path}
+	if err := u.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	defer u.Cleanup()
+	if ok, err := u.Validate(context.Background(), k); err != nil || !ok {
+		t.Fatalf("validate user of file error")
+	}
+	u.Consume(context.Background(), k, ProtocolTCP, 1, 2)
+
+	// the file is changed by others, with traffic which does not include
+	// the pending traffic
+	key2 := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test5678", key2[:])
+	b := fmt.Sprintf(`{"keys":["%s","%s"],"traffic":{"%s":{"up":10,"down":20}}}`, key[:], key2[:], key[:])
+	if err := writeFile(path, []byte(b)); err != nil {
+		t.Fatalf("write users file error: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if ok, err := u.Validate(context.Background(), utils.ByteSliceToString(key2[:])); err == nil && ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("users file is not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if up, down, err := u.GetTraffic(context.Background(), k); err != nil || up != 11 || down != 22 {
+		t.Errorf("get traffic after reload error: up %v, down %v, error %v", up, down, err)
+	}
+
+	if err := u.Flush(); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+	f, err := readFileUsers(path)
+	if err != nil {
+		t.Fatalf("read users file error: %v", err)
+	}
+	if traffic := f.traffic(k); traffic.Up != 11 || traffic.Down != 22 {
+		t.Errorf("flushed traffic error: %+v", traffic)
+	}
+
+	if err := u.SetEnabled(context.Background(), k, false); err != nil {
+		t.Fatalf("disable user error: %v", err)
+	}
+	if ok, err := u.Validate(context.Background(), k); err != nil || ok {
+		t.Errorf("validate disabled user")
+	}
+	if err := u.Del(context.Background(), "test5678"); err != nil {
+		t.Fatalf("delete user error: %v", err)
+	}
+	if n, _ := u.Count(context.Background()); n != 1 {
+		t.Errorf("count users error: got %v, want 1", n)
+	}
+	if err := u.SetQuota(context.Background(), utils.ByteSliceToString(key2[:]), 1); err != ErrUserNotFound {
+		t.Errorf("set quota of deleted user error: %v", err)
+	}
+}
+
+func TestFileUpstreamBatch(t *testing.T) {
+	u := &FileUpstream{Path: filepath.Join(t.TempDir(), "users.json")}
+	if err := u.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	defer u.Cleanup()
+	testBatch(t, u)
+}
+
+func TestFileUpstreamLabels(t *testing.T) {
+	u := &FileUpstream{Path: filepath.Join(t.TempDir(), "users.json")}
+	if err := u.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	defer u.Cleanup()
+	testLabels(t, u)
+}
+
+func TestFileUpstreamProtocol(t *testing.T) {
+	u := &FileUpstream{Path: filepath.Join(t.TempDir(), "users.json")}
+	if err := u.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	defer u.Cleanup()
+	testProtocol(t, u)
+}
+
+func TestFileUpstreamTotalTraffic(t *testing.T) {
+	u := &FileUpstream{Path: filepath.Join(t.TempDir(), "users.json")}
+	if err := u.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	defer u.Cleanup()
+	testTotalTraffic(t, u)
+}
+
+func TestFileUpstreamExpiry(t *testing.T) {
+	u := &FileUpstream{Path: filepath.Join(t.TempDir(), "users.json")}
+	if err := u.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	defer u.Cleanup()
+	testExpiry(t, u)
+}
+
+func TestFileUpstreamHas(t *testing.T) {
+	u := &FileUpstream{Path: filepath.Join(t.TempDir(), "users.json")}
+	if err := u.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	defer u.Cleanup()
+	testHas(t, u)
+}
+
+func TestFileUpstreamSourceIP(t *testing.T) {
+	u := &FileUpstream{Path: filepath.Join(t.TempDir(), "users.json")}
+	if err := u.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	defer u.Cleanup()
+	testSourceIP(t, u)
+}
+
+func TestFileUpstreamAllowedCIDRs(t *testing.T) {
+	u := &FileUpstream{Path: filepath.Join(t.TempDir(), "users.json")}
+	if err := u.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	defer u.Cleanup()
+	testAllowedCIDRs(t, u)
+}
+
+func TestFileUpstreamListKeys(t *testing.T) {
+	u := &FileUpstream{Path: filepath.Join(t.TempDir(), "users.json")}
+	if err := u.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	defer u.Cleanup()
+	testListKeys(t, u)
+}
+
+func TestFileUpstreamQuotaEvent(t *testing.T) {
+	u := &FileUpstream{Path: filepath.Join(t.TempDir(), "users.json")}
+	if err := u.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	defer u.Cleanup()
+	testQuotaEvent(t, u)
+}
+
+func TestFileUpstreamPing(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "users")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatalf("mkdir error: %v", err)
+	}
+	u := &FileUpstream{Path: filepath.Join(dir, "users.json")}
+	if err := u.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	defer u.Cleanup()
+	if err := u.Ping(context.Background()); err != nil {
+		t.Errorf("ping file upstream error: %v", err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("remove dir error: %v", err)
+	}
+	if err := u.Ping(context.Background()); err == nil {
+		t.Errorf("ping file upstream without directory")
+	}
+}
@@ -0,0 +1,250 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+// defaultStatsInterval is ...
+const defaultStatsInterval = 10 * time.Second
+
+// minStatsInterval is the min interval of GetStats requested by clients.
+const minStatsInterval = time.Second
+
+// GRPC serves the management service of users for control planes, which is
+// trojan.Management of grpc.proto. Messages are well-known types of protobuf,
+// so clients do not need generated code of trojan. There is no TLS or
+// authentication, so Listen should be a local or private address.
+type GRPC struct {
+	// Listen is the address of the gRPC server.
+	Listen string `json:"listen"`
+	// StatsInterval is the default interval of GetStats, default is 10s.
+	StatsInterval caddy.Duration `json:"stats_interval,omitempty"`
+
+	up Upstream
+	rs *Relays
+	lg *zap.Logger
+
+	ln  net.Listener
+	srv *grpc.Server
+}
+
+// Provision is ...
+func (g *GRPC) Provision(up Upstream, lg *zap.Logger) error {
+	if g.Listen == "" {
+		return errors.New("listen address of grpc is not configured")
+	}
+	if g.StatsInterval < 0 {
+		return errors.New("stats_interval must not be negative")
+	}
+	if g.StatsInterval == 0 {
+		g.StatsInterval = caddy.Duration(defaultStatsInterval)
+	}
+	g.up, g.lg = up, lg
+	return nil
+}
+
+// Start is ...
+func (g *GRPC) Start() error {
+	// the listener is shared with the server of the new config on reload
+	ln, err := caddy.Listen("tcp", g.Listen)
+	if err != nil {
+		return fmt.Errorf("listen grpc error: %w", err)
+	}
+	g.ln = ln
+	g.srv = grpc.NewServer()
+	g.srv.RegisterService(&managementServiceDesc, g)
+
+	go func(srv *grpc.Server, ln net.Listener) {
+		if err := srv.Serve(ln); err != nil {
+			g.lg.Error(fmt.Sprintf("serve grpc error: %v", err))
+		}
+	}(g.srv, ln)
+	return nil
+}
+
+// Stop is ...
+func (g *GRPC) Stop() {
+	if g.srv == nil {
+		return
+	}
+	// streams of GetStats never end, so they are not waited for
+	g.srv.Stop()
+}
+
+// AddUser adds the user of the password.
+func (g *GRPC) AddUser(ctx context.Context, in *wrapperspb.StringValue) (*emptypb.Empty, error) {
+	if in.GetValue() == "" {
+		return nil, status.Error(codes.InvalidArgument, "password is required")
+	}
+	if err := g.up.Add(ctx, in.GetValue()); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// DelUser deletes the user of the password.
+func (g *GRPC) DelUser(ctx context.Context, in *wrapperspb.StringValue) (*emptypb.Empty, error) {
+	if in.GetValue() == "" {
+		return nil, status.Error(codes.InvalidArgument, "password is required")
+	}
+	if err := g.up.Del(ctx, in.GetValue()); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	key := [trojan.HeaderLen]byte{}
+	GenKey(g.up, in.GetValue(), key[:])
+	g.rs.Revoke(utils.ByteSliceToString(key[:]))
+	return &emptypb.Empty{}, nil
+}
+
+// ListUsers returns all users and their traffic, in the JSON of Export.
+func (g *GRPC) ListUsers(ctx context.Context, _ *emptypb.Empty) (*structpb.Struct, error) {
+	return g.snapshot(ctx)
+}
+
+// GetStats pushes a snapshot of all users every interval, which is
+// StatsInterval if not set, until the client is gone.
+func (g *GRPC) GetStats(in *durationpb.Duration, stream grpc.ServerStream) error {
+	interval := time.Duration(g.StatsInterval)
+	if in.GetSeconds() != 0 || in.GetNanos() != 0 {
+		interval = in.AsDuration()
+	}
+	if interval < minStatsInterval {
+		return status.Errorf(codes.InvalidArgument, "interval must be at least %v", minStatsInterval)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		v, err := g.snapshot(stream.Context())
+		if err != nil {
+			return err
+		}
+		if err := stream.SendMsg(v); err != nil {
+			return err
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// snapshot returns all users of Range as a struct of the JSON of Export.
+func (g *GRPC) snapshot(ctx context.Context) (*structpb.Struct, error) {
+	users := exportedUsers{Users: map[string]Traffic{}}
+	if err := g.up.Range(ctx, func(k string, traffic Traffic) {
+		users.Users[k] = traffic
+	}); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	b, err := json.Marshal(&users)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	v := &structpb.Struct{}
+	if err := protojson.Unmarshal(b, v); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return v, nil
+}
+
+// managementServer is the server of trojan.Management.
+type managementServer interface {
+	AddUser(context.Context, *wrapperspb.StringValue) (*emptypb.Empty, error)
+	DelUser(context.Context, *wrapperspb.StringValue) (*emptypb.Empty, error)
+	ListUsers(context.Context, *emptypb.Empty) (*structpb.Struct, error)
+	GetStats(*durationpb.Duration, grpc.ServerStream) error
+}
+
+// managementServiceDesc is the service of grpc.proto, which is written as
+// protoc-gen-go-grpc does.
+var managementServiceDesc = grpc.ServiceDesc{
+	ServiceName: "trojan.Management",
+	HandlerType: (*managementServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "AddUser",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := &wrapperspb.StringValue{}
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(managementServer).AddUser(ctx, req.(*wrapperspb.StringValue))
+				}
+				if interceptor == nil {
+					return handler(ctx, in)
+				}
+				return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/trojan.Management/AddUser"}, handler)
+			},
+		},
+		{
+			MethodName: "DelUser",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := &wrapperspb.StringValue{}
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(managementServer).DelUser(ctx, req.(*wrapperspb.StringValue))
+				}
+				if interceptor == nil {
+					return handler(ctx, in)
+				}
+				return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/trojan.Management/DelUser"}, handler)
+			},
+		},
+		{
+			MethodName: "ListUsers",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := &emptypb.Empty{}
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(managementServer).ListUsers(ctx, req.(*emptypb.Empty))
+				}
+				if interceptor == nil {
+					return handler(ctx, in)
+				}
+				return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/trojan.Management/ListUsers"}, handler)
+			},
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "GetStats",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				in := &durationpb.Duration{}
+				if err := stream.RecvMsg(in); err != nil {
+					return err
+				}
+				return srv.(managementServer).GetStats(in, stream)
+			},
+			ServerStreams: true,
+		},
+	},
+	Metadata: "grpc.proto",
+}
+
+var _ managementServer = (*GRPC)(nil)
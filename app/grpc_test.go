@@ -0,0 +1,106 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+func TestGRPC(t *testing.T) {
+	up := &MemoryUpstream{}
+	g := &GRPC{Listen: "127.0.0.1:0"}
+	if err := g.Provision(up, zap.NewNop()); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	if err := g.Start(); err != nil {
+		t.Fatalf("start error: %v", err)
+	}
+	defer g.Stop()
+
+	conn, err := grpc.Dial(g.ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := conn.Invoke(ctx, "/trojan.Management/AddUser", wrapperspb.String("test1234"), &emptypb.Empty{}); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	if err := conn.Invoke(ctx, "/trojan.Management/AddUser", wrapperspb.String(""), &emptypb.Empty{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("add user without password error: %v", err)
+	}
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := base64.StdEncoding.EncodeToString(key[:])
+	// traffic returns the traffic of the user in users
+	traffic := func(users *structpb.Struct) (float64, float64) {
+		user := users.GetFields()["users"].GetStructValue().GetFields()[k].GetStructValue()
+		if user == nil {
+			t.Fatalf("user is not listed: %v", users)
+		}
+		return user.GetFields()["up"].GetNumberValue(), user.GetFields()["down"].GetNumberValue()
+	}
+
+	users := &structpb.Struct{}
+	if err := conn.Invoke(ctx, "/trojan.Management/ListUsers", &emptypb.Empty{}, users); err != nil {
+		t.Fatalf("list users error: %v", err)
+	}
+	if up, down := traffic(users); up != 0 || down != 0 {
+		t.Errorf("list users error: %v, %v", up, down)
+	}
+
+	desc := &grpc.StreamDesc{StreamName: "GetStats", ServerStreams: true}
+	stream, err := conn.NewStream(ctx, desc, "/trojan.Management/GetStats")
+	if err != nil {
+		t.Fatalf("get stats error: %v", err)
+	}
+	if err := stream.SendMsg(durationpb.New(time.Second)); err != nil {
+		t.Fatalf("send interval error: %v", err)
+	}
+	stream.CloseSend()
+	if err := stream.RecvMsg(users); err != nil {
+		t.Fatalf("receive stats error: %v", err)
+	}
+	// the next snapshot has the live traffic
+	up.Consume(ctx, utils.ByteSliceToString(key[:]), ProtocolTCP, 1, 2)
+	if err := stream.RecvMsg(users); err != nil {
+		t.Fatalf("receive stats error: %v", err)
+	}
+	if up, down := traffic(users); up != 1 || down != 2 {
+		t.Errorf("stats error: %v, %v", up, down)
+	}
+
+	stream, err = conn.NewStream(ctx, desc, "/trojan.Management/GetStats")
+	if err != nil {
+		t.Fatalf("get stats error: %v", err)
+	}
+	stream.SendMsg(durationpb.New(time.Millisecond))
+	stream.CloseSend()
+	if err := stream.RecvMsg(users); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("get stats of a short interval error: %v", err)
+	}
+
+	if err := conn.Invoke(ctx, "/trojan.Management/DelUser", wrapperspb.String("test1234"), &emptypb.Empty{}); err != nil {
+		t.Fatalf("delete user error: %v", err)
+	}
+	if n, _ := up.Count(ctx); n != 0 {
+		t.Errorf("user is not deleted")
+	}
+}
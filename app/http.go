@@ -0,0 +1,533 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(HTTPUpstream{})
+}
+
+// HTTPSecretHeader is the header of the shared secret of requests of HTTPUpstream.
+const HTTPSecretHeader = "X-Trojan-Secret"
+
+// errHTTPManaged is returned by management of users of HTTPUpstream.
+var errHTTPManaged = errors.New("users are managed by the http service")
+
+// HTTPUpstream is an upstream which delegates users to an external HTTP
+// service, so caddy-trojan keeps no users. Requests carry Secret in the
+// X-Trojan-Secret header, and keys are the hex of the 56-byte trojan header.
+//
+//	GET {endpoint}/validate?key={key}
+//
+// replies 200 if the user is valid, and 403 or 404 if not. Valid users are
+// cached for CacheTTL, so a user disabled by the service may connect until
+// its cache expires.
+//
+//	POST {endpoint}/consume
+//	[{"key": "{key}", "up": 0, "down": 0, "up_udp": 0, "down_udp": 0}]
+//
+// reports the traffic of users since the last report, once for each
+// FlushInterval, and replies 2xx. Traffic failed to report is kept in memory
+// for the next flush. Management of users, like Add and SetQuota, fails with
+// an error, and Range lists no user.
+type HTTPUpstream struct {
+	// traffic of all users since provisioned, first for 64-bit alignment of atomic
+	up, down int64
+
+	// Endpoint is the base URL of the service, like https://auth.example.com/trojan.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Secret is the shared secret sent to the service, which supports
+	// placeholders like {env.TROJAN_SECRET}.
+	Secret string `json:"secret,omitempty"`
+	// Timeout is the timeout of a request to the service, default is 5s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+	// CacheSize is the number of valid users cached in memory, default is 1024.
+	CacheSize int `json:"cache_size,omitempty"`
+	// CacheTTL is the time a valid user is cached, default is 30s.
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+	// FlushInterval is the interval of reporting traffic to the service, default is 10s.
+	FlushInterval caddy.Duration `json:"flush_interval,omitempty"`
+	KeyScheme
+
+	endpoint *url.URL
+	secret   string
+	client   *http.Client
+	cache    *validationCache
+	pt       *pendingTraffic
+	lg       *zap.Logger
+
+	closed chan struct{}
+	wg     *sync.WaitGroup
+}
+
+// CaddyModule is ...
+func (HTTPUpstream) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "trojan.upstreams.http",
+		New: func() caddy.Module { return new(HTTPUpstream) },
+	}
+}
+
+// Provision is ...
+func (u *HTTPUpstream) Provision(ctx caddy.Context) error {
+	if err := u.KeyScheme.Provision(); err != nil {
+		return err
+	}
+	if u.Endpoint == "" {
+		return errors.New("endpoint of http upstream is not configured")
+	}
+	endpoint, err := url.Parse(u.Endpoint)
+	if err != nil {
+		return fmt.Errorf("parse endpoint error: %w", err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return fmt.Errorf("scheme of endpoint %v is not http or https", u.Endpoint)
+	}
+	if u.Timeout < 0 {
+		return errors.New("timeout must not be negative")
+	}
+	if u.Timeout == 0 {
+		u.Timeout = caddy.Duration(5 * time.Second)
+	}
+	if u.CacheSize < 0 {
+		return errors.New("cache_size must not be negative")
+	}
+	if u.CacheSize == 0 {
+		u.CacheSize = 1024
+	}
+	if u.CacheTTL < 0 {
+		return errors.New("cache_ttl must not be negative")
+	}
+	if u.CacheTTL == 0 {
+		u.CacheTTL = caddy.Duration(30 * time.Second)
+	}
+	if u.FlushInterval < 0 {
+		return errors.New("flush_interval must not be negative")
+	}
+	if u.FlushInterval == 0 {
+		u.FlushInterval = caddy.Duration(10 * time.Second)
+	}
+
+	u.endpoint = endpoint
+	u.secret = caddy.NewReplacer().ReplaceKnown(u.Secret, "")
+	// an own transport, of which idle connections are closed on Cleanup
+	u.client = &http.Client{Timeout: time.Duration(u.Timeout), Transport: http.DefaultTransport.(*http.Transport).Clone()}
+	u.cache = newValidationCache(u.CacheSize, time.Duration(u.CacheTTL))
+	u.pt = &pendingTraffic{}
+	u.lg = ctx.Logger(u)
+	u.closed = make(chan struct{})
+	u.wg = &sync.WaitGroup{}
+
+	u.wg.Add(1)
+	go u.loop()
+
+	return nil
+}
+
+// Cleanup is ...
+func (u *HTTPUpstream) Cleanup() error {
+	if u.closed == nil {
+		// provision failed
+		return nil
+	}
+	close(u.closed)
+	u.wg.Wait()
+	err := u.Flush()
+	u.client.CloseIdleConnections()
+	return err
+}
+
+// loop is ...
+func (u *HTTPUpstream) loop() {
+	defer u.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(u.FlushInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-u.closed:
+			return
+		case <-ticker.C:
+			if err := u.Flush(); err != nil {
+				u.lg.Error(fmt.Sprintf("flush traffic error: %v", err))
+			}
+		}
+	}
+}
+
+// httpTraffic is the traffic of a user reported to the service.
+type httpTraffic struct {
+	Key     string `json:"key"`
+	Up      int64  `json:"up"`
+	Down    int64  `json:"down"`
+	UpUDP   int64  `json:"up_udp"`
+	DownUDP int64  `json:"down_udp"`
+}
+
+// Flush reports accumulated traffic to the service in one request.
+func (u *HTTPUpstream) Flush() error {
+	u.pt.flush.Lock()
+	defer u.pt.flush.Unlock()
+
+	mm := u.pt.take()
+	if len(mm) == 0 {
+		return nil
+	}
+
+	traffic := make([]httpTraffic, 0, len(mm))
+	for k, v := range mm {
+		traffic = append(traffic, httpTraffic{Key: k, Up: v.Up, Down: v.Down, UpUDP: v.UpUDP, DownUDP: v.DownUDP})
+	}
+	err := func() error {
+		b, err := json.Marshal(traffic)
+		if err != nil {
+			return err
+		}
+		req, err := u.request(context.Background(), http.MethodPost, "consume", nil, bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		res, err := u.do(req)
+		if err != nil {
+			return err
+		}
+		if res.StatusCode/100 != 2 {
+			return fmt.Errorf("consume status %v", res.Status)
+		}
+		return nil
+	}()
+	if err != nil {
+		// put traffic back and retry next time
+		for k, v := range mm {
+			u.pt.add(k, v)
+		}
+		return fmt.Errorf("report traffic of %v users error: %w", len(mm), err)
+	}
+	return nil
+}
+
+// request returns a request of the path under Endpoint with the secret.
+func (u *HTTPUpstream) request(ctx context.Context, method, path string, query url.Values, body io.Reader) (*http.Request, error) {
+	ep := *u.endpoint
+	ep.Path = strings.TrimSuffix(ep.Path, "/") + "/" + path
+	ep.RawPath = ""
+	ep.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, ep.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if u.secret != "" {
+		req.Header.Set(HTTPSecretHeader, u.secret)
+	}
+	return req, nil
+}
+
+// do sends the request, and drains and closes the body of the response.
+func (u *HTTPUpstream) do(req *http.Request) (*http.Response, error) {
+	res, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	res.Body.Close()
+	return res, nil
+}
+
+// key returns the hex key of the 56-byte trojan header or its base64.
+func (u *HTTPUpstream) key(k string) string {
+	return header(k)
+}
+
+// Validate asks the service unless the user is cached as valid.
+func (u *HTTPUpstream) Validate(ctx context.Context, k string) (bool, error) {
+	k = u.key(k)
+	if u.cache.get(k) {
+		return true, nil
+	}
+
+	req, err := u.request(ctx, http.MethodGet, "validate", url.Values{"key": {k}}, nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := u.do(req)
+	if err != nil {
+		return false, fmt.Errorf("validate user error: %w", err)
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		u.cache.set(k)
+		return true, nil
+	case http.StatusForbidden, http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("validate user error: status %v", res.Status)
+	}
+}
+
+// Has reports whether the service validates the user, as the service
+// does not tell a disabled user from an unknown one.
+func (u *HTTPUpstream) Has(ctx context.Context, k string) (bool, error) {
+	return u.Validate(ctx, k)
+}
+
+// CacheStats returns the number of hits and misses of the validation cache.
+func (u *HTTPUpstream) CacheStats() (hits, misses uint64) {
+	return u.cache.stats()
+}
+
+// Consume adds the traffic to the next report.
+func (u *HTTPUpstream) Consume(ctx context.Context, k string, proto Protocol, nr, nw int64) error {
+	u.pt.add(u.key(k), consumed(proto, nr, nw))
+	atomic.AddInt64(&u.up, nr)
+	atomic.AddInt64(&u.down, nw)
+	return nil
+}
+
+// TotalTraffic is ...
+// The service has no total, so it is only counted since provisioned.
+func (u *HTTPUpstream) TotalTraffic(ctx context.Context) (int64, int64, error) {
+	return atomic.LoadInt64(&u.up), atomic.LoadInt64(&u.down), nil
+}
+
+// GetTraffic returns the traffic not reported yet.
+func (u *HTTPUpstream) GetTraffic(ctx context.Context, k string) (int64, int64, error) {
+	traffic := u.pt.get(u.key(k))
+	return traffic.Up, traffic.Down, nil
+}
+
+// Range yields no user, as users are kept by the service.
+func (u *HTTPUpstream) Range(ctx context.Context, fn func(k string, traffic Traffic)) error {
+	return nil
+}
+
+// ListKeys returns no key, as Range.
+func (u *HTTPUpstream) ListKeys(ctx context.Context) ([]string, error) {
+	return []string{}, nil
+}
+
+// Count is ...
+func (u *HTTPUpstream) Count(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+// Add is ...
+func (u *HTTPUpstream) Add(ctx context.Context, s string) error {
+	return errHTTPManaged
+}
+
+// AddKey is ...
+func (u *HTTPUpstream) AddKey(ctx context.Context, k string) error {
+	return errHTTPManaged
+}
+
+// Del is ...
+func (u *HTTPUpstream) Del(ctx context.Context, s string) error {
+	return errHTTPManaged
+}
+
+// DelKey is ...
+func (u *HTTPUpstream) DelKey(ctx context.Context, k string) error {
+	return errHTTPManaged
+}
+
+// AddKeys is ...
+func (u *HTTPUpstream) AddKeys(ctx context.Context, keys []string) error {
+	return errHTTPManaged
+}
+
+// DelKeys is ...
+func (u *HTTPUpstream) DelKeys(ctx context.Context, keys []string) error {
+	return errHTTPManaged
+}
+
+// ResetTraffic is ...
+func (u *HTTPUpstream) ResetTraffic(ctx context.Context, k string) error {
+	return errHTTPManaged
+}
+
+// SetQuota is ...
+func (u *HTTPUpstream) SetQuota(ctx context.Context, k string, quota int64) error {
+	return errHTTPManaged
+}
+
+// QuotaExceeded is always false, as the service stops validating a user
+// over its quota.
+func (u *HTTPUpstream) QuotaExceeded(ctx context.Context, k string) bool {
+	return false
+}
+
+// SetEnabled is ...
+func (u *HTTPUpstream) SetEnabled(ctx context.Context, k string, enabled bool) error {
+	return errHTTPManaged
+}
+
+// SetRateLimit is ...
+func (u *HTTPUpstream) SetRateLimit(ctx context.Context, k string, limit int64) error {
+	return errHTTPManaged
+}
+
+// GetRateLimit is ...
+func (u *HTTPUpstream) GetRateLimit(ctx context.Context, k string) (int64, error) {
+	return 0, nil
+}
+
+// GetLastSeen is ...
+func (u *HTTPUpstream) GetLastSeen(ctx context.Context, k string) (time.Time, error) {
+	return u.pt.get(u.key(k)).LastSeen, nil
+}
+
+// SetLabels is ...
+func (u *HTTPUpstream) SetLabels(ctx context.Context, k string, labels map[string]string) error {
+	return errHTTPManaged
+}
+
+// GetLabels is ...
+func (u *HTTPUpstream) GetLabels(ctx context.Context, k string) (map[string]string, error) {
+	return nil, nil
+}
+
+// SetExpiry is ...
+func (u *HTTPUpstream) SetExpiry(ctx context.Context, k string, t time.Time) error {
+	return errHTTPManaged
+}
+
+// SetSourceIP is ...
+func (u *HTTPUpstream) SetSourceIP(ctx context.Context, k string, ip net.IP) error {
+	return errHTTPManaged
+}
+
+// GetSourceIP is ...
+func (u *HTTPUpstream) GetSourceIP(ctx context.Context, k string) (net.IP, error) {
+	return nil, nil
+}
+
+// SetAllowedCIDRs is ...
+func (u *HTTPUpstream) SetAllowedCIDRs(ctx context.Context, k string, cidrs []string) error {
+	return errHTTPManaged
+}
+
+// GetAllowedCIDRs is ...
+func (u *HTTPUpstream) GetAllowedCIDRs(ctx context.Context, k string) ([]string, error) {
+	return nil, nil
+}
+
+// Ping checks the service replies, a status of other than 5xx is reachable.
+func (u *HTTPUpstream) Ping(ctx context.Context) error {
+	req, err := u.request(ctx, http.MethodGet, "validate", nil, nil)
+	if err != nil {
+		return err
+	}
+	res, err := u.do(req)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode/100 == 5 {
+		return fmt.Errorf("http service status %v", res.Status)
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile is ...
+func (u *HTTPUpstream) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.Next() {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		u.Endpoint = d.Val()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	// duration parses the argument of the subdirective
+	duration := func(name string) (caddy.Duration, error) {
+		if !d.NextArg() {
+			return 0, d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return 0, d.Errf("parse %v error: %v", name, err)
+		}
+		return caddy.Duration(dur), nil
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		subdirective := d.Val()
+		switch subdirective {
+		case "endpoint":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.Endpoint = d.Val()
+		case "secret":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.Secret = d.Val()
+		case "timeout":
+			dur, err := duration(subdirective)
+			if err != nil {
+				return err
+			}
+			u.Timeout = dur
+		case "cache_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("parse cache_size error: %v", err)
+			}
+			u.CacheSize = n
+		case "cache_ttl":
+			dur, err := duration(subdirective)
+			if err != nil {
+				return err
+			}
+			u.CacheTTL = dur
+		case "flush_interval":
+			dur, err := duration(subdirective)
+			if err != nil {
+				return err
+			}
+			u.FlushInterval = dur
+		case "key_scheme":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.Scheme = d.Val()
+		default:
+			return d.Errf("unknown http subdirective: %v", subdirective)
+		}
+	}
+	if u.Endpoint == "" {
+		return d.Err("http endpoint is required")
+	}
+	return nil
+}
+
+var (
+	_ Upstream              = (*HTTPUpstream)(nil)
+	_ KeyGenerator          = (*HTTPUpstream)(nil)
+	_ caddy.Provisioner     = (*HTTPUpstream)(nil)
+	_ caddy.CleanerUpper    = (*HTTPUpstream)(nil)
+	_ caddyfile.Unmarshaler = (*HTTPUpstream)(nil)
+)
@@ -0,0 +1,170 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+// authService is a service of HTTPUpstream of one valid user.
+type authService struct {
+	key string
+
+	mu        sync.Mutex
+	validates int
+	fail      bool
+	traffic   []httpTraffic
+}
+
+// ServeHTTP is ...
+func (s *authService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Header.Get(HTTPSecretHeader) != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if s.fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	switch r.URL.Path {
+	case "/trojan/validate":
+		s.validates++
+		if r.URL.Query().Get("key") != s.key {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	case "/trojan/consume":
+		traffic := []httpTraffic{}
+		if err := json.NewDecoder(r.Body).Decode(&traffic); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.traffic = append(s.traffic, traffic...)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestHTTPUpstream(t *testing.T) {
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := utils.ByteSliceToString(key[:])
+
+	s := &authService{key: k}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	u := &HTTPUpstream{Endpoint: srv.URL + "/trojan/", Secret: "secret"}
+	if err := u.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	defer u.Cleanup()
+
+	// base64 keys listed by the admin api are the same user
+	for _, v := range []string{k, base64.StdEncoding.EncodeToString(key[:]), k} {
+		if ok, err := u.Validate(context.Background(), v); !ok || err != nil {
+			t.Errorf("validate user error: %v, %v", ok, err)
+		}
+	}
+	if hits, misses := u.CacheStats(); hits != 2 || misses != 1 || s.validates != 1 {
+		t.Errorf("cache error: %v hits, %v misses, %v validates", hits, misses, s.validates)
+	}
+
+	if err := u.Ping(context.Background()); err != nil {
+		t.Errorf("ping error: %v", err)
+	}
+
+	unknown := [trojan.HeaderLen]byte{}
+	trojan.GenKey("unknown", unknown[:])
+	if ok, err := u.Validate(context.Background(), string(unknown[:])); ok || err != nil {
+		t.Errorf("validate unknown user error: %v, %v", ok, err)
+	}
+	if err := u.Add(context.Background(), "test5678"); err == nil {
+		t.Errorf("add user to http upstream")
+	}
+
+	// traffic failed to report is kept for the next flush
+	u.Consume(context.Background(), k, ProtocolTCP, 1, 2)
+	u.Consume(context.Background(), k, ProtocolUDP, 3, 4)
+	s.mu.Lock()
+	s.fail = true
+	s.mu.Unlock()
+	if err := u.Flush(); err == nil {
+		t.Errorf("flush to failed service without error")
+	}
+	if ok, err := u.Validate(context.Background(), string(unknown[:])); ok || err == nil {
+		t.Errorf("validate by failed service error: %v, %v", ok, err)
+	}
+	s.mu.Lock()
+	s.fail = false
+	s.mu.Unlock()
+	if err := u.Flush(); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+	want := httpTraffic{Key: k, Up: 4, Down: 6, UpUDP: 3, DownUDP: 4}
+	if len(s.traffic) != 1 || s.traffic[0] != want {
+		t.Errorf("report traffic error: %+v", s.traffic)
+	}
+	if up, down, err := u.TotalTraffic(context.Background()); up != 4 || down != 6 || err != nil {
+		t.Errorf("total traffic error: %v, %v, %v", up, down, err)
+	}
+
+	// nothing is reported without traffic
+	if err := u.Flush(); err != nil || len(s.traffic) != 1 {
+		t.Errorf("flush without traffic error: %v, %+v", err, s.traffic)
+	}
+}
+
+func TestHTTPUpstreamPingWrongSecret(t *testing.T) {
+	srv := httptest.NewServer(&authService{})
+	defer srv.Close()
+
+	// 401 is a reply of a reachable service, but validation fails
+	u := &HTTPUpstream{Endpoint: srv.URL + "/trojan", Secret: "wrong"}
+	if err := u.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	defer u.Cleanup()
+	if err := u.Ping(context.Background()); err != nil {
+		t.Errorf("ping error: %v", err)
+	}
+	if _, err := u.Validate(context.Background(), "key"); err == nil {
+		t.Errorf("validate with wrong secret without error")
+	}
+}
+
+func TestUnmarshalCaddyfileHTTPUpstream(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`http https://auth.example.com/trojan {
+		secret {env.TROJAN_SECRET}
+		timeout 3s
+		cache_size 16
+		cache_ttl 1m
+		flush_interval 5s
+	}`)
+	u := &HTTPUpstream{}
+	if err := u.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal caddyfile error: %v", err)
+	}
+	if u.Endpoint != "https://auth.example.com/trojan" || u.Secret != "{env.TROJAN_SECRET}" || u.CacheSize != 16 {
+		t.Errorf("unmarshal caddyfile error: %+v", u)
+	}
+	if u.Timeout != caddy.Duration(3*time.Second) || u.CacheTTL != caddy.Duration(time.Minute) || u.FlushInterval != caddy.Duration(5*time.Second) {
+		t.Errorf("unmarshal durations error: %+v", u)
+	}
+
+	if err := (&HTTPUpstream{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser(`http`)); err == nil {
+		t.Errorf("unmarshal http upstream without endpoint")
+	}
+}
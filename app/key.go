@@ -0,0 +1,62 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+// authLen is the length of the base64 of a 56-byte trojan header, which is
+// the key of users in upstreams.
+// base64.StdEncoding.EncodeToString(hex.Encode(sha256.Sum224([]byte("Test1234"))))
+const authLen = 76
+
+// isBase64Key reports whether k is the base64 of a 56-byte trojan header.
+func isBase64Key(k string) bool {
+	if len(k) != authLen {
+		return false
+	}
+	b := [authLen]byte{}
+	n, err := base64.StdEncoding.Decode(b[:], utils.StringToByteSlice(k))
+	return err == nil && n == trojan.HeaderLen
+}
+
+// normalizeKey returns the base64 key of a 56-byte trojan header or of a
+// base64 key. A key of 76 bytes is kept only if it is the base64 of a
+// header, any other key is encoded as it is.
+func normalizeKey(k string) string {
+	if isBase64Key(k) {
+		return k
+	}
+	return base64.StdEncoding.EncodeToString(utils.StringToByteSlice(k))
+}
+
+// header returns the 56-byte trojan header of a 56-byte header or a base64
+// key, any other key is returned as it is.
+func header(k string) string {
+	if !isBase64Key(k) {
+		return k
+	}
+	b, _ := base64.StdEncoding.DecodeString(k)
+	return utils.ByteSliceToString(b)
+}
+
+// CanonicalKey returns the key a user of k is stored by in upstreams, which
+// is the base64 of the 56-byte trojan header, for a header or a base64 key.
+func CanonicalKey(k string) string {
+	return normalizeKey(k)
+}
+
+// Lookup validates the user of k, a 56-byte trojan header or a base64 key,
+// and returns the canonical key of the valid user, so one identifier of the
+// user is used for Consume, logs, rate limits and connection counting,
+// whichever form k is of. The error is only of the upstream.
+func Lookup(ctx context.Context, up Upstream, k string) (string, bool, error) {
+	ok, err := up.Validate(ctx, k)
+	if err != nil || !ok {
+		return "", false, err
+	}
+	return CanonicalKey(k), true, nil
+}
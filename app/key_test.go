@@ -0,0 +1,88 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+func TestNormalizeKey(t *testing.T) {
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	b64 := base64.StdEncoding.EncodeToString(key[:])
+
+	for _, v := range []struct {
+		Name   string
+		Key    string
+		Base64 bool
+	}{
+		{Name: "header", Key: string(key[:])},
+		{Name: "base64 key", Key: b64, Base64: true},
+		// 76 bytes, but not base64
+		{Name: "76 bytes of other characters", Key: strings.Repeat("!", authLen)},
+		// 76 bytes of base64, but of 57 bytes
+		{Name: "base64 of 57 bytes", Key: strings.Repeat("A", authLen)},
+		{Name: "base64 with bad padding", Key: b64[:authLen-2] + "=A"},
+		{Name: "short key", Key: "abc"},
+	} {
+		if ok := isBase64Key(v.Key); ok != v.Base64 {
+			t.Errorf("%v is base64 key: %v, want %v", v.Name, ok, v.Base64)
+		}
+		want := base64.StdEncoding.EncodeToString([]byte(v.Key))
+		if v.Base64 {
+			want = v.Key
+		}
+		if k := normalizeKey(v.Key); k != want {
+			t.Errorf("normalize %v error: %v, want %v", v.Name, k, want)
+		}
+		want = v.Key
+		if v.Base64 {
+			want = string(key[:])
+		}
+		if k := header(v.Key); k != want {
+			t.Errorf("header of %v error: %v, want %v", v.Name, k, want)
+		}
+	}
+}
+
+func TestMemoryUpstreamAmbiguousKey(t *testing.T) {
+	u := &MemoryUpstream{}
+	// a key of 76 bytes which is not base64 is a user as it is
+	for _, k := range []string{strings.Repeat("!", authLen), strings.Repeat("A", authLen)} {
+		if err := u.AddKey(context.Background(), k); err != nil {
+			t.Fatalf("add key error: %v", err)
+		}
+		if ok, err := u.Validate(context.Background(), k); !ok || err != nil {
+			t.Errorf("validate key %v error: %v, %v", k, ok, err)
+		}
+		u.Consume(context.Background(), k, ProtocolTCP, 1, 2)
+		if up, down, err := u.GetTraffic(context.Background(), k); up != 1 || down != 2 || err != nil {
+			t.Errorf("traffic of key %v error: %v, %v, %v", k, up, down, err)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	u := &MemoryUpstream{}
+	if err := u.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	b64 := base64.StdEncoding.EncodeToString(key[:])
+
+	// a header and a base64 key are of the same canonical key
+	for _, k := range []string{string(key[:]), b64} {
+		canonical, ok, err := Lookup(context.Background(), u, k)
+		if !ok || err != nil || canonical != b64 || CanonicalKey(k) != b64 {
+			t.Errorf("lookup %q error: %v, %v, %v", k, canonical, ok, err)
+		}
+	}
+	trojan.GenKey("test5678", key[:])
+	if k, ok, err := Lookup(context.Background(), u, string(key[:])); k != "" || ok || err != nil {
+		t.Errorf("lookup unknown user error: %v, %v, %v", k, ok, err)
+	}
+}
@@ -0,0 +1,280 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+// Metrics is the prometheus metrics of trojan app.
+type Metrics struct {
+	// KeyLabel is how a user key is shown in the key label,
+	// raw | hash | truncate | none, default is raw.
+	KeyLabel string `json:"key_label,omitempty"`
+
+	registry    *prometheus.Registry
+	bytes       *prometheus.CounterVec
+	active      prometheus.Gauge
+	authFailure prometheus.Counter
+	connections *prometheus.CounterVec
+}
+
+// Result of a trojan connection
+const (
+	ResultAccepted           = "accepted"
+	ResultAuthFailed         = "auth_failed"
+	ResultQuotaExceeded      = "quota_exceeded"
+	ResultTooManyConnections = "too_many_connections"
+	ResultUpstreamError      = "upstream_error"
+	ResultReplay             = "replay"
+	ResultBanned             = "banned"
+	ResultSourceNotAllowed   = "source_not_allowed"
+	ResultBadCommand         = "bad_command"
+)
+
+// GlobalMetrics is the process-global counters of trojan connections,
+// which are kept whether or not metrics of trojan app is enabled, and are
+// served with the metrics of caddy at /metrics.
+var GlobalMetrics = &globalMetrics{}
+
+// globalMetrics is ...
+type globalMetrics struct {
+	active      int64
+	up          int64
+	down        int64
+	authFailure int64
+}
+
+// Active returns the number of active trojan connections.
+func (g *globalMetrics) Active() int64 {
+	return atomic.LoadInt64(&g.active)
+}
+
+// Bytes returns bytes relayed since start.
+func (g *globalMetrics) Bytes() (up, down int64) {
+	return atomic.LoadInt64(&g.up), atomic.LoadInt64(&g.down)
+}
+
+// AuthFailures returns the number of trojan headers with an invalid key since start.
+func (g *globalMetrics) AuthFailures() int64 {
+	return atomic.LoadInt64(&g.authFailure)
+}
+
+func init() {
+	// caddy serves the default registry at /metrics
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "caddy",
+			Subsystem: "trojan",
+			Name:      "active_connections",
+			Help:      "Number of active trojan connections.",
+		}, func() float64 {
+			return float64(GlobalMetrics.Active())
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "caddy",
+			Subsystem:   "trojan",
+			Name:        "bytes_total",
+			Help:        "Bytes relayed by trojan connections.",
+			ConstLabels: prometheus.Labels{"direction": "up"},
+		}, func() float64 {
+			n, _ := GlobalMetrics.Bytes()
+			return float64(n)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "caddy",
+			Subsystem:   "trojan",
+			Name:        "bytes_total",
+			Help:        "Bytes relayed by trojan connections.",
+			ConstLabels: prometheus.Labels{"direction": "down"},
+		}, func() float64 {
+			_, n := GlobalMetrics.Bytes()
+			return float64(n)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "caddy",
+			Subsystem: "trojan",
+			Name:      "auth_failures_total",
+			Help:      "Number of trojan headers with an invalid key.",
+		}, func() float64 {
+			return float64(GlobalMetrics.AuthFailures())
+		}),
+	)
+}
+
+// Provision is ...
+func (m *Metrics) Provision() error {
+	switch m.KeyLabel {
+	case "", "raw", "hash", "truncate", "none":
+	default:
+		return fmt.Errorf("unknown key_label: %v", m.KeyLabel)
+	}
+
+	m.bytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "trojan",
+		Subsystem: "upstream",
+		Name:      "bytes_total",
+		Help:      "Bytes relayed for each user.",
+	}, []string{"key", "direction"})
+	m.active = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "trojan",
+		Name:      "active_connections",
+		Help:      "Number of active trojan connections.",
+	})
+	m.authFailure = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "trojan",
+		Name:      "auth_failures_total",
+		Help:      "Number of trojan headers with an invalid key.",
+	})
+	m.connections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "trojan",
+		Name:      "connections_total",
+		Help:      "Number of trojan connections by result.",
+	}, []string{"result"})
+
+	// use an own registry, so reloading config does not register metrics twice
+	m.registry = prometheus.NewRegistry()
+	for _, c := range []prometheus.Collector{m.bytes, m.active, m.authFailure, m.connections} {
+		if err := m.registry.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cacheStater is an Upstream with a validation cache.
+type cacheStater interface {
+	CacheStats() (hits, misses uint64)
+}
+
+// registerUpstream exports the latency of operations of the upstream if it
+// is an ObservableUpstream, and the stats of validation cache of the
+// upstream it wraps, if any.
+func (m *Metrics) registerUpstream(up Upstream) error {
+	if ou, ok := up.(*ObservableUpstream); ok {
+		if err := m.registry.Register(ou.Collector()); err != nil {
+			return err
+		}
+		up = ou.Upstream()
+	}
+	return m.registerCache(up)
+}
+
+// registerCache exports the stats of validation cache of the upstream, if any.
+func (m *Metrics) registerCache(up Upstream) error {
+	cs, ok := up.(cacheStater)
+	if !ok {
+		return nil
+	}
+	hits := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: "trojan",
+		Subsystem: "upstream",
+		Name:      "cache_hits_total",
+		Help:      "Number of users validated by the cache of upstream.",
+	}, func() float64 {
+		n, _ := cs.CacheStats()
+		return float64(n)
+	})
+	misses := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: "trojan",
+		Subsystem: "upstream",
+		Name:      "cache_misses_total",
+		Help:      "Number of users not found in the cache of upstream.",
+	}, func() float64 {
+		_, n := cs.CacheStats()
+		return float64(n)
+	})
+	for _, c := range []prometheus.Collector{hits, misses} {
+		if err := m.registry.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// label returns the key label of a user key.
+func (m *Metrics) label(k string) string {
+	return keyLabel(m.KeyLabel, k)
+}
+
+// keyLabel shows a user key as raw | hash | truncate | none, default is raw.
+func keyLabel(mode, k string) string {
+	k = normalizeKey(k)
+
+	switch mode {
+	case "hash":
+		sum := sha256.Sum256(utils.StringToByteSlice(k))
+		return hex.EncodeToString(sum[:8])
+	case "truncate":
+		return string(utils.StringToByteSlice(k[:8]))
+	case "none":
+		return ""
+	default:
+		return k
+	}
+}
+
+// Consume is ...
+// Metrics is nil if not enabled, and GlobalMetrics is always updated.
+func (m *Metrics) Consume(k string, nr, nw int64) {
+	atomic.AddInt64(&GlobalMetrics.up, nr)
+	atomic.AddInt64(&GlobalMetrics.down, nw)
+	if m == nil {
+		return
+	}
+	k = m.label(k)
+	m.bytes.WithLabelValues(k, "up").Add(float64(nr))
+	m.bytes.WithLabelValues(k, "down").Add(float64(nw))
+}
+
+// ConsumeTotal records traffic of no user, which is counted in the total
+// of all users only.
+func (m *Metrics) ConsumeTotal(nr, nw int64) {
+	atomic.AddInt64(&GlobalMetrics.up, nr)
+	atomic.AddInt64(&GlobalMetrics.down, nw)
+}
+
+// Open records an accepted connection, and must be paired with a Close.
+func (m *Metrics) Open() {
+	atomic.AddInt64(&GlobalMetrics.active, 1)
+	if m == nil {
+		return
+	}
+	m.connections.WithLabelValues(ResultAccepted).Inc()
+	m.active.Inc()
+}
+
+// Close is ...
+func (m *Metrics) Close() {
+	atomic.AddInt64(&GlobalMetrics.active, -1)
+	if m == nil {
+		return
+	}
+	m.active.Dec()
+}
+
+// Reject records a rejected connection.
+func (m *Metrics) Reject(result string) {
+	if result == ResultAuthFailed {
+		atomic.AddInt64(&GlobalMetrics.authFailure, 1)
+	}
+	if m == nil {
+		return
+	}
+	if result == ResultAuthFailed {
+		m.authFailure.Inc()
+	}
+	m.connections.WithLabelValues(result).Inc()
+}
+
+// ServeHTTP is ...
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
@@ -0,0 +1,54 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestGlobalMetrics(t *testing.T) {
+	active := GlobalMetrics.Active()
+	up, down := GlobalMetrics.Bytes()
+	failures := GlobalMetrics.AuthFailures()
+
+	// global metrics are updated whether or not metrics is enabled
+	for _, m := range []*Metrics{nil, {}} {
+		if m != nil {
+			if err := m.Provision(); err != nil {
+				t.Fatalf("provision metrics error: %v", err)
+			}
+		}
+		m.Open()
+		if n := GlobalMetrics.Active(); n != active+1 {
+			t.Errorf("active connections error: got %v, want %v", n, active+1)
+		}
+		m.Consume("test1234", 1, 2)
+		m.Close()
+		m.Reject(ResultAuthFailed)
+		m.Reject(ResultQuotaExceeded)
+	}
+
+	if n := GlobalMetrics.Active(); n != active {
+		t.Errorf("active connections error: got %v, want %v", n, active)
+	}
+	if nr, nw := GlobalMetrics.Bytes(); nr != up+2 || nw != down+4 {
+		t.Errorf("bytes error: got %v, %v, want %v, %v", nr, nw, up+2, down+4)
+	}
+	if n := GlobalMetrics.AuthFailures(); n != failures+2 {
+		t.Errorf("auth failures error: got %v, want %v", n, failures+2)
+	}
+
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("gather metrics error: %v", err)
+	}
+	names := map[string]bool{}
+	for _, mf := range mfs {
+		names[mf.GetName()] = true
+	}
+	for _, name := range []string{"caddy_trojan_active_connections", "caddy_trojan_bytes_total", "caddy_trojan_auth_failures_total"} {
+		if !names[name] {
+			t.Errorf("metric %v is not registered", name)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"go.uber.org/zap"
+)
+
+// migrateLogInterval is the number of users between logs of the progress of Migrate.
+const migrateLogInterval = 1000
+
+// MigrateResult is ...
+type MigrateResult struct {
+	// Users is the number of users of the source.
+	Users int `json:"users"`
+	// Migrated is the number of users added to the destination, or of
+	// which traffic is restored.
+	Migrated int `json:"migrated"`
+	// Skipped is the number of users of the destination with equal or
+	// greater traffic, which are migrated before.
+	Skipped int `json:"skipped"`
+}
+
+// Migrate copies users of src to dst, with their traffic, quota, rate
+// limit, expiry, labels, source ip and allowed networks, and disabled
+// users are disabled.
+// A user already in dst with equal or greater traffic in both directions
+// is skipped, and traffic of other users is restored by consuming the
+// missing part, so Migrate is safe to run again after a failure. The
+// consumed traffic is counted in TotalTraffic of dst.
+func Migrate(ctx context.Context, dst, src Upstream, lg *zap.Logger) (MigrateResult, error) {
+	existing := map[string]Traffic{}
+	if err := dst.Range(ctx, func(k string, traffic Traffic) {
+		existing[normalizeKey(k)] = traffic
+	}); err != nil {
+		return MigrateResult{}, fmt.Errorf("range destination error: %w", err)
+	}
+
+	type User struct {
+		Key     string
+		Traffic Traffic
+	}
+
+	// do not call dst in src.Range, which may hold locks of src
+	users := []User{}
+	if err := src.Range(ctx, func(k string, traffic Traffic) {
+		users = append(users, User{Key: k, Traffic: traffic})
+	}); err != nil {
+		return MigrateResult{}, fmt.Errorf("range source error: %w", err)
+	}
+
+	res := MigrateResult{Users: len(users)}
+	for i, user := range users {
+		if i > 0 && i%migrateLogInterval == 0 {
+			lg.Info(fmt.Sprintf("migrate users: %v of %v, %v migrated, %v skipped", i, res.Users, res.Migrated, res.Skipped))
+		}
+		old, ok := existing[normalizeKey(user.Key)]
+		if ok && old.Up >= user.Traffic.Up && old.Down >= user.Traffic.Down {
+			res.Skipped++
+			continue
+		}
+		// keys of Range are base64, and AddKey takes the trojan header
+		if err := migrateUser(ctx, dst, header(user.Key), old, user.Traffic, !ok); err != nil {
+			return res, fmt.Errorf("migrate user %v error: %w", normalizeKey(user.Key), err)
+		}
+		res.Migrated++
+	}
+	lg.Info(fmt.Sprintf("migrate users: %v users, %v migrated, %v skipped", res.Users, res.Migrated, res.Skipped))
+	return res, nil
+}
+
+// migrateUser adds the user k of traffic to dst if add is set, and consumes
+// the traffic which old of dst does not have.
+func migrateUser(ctx context.Context, dst Upstream, k string, old, traffic Traffic, add bool) error {
+	if add {
+		if err := dst.AddKey(ctx, k); err != nil {
+			return err
+		}
+	}
+
+	missing := func(n, m int64) int64 {
+		if n > m {
+			return n - m
+		}
+		return 0
+	}
+	upTCP := missing(traffic.Up-traffic.UpUDP, old.Up-old.UpUDP)
+	downTCP := missing(traffic.Down-traffic.DownUDP, old.Down-old.DownUDP)
+	if upTCP > 0 || downTCP > 0 {
+		if err := dst.Consume(ctx, k, ProtocolTCP, upTCP, downTCP); err != nil {
+			return err
+		}
+	}
+	upUDP, downUDP := missing(traffic.UpUDP, old.UpUDP), missing(traffic.DownUDP, old.DownUDP)
+	if upUDP > 0 || downUDP > 0 {
+		if err := dst.Consume(ctx, k, ProtocolUDP, upUDP, downUDP); err != nil {
+			return err
+		}
+	}
+
+	if traffic.Quota > 0 {
+		if err := dst.SetQuota(ctx, k, traffic.Quota); err != nil {
+			return err
+		}
+	}
+	if traffic.RateLimit > 0 {
+		if err := dst.SetRateLimit(ctx, k, traffic.RateLimit); err != nil {
+			return err
+		}
+	}
+	if !traffic.ExpiresAt.IsZero() {
+		if err := dst.SetExpiry(ctx, k, traffic.ExpiresAt); err != nil {
+			return err
+		}
+	}
+	if len(traffic.Labels) > 0 {
+		if err := dst.SetLabels(ctx, k, traffic.Labels); err != nil {
+			return err
+		}
+	}
+	if ip := net.ParseIP(traffic.SourceIP); ip != nil {
+		if err := dst.SetSourceIP(ctx, k, ip); err != nil {
+			return err
+		}
+	}
+	if len(traffic.AllowedCIDRs) > 0 {
+		if err := dst.SetAllowedCIDRs(ctx, k, traffic.AllowedCIDRs); err != nil {
+			return err
+		}
+	}
+	if !traffic.Enabled {
+		if err := dst.SetEnabled(ctx, k, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
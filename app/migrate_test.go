@@ -0,0 +1,67 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+func TestMigrate(t *testing.T) {
+	keys := [3][trojan.HeaderLen]byte{}
+	for i, v := range []string{"test1234", "test5678", "test9012"} {
+		trojan.GenKey(v, keys[i][:])
+	}
+	k1, k2, k3 := string(keys[0][:]), string(keys[1][:]), string(keys[2][:])
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	src := &MemoryUpstream{}
+	src.AddKeys(context.Background(), []string{k1, k2, k3})
+	src.Consume(context.Background(), k1, ProtocolTCP, 1, 2)
+	src.Consume(context.Background(), k1, ProtocolUDP, 3, 4)
+	src.SetQuota(context.Background(), k1, 100)
+	src.SetLabels(context.Background(), k1, map[string]string{"name": "test"})
+	src.SetExpiry(context.Background(), k1, expiry)
+	src.SetEnabled(context.Background(), k2, false)
+	src.Consume(context.Background(), k3, ProtocolTCP, 5, 5)
+
+	// k3 is migrated before, and has more traffic in the destination
+	dst := &MemoryUpstream{}
+	dst.AddKey(context.Background(), k3)
+	dst.Consume(context.Background(), k3, ProtocolTCP, 6, 6)
+
+	res, err := Migrate(context.Background(), dst, src, zap.NewNop())
+	if err != nil {
+		t.Fatalf("migrate error: %v", err)
+	}
+	if res != (MigrateResult{Users: 3, Migrated: 2, Skipped: 1}) {
+		t.Errorf("migrate result error: %+v", res)
+	}
+
+	users := map[string]Traffic{}
+	dst.Range(context.Background(), func(k string, traffic Traffic) {
+		users[header(k)] = traffic
+	})
+	if v := users[k1]; v.Up != 4 || v.Down != 6 || v.UpUDP != 3 || v.DownUDP != 4 || v.Quota != 100 ||
+		v.Labels["name"] != "test" || !v.ExpiresAt.Equal(expiry) || !v.Enabled {
+		t.Errorf("migrate user error: %+v", v)
+	}
+	if v := users[k2]; v.Enabled {
+		t.Errorf("disabled user is enabled: %+v", v)
+	}
+	if v := users[k3]; v.Up != 6 || v.Down != 6 {
+		t.Errorf("migrated user is changed: %+v", v)
+	}
+
+	// migrating again changes nothing
+	res, err = Migrate(context.Background(), dst, src, zap.NewNop())
+	if err != nil || res != (MigrateResult{Users: 3, Skipped: 3}) {
+		t.Errorf("migrate again error: %+v, %v", res, err)
+	}
+	if up, down, _ := dst.GetTraffic(context.Background(), k1); up != 4 || down != 6 {
+		t.Errorf("traffic of migrated user error: %v, %v", up, down)
+	}
+}
@@ -0,0 +1,370 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(MultiUpstream{})
+}
+
+// MultiUpstream is a composite of upstreams, which separates the authority
+// of users from the store of traffic. For an edge node, users are validated
+// by a read-only replica of the central database, and traffic is accounted
+// by a local upstream.
+type MultiUpstream struct {
+	// UpstreamsRaw is the list of member upstreams.
+	UpstreamsRaw []json.RawMessage `json:"upstreams,omitempty" caddy:"namespace=trojan.upstreams inline_key=upstream"`
+	// Validators is the list of indexes of members which Validate tries in
+	// order, a user is valid if any of them validates it. Default is all members.
+	Validators []int `json:"validators,omitempty"`
+	// Primary is the index of the member which is the authority of users,
+	// Add, Del, SetEnabled, SetExpiry and labels go to it. Default is 0.
+	Primary int `json:"primary,omitempty"`
+	// Accounting is the index of the member which accounts traffic, Consume,
+	// Range, Count, traffic, quota, rate limit and last seen go to it.
+	// A user validated by another member is added to it, so its traffic is
+	// kept. Default is 0.
+	Accounting int `json:"accounting,omitempty"`
+
+	members    []Upstream
+	validators []Upstream
+	primary    Upstream
+	accounting Upstream
+}
+
+// CaddyModule is ...
+func (MultiUpstream) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "trojan.upstreams.multi",
+		New: func() caddy.Module { return new(MultiUpstream) },
+	}
+}
+
+// Provision is ...
+func (u *MultiUpstream) Provision(ctx caddy.Context) error {
+	if len(u.UpstreamsRaw) == 0 {
+		return errors.New("multi upstream has no member")
+	}
+	mods, err := ctx.LoadModule(u, "UpstreamsRaw")
+	if err != nil {
+		return fmt.Errorf("load member upstreams error: %w", err)
+	}
+	for _, v := range mods.([]interface{}) {
+		u.members = append(u.members, v.(Upstream))
+	}
+
+	return u.resolve()
+}
+
+// resolve resolves the indexes of primary, accounting and validators.
+func (u *MultiUpstream) resolve() (err error) {
+	member := func(name string, i int) (Upstream, error) {
+		if i < 0 || i >= len(u.members) {
+			return nil, fmt.Errorf("%v %v is not a member, there are %v members", name, i, len(u.members))
+		}
+		return u.members[i], nil
+	}
+	if u.primary, err = member("primary", u.Primary); err != nil {
+		return err
+	}
+	if u.accounting, err = member("accounting", u.Accounting); err != nil {
+		return err
+	}
+	if len(u.Validators) == 0 {
+		u.validators = u.members
+		return nil
+	}
+	for _, v := range u.Validators {
+		up, err := member("validator", v)
+		if err != nil {
+			return err
+		}
+		u.validators = append(u.validators, up)
+	}
+	return nil
+}
+
+// Add is ...
+func (u *MultiUpstream) Add(ctx context.Context, s string) error {
+	return u.primary.Add(ctx, s)
+}
+
+// AddKey is ...
+func (u *MultiUpstream) AddKey(ctx context.Context, k string) error {
+	return u.primary.AddKey(ctx, k)
+}
+
+// Del deletes the user from the primary and the accounting member.
+func (u *MultiUpstream) Del(ctx context.Context, s string) error {
+	if err := u.primary.Del(ctx, s); err != nil {
+		return err
+	}
+	if u.accounting == u.primary {
+		return nil
+	}
+	return u.accounting.Del(ctx, s)
+}
+
+// DelKey deletes the user from the primary and the accounting member.
+func (u *MultiUpstream) DelKey(ctx context.Context, k string) error {
+	if err := u.primary.DelKey(ctx, k); err != nil {
+		return err
+	}
+	if u.accounting == u.primary {
+		return nil
+	}
+	return u.accounting.DelKey(ctx, k)
+}
+
+// AddKeys is ...
+func (u *MultiUpstream) AddKeys(ctx context.Context, keys []string) error {
+	return u.primary.AddKeys(ctx, keys)
+}
+
+// DelKeys deletes the users from the primary and the accounting member.
+func (u *MultiUpstream) DelKeys(ctx context.Context, keys []string) error {
+	if err := u.primary.DelKeys(ctx, keys); err != nil {
+		return err
+	}
+	if u.accounting == u.primary {
+		return nil
+	}
+	return u.accounting.DelKeys(ctx, keys)
+}
+
+// Range is ...
+func (u *MultiUpstream) Range(ctx context.Context, fn func(k string, traffic Traffic)) error {
+	return u.accounting.Range(ctx, fn)
+}
+
+// ListKeys is ...
+func (u *MultiUpstream) ListKeys(ctx context.Context) ([]string, error) {
+	return u.accounting.ListKeys(ctx)
+}
+
+// Validate tries validators in order, and returns the error of a validator
+// only if no validator validates the user.
+func (u *MultiUpstream) Validate(ctx context.Context, k string) (bool, error) {
+	var err error
+	for _, v := range u.validators {
+		ok, er := v.Validate(ctx, k)
+		if er != nil {
+			err = er
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if v != u.accounting {
+			// AddKey keeps an existing user
+			if er := u.accounting.AddKey(ctx, header(k)); er != nil {
+				return false, fmt.Errorf("add user to accounting upstream error: %w", er)
+			}
+		}
+		return true, nil
+	}
+	return false, err
+}
+
+// Has tries validators in order like Validate, without adding the user to
+// the accounting upstream.
+func (u *MultiUpstream) Has(ctx context.Context, k string) (bool, error) {
+	var err error
+	for _, v := range u.validators {
+		ok, er := v.Has(ctx, k)
+		if er != nil {
+			err = er
+			continue
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, err
+}
+
+// Consume is ...
+func (u *MultiUpstream) Consume(ctx context.Context, k string, proto Protocol, nr, nw int64) error {
+	return u.accounting.Consume(ctx, k, proto, nr, nw)
+}
+
+// GetTraffic is ...
+func (u *MultiUpstream) GetTraffic(ctx context.Context, k string) (int64, int64, error) {
+	return u.accounting.GetTraffic(ctx, k)
+}
+
+// TotalTraffic is ...
+func (u *MultiUpstream) TotalTraffic(ctx context.Context) (int64, int64, error) {
+	return u.accounting.TotalTraffic(ctx)
+}
+
+// ResetTraffic is ...
+func (u *MultiUpstream) ResetTraffic(ctx context.Context, k string) error {
+	return u.accounting.ResetTraffic(ctx, k)
+}
+
+// SetQuota is ...
+func (u *MultiUpstream) SetQuota(ctx context.Context, k string, quota int64) error {
+	return u.accounting.SetQuota(ctx, k, quota)
+}
+
+// QuotaExceeded is ...
+func (u *MultiUpstream) QuotaExceeded(ctx context.Context, k string) bool {
+	return u.accounting.QuotaExceeded(ctx, k)
+}
+
+// SetEnabled is ...
+func (u *MultiUpstream) SetEnabled(ctx context.Context, k string, enabled bool) error {
+	return u.primary.SetEnabled(ctx, k, enabled)
+}
+
+// Count is ...
+func (u *MultiUpstream) Count(ctx context.Context) (int, error) {
+	return u.accounting.Count(ctx)
+}
+
+// SetRateLimit is ...
+func (u *MultiUpstream) SetRateLimit(ctx context.Context, k string, limit int64) error {
+	return u.accounting.SetRateLimit(ctx, k, limit)
+}
+
+// GetRateLimit is ...
+func (u *MultiUpstream) GetRateLimit(ctx context.Context, k string) (int64, error) {
+	return u.accounting.GetRateLimit(ctx, k)
+}
+
+// GetLastSeen is ...
+func (u *MultiUpstream) GetLastSeen(ctx context.Context, k string) (time.Time, error) {
+	return u.accounting.GetLastSeen(ctx, k)
+}
+
+// SetLabels is ...
+func (u *MultiUpstream) SetLabels(ctx context.Context, k string, labels map[string]string) error {
+	return u.primary.SetLabels(ctx, k, labels)
+}
+
+// GetLabels is ...
+func (u *MultiUpstream) GetLabels(ctx context.Context, k string) (map[string]string, error) {
+	return u.primary.GetLabels(ctx, k)
+}
+
+// SetExpiry is ...
+func (u *MultiUpstream) SetExpiry(ctx context.Context, k string, t time.Time) error {
+	return u.primary.SetExpiry(ctx, k, t)
+}
+
+// SetSourceIP sets the source ip in the accounting upstream, which is of
+// this host, like the rate limit.
+func (u *MultiUpstream) SetSourceIP(ctx context.Context, k string, ip net.IP) error {
+	return u.accounting.SetSourceIP(ctx, k, ip)
+}
+
+// GetSourceIP is ...
+func (u *MultiUpstream) GetSourceIP(ctx context.Context, k string) (net.IP, error) {
+	return u.accounting.GetSourceIP(ctx, k)
+}
+
+// SetAllowedCIDRs sets the allowed networks in the accounting upstream,
+// as the source ip.
+func (u *MultiUpstream) SetAllowedCIDRs(ctx context.Context, k string, cidrs []string) error {
+	return u.accounting.SetAllowedCIDRs(ctx, k, cidrs)
+}
+
+// GetAllowedCIDRs is ...
+func (u *MultiUpstream) GetAllowedCIDRs(ctx context.Context, k string) ([]string, error) {
+	return u.accounting.GetAllowedCIDRs(ctx, k)
+}
+
+// GenKey derives trojan headers by the scheme of the primary, which adds
+// and deletes users.
+func (u *MultiUpstream) GenKey(s string, key []byte) {
+	GenKey(u.primary, s, key)
+}
+
+// Ping checks every member.
+func (u *MultiUpstream) Ping(ctx context.Context) error {
+	for i, v := range u.members {
+		if err := v.Ping(ctx); err != nil {
+			return fmt.Errorf("ping member %v error: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile is ...
+func (u *MultiUpstream) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.Next() {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	index := func(name string) (int, error) {
+		if !d.NextArg() {
+			return 0, d.ArgErr()
+		}
+		n, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return 0, d.Errf("parse %v error: %v", name, err)
+		}
+		return n, nil
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		subdirective := d.Val()
+		switch subdirective {
+		case "upstream":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			raw, err := parseUpstream(d)
+			if err != nil {
+				return err
+			}
+			u.UpstreamsRaw = append(u.UpstreamsRaw, raw)
+		case "validators":
+			args := d.RemainingArgs()
+			if len(args) < 1 {
+				return d.ArgErr()
+			}
+			for _, v := range args {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return d.Errf("parse validators error: %v", err)
+				}
+				u.Validators = append(u.Validators, n)
+			}
+		case "primary":
+			n, err := index(subdirective)
+			if err != nil {
+				return err
+			}
+			u.Primary = n
+		case "accounting":
+			n, err := index(subdirective)
+			if err != nil {
+				return err
+			}
+			u.Accounting = n
+		default:
+			return d.Errf("unknown multi subdirective: %v", subdirective)
+		}
+	}
+	return nil
+}
+
+var (
+	_ Upstream              = (*MultiUpstream)(nil)
+	_ KeyGenerator          = (*MultiUpstream)(nil)
+	_ caddy.Provisioner     = (*MultiUpstream)(nil)
+	_ caddyfile.Unmarshaler = (*MultiUpstream)(nil)
+)
@@ -0,0 +1,140 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+// newMultiUpstream returns a MultiUpstream of n memory members.
+func newMultiUpstream(t *testing.T, n int, config string) *MultiUpstream {
+	t.Helper()
+
+	u := &MultiUpstream{}
+	if err := json.Unmarshal([]byte(config), u); err != nil {
+		t.Fatalf("unmarshal config error: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		u.members = append(u.members, &MemoryUpstream{})
+	}
+	if err := u.resolve(); err != nil {
+		t.Fatalf("resolve error: %v", err)
+	}
+	return u
+}
+
+func TestMultiUpstream(t *testing.T) {
+	// the replica of the central database, and the local upstream of traffic
+	u := newMultiUpstream(t, 2, `{"validators":[0],"accounting":1}`)
+	replica, local := u.members[0], u.members[1]
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := utils.ByteSliceToString(key[:])
+
+	if err := u.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	if _, _, err := local.GetTraffic(context.Background(), k); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("user is added to accounting upstream: %v", err)
+	}
+
+	// a user validated by the replica is accounted locally
+	if ok, err := u.Validate(context.Background(), k); err != nil || !ok {
+		t.Fatalf("validate user error: %v, %v", ok, err)
+	}
+	if err := u.Consume(context.Background(), k, ProtocolTCP, 1, 2); err != nil {
+		t.Fatalf("consume error: %v", err)
+	}
+	if up, down, err := local.GetTraffic(context.Background(), k); err != nil || up != 1 || down != 2 {
+		t.Errorf("local traffic error: %v, %v, %v", up, down, err)
+	}
+	if up, down, err := replica.GetTraffic(context.Background(), k); err != nil || up != 0 || down != 0 {
+		t.Errorf("replica traffic error: %v, %v, %v", up, down, err)
+	}
+	// validated again, the traffic is kept
+	if ok, err := u.Validate(context.Background(), k); err != nil || !ok {
+		t.Fatalf("validate user error: %v, %v", ok, err)
+	}
+	if up, down, err := u.GetTraffic(context.Background(), k); err != nil || up != 1 || down != 2 {
+		t.Errorf("traffic error: %v, %v, %v", up, down, err)
+	}
+
+	// a user disabled by the authority is not valid, even if it is local
+	if err := u.SetEnabled(context.Background(), k, false); err != nil {
+		t.Fatalf("disable user error: %v", err)
+	}
+	if ok, err := u.Validate(context.Background(), k); err != nil || ok {
+		t.Errorf("validate disabled user error: %v, %v", ok, err)
+	}
+	if ok, err := u.Has(context.Background(), k); err != nil || !ok {
+		t.Errorf("has disabled user error: %v, %v", ok, err)
+	}
+
+	if err := u.Del(context.Background(), "test1234"); err != nil {
+		t.Fatalf("delete user error: %v", err)
+	}
+	for i, v := range u.members {
+		if _, _, err := v.GetTraffic(context.Background(), k); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("user is not deleted from member %v: %v", i, err)
+		}
+	}
+}
+
+// brokenUpstream is an Upstream which fails to validate users.
+type brokenUpstream struct {
+	*MemoryUpstream
+}
+
+// Validate is ...
+func (brokenUpstream) Validate(ctx context.Context, k string) (bool, error) {
+	return false, errors.New("replica is down")
+}
+
+func TestMultiUpstreamValidateError(t *testing.T) {
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := utils.ByteSliceToString(key[:])
+
+	broken, backup := brokenUpstream{MemoryUpstream: &MemoryUpstream{}}, &MemoryUpstream{}
+	u := &MultiUpstream{validators: []Upstream{broken, backup}, primary: backup, accounting: backup}
+
+	// the error is returned only if no validator validates the user
+	if ok, err := u.Validate(context.Background(), k); err == nil || ok {
+		t.Errorf("validate unknown user error: %v, %v", ok, err)
+	}
+	if err := backup.AddKey(context.Background(), k); err != nil {
+		t.Fatalf("add key error: %v", err)
+	}
+	if ok, err := u.Validate(context.Background(), k); err != nil || !ok {
+		t.Errorf("validate user by backup error: %v, %v", ok, err)
+	}
+}
+
+func TestMultiUpstreamProvisionError(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := (&MultiUpstream{}).Provision(ctx); err == nil {
+		t.Errorf("provision multi upstream without member")
+	}
+
+	for _, config := range []string{
+		`{"accounting":1}`,
+		`{"primary":-1}`,
+		`{"validators":[0, 2]}`,
+	} {
+		u := &MultiUpstream{members: []Upstream{&MemoryUpstream{}}}
+		if err := json.Unmarshal([]byte(config), u); err != nil {
+			t.Fatalf("unmarshal config error: %v", err)
+		}
+		if err := u.resolve(); err == nil {
+			t.Errorf("resolve invalid config %v", config)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(NullUpstream{})
+}
+
+// NullUpstream is an upstream which validates any key and discards
+// traffic, for load testing the relay without the cost of storage.
+// It lets anyone use the server, so AllowAnyKey must be set to enable it.
+type NullUpstream struct {
+	// AllowAnyKey confirms that any key is a valid user.
+	AllowAnyKey bool `json:"allow_any_key,omitempty"`
+}
+
+// CaddyModule is ...
+func (NullUpstream) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "trojan.upstreams.null",
+		New: func() caddy.Module { return new(NullUpstream) },
+	}
+}
+
+// Provision is ...
+func (u *NullUpstream) Provision(ctx caddy.Context) error {
+	if !u.AllowAnyKey {
+		return errors.New("null upstream accepts any key, set allow_any_key to enable it")
+	}
+	ctx.Logger(u).Warn("null upstream accepts any key, do not use it in production")
+	return nil
+}
+
+// Add is ...
+func (u *NullUpstream) Add(ctx context.Context, s string) error {
+	return nil
+}
+
+// AddKey is ...
+func (u *NullUpstream) AddKey(ctx context.Context, k string) error {
+	return nil
+}
+
+// Del is ...
+func (u *NullUpstream) Del(ctx context.Context, s string) error {
+	return nil
+}
+
+// DelKey is ...
+func (u *NullUpstream) DelKey(ctx context.Context, k string) error {
+	return nil
+}
+
+// AddKeys is ...
+func (u *NullUpstream) AddKeys(ctx context.Context, keys []string) error {
+	return nil
+}
+
+// DelKeys is ...
+func (u *NullUpstream) DelKeys(ctx context.Context, keys []string) error {
+	return nil
+}
+
+// Range yields no user.
+func (u *NullUpstream) Range(ctx context.Context, fn func(k string, traffic Traffic)) error {
+	return nil
+}
+
+// ListKeys returns no key.
+func (u *NullUpstream) ListKeys(ctx context.Context) ([]string, error) {
+	return []string{}, nil
+}
+
+// Validate reports any key is valid.
+func (u *NullUpstream) Validate(ctx context.Context, k string) (bool, error) {
+	return true, nil
+}
+
+// Has reports any key is a user.
+func (u *NullUpstream) Has(ctx context.Context, k string) (bool, error) {
+	return true, nil
+}
+
+// Consume discards the traffic.
+func (u *NullUpstream) Consume(ctx context.Context, k string, proto Protocol, nr, nw int64) error {
+	return nil
+}
+
+// GetTraffic is ...
+func (u *NullUpstream) GetTraffic(ctx context.Context, k string) (int64, int64, error) {
+	return 0, 0, nil
+}
+
+// TotalTraffic is ...
+func (u *NullUpstream) TotalTraffic(ctx context.Context) (int64, int64, error) {
+	return 0, 0, nil
+}
+
+// ResetTraffic is ...
+func (u *NullUpstream) ResetTraffic(ctx context.Context, k string) error {
+	return nil
+}
+
+// SetQuota is ...
+func (u *NullUpstream) SetQuota(ctx context.Context, k string, quota int64) error {
+	return nil
+}
+
+// QuotaExceeded is ...
+func (u *NullUpstream) QuotaExceeded(ctx context.Context, k string) bool {
+	return false
+}
+
+// SetEnabled is ...
+func (u *NullUpstream) SetEnabled(ctx context.Context, k string, enabled bool) error {
+	return nil
+}
+
+// Count is ...
+func (u *NullUpstream) Count(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+// SetRateLimit is ...
+func (u *NullUpstream) SetRateLimit(ctx context.Context, k string, limit int64) error {
+	return nil
+}
+
+// GetRateLimit is ...
+func (u *NullUpstream) GetRateLimit(ctx context.Context, k string) (int64, error) {
+	return 0, nil
+}
+
+// GetLastSeen is ...
+func (u *NullUpstream) GetLastSeen(ctx context.Context, k string) (time.Time, error) {
+	return time.Time{}, nil
+}
+
+// SetLabels is ...
+func (u *NullUpstream) SetLabels(ctx context.Context, k string, labels map[string]string) error {
+	return nil
+}
+
+// GetLabels is ...
+func (u *NullUpstream) GetLabels(ctx context.Context, k string) (map[string]string, error) {
+	return nil, nil
+}
+
+// SetExpiry is ...
+func (u *NullUpstream) SetExpiry(ctx context.Context, k string, t time.Time) error {
+	return nil
+}
+
+// SetSourceIP is ...
+func (u *NullUpstream) SetSourceIP(ctx context.Context, k string, ip net.IP) error {
+	return nil
+}
+
+// GetSourceIP is ...
+func (u *NullUpstream) GetSourceIP(ctx context.Context, k string) (net.IP, error) {
+	return nil, nil
+}
+
+// SetAllowedCIDRs is ...
+func (u *NullUpstream) SetAllowedCIDRs(ctx context.Context, k string, cidrs []string) error {
+	return nil
+}
+
+// GetAllowedCIDRs is ...
+func (u *NullUpstream) GetAllowedCIDRs(ctx context.Context, k string) ([]string, error) {
+	return nil, nil
+}
+
+// Ping is ...
+func (u *NullUpstream) Ping(ctx context.Context) error {
+	return nil
+}
+
+// UnmarshalCaddyfile is ...
+func (u *NullUpstream) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.Next() {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		subdirective := d.Val()
+		switch subdirective {
+		case "allow_any_key":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			u.AllowAnyKey = true
+		default:
+			return d.Errf("unknown null subdirective: %v", subdirective)
+		}
+	}
+	return nil
+}
+
+var (
+	_ Upstream              = (*NullUpstream)(nil)
+	_ caddy.Provisioner     = (*NullUpstream)(nil)
+	_ caddyfile.Unmarshaler = (*NullUpstream)(nil)
+)
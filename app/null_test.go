@@ -0,0 +1,43 @@
+package app
+
+import (
+	"context"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+func TestNullUpstream(t *testing.T) {
+	// null upstream must be enabled explicitly
+	if err := (&NullUpstream{}).Provision(caddy.Context{Context: context.Background()}); err == nil {
+		t.Fatalf("provision null upstream without allow_any_key")
+	}
+
+	u := &NullUpstream{AllowAnyKey: true}
+	if err := u.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := utils.ByteSliceToString(key[:])
+	if ok, err := u.Validate(context.Background(), k); !ok || err != nil {
+		t.Errorf("validate any key error: %v, %v", ok, err)
+	}
+	if err := u.Consume(context.Background(), k, ProtocolTCP, 1, 2); err != nil {
+		t.Errorf("consume error: %v", err)
+	}
+	if nr, nw, err := u.GetTraffic(context.Background(), k); nr != 0 || nw != 0 || err != nil {
+		t.Errorf("traffic is not discarded: %v, %v, %v", nr, nw, err)
+	}
+	if u.QuotaExceeded(context.Background(), k) {
+		t.Errorf("quota exceeded")
+	}
+	n := 0
+	if err := u.Range(context.Background(), func(string, Traffic) { n++ }); err != nil || n != 0 {
+		t.Errorf("range users error: %v, %v", n, err)
+	}
+}
@@ -0,0 +1,338 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(ObservableUpstream{})
+}
+
+// defaultSlowThreshold is the default SlowThreshold of ObservableUpstream.
+const defaultSlowThreshold = 100 * time.Millisecond
+
+// ObservableUpstream wraps an upstream, and records the latency of every
+// operation of it in a histogram of metrics, and logs the operations slower
+// than SlowThreshold, to tell if the backing store of the upstream is slow.
+// Range is timed with the fn it calls.
+type ObservableUpstream struct {
+	// UpstreamRaw is the upstream which is observed.
+	UpstreamRaw json.RawMessage `json:"upstream,omitempty" caddy:"namespace=trojan.upstreams inline_key=upstream"`
+	// SlowThreshold is the latency of an operation over which it is logged,
+	// default is 100ms. A negative value disables it.
+	SlowThreshold caddy.Duration `json:"slow_threshold,omitempty"`
+
+	up        Upstream
+	threshold time.Duration
+	latency   *prometheus.HistogramVec
+	lg        *zap.Logger
+}
+
+// NewObservableUpstream wraps up, and logs operations slower than threshold
+// to lg, none if threshold is not positive.
+func NewObservableUpstream(up Upstream, threshold time.Duration, lg *zap.Logger) *ObservableUpstream {
+	u := &ObservableUpstream{up: up, threshold: threshold, lg: lg}
+	u.latency = newLatencyHistogram()
+	return u
+}
+
+// newLatencyHistogram is ...
+func newLatencyHistogram() *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "trojan",
+		Subsystem: "upstream",
+		Name:      "operation_duration_seconds",
+		Help:      "Latency of operations of upstream.",
+		// 0.5ms to 16s
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 16),
+	}, []string{"operation"})
+}
+
+// CaddyModule is ...
+func (ObservableUpstream) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "trojan.upstreams.observable",
+		New: func() caddy.Module { return new(ObservableUpstream) },
+	}
+}
+
+// Provision is ...
+func (u *ObservableUpstream) Provision(ctx caddy.Context) error {
+	if u.UpstreamRaw == nil {
+		return errors.New("observable upstream has no upstream")
+	}
+	mod, err := ctx.LoadModule(u, "UpstreamRaw")
+	if err != nil {
+		return fmt.Errorf("load upstream error: %w", err)
+	}
+	u.up = mod.(Upstream)
+	u.threshold = time.Duration(u.SlowThreshold)
+	if u.SlowThreshold == 0 {
+		u.threshold = defaultSlowThreshold
+	}
+	u.latency = newLatencyHistogram()
+	u.lg = ctx.Logger(u)
+	return nil
+}
+
+// Upstream returns the upstream which is observed.
+func (u *ObservableUpstream) Upstream() Upstream {
+	return u.up
+}
+
+// Collector returns the histogram of latency of operations.
+func (u *ObservableUpstream) Collector() prometheus.Collector {
+	return u.latency
+}
+
+// observe records the latency of the operation which starts at start.
+func (u *ObservableUpstream) observe(op string, start time.Time) {
+	d := time.Since(start)
+	u.latency.WithLabelValues(op).Observe(d.Seconds())
+	if u.threshold > 0 && d > u.threshold {
+		u.lg.Warn(fmt.Sprintf("slow upstream operation %v: %v", op, d), zap.String("operation", op), zap.Duration("duration", d))
+	}
+}
+
+// Add is ...
+func (u *ObservableUpstream) Add(ctx context.Context, s string) error {
+	defer u.observe("add", time.Now())
+	return u.up.Add(ctx, s)
+}
+
+// AddKey is ...
+func (u *ObservableUpstream) AddKey(ctx context.Context, k string) error {
+	defer u.observe("add_key", time.Now())
+	return u.up.AddKey(ctx, k)
+}
+
+// Del is ...
+func (u *ObservableUpstream) Del(ctx context.Context, s string) error {
+	defer u.observe("del", time.Now())
+	return u.up.Del(ctx, s)
+}
+
+// DelKey is ...
+func (u *ObservableUpstream) DelKey(ctx context.Context, k string) error {
+	defer u.observe("del_key", time.Now())
+	return u.up.DelKey(ctx, k)
+}
+
+// AddKeys is ...
+func (u *ObservableUpstream) AddKeys(ctx context.Context, keys []string) error {
+	defer u.observe("add_keys", time.Now())
+	return u.up.AddKeys(ctx, keys)
+}
+
+// DelKeys is ...
+func (u *ObservableUpstream) DelKeys(ctx context.Context, keys []string) error {
+	defer u.observe("del_keys", time.Now())
+	return u.up.DelKeys(ctx, keys)
+}
+
+// Range is ...
+func (u *ObservableUpstream) Range(ctx context.Context, fn func(k string, traffic Traffic)) error {
+	defer u.observe("range", time.Now())
+	return u.up.Range(ctx, fn)
+}
+
+// ListKeys is ...
+func (u *ObservableUpstream) ListKeys(ctx context.Context) ([]string, error) {
+	defer u.observe("list_keys", time.Now())
+	return u.up.ListKeys(ctx)
+}
+
+// Validate is ...
+func (u *ObservableUpstream) Validate(ctx context.Context, k string) (bool, error) {
+	defer u.observe("validate", time.Now())
+	return u.up.Validate(ctx, k)
+}
+
+// Has is ...
+func (u *ObservableUpstream) Has(ctx context.Context, k string) (bool, error) {
+	defer u.observe("has", time.Now())
+	return u.up.Has(ctx, k)
+}
+
+// Consume is ...
+func (u *ObservableUpstream) Consume(ctx context.Context, k string, proto Protocol, nr, nw int64) error {
+	defer u.observe("consume", time.Now())
+	return u.up.Consume(ctx, k, proto, nr, nw)
+}
+
+// GetTraffic is ...
+func (u *ObservableUpstream) GetTraffic(ctx context.Context, k string) (int64, int64, error) {
+	defer u.observe("get_traffic", time.Now())
+	return u.up.GetTraffic(ctx, k)
+}
+
+// TotalTraffic is ...
+func (u *ObservableUpstream) TotalTraffic(ctx context.Context) (int64, int64, error) {
+	defer u.observe("total_traffic", time.Now())
+	return u.up.TotalTraffic(ctx)
+}
+
+// ResetTraffic is ...
+func (u *ObservableUpstream) ResetTraffic(ctx context.Context, k string) error {
+	defer u.observe("reset_traffic", time.Now())
+	return u.up.ResetTraffic(ctx, k)
+}
+
+// SetQuota is ...
+func (u *ObservableUpstream) SetQuota(ctx context.Context, k string, quota int64) error {
+	defer u.observe("set_quota", time.Now())
+	return u.up.SetQuota(ctx, k, quota)
+}
+
+// QuotaExceeded is ...
+func (u *ObservableUpstream) QuotaExceeded(ctx context.Context, k string) bool {
+	defer u.observe("quota_exceeded", time.Now())
+	return u.up.QuotaExceeded(ctx, k)
+}
+
+// SetEnabled is ...
+func (u *ObservableUpstream) SetEnabled(ctx context.Context, k string, enabled bool) error {
+	defer u.observe("set_enabled", time.Now())
+	return u.up.SetEnabled(ctx, k, enabled)
+}
+
+// Count is ...
+func (u *ObservableUpstream) Count(ctx context.Context) (int, error) {
+	defer u.observe("count", time.Now())
+	return u.up.Count(ctx)
+}
+
+// SetRateLimit is ...
+func (u *ObservableUpstream) SetRateLimit(ctx context.Context, k string, limit int64) error {
+	defer u.observe("set_rate_limit", time.Now())
+	return u.up.SetRateLimit(ctx, k, limit)
+}
+
+// GetRateLimit is ...
+func (u *ObservableUpstream) GetRateLimit(ctx context.Context, k string) (int64, error) {
+	defer u.observe("get_rate_limit", time.Now())
+	return u.up.GetRateLimit(ctx, k)
+}
+
+// GetLastSeen is ...
+func (u *ObservableUpstream) GetLastSeen(ctx context.Context, k string) (time.Time, error) {
+	defer u.observe("get_last_seen", time.Now())
+	return u.up.GetLastSeen(ctx, k)
+}
+
+// SetLabels is ...
+func (u *ObservableUpstream) SetLabels(ctx context.Context, k string, labels map[string]string) error {
+	defer u.observe("set_labels", time.Now())
+	return u.up.SetLabels(ctx, k, labels)
+}
+
+// GetLabels is ...
+func (u *ObservableUpstream) GetLabels(ctx context.Context, k string) (map[string]string, error) {
+	defer u.observe("get_labels", time.Now())
+	return u.up.GetLabels(ctx, k)
+}
+
+// SetExpiry is ...
+func (u *ObservableUpstream) SetExpiry(ctx context.Context, k string, t time.Time) error {
+	defer u.observe("set_expiry", time.Now())
+	return u.up.SetExpiry(ctx, k, t)
+}
+
+// SetSourceIP is ...
+func (u *ObservableUpstream) SetSourceIP(ctx context.Context, k string, ip net.IP) error {
+	defer u.observe("set_source_ip", time.Now())
+	return u.up.SetSourceIP(ctx, k, ip)
+}
+
+// GetSourceIP is ...
+func (u *ObservableUpstream) GetSourceIP(ctx context.Context, k string) (net.IP, error) {
+	defer u.observe("get_source_ip", time.Now())
+	return u.up.GetSourceIP(ctx, k)
+}
+
+// SetAllowedCIDRs is ...
+func (u *ObservableUpstream) SetAllowedCIDRs(ctx context.Context, k string, cidrs []string) error {
+	defer u.observe("set_allowed_cidrs", time.Now())
+	return u.up.SetAllowedCIDRs(ctx, k, cidrs)
+}
+
+// GetAllowedCIDRs is ...
+func (u *ObservableUpstream) GetAllowedCIDRs(ctx context.Context, k string) ([]string, error) {
+	defer u.observe("get_allowed_cidrs", time.Now())
+	return u.up.GetAllowedCIDRs(ctx, k)
+}
+
+// Ping is ...
+func (u *ObservableUpstream) Ping(ctx context.Context) error {
+	defer u.observe("ping", time.Now())
+	return u.up.Ping(ctx)
+}
+
+// GenKey derives trojan headers by the scheme of the upstream, so users
+// of passwords are of the same keys with or without the wrapper.
+func (u *ObservableUpstream) GenKey(s string, key []byte) {
+	GenKey(u.up, s, key)
+}
+
+// UnmarshalCaddyfile is ...
+func (u *ObservableUpstream) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.Next() {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		subdirective := d.Val()
+		switch subdirective {
+		case "upstream":
+			if u.UpstreamRaw != nil {
+				return d.Err("only one upstream is allowed")
+			}
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			raw, err := parseUpstream(d)
+			if err != nil {
+				return err
+			}
+			u.UpstreamRaw = raw
+		case "slow_threshold":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if d.Val() == "off" {
+				u.SlowThreshold = -1
+				continue
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parse slow_threshold error: %v", err)
+			}
+			if dur <= 0 {
+				return d.Errf("slow_threshold must be positive: %v", d.Val())
+			}
+			u.SlowThreshold = caddy.Duration(dur)
+		default:
+			return d.Errf("unknown observable subdirective: %v", subdirective)
+		}
+	}
+	return nil
+}
+
+var (
+	_ Upstream              = (*ObservableUpstream)(nil)
+	_ KeyGenerator          = (*ObservableUpstream)(nil)
+	_ caddy.Provisioner     = (*ObservableUpstream)(nil)
+	_ caddyfile.Unmarshaler = (*ObservableUpstream)(nil)
+)
@@ -0,0 +1,112 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+// slowUpstream is a MemoryUpstream of which Validate takes delay, with a
+// validation cache.
+type slowUpstream struct {
+	*MemoryUpstream
+	delay time.Duration
+}
+
+// Validate is ...
+func (u *slowUpstream) Validate(ctx context.Context, k string) (bool, error) {
+	time.Sleep(u.delay)
+	return u.MemoryUpstream.Validate(ctx, k)
+}
+
+// CacheStats is ...
+func (u *slowUpstream) CacheStats() (uint64, uint64) {
+	return 1, 2
+}
+
+func TestObservableUpstream(t *testing.T) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	u := NewObservableUpstream(&slowUpstream{MemoryUpstream: &MemoryUpstream{}, delay: 20 * time.Millisecond}, 10*time.Millisecond, zap.New(core))
+
+	if err := u.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	key := [trojan.HeaderLen]byte{}
+	GenKey(u, "test1234", key[:])
+	k := utils.ByteSliceToString(key[:])
+	if ok, err := u.Validate(context.Background(), k); !ok || err != nil {
+		t.Errorf("validate user error: %v, %v", ok, err)
+	}
+	u.Consume(context.Background(), k, ProtocolTCP, 1, 2)
+	if up, down, err := u.GetTraffic(context.Background(), k); up != 1 || down != 2 || err != nil {
+		t.Errorf("get traffic error: %v, %v, %v", up, down, err)
+	}
+
+	// only the slow operation is logged, without the key
+	entries := logs.All()
+	if len(entries) != 1 || entries[0].ContextMap()["operation"] != "validate" {
+		t.Fatalf("log of slow operations error: %v", entries)
+	}
+
+	// the latency and the cache of the wrapped upstream are exported
+	m := &Metrics{}
+	if err := m.Provision(); err != nil {
+		t.Fatalf("provision metrics error: %v", err)
+	}
+	if err := m.registerUpstream(u); err != nil {
+		t.Fatalf("register upstream error: %v", err)
+	}
+	families, err := m.registry.Gather()
+	if err != nil {
+		t.Fatalf("gather metrics error: %v", err)
+	}
+	counts := map[string]uint64{}
+	for _, f := range families {
+		switch f.GetName() {
+		case "trojan_upstream_operation_duration_seconds":
+			for _, v := range f.GetMetric() {
+				counts[v.GetLabel()[0].GetValue()] = v.GetHistogram().GetSampleCount()
+			}
+		case "trojan_upstream_cache_hits_total":
+			counts["cache_hits"] = uint64(f.GetMetric()[0].GetCounter().GetValue())
+		}
+	}
+	for _, op := range []string{"add", "validate", "consume", "get_traffic", "cache_hits"} {
+		if counts[op] != 1 {
+			t.Errorf("metrics of %v error: %v", op, counts)
+		}
+	}
+}
+
+func TestUnmarshalCaddyfileObservable(t *testing.T) {
+	u := &ObservableUpstream{}
+	if err := u.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`observable {
+		upstream memory {
+			users pass1234
+		}
+		slow_threshold 50ms
+	}`)); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if u.UpstreamRaw == nil || u.SlowThreshold != caddy.Duration(50*time.Millisecond) {
+		t.Errorf("unmarshal observable error: %s, %v", u.UpstreamRaw, u.SlowThreshold)
+	}
+	for _, v := range []string{
+		"observable {\n slow_threshold 0s\n}",
+		"observable {\n upstream memory\n upstream memory\n}",
+		"observable {\n cache_size 1\n}",
+	} {
+		if err := (&ObservableUpstream{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser(v)); err == nil {
+			t.Errorf("unmarshal %q: no error", v)
+		}
+	}
+}
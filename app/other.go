@@ -1,9 +1,231 @@
 package app
 
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
 // Traffic is ...
 type Traffic struct {
 	// Up is ...
-	Up int64 `json:"up"`
+	Up int64 `json:"up" redis:"up"`
 	// Down is ...
-	Down int64 `json:"down"`
+	Down int64 `json:"down" redis:"down"`
+	// UpUDP is the part of Up relayed by UDP, the rest is relayed by TCP.
+	UpUDP int64 `json:"up_udp,omitempty" redis:"up_udp"`
+	// DownUDP is the part of Down relayed by UDP, the rest is relayed by TCP.
+	DownUDP int64 `json:"down_udp,omitempty" redis:"down_udp"`
+	// Quota is the max number of bytes of Up+Down, 0 means unlimited.
+	Quota int64 `json:"quota,omitempty" redis:"quota"`
+	// QuotaNotified is set when EventQuotaExceeded is fired, and cleared when
+	// traffic is reset or quota is set, so a crossing is notified once.
+	QuotaNotified bool `json:"quota_notified,omitempty" redis:"quota_notified"`
+	// Enabled is ...
+	Enabled bool `json:"enabled" redis:"enabled"`
+	// RateLimit is the max bytes per second of Up+Down, 0 means the default of trojan app.
+	RateLimit int64 `json:"rate_limit,omitempty" redis:"rate_limit"`
+	// LastSeen is the time of the last Consume, zero if never seen.
+	// RedisUpstream stores it as unix seconds in field last_seen.
+	LastSeen time.Time `json:"last_seen" redis:"-"`
+	// ExpiresAt is the time the user expires, zero if never.
+	// RedisUpstream stores it as unix seconds in field expires_at.
+	ExpiresAt time.Time `json:"expires_at" redis:"-"`
+	// Labels is human-readable metadata of the user, like name, email and notes.
+	// RedisUpstream stores it as JSON in field labels.
+	Labels map[string]string `json:"labels,omitempty" redis:"-"`
+	// SourceIP is the address connections of the user are dialed from,
+	// empty for the default route.
+	SourceIP string `json:"source_ip,omitempty" redis:"source_ip"`
+	// AllowedCIDRs is the networks clients of the user connect from, empty
+	// for all. RedisUpstream stores it separated by commas in field
+	// allowed_cidrs.
+	AllowedCIDRs []string `json:"allowed_cidrs,omitempty" redis:"-"`
+}
+
+// UnmarshalJSON is ...
+// records stored before Enabled was introduced are enabled.
+func (t *Traffic) UnmarshalJSON(b []byte) error {
+	type traffic Traffic
+	v := traffic{Enabled: true}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*t = Traffic(v)
+	return nil
+}
+
+// UpTCP is the part of Up relayed by TCP.
+func (t *Traffic) UpTCP() int64 {
+	return t.Up - t.UpUDP
+}
+
+// DownTCP is the part of Down relayed by TCP.
+func (t *Traffic) DownTCP() int64 {
+	return t.Down - t.DownUDP
+}
+
+// Expired reports whether the user is expired at now.
+func (t *Traffic) Expired(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt)
+}
+
+// QuotaExceeded is ...
+func (t *Traffic) QuotaExceeded() bool {
+	return t.Quota > 0 && t.Up+t.Down >= t.Quota
+}
+
+// crossQuota reports whether t exceeds its quota without being notified,
+// and marks it notified.
+func (t *Traffic) crossQuota() bool {
+	if t.QuotaNotified || !t.QuotaExceeded() {
+		return false
+	}
+	t.QuotaNotified = true
+	return true
+}
+
+// copyLabels returns a copy of labels, nil if there is no label.
+func copyLabels(labels map[string]string) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	mm := make(map[string]string, len(labels))
+	for k, v := range labels {
+		mm[k] = v
+	}
+	return mm
+}
+
+// merge adds the traffic of v to t and keeps the later LastSeen.
+func (t *Traffic) merge(v Traffic) {
+	t.Up += v.Up
+	t.Down += v.Down
+	t.UpUDP += v.UpUDP
+	t.DownUDP += v.DownUDP
+	if v.LastSeen.After(t.LastSeen) {
+		t.LastSeen = v.LastSeen
+	}
+}
+
+// Protocol is the protocol of relayed traffic.
+type Protocol uint8
+
+const (
+	// ProtocolTCP is ...
+	ProtocolTCP Protocol = iota
+	// ProtocolUDP is ...
+	ProtocolUDP
+)
+
+// ProtocolOf returns the protocol of the traffic of the trojan request.
+func ProtocolOf(req *trojan.Request) Protocol {
+	if req.Command == trojan.CmdAssociate {
+		return ProtocolUDP
+	}
+	return ProtocolTCP
+}
+
+// consumed returns the traffic of a Consume, which is seen now.
+func consumed(proto Protocol, nr, nw int64) Traffic {
+	traffic := Traffic{Up: nr, Down: nw, LastSeen: time.Now()}
+	if proto == ProtocolUDP {
+		traffic.UpUDP, traffic.DownUDP = nr, nw
+	}
+	return traffic
+}
+
+// pendingTraffic is traffic which is not flushed to the backend of an upstream.
+type pendingTraffic struct {
+	// flush is held when flushing pending traffic and when resetting or
+	// deleting a user, so traffic taken by a flush before the reset is not
+	// written back after it. An upstream of locks of users in storage
+	// acquires them before flush, so a stuck lock does not hold it.
+	flush sync.Mutex
+	// total is traffic written to users but not to the total of all
+	// users, which is guarded by flush
+	total Traffic
+
+	mu sync.Mutex
+	mm map[string]Traffic
+}
+
+// add is ...
+func (p *pendingTraffic) add(k string, v Traffic) {
+	p.mu.Lock()
+	if p.mm == nil {
+		p.mm = make(map[string]Traffic)
+	}
+	traffic := p.mm[k]
+	traffic.merge(v)
+	p.mm[k] = traffic
+	p.mu.Unlock()
+}
+
+// get is ...
+func (p *pendingTraffic) get(k string) Traffic {
+	p.mu.Lock()
+	traffic := p.mm[k]
+	p.mu.Unlock()
+	return traffic
+}
+
+// all returns a copy of all pending traffic.
+func (p *pendingTraffic) all() map[string]Traffic {
+	p.mu.Lock()
+	mm := make(map[string]Traffic, len(p.mm))
+	for k, v := range p.mm {
+		mm[k] = v
+	}
+	p.mu.Unlock()
+	return mm
+}
+
+// sum returns the sum of all pending traffic.
+func (p *pendingTraffic) sum() Traffic {
+	p.mu.Lock()
+	total := Traffic{}
+	for _, v := range p.mm {
+		total.merge(v)
+	}
+	p.mu.Unlock()
+	return total
+}
+
+// del is ...
+func (p *pendingTraffic) del(k string) {
+	p.mu.Lock()
+	delete(p.mm, k)
+	p.mu.Unlock()
+}
+
+// keys returns the users of pending traffic.
+func (p *pendingTraffic) keys() []string {
+	p.mu.Lock()
+	keys := make([]string, 0, len(p.mm))
+	for k := range p.mm {
+		keys = append(keys, k)
+	}
+	p.mu.Unlock()
+	return keys
+}
+
+// takeKey returns the pending traffic of the user and clears it.
+func (p *pendingTraffic) takeKey(k string) (Traffic, bool) {
+	p.mu.Lock()
+	traffic, ok := p.mm[k]
+	delete(p.mm, k)
+	p.mu.Unlock()
+	return traffic, ok
+}
+
+// take returns all pending traffic and clears it.
+func (p *pendingTraffic) take() map[string]Traffic {
+	p.mu.Lock()
+	mm := p.mm
+	p.mm = nil
+	p.mu.Unlock()
+	return mm
 }
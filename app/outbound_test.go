@@ -0,0 +1,115 @@
+package app
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// serveEcho accepts a connection, handles the handshake of a proxy
+// and echoes data.
+func serveEcho(t *testing.T, handshake func(net.Conn, *bufio.Reader) bool) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		br := bufio.NewReader(c)
+		if !handshake(c, br) {
+			return
+		}
+		io.Copy(c, br)
+	}()
+	return ln
+}
+
+// dialEcho dials addr through d and checks the echo.
+func dialEcho(t *testing.T, d interface {
+	Dial(string, string) (net.Conn, error)
+}, addr string) {
+	c, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial through proxy error: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second))
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+		t.Errorf("read echo error: %q, %v", b, err)
+	}
+}
+
+func TestOutboundHTTP(t *testing.T) {
+	ln := serveEcho(t, func(c net.Conn, br *bufio.Reader) bool {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return false
+		}
+		if req.Method != http.MethodConnect || req.Host != "example.com:443" {
+			c.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+			return false
+		}
+		// base64 of user:pass
+		if req.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+			c.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return false
+		}
+		c.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		return true
+	})
+	defer ln.Close()
+
+	d, err := newOutboundDialer("http://user:pass@"+ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("new outbound dialer error: %v", err)
+	}
+	dialEcho(t, d, "example.com:443")
+}
+
+func TestOutboundSOCKS5(t *testing.T) {
+	ln := serveEcho(t, func(c net.Conn, br *bufio.Reader) bool {
+		// [VER, NMETHODS, METHODS]
+		b := make([]byte, 3)
+		if _, err := io.ReadFull(br, b); err != nil || b[0] != 5 {
+			return false
+		}
+		c.Write([]byte{5, 0})
+		// [VER, CMD, RSV, ATYP, LEN, DOMAIN, PORT]
+		b = make([]byte, 5)
+		if _, err := io.ReadFull(br, b); err != nil || b[1] != 1 || b[3] != 3 {
+			return false
+		}
+		domain := make([]byte, int(b[4])+2)
+		if _, err := io.ReadFull(br, domain); err != nil || string(domain[:b[4]]) != "example.com" {
+			return false
+		}
+		c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		return true
+	})
+	defer ln.Close()
+
+	d, err := newOutboundDialer("socks5://"+ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("new outbound dialer error: %v", err)
+	}
+	dialEcho(t, d, "example.com:443")
+}
+
+func TestOutboundURLError(t *testing.T) {
+	for _, v := range []string{"", "ftp://127.0.0.1:21", "socks5://", "127.0.0.1:1080"} {
+		if _, err := newOutboundDialer(v, time.Second); err == nil {
+			t.Errorf("new outbound dialer of %q without error", v)
+		}
+	}
+}
@@ -4,12 +4,16 @@ import (
 	"errors"
 	"io"
 	"net"
+	"strings"
+	"time"
 
 	"golang.org/x/net/proxy"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 
 	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
 )
 
 func init() {
@@ -17,16 +21,103 @@ func init() {
 	caddy.RegisterModule(EnvProxy{})
 }
 
+// defaultDialTimeout is ...
+const defaultDialTimeout = 10 * time.Second
+
+// defaultHappyEyeballsDelay is the connection attempt delay recommended by RFC 8305.
+const defaultHappyEyeballsDelay = 250 * time.Millisecond
+
+// newIdleTimer closes r when idle, which stops reading from the
+// client and then the relay.
+func newIdleTimer(r io.Reader, timeout time.Duration) *utils.IdleTimer {
+	return utils.NewIdleTimer(timeout, func() {
+		if c, ok := r.(io.Closer); ok {
+			c.Close()
+		}
+	})
+}
+
+// withTimeouts wraps r and w of the client with the idle timeout and the
+// read and write timeouts of each operation, which close r when they fire.
+// stop must be called when the relay is done.
+func withTimeouts(r io.Reader, w io.Writer, idle, read, write caddy.Duration) (_ io.Reader, _ io.Writer, stop func()) {
+	c := r
+	stops := []func(){}
+	if read > 0 || write > 0 {
+		d := utils.NewDeadline(time.Duration(read), time.Duration(write), func() {
+			if c, ok := c.(io.Closer); ok {
+				c.Close()
+			}
+		})
+		stops = append(stops, d.Stop)
+		r, w = d.Reader(r), d.Writer(w)
+	}
+	if idle > 0 {
+		t := newIdleTimer(c, time.Duration(idle))
+		stops = append(stops, t.Stop)
+		r, w = t.Reader(r), t.Writer(w)
+	}
+	return r, w, func() {
+		for _, fn := range stops {
+			fn()
+		}
+	}
+}
+
+// parseTimeout parses the idle_timeout, read_timeout or write_timeout
+// subdirective of a proxy.
+func parseTimeout(d *caddyfile.Dispenser, idle, read, write *caddy.Duration) error {
+	subdirective := d.Val()
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	dur, err := caddy.ParseDuration(d.Val())
+	if err != nil {
+		return d.Errf("parse %v error: %v", subdirective, err)
+	}
+	switch subdirective {
+	case "idle_timeout":
+		*idle = caddy.Duration(dur)
+	case "read_timeout":
+		*read = caddy.Duration(dur)
+	case "write_timeout":
+		*write = caddy.Duration(dur)
+	}
+	return nil
+}
+
 // Proxy is ...
 type Proxy interface {
-	// Handle is ...
-	Handle(r io.Reader, w io.Writer) (int64, int64, error)
+	// Handle relays a trojan connection, and records the request to req.
+	Handle(r io.Reader, w io.Writer, req *trojan.Request) (int64, int64, error)
 	// Closer is ...
 	io.Closer
 }
 
 // NoProxy is ...
-type NoProxy struct{}
+type NoProxy struct {
+	AddrFilter
+	// DialTimeout is the timeout of connecting to the destination, default is 10s.
+	DialTimeout caddy.Duration `json:"dial_timeout,omitempty"`
+	// IdleTimeout closes a connection without data in either direction, 0 means no timeout.
+	IdleTimeout caddy.Duration `json:"idle_timeout,omitempty"`
+	// ReadTimeout closes a connection of which a read from the client does not
+	// return in the duration, even if the other direction is relaying, 0 means no timeout.
+	ReadTimeout caddy.Duration `json:"read_timeout,omitempty"`
+	// WriteTimeout closes a connection of which a write to the client does not
+	// finish in the duration, 0 means no timeout.
+	WriteTimeout caddy.Duration `json:"write_timeout,omitempty"`
+	// HappyEyeballsDelay is the delay before racing a connection to an address
+	// of the other family, when a domain has both IPv4 and IPv6 addresses.
+	// Default is 250ms, negative dials the addresses one by one.
+	HappyEyeballsDelay caddy.Duration `json:"happy_eyeballs_delay,omitempty"`
+	// Resolver resolves destination domains, nil uses the resolver of the OS.
+	Resolver *Resolver `json:"resolver,omitempty"`
+	// DNSCache caches addresses of destination domains, nil does not cache.
+	DNSCache *DNSCache `json:"dns_cache,omitempty"`
+
+	dialer *netDialer
+}
 
 // CaddyModule is ...
 func (NoProxy) CaddyModule() caddy.ModuleInfo {
@@ -36,9 +127,151 @@ func (NoProxy) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
+// Provision is ...
+func (p *NoProxy) Provision(ctx caddy.Context) error {
+	if err := p.AddrFilter.Provision(); err != nil {
+		return err
+	}
+	if p.DialTimeout == 0 {
+		p.DialTimeout = caddy.Duration(defaultDialTimeout)
+	}
+	if p.HappyEyeballsDelay == 0 {
+		p.HappyEyeballsDelay = caddy.Duration(defaultHappyEyeballsDelay)
+	}
+	p.dialer = newNetDialer(&p.AddrFilter)
+	p.dialer.Timeout = time.Duration(p.DialTimeout)
+	// net.Dialer resolves both A and AAAA records of the domain, and races
+	// the address families after FallbackDelay as RFC 8305 does
+	p.dialer.FallbackDelay = time.Duration(p.HappyEyeballsDelay)
+	if p.Resolver != nil {
+		if err := p.Resolver.Provision(); err != nil {
+			return err
+		}
+		p.dialer.lookup = p.Resolver.LookupIP
+	}
+	if p.DNSCache != nil {
+		p.DNSCache.resolver = p.Resolver
+		if err := p.DNSCache.Provision(); err != nil {
+			return err
+		}
+		p.dialer.lookup = p.DNSCache.Lookup
+	}
+	return nil
+}
+
 // Handle is ...
-func (*NoProxy) Handle(r io.Reader, w io.Writer) (int64, int64, error) {
-	return trojan.Handle(r, w)
+func (p *NoProxy) Handle(r io.Reader, w io.Writer, req *trojan.Request) (int64, int64, error) {
+	r, w, stop := withTimeouts(r, w, p.IdleTimeout, p.ReadTimeout, p.WriteTimeout)
+	defer stop()
+	if req.LocalIP != nil {
+		return trojan.HandleRequest(r, w, p.dialer.from(req.LocalIP), req)
+	}
+	return trojan.HandleRequest(r, w, p.dialer, req)
+}
+
+// UnmarshalCaddyfile is ...
+func (p *NoProxy) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.Next() {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		subdirective := d.Val()
+		switch subdirective {
+		case "block_private":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			p.BlockPrivate = true
+		case "blocked_cidrs":
+			args := d.RemainingArgs()
+			if len(args) < 1 {
+				return d.ArgErr()
+			}
+			for _, v := range args {
+				if _, _, err := net.ParseCIDR(v); err != nil {
+					return d.Errf("parse blocked cidr error: %v", err)
+				}
+			}
+			p.BlockedCIDRs = append(p.BlockedCIDRs, args...)
+		case "dial_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parse dial_timeout error: %v", err)
+			}
+			p.DialTimeout = caddy.Duration(dur)
+		case "idle_timeout", "read_timeout", "write_timeout":
+			if err := parseTimeout(d, &p.IdleTimeout, &p.ReadTimeout, &p.WriteTimeout); err != nil {
+				return err
+			}
+		case "happy_eyeballs":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if d.Val() == "off" {
+				p.HappyEyeballsDelay = -1
+				break
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parse happy_eyeballs error: %v", err)
+			}
+			if dur <= 0 {
+				return d.Err("happy_eyeballs must be positive or off")
+			}
+			p.HappyEyeballsDelay = caddy.Duration(dur)
+		case "resolver":
+			if p.Resolver != nil {
+				return d.Err("only one resolver is allowed")
+			}
+			p.Resolver = &Resolver{}
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			p.Resolver.Address = d.Val()
+			if d.NextArg() {
+				p.Resolver.Protocol = d.Val()
+			} else if strings.HasPrefix(p.Resolver.Address, "https://") {
+				p.Resolver.Protocol = "doh"
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "dns_cache":
+			if p.DNSCache != nil {
+				return d.Err("only one dns_cache is allowed")
+			}
+			p.DNSCache = &DNSCache{}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				option := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("parse %v error: %v", option, err)
+				}
+				switch option {
+				case "min_ttl":
+					p.DNSCache.MinTTL = caddy.Duration(dur)
+				case "max_ttl":
+					p.DNSCache.MaxTTL = caddy.Duration(dur)
+				case "negative_ttl":
+					p.DNSCache.NegativeTTL = caddy.Duration(dur)
+				default:
+					return d.Errf("unknown dns_cache option: %v", option)
+				}
+			}
+		default:
+			return d.Errf("unknown no_proxy subdirective: %v", subdirective)
+		}
+	}
+	return nil
 }
 
 // Close is ...
@@ -48,6 +281,17 @@ func (*NoProxy) Close() error {
 
 // EnvProxy is ...
 type EnvProxy struct {
+	// DialTimeout is the timeout of connecting to the proxy, default is 10s.
+	DialTimeout caddy.Duration `json:"dial_timeout,omitempty"`
+	// IdleTimeout closes a connection without data in either direction, 0 means no timeout.
+	IdleTimeout caddy.Duration `json:"idle_timeout,omitempty"`
+	// ReadTimeout closes a connection of which a read from the client does not
+	// return in the duration, even if the other direction is relaying, 0 means no timeout.
+	ReadTimeout caddy.Duration `json:"read_timeout,omitempty"`
+	// WriteTimeout closes a connection of which a write to the client does not
+	// finish in the duration, 0 means no timeout.
+	WriteTimeout caddy.Duration `json:"write_timeout,omitempty"`
+
 	proxy.Dialer `json:"-,omitempty"`
 }
 
@@ -61,13 +305,18 @@ func (EnvProxy) CaddyModule() caddy.ModuleInfo {
 
 // Provision is ...
 func (p *EnvProxy) Provision(ctx caddy.Context) error {
-	p.Dialer = proxy.FromEnvironment()
+	if p.DialTimeout == 0 {
+		p.DialTimeout = caddy.Duration(defaultDialTimeout)
+	}
+	p.Dialer = proxy.FromEnvironmentUsing(&net.Dialer{Timeout: time.Duration(p.DialTimeout)})
 	return nil
 }
 
 // Handle is ...
-func (p *EnvProxy) Handle(r io.Reader, w io.Writer) (int64, int64, error) {
-	return trojan.HandleWithDialer(r, w, p)
+func (p *EnvProxy) Handle(r io.Reader, w io.Writer, req *trojan.Request) (int64, int64, error) {
+	r, w, stop := withTimeouts(r, w, p.IdleTimeout, p.ReadTimeout, p.WriteTimeout)
+	defer stop()
+	return trojan.HandleRequest(r, w, p, req)
 }
 
 // Close is ...
@@ -75,13 +324,48 @@ func (*EnvProxy) Close() error {
 	return nil
 }
 
+// UnmarshalCaddyfile is ...
+func (p *EnvProxy) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.Next() {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		subdirective := d.Val()
+		switch subdirective {
+		case "dial_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parse dial_timeout error: %v", err)
+			}
+			p.DialTimeout = caddy.Duration(dur)
+		case "idle_timeout", "read_timeout", "write_timeout":
+			if err := parseTimeout(d, &p.IdleTimeout, &p.ReadTimeout, &p.WriteTimeout); err != nil {
+				return err
+			}
+		default:
+			return d.Errf("unknown env_proxy subdirective: %v", subdirective)
+		}
+	}
+	return nil
+}
+
 // ListenPacket is ...
 func (*EnvProxy) ListenPacket(network, addr string) (net.PacketConn, error) {
 	return nil, errors.New("proxy from environment does not support UDP")
 }
 
 var (
-	_ Proxy             = (*NoProxy)(nil)
-	_ caddy.Provisioner = (*EnvProxy)(nil)
-	_ Proxy             = (*EnvProxy)(nil)
+	_ Proxy                 = (*NoProxy)(nil)
+	_ caddy.Provisioner     = (*NoProxy)(nil)
+	_ caddyfile.Unmarshaler = (*NoProxy)(nil)
+	_ caddy.Provisioner     = (*EnvProxy)(nil)
+	_ Proxy                 = (*EnvProxy)(nil)
+	_ caddyfile.Unmarshaler = (*EnvProxy)(nil)
+	_ trojan.UDPResolver    = (*netDialer)(nil)
 )
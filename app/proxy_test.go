@@ -0,0 +1,53 @@
+package app
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestWithTimeouts(t *testing.T) {
+	c, peer := net.Pipe()
+	defer peer.Close()
+
+	// the peer never reads, so a write to it is blocked until it is closed
+	_, w, stop := withTimeouts(c, c, caddy.Duration(time.Minute), 0, caddy.Duration(50*time.Millisecond))
+	defer stop()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := w.Write([]byte("data"))
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Errorf("write to stalled peer without error")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("write timeout does not close the connection")
+	}
+}
+
+func TestUnmarshalCaddyfileTimeouts(t *testing.T) {
+	p := &NoProxy{}
+	if err := p.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`no_proxy {
+		idle_timeout 5m
+		read_timeout 2m
+		write_timeout 30s
+	}`)); err != nil {
+		t.Fatalf("unmarshal caddyfile error: %v", err)
+	}
+	if p.IdleTimeout != caddy.Duration(5*time.Minute) || p.ReadTimeout != caddy.Duration(2*time.Minute) || p.WriteTimeout != caddy.Duration(30*time.Second) {
+		t.Errorf("unmarshal timeouts error: %+v", p)
+	}
+
+	if err := (&EnvProxy{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser(`env_proxy {
+		write_timeout soon
+	}`)); err == nil {
+		t.Errorf("unmarshal invalid write_timeout")
+	}
+}
@@ -0,0 +1,55 @@
+package app
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// minBurst is the min burst of a limiter, so a single read or write
+// of the relay does not wait for too many rounds.
+const minBurst = 64 << 10
+
+// Limiters is a set of rate limiters shared by all connections of a user.
+type Limiters struct {
+	// Default is the rate limit in bytes per second for users without one.
+	Default int64
+
+	up Upstream
+	mm sync.Map
+}
+
+// Get returns the limiter of the user, or nil if the user is unlimited.
+func (l *Limiters) Get(ctx context.Context, k string) *rate.Limiter {
+	if l == nil {
+		return nil
+	}
+
+	k = normalizeKey(k)
+
+	n, err := l.up.GetRateLimit(ctx, k)
+	if err != nil || n <= 0 {
+		n = l.Default
+	}
+	if n <= 0 {
+		l.mm.Delete(k)
+		return nil
+	}
+
+	burst := int(n)
+	if burst < minBurst {
+		burst = minBurst
+	}
+
+	if v, ok := l.mm.Load(k); ok {
+		lim := v.(*rate.Limiter)
+		if lim.Limit() != rate.Limit(n) {
+			lim.SetLimit(rate.Limit(n))
+			lim.SetBurst(burst)
+		}
+		return lim
+	}
+	v, _ := l.mm.LoadOrStore(k, rate.NewLimiter(rate.Limit(n), burst))
+	return v.(*rate.Limiter)
+}
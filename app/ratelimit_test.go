@@ -0,0 +1,54 @@
+package app
+
+import (
+	"context"
+	"testing"
+
+	"golang.org/x/time/rate"
+
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+func TestLimiters(t *testing.T) {
+	up := &MemoryUpstream{}
+	if err := up.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := utils.ByteSliceToString(key[:])
+
+	l := &Limiters{up: up}
+	if lim := l.Get(context.Background(), k); lim != nil {
+		t.Errorf("user without rate limit is limited: %v", lim.Limit())
+	}
+
+	if err := up.SetRateLimit(context.Background(), k, 1<<20); err != nil {
+		t.Fatalf("set rate limit error: %v", err)
+	}
+	lim := l.Get(context.Background(), k)
+	if lim == nil || lim.Limit() != rate.Limit(1<<20) || lim.Burst() != 1<<20 {
+		t.Fatalf("rate limit of user error: %v", lim)
+	}
+	// a change applies to the next connection, with the limiter shared by
+	// the live connections of the user
+	if err := up.SetRateLimit(context.Background(), k, 1<<10); err != nil {
+		t.Fatalf("set rate limit error: %v", err)
+	}
+	if next := l.Get(context.Background(), k); next != lim || next.Limit() != rate.Limit(1<<10) || next.Burst() != minBurst {
+		t.Errorf("changed rate limit error: %v, %v", next.Limit(), next.Burst())
+	}
+
+	// 0 is the default
+	l.Default = 1 << 16
+	if err := up.SetRateLimit(context.Background(), k, 0); err != nil {
+		t.Fatalf("set rate limit error: %v", err)
+	}
+	if lim := l.Get(context.Background(), k); lim == nil || lim.Limit() != rate.Limit(1<<16) {
+		t.Errorf("default rate limit error: %v", lim)
+	}
+	if lim := (*Limiters)(nil).Get(context.Background(), k); lim != nil {
+		t.Errorf("nil limiters error: %v", lim)
+	}
+}
@@ -0,0 +1,615 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+func init() {
+	caddy.RegisterModule(RedisUpstream{})
+}
+
+// consumeScript only increases the counters of an existing user,
+// so a concurrent Del won't be undone by HINCRBY recreating the hash,
+// and increases the total of all users of KEYS[2] with it.
+// It returns 2 and marks the user notified if the user crosses its quota.
+var consumeScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("HINCRBY", KEYS[2], "up", ARGV[1])
+redis.call("HINCRBY", KEYS[2], "down", ARGV[2])
+redis.call("HINCRBY", KEYS[2], "up_udp", ARGV[4])
+redis.call("HINCRBY", KEYS[2], "down_udp", ARGV[5])
+local up = redis.call("HINCRBY", KEYS[1], "up", ARGV[1])
+local down = redis.call("HINCRBY", KEYS[1], "down", ARGV[2])
+redis.call("HINCRBY", KEYS[1], "up_udp", ARGV[4])
+redis.call("HINCRBY", KEYS[1], "down_udp", ARGV[5])
+redis.call("HSET", KEYS[1], "last_seen", ARGV[3])
+local quota = tonumber(redis.call("HGET", KEYS[1], "quota") or "0")
+if quota > 0 and up + down >= quota and redis.call("HGET", KEYS[1], "quota_notified") ~= "1" then
+	redis.call("HSET", KEYS[1], "quota_notified", 1)
+	return 2
+end
+return 1
+`)
+
+// resetScript only zeros the counters of an existing user.
+var resetScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[1], "up", 0, "down", 0, "up_udp", 0, "down_udp", 0, "quota_notified", 0)
+return 1
+`)
+
+// setScript only sets fields of an existing user, ARGV are pairs of
+// field and value.
+var setScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[1], unpack(ARGV))
+return 1
+`)
+
+// validateScript checks that the user exists, is not disabled and is not
+// expired at ARGV[1], users added before "enabled" was introduced are enabled.
+var validateScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+if redis.call("HGET", KEYS[1], "enabled") == "0" then
+	return 0
+end
+local expires = tonumber(redis.call("HGET", KEYS[1], "expires_at") or "0")
+if expires > 0 and expires <= tonumber(ARGV[1]) then
+	return 0
+end
+return 1
+`)
+
+// RedisUpstream is ...
+type RedisUpstream struct {
+	// Address is ...
+	Address string `json:"address,omitempty"`
+	// Password is ...
+	Password string `json:"password,omitempty"`
+	// DB is ...
+	DB int `json:"db,omitempty"`
+	// Prefix is ...
+	Prefix string `json:"prefix,omitempty"`
+	KeyScheme
+
+	client *redis.Client
+	lg     *zap.Logger
+}
+
+// CaddyModule is ...
+func (RedisUpstream) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "trojan.upstreams.redis",
+		New: func() caddy.Module { return new(RedisUpstream) },
+	}
+}
+
+// Provision is ...
+func (u *RedisUpstream) Provision(ctx caddy.Context) error {
+	if err := u.KeyScheme.Provision(); err != nil {
+		return err
+	}
+	if u.Address == "" {
+		u.Address = "127.0.0.1:6379"
+	}
+	if u.Prefix == "" {
+		u.Prefix = "trojan/"
+	}
+	u.client = redis.NewClient(&redis.Options{
+		Addr:     u.Address,
+		Password: u.Password,
+		DB:       u.DB,
+	})
+	u.lg = ctx.Logger(u)
+	return nil
+}
+
+// Cleanup is ...
+func (u *RedisUpstream) Cleanup() error {
+	if u.client == nil {
+		// provision failed
+		return nil
+	}
+	return u.client.Close()
+}
+
+// AddKey is ...
+func (u *RedisUpstream) AddKey(ctx context.Context, k string) error {
+	key := u.Prefix + base64.StdEncoding.EncodeToString(utils.StringToByteSlice(k))
+	_, err := u.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSetNX(ctx, key, "up", 0)
+		pipe.HSetNX(ctx, key, "down", 0)
+		pipe.HSetNX(ctx, key, "enabled", 1)
+		return nil
+	})
+	return err
+}
+
+// Add is ...
+func (u *RedisUpstream) Add(ctx context.Context, s string) error {
+	b := [trojan.HeaderLen]byte{}
+	u.GenKey(s, b[:])
+	return u.AddKey(ctx, utils.ByteSliceToString(b[:]))
+}
+
+// DelKey is ...
+func (u *RedisUpstream) DelKey(ctx context.Context, k string) error {
+	key := u.Prefix + base64.StdEncoding.EncodeToString(utils.StringToByteSlice(k))
+	return u.client.Del(ctx, key).Err()
+}
+
+// AddKeys is ...
+func (u *RedisUpstream) AddKeys(ctx context.Context, keys []string) error {
+	_, err := u.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, k := range keys {
+			key := u.Prefix + base64.StdEncoding.EncodeToString(utils.StringToByteSlice(k))
+			pipe.HSetNX(ctx, key, "up", 0)
+			pipe.HSetNX(ctx, key, "down", 0)
+			pipe.HSetNX(ctx, key, "enabled", 1)
+		}
+		return nil
+	})
+	return err
+}
+
+// DelKeys is ...
+func (u *RedisUpstream) DelKeys(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	ss := make([]string, 0, len(keys))
+	for _, k := range keys {
+		ss = append(ss, u.Prefix+base64.StdEncoding.EncodeToString(utils.StringToByteSlice(k)))
+	}
+	return u.client.Del(ctx, ss...).Err()
+}
+
+// Del is ...
+func (u *RedisUpstream) Del(ctx context.Context, s string) error {
+	b := [trojan.HeaderLen]byte{}
+	u.GenKey(s, b[:])
+	return u.DelKey(ctx, utils.ByteSliceToString(b[:]))
+}
+
+// Range is ...
+func (u *RedisUpstream) Range(ctx context.Context, fn func(k string, traffic Traffic)) error {
+	iter := u.client.Scan(ctx, 0, u.Prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		k := iter.Val()
+		if k == u.totalKey() {
+			continue
+		}
+
+		traffic, err := u.load(ctx, k)
+		if err != nil {
+			// deleted after scanned
+			if errors.Is(err, ErrUserNotFound) {
+				continue
+			}
+			return fmt.Errorf("load user %v error: %w", k, err)
+		}
+		fn(strings.TrimPrefix(k, u.Prefix), traffic)
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("scan users error: %w", err)
+	}
+	return nil
+}
+
+// ListKeys scans the keys of users without loading their fields.
+func (u *RedisUpstream) ListKeys(ctx context.Context) ([]string, error) {
+	keys := []string{}
+	iter := u.client.Scan(ctx, 0, u.Prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		k := iter.Val()
+		if k == u.totalKey() {
+			continue
+		}
+		keys = append(keys, strings.TrimPrefix(k, u.Prefix))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("scan users error: %w", err)
+	}
+	return keys, nil
+}
+
+// load returns all fields of the user.
+func (u *RedisUpstream) load(ctx context.Context, k string) (Traffic, error) {
+	// users added before "enabled" was introduced are enabled
+	traffic := Traffic{Enabled: true}
+
+	cmd := u.client.HMGet(ctx, k, "up", "down", "up_udp", "down_udp", "quota", "enabled", "rate_limit", "last_seen", "labels", "expires_at", "source_ip", "allowed_cidrs")
+	vals, err := cmd.Result()
+	if err != nil {
+		return traffic, err
+	}
+	if vals[0] == nil {
+		return traffic, ErrUserNotFound
+	}
+	if err := cmd.Scan(&traffic); err != nil {
+		return traffic, err
+	}
+	if s, ok := vals[7].(string); ok {
+		sec, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return traffic, err
+		}
+		traffic.LastSeen = time.Unix(sec, 0)
+	}
+	if traffic.Labels, err = parseLabels(vals[8]); err != nil {
+		return traffic, err
+	}
+	if s, ok := vals[9].(string); ok {
+		sec, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return traffic, err
+		}
+		if sec > 0 {
+			traffic.ExpiresAt = time.Unix(sec, 0)
+		}
+	}
+	if s, ok := vals[11].(string); ok {
+		traffic.AllowedCIDRs = splitAllowedCIDRs(s)
+	}
+	return traffic, nil
+}
+
+// Validate is ...
+func (u *RedisUpstream) Validate(ctx context.Context, k string) (bool, error) {
+	k = u.Prefix + normalizeKey(k)
+	ok, err := validateScript.Run(ctx, u.client, []string{k}, time.Now().Unix()).Int()
+	if err != nil {
+		return false, fmt.Errorf("validate user error: %w", err)
+	}
+	return ok == 1, nil
+}
+
+// Has is ...
+func (u *RedisUpstream) Has(ctx context.Context, k string) (bool, error) {
+	k = u.Prefix + normalizeKey(k)
+	n, err := u.client.Exists(ctx, k).Result()
+	if err != nil {
+		return false, fmt.Errorf("find user error: %w", err)
+	}
+	return n == 1, nil
+}
+
+// Consume is ...
+func (u *RedisUpstream) Consume(ctx context.Context, k string, proto Protocol, nr, nw int64) error {
+	k = u.Prefix + normalizeKey(k)
+	traffic := consumed(proto, nr, nw)
+	n, err := consumeScript.Run(ctx, u.client, []string{k, u.totalKey()}, traffic.Up, traffic.Down, traffic.LastSeen.Unix(), traffic.UpUDP, traffic.DownUDP).Int()
+	if err != nil || n != 2 {
+		return err
+	}
+	if err := u.client.HMGet(ctx, k, "up", "down", "quota", "quota_notified").Scan(&traffic); err != nil {
+		return fmt.Errorf("load user error: %w", err)
+	}
+	emitQuotaExceeded(strings.TrimPrefix(k, u.Prefix), traffic)
+	return nil
+}
+
+// totalKey returns the key of the hash of the traffic of all users, which
+// is next to Prefix, and is skipped as a user if Prefix does not end with /.
+func (u *RedisUpstream) totalKey() string {
+	return strings.TrimSuffix(u.Prefix, "/") + ".total"
+}
+
+// TotalTraffic is ...
+// The total is increased with the user in one script, so it is always
+// the traffic written to users.
+func (u *RedisUpstream) TotalTraffic(ctx context.Context) (int64, int64, error) {
+	total := Traffic{}
+	if err := u.client.HMGet(ctx, u.totalKey(), "up", "down").Scan(&total); err != nil {
+		return 0, 0, fmt.Errorf("load total traffic error: %w", err)
+	}
+	return total.Up, total.Down, nil
+}
+
+// GetTraffic is ...
+func (u *RedisUpstream) GetTraffic(ctx context.Context, k string) (int64, int64, error) {
+	k = u.Prefix + normalizeKey(k)
+
+	cmd := u.client.HMGet(ctx, k, "up", "down")
+	vals, err := cmd.Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	if vals[0] == nil && vals[1] == nil {
+		return 0, 0, ErrUserNotFound
+	}
+
+	traffic := Traffic{}
+	if err := cmd.Scan(&traffic); err != nil {
+		return 0, 0, err
+	}
+	return traffic.Up, traffic.Down, nil
+}
+
+// ResetTraffic is ...
+func (u *RedisUpstream) ResetTraffic(ctx context.Context, k string) error {
+	k = u.Prefix + normalizeKey(k)
+	return resetScript.Run(ctx, u.client, []string{k}).Err()
+}
+
+// SetQuota is ...
+func (u *RedisUpstream) SetQuota(ctx context.Context, k string, n int64) error {
+	k = u.Prefix + normalizeKey(k)
+	return u.set(ctx, k, "quota", n, "quota_notified", 0)
+}
+
+// set sets pairs of field and value of an existing user.
+func (u *RedisUpstream) set(ctx context.Context, k string, fields ...interface{}) error {
+	ok, err := setScript.Run(ctx, u.client, []string{k}, fields...).Int()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// QuotaExceeded is ...
+func (u *RedisUpstream) QuotaExceeded(ctx context.Context, k string) bool {
+	k = u.Prefix + normalizeKey(k)
+
+	traffic := Traffic{}
+	if err := u.client.HMGet(ctx, k, "up", "down", "quota").Scan(&traffic); err != nil {
+		u.lg.Error(fmt.Sprintf("load user error: %v", err))
+		return false
+	}
+	return traffic.QuotaExceeded()
+}
+
+// SetEnabled is ...
+func (u *RedisUpstream) SetEnabled(ctx context.Context, k string, enabled bool) error {
+	k = u.Prefix + normalizeKey(k)
+	if enabled {
+		return u.set(ctx, k, "enabled", 1)
+	}
+	return u.set(ctx, k, "enabled", 0)
+}
+
+// Count is ...
+func (u *RedisUpstream) Count(ctx context.Context) (int, error) {
+	n := 0
+	iter := u.client.Scan(ctx, 0, u.Prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		if iter.Val() != u.totalKey() {
+			n++
+		}
+	}
+	return n, iter.Err()
+}
+
+// SetRateLimit is ...
+func (u *RedisUpstream) SetRateLimit(ctx context.Context, k string, n int64) error {
+	k = u.Prefix + normalizeKey(k)
+	return u.set(ctx, k, "rate_limit", n)
+}
+
+// GetRateLimit is ...
+func (u *RedisUpstream) GetRateLimit(ctx context.Context, k string) (int64, error) {
+	k = u.Prefix + normalizeKey(k)
+
+	cmd := u.client.HMGet(ctx, k, "up", "rate_limit")
+	vals, err := cmd.Result()
+	if err != nil {
+		return 0, err
+	}
+	if vals[0] == nil {
+		return 0, ErrUserNotFound
+	}
+
+	traffic := Traffic{}
+	if err := cmd.Scan(&traffic); err != nil {
+		return 0, err
+	}
+	return traffic.RateLimit, nil
+}
+
+// GetLastSeen is ...
+func (u *RedisUpstream) GetLastSeen(ctx context.Context, k string) (time.Time, error) {
+	k = u.Prefix + normalizeKey(k)
+
+	vals, err := u.client.HMGet(ctx, k, "up", "last_seen").Result()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if vals[0] == nil {
+		return time.Time{}, ErrUserNotFound
+	}
+	if vals[1] == nil {
+		return time.Time{}, nil
+	}
+	sec, err := strconv.ParseInt(vals[1].(string), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec, 0), nil
+}
+
+// SetLabels is ...
+func (u *RedisUpstream) SetLabels(ctx context.Context, k string, labels map[string]string) error {
+	k = u.Prefix + normalizeKey(k)
+
+	v := ""
+	if len(labels) > 0 {
+		b, err := json.Marshal(labels)
+		if err != nil {
+			return err
+		}
+		v = string(b)
+	}
+	return u.set(ctx, k, "labels", v)
+}
+
+// GetLabels is ...
+func (u *RedisUpstream) GetLabels(ctx context.Context, k string) (map[string]string, error) {
+	k = u.Prefix + normalizeKey(k)
+
+	vals, err := u.client.HMGet(ctx, k, "up", "labels").Result()
+	if err != nil {
+		return nil, err
+	}
+	if vals[0] == nil {
+		return nil, ErrUserNotFound
+	}
+	return parseLabels(vals[1])
+}
+
+// parseLabels decodes labels stored as JSON, nil or an empty string if
+// there is no label.
+func parseLabels(v interface{}) (map[string]string, error) {
+	s, _ := v.(string)
+	if s == "" {
+		return nil, nil
+	}
+	labels := map[string]string{}
+	if err := json.Unmarshal([]byte(s), &labels); err != nil {
+		return nil, fmt.Errorf("parse labels error: %w", err)
+	}
+	return copyLabels(labels), nil
+}
+
+// SetExpiry is ...
+func (u *RedisUpstream) SetExpiry(ctx context.Context, k string, t time.Time) error {
+	k = u.Prefix + normalizeKey(k)
+	return u.set(ctx, k, "expires_at", unixSeconds(t))
+}
+
+// SetSourceIP is ...
+func (u *RedisUpstream) SetSourceIP(ctx context.Context, k string, ip net.IP) error {
+	if err := checkSourceIP(ip); err != nil {
+		return err
+	}
+
+	k = u.Prefix + normalizeKey(k)
+	return u.set(ctx, k, "source_ip", sourceIPString(ip))
+}
+
+// GetSourceIP is ...
+func (u *RedisUpstream) GetSourceIP(ctx context.Context, k string) (net.IP, error) {
+	k = u.Prefix + normalizeKey(k)
+
+	vals, err := u.client.HMGet(ctx, k, "up", "source_ip").Result()
+	if err != nil {
+		return nil, err
+	}
+	if vals[0] == nil {
+		return nil, ErrUserNotFound
+	}
+	s, _ := vals[1].(string)
+	return net.ParseIP(s), nil
+}
+
+// SetAllowedCIDRs is ...
+func (u *RedisUpstream) SetAllowedCIDRs(ctx context.Context, k string, cidrs []string) error {
+	cidrs, err := parseAllowedCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+
+	k = u.Prefix + normalizeKey(k)
+	return u.set(ctx, k, "allowed_cidrs", allowedCIDRsString(cidrs))
+}
+
+// GetAllowedCIDRs is ...
+func (u *RedisUpstream) GetAllowedCIDRs(ctx context.Context, k string) ([]string, error) {
+	k = u.Prefix + normalizeKey(k)
+
+	vals, err := u.client.HMGet(ctx, k, "up", "allowed_cidrs").Result()
+	if err != nil {
+		return nil, err
+	}
+	if vals[0] == nil {
+		return nil, ErrUserNotFound
+	}
+	s, _ := vals[1].(string)
+	return splitAllowedCIDRs(s), nil
+}
+
+// Ping is ...
+func (u *RedisUpstream) Ping(ctx context.Context) error {
+	return u.client.Ping(ctx).Err()
+}
+
+// UnmarshalCaddyfile is ...
+func (u *RedisUpstream) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.Next() {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		subdirective := d.Val()
+		switch subdirective {
+		case "address":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.Address = d.Val()
+		case "password":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.Password = d.Val()
+		case "db":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			db, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("parse redis db error: %v", err)
+			}
+			u.DB = db
+		case "prefix":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.Prefix = d.Val()
+		case "key_scheme":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.Scheme = d.Val()
+		default:
+			return d.Errf("unknown redis subdirective: %v", subdirective)
+		}
+	}
+	return nil
+}
+
+var (
+	_ Upstream              = (*RedisUpstream)(nil)
+	_ KeyGenerator          = (*RedisUpstream)(nil)
+	_ caddy.Provisioner     = (*RedisUpstream)(nil)
+	_ caddy.CleanerUpper    = (*RedisUpstream)(nil)
+	_ caddyfile.Unmarshaler = (*RedisUpstream)(nil)
+)
@@ -0,0 +1,168 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+// newRedisUpstream connects to the redis server of REDIS_ADDR with
+// a prefix only used by this test.
+func newRedisUpstream(t *testing.T) *RedisUpstream {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR is not set")
+	}
+
+	u := &RedisUpstream{
+		Address: addr,
+		Prefix:  fmt.Sprintf("trojan-test/%v/", time.Now().UnixNano()),
+		client:  redis.NewClient(&redis.Options{Addr: addr}),
+		lg:      zap.NewNop(),
+	}
+	if err := u.client.Ping(context.Background()).Err(); err != nil {
+		t.Skipf("connect redis %v error: %v", addr, err)
+	}
+	t.Cleanup(func() {
+		u.Range(context.Background(), func(k string, traffic Traffic) {
+			u.client.Del(context.Background(), u.Prefix+k)
+		})
+		u.client.Del(context.Background(), u.totalKey())
+		u.Cleanup()
+	})
+	return u
+}
+
+func TestRedisUpstream(t *testing.T) {
+	u := newRedisUpstream(t)
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := utils.ByteSliceToString(key[:])
+
+	// consumeScript and resetScript don't create missing users
+	if err := u.Consume(context.Background(), k, ProtocolTCP, 1, 2); err != nil {
+		t.Fatalf("consume missing user error: %v", err)
+	}
+	if err := u.ResetTraffic(context.Background(), k); err != nil {
+		t.Fatalf("reset missing user error: %v", err)
+	}
+	if n, err := u.Count(context.Background()); err != nil || n != 0 {
+		t.Errorf("count users error: got %v, %v, want 0", n, err)
+	}
+	if ok, err := u.Validate(context.Background(), k); err != nil || ok {
+		t.Errorf("validate missing user")
+	}
+	if err := u.SetQuota(context.Background(), k, 1); err != ErrUserNotFound {
+		t.Errorf("set quota of missing user error: %v", err)
+	}
+
+	if err := u.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	if ok, err := u.Validate(context.Background(), k); err != nil || !ok {
+		t.Errorf("validate user error")
+	}
+
+	if err := u.Consume(context.Background(), k, ProtocolTCP, 1, 2); err != nil {
+		t.Fatalf("consume error: %v", err)
+	}
+	if up, down, err := u.GetTraffic(context.Background(), k); err != nil || up != 1 || down != 2 {
+		t.Errorf("get traffic error: up %v, down %v, error %v", up, down, err)
+	}
+	if ts, err := u.GetLastSeen(context.Background(), k); err != nil || ts.IsZero() {
+		t.Errorf("last seen after consume error: %v, %v", ts, err)
+	}
+
+	if err := u.ResetTraffic(context.Background(), k); err != nil {
+		t.Fatalf("reset traffic error: %v", err)
+	}
+	if up, down, err := u.GetTraffic(context.Background(), k); err != nil || up != 0 || down != 0 {
+		t.Errorf("get traffic after reset error: up %v, down %v, error %v", up, down, err)
+	}
+
+	// validateScript rejects disabled users
+	if err := u.SetEnabled(context.Background(), k, false); err != nil {
+		t.Fatalf("disable user error: %v", err)
+	}
+	if ok, err := u.Validate(context.Background(), k); err != nil || ok {
+		t.Errorf("validate disabled user")
+	}
+	if err := u.SetEnabled(context.Background(), k, true); err != nil {
+		t.Fatalf("enable user error: %v", err)
+	}
+	if ok, err := u.Validate(context.Background(), k); err != nil || !ok {
+		t.Errorf("validate enabled user error")
+	}
+
+	if err := u.SetQuota(context.Background(), k, 2); err != nil {
+		t.Fatalf("set quota error: %v", err)
+	}
+	u.Consume(context.Background(), k, ProtocolTCP, 1, 2)
+	if !u.QuotaExceeded(context.Background(), k) {
+		t.Errorf("quota is not exceeded")
+	}
+
+	if err := u.Del(context.Background(), "test1234"); err != nil {
+		t.Fatalf("delete user error: %v", err)
+	}
+	if err := u.Consume(context.Background(), k, ProtocolTCP, 1, 2); err != nil {
+		t.Fatalf("consume deleted user error: %v", err)
+	}
+	if _, _, err := u.GetTraffic(context.Background(), k); err != ErrUserNotFound {
+		t.Errorf("consume recreates deleted user: %v", err)
+	}
+}
+
+func TestRedisUpstreamProtocol(t *testing.T) {
+	testProtocol(t, newRedisUpstream(t))
+}
+
+func TestRedisUpstreamTotalTraffic(t *testing.T) {
+	testTotalTraffic(t, newRedisUpstream(t))
+}
+
+func TestRedisUpstreamExpiry(t *testing.T) {
+	testExpiry(t, newRedisUpstream(t))
+}
+
+func TestRedisUpstreamHas(t *testing.T) {
+	testHas(t, newRedisUpstream(t))
+}
+
+func TestRedisUpstreamSourceIP(t *testing.T) {
+	testSourceIP(t, newRedisUpstream(t))
+}
+
+func TestRedisUpstreamAllowedCIDRs(t *testing.T) {
+	testAllowedCIDRs(t, newRedisUpstream(t))
+}
+
+func TestRedisUpstreamListKeys(t *testing.T) {
+	testListKeys(t, newRedisUpstream(t))
+}
+
+func TestRedisUpstreamQuotaEvent(t *testing.T) {
+	testQuotaEvent(t, newRedisUpstream(t))
+}
+
+func TestRedisUpstreamPing(t *testing.T) {
+	// nothing listens on the port
+	u := &RedisUpstream{Address: "127.0.0.1:1"}
+	if err := u.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	defer u.Cleanup()
+	if err := u.Ping(context.Background()); err == nil {
+		t.Errorf("ping unreachable redis")
+	}
+}
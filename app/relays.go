@@ -0,0 +1,120 @@
+package app
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+// defaultGracePeriod is ...
+const defaultGracePeriod = 30 * time.Second
+
+// Relays tracks active relays of trojan app, so that they can be
+// drained when the config is reloaded, and closed when the user is kicked.
+type Relays struct {
+	// KickUsers makes Revoke kick the user.
+	KickUsers bool
+
+	mu       sync.Mutex
+	mm       map[*relay]struct{}
+	draining bool
+	wg       sync.WaitGroup
+}
+
+// relay is ...
+type relay struct {
+	// base64 key of the user
+	key string
+	c   io.Closer
+}
+
+// Add adds an active relay of the user of key k, c is closed if the relay
+// is not done when draining times out or the user is kicked. It returns
+// false when draining, otherwise done must be called when the relay is done.
+func (rs *Relays) Add(k string, c io.Closer) (done func(), ok bool) {
+	if rs == nil {
+		return func() {}, true
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.draining {
+		return nil, false
+	}
+	if rs.mm == nil {
+		rs.mm = make(map[*relay]struct{})
+	}
+	// k may share memory with a read buffer
+	r := &relay{key: string(utils.StringToByteSlice(normalizeKey(k))), c: c}
+	rs.mm[r] = struct{}{}
+	rs.wg.Add(1)
+
+	return func() {
+		rs.mu.Lock()
+		delete(rs.mm, r)
+		rs.mu.Unlock()
+		rs.wg.Done()
+	}, true
+}
+
+// Kick closes all active relays of the user of key k, and returns the
+// number of relays closed. New relays of the user are not rejected, so the
+// user should be deleted or disabled first.
+func (rs *Relays) Kick(k string) int {
+	if rs == nil {
+		return 0
+	}
+	k = normalizeKey(k)
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	n := 0
+	for r := range rs.mm {
+		if r.key == k {
+			r.c.Close()
+			n++
+		}
+	}
+	return n
+}
+
+// Revoke is called when the user of key k is deleted or disabled, it kicks
+// the user if KickUsers is set.
+func (rs *Relays) Revoke(k string) {
+	if rs == nil || !rs.KickUsers {
+		return
+	}
+	rs.Kick(k)
+}
+
+// Drain stops accepting new relays and waits for active relays
+// for at most timeout, then closes the remaining relays.
+func (rs *Relays) Drain(timeout time.Duration) {
+	rs.mu.Lock()
+	rs.draining = true
+	rs.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		rs.wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	}
+
+	rs.mu.Lock()
+	for r := range rs.mm {
+		r.c.Close()
+	}
+	rs.mu.Unlock()
+	<-done
+}
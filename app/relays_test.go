@@ -0,0 +1,111 @@
+package app
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+// closer records whether it is closed.
+type closer chan struct{}
+
+// Close is ...
+func (c closer) Close() error {
+	close(c)
+	return nil
+}
+
+func TestRelaysDrain(t *testing.T) {
+	rs := &Relays{}
+
+	// a relay finishing in the grace period is not closed
+	c1 := make(closer)
+	done, ok := rs.Add("test1234", c1)
+	if !ok {
+		t.Fatalf("add relay error")
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		done()
+	}()
+	rs.Drain(time.Second)
+	select {
+	case <-c1:
+		t.Errorf("relay finished in grace period is closed")
+	default:
+	}
+
+	if _, ok := rs.Add("test1234", make(closer)); ok {
+		t.Errorf("add relay when draining")
+	}
+
+	// a relay not finishing in the grace period is closed
+	rs = &Relays{}
+	c2 := make(closer)
+	done, _ = rs.Add("test1234", c2)
+	go func() {
+		<-c2
+		done()
+	}()
+	rs.Drain(50 * time.Millisecond)
+	select {
+	case <-c2:
+	default:
+		t.Errorf("relay not finished in grace period is not closed")
+	}
+}
+
+func TestRelaysKick(t *testing.T) {
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+
+	rs := &Relays{}
+	c1, c2, c3 := make(closer), make(closer), make(closer)
+	for _, v := range []struct {
+		Key string
+		C   closer
+	}{
+		{Key: string(key[:]), C: c1},
+		{Key: base64.StdEncoding.EncodeToString(key[:]), C: c2},
+		{Key: "test5678", C: c3},
+	} {
+		if _, ok := rs.Add(v.Key, v.C); !ok {
+			t.Fatalf("add relay error")
+		}
+	}
+
+	// Revoke does not kick users without KickUsers
+	rs.Revoke(string(key[:]))
+	select {
+	case <-c1:
+		t.Errorf("relay is closed by Revoke without KickUsers")
+	default:
+	}
+
+	// raw and base64 keys are the same user
+	if n := rs.Kick(base64.StdEncoding.EncodeToString(key[:])); n != 2 {
+		t.Errorf("kick user error: %v relays, want 2", n)
+	}
+	for _, c := range []closer{c1, c2} {
+		select {
+		case <-c:
+		default:
+			t.Errorf("relay of kicked user is not closed")
+		}
+	}
+	select {
+	case <-c3:
+		t.Errorf("relay of other user is closed")
+	default:
+	}
+
+	rs.KickUsers = true
+	rs.Revoke("test5678")
+	select {
+	case <-c3:
+	default:
+		t.Errorf("relay is not closed by Revoke with KickUsers")
+	}
+}
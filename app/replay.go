@@ -0,0 +1,69 @@
+package app
+
+import (
+	"sync"
+	"time"
+
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+// Replays detects replays of trojan headers, shared by all handlers and
+// listeners of trojan app. The trojan header of a user is a static hash,
+// so a captured handshake can be replayed. Replays remembers the source
+// address of each user within Window, and a header from another source
+// within Window is taken as a replay.
+//
+// It is best-effort: a replay from the same address is not detected, and
+// a user connecting from two addresses within Window is rejected.
+type Replays struct {
+	// Window is the time a source address of a user is remembered,
+	// 0 disables detection.
+	Window time.Duration
+
+	mu sync.Mutex
+	mm map[string]replaySource
+	// the time expired sources were last swept
+	swept time.Time
+}
+
+// replaySource is the last source address of a user.
+type replaySource struct {
+	host string
+	seen time.Time
+}
+
+// Check records a connection of the user from addr, and returns false if it
+// is a replay of a connection from another source within Window.
+func (r *Replays) Check(k string, addr string) bool {
+	if r == nil || r.Window <= 0 {
+		return true
+	}
+	k = normalizeKey(k)
+	host := hostOf(addr)
+
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mm == nil {
+		r.mm = make(map[string]replaySource)
+	}
+	if now.Sub(r.swept) >= r.Window {
+		r.sweep(now)
+	}
+	if v, ok := r.mm[k]; ok && v.host != host && now.Sub(v.seen) < r.Window {
+		return false
+	}
+	// k may share memory with a read buffer
+	r.mm[string(utils.StringToByteSlice(k))] = replaySource{host: host, seen: now}
+	return true
+}
+
+// sweep deletes sources which are not seen within Window.
+func (r *Replays) sweep(now time.Time) {
+	for k, v := range r.mm {
+		if now.Sub(v.seen) >= r.Window {
+			delete(r.mm, k)
+		}
+	}
+	r.swept = now
+}
@@ -0,0 +1,57 @@
+package app
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+func TestReplaysCheck(t *testing.T) {
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := utils.ByteSliceToString(key[:])
+
+	r := &Replays{Window: time.Minute}
+	for _, v := range []struct {
+		Addr string
+		Ok   bool
+	}{
+		{Addr: "192.0.2.1:1000", Ok: true},
+		// another connection of the client
+		{Addr: "192.0.2.1:1001", Ok: true},
+		{Addr: "198.51.100.1:1000", Ok: false},
+		{Addr: "[2001:db8::1]:1000", Ok: false},
+		{Addr: "192.0.2.1:1002", Ok: true},
+	} {
+		if ok := r.Check(k, v.Addr); ok != v.Ok {
+			t.Errorf("check %v error: got %v, want %v", v.Addr, ok, v.Ok)
+		}
+	}
+
+	// the source is forgotten after the window
+	r.mm[base64.StdEncoding.EncodeToString(key[:])] = replaySource{host: "192.0.2.1", seen: time.Now().Add(-time.Minute)}
+	if !r.Check(k, "198.51.100.1:1000") {
+		t.Errorf("reject a connection after the window")
+	}
+	if r.Check(k, "192.0.2.1:1000") {
+		t.Errorf("accept a replay of the new source")
+	}
+
+	// expired sources are swept
+	r.swept = time.Now().Add(-time.Minute)
+	r.mm["expired"] = replaySource{host: "192.0.2.1", seen: time.Now().Add(-time.Hour)}
+	r.Check(k, "198.51.100.1:1000")
+	if _, ok := r.mm["expired"]; ok {
+		t.Errorf("expired source is not swept")
+	}
+
+	// disabled
+	for _, r := range []*Replays{nil, {}} {
+		if !r.Check(k, "192.0.2.1:1000") || !r.Check(k, "198.51.100.1:1000") {
+			t.Errorf("disabled replays rejects a connection")
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// resetStorageKey is the storage key of the start of the last period whose
+// traffic is reset. It is not under the prefix of CaddyUpstream, so it is
+// never listed as a user.
+const resetStorageKey = "trojan-reset/last_reset"
+
+// resetCheckInterval is the interval of checking whether a new period starts.
+const resetCheckInterval = time.Minute
+
+// ResetSchedule resets traffic of all users at the start of each billing
+// period, which is 00:00 of Day in the local time zone of each month.
+// The start of the last reset period is kept in caddy storage, so a restart
+// does not reset a period twice or skip it, and caddy instances sharing
+// the storage reset a period once. When there is no record, e.g. the first
+// start, the current period is recorded without a reset.
+type ResetSchedule struct {
+	// Day is the day of month to reset traffic, 1 to 31. Months without the
+	// day reset on their last day.
+	Day int `json:"day"`
+
+	up      Upstream
+	storage certmagic.Storage
+	lg      *zap.Logger
+
+	closed chan struct{}
+	wg     *sync.WaitGroup
+}
+
+// Provision is ...
+func (s *ResetSchedule) Provision(up Upstream, storage certmagic.Storage, lg *zap.Logger) error {
+	if s.Day < 1 || s.Day > 31 {
+		return fmt.Errorf("invalid day of reset_schedule: %v", s.Day)
+	}
+	s.up, s.storage, s.lg = up, storage, lg
+	return nil
+}
+
+// Start is ...
+func (s *ResetSchedule) Start() {
+	s.closed = make(chan struct{})
+	s.wg = &sync.WaitGroup{}
+
+	s.wg.Add(1)
+	go s.loop()
+}
+
+// Stop is ...
+func (s *ResetSchedule) Stop() {
+	if s.closed == nil {
+		return
+	}
+	close(s.closed)
+	s.wg.Wait()
+}
+
+// loop is ...
+func (s *ResetSchedule) loop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(resetCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.check(context.Background(), time.Now()); err != nil {
+			s.lg.Error(fmt.Sprintf("reset traffic error: %v", err))
+		}
+
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// periodStart returns the start of the period which t is in.
+func (s *ResetSchedule) periodStart(t time.Time) time.Time {
+	start := func(y int, m time.Month) time.Time {
+		day := s.Day
+		// the day 0 of next month is the last day of this month
+		if last := time.Date(y, m+1, 0, 0, 0, 0, 0, t.Location()).Day(); day > last {
+			day = last
+		}
+		return time.Date(y, m, day, 0, 0, 0, 0, t.Location())
+	}
+
+	y, m, _ := t.Date()
+	if v := start(y, m); !t.Before(v) {
+		return v
+	}
+	return start(y, m-1)
+}
+
+// check resets traffic of all users if the period of now is not reset.
+func (s *ResetSchedule) check(ctx context.Context, now time.Time) error {
+	if err := s.storage.Lock(ctx, resetStorageKey); err != nil {
+		return fmt.Errorf("lock %v error: %w", resetStorageKey, err)
+	}
+	defer s.storage.Unlock(ctx, resetStorageKey)
+
+	start := s.periodStart(now)
+
+	b, err := s.storage.Load(ctx, resetStorageKey)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("load %v error: %w", resetStorageKey, err)
+		}
+		return s.storage.Store(ctx, resetStorageKey, []byte(start.Format(time.RFC3339)))
+	}
+	last, err := time.Parse(time.RFC3339, string(b))
+	if err != nil {
+		return fmt.Errorf("parse %v error: %w", resetStorageKey, err)
+	}
+	if !last.Before(start) {
+		return nil
+	}
+
+	if err := s.reset(ctx); err != nil {
+		// not recorded, so retry next time
+		return err
+	}
+	s.lg.Info(fmt.Sprintf("reset traffic of all users for period starting at %v", start.Format(time.RFC3339)))
+	return s.storage.Store(ctx, resetStorageKey, []byte(start.Format(time.RFC3339)))
+}
+
+// reset resets traffic of all users. Keys are collected first, as an
+// upstream may hold a lock while calling fn of Range. Traffic consumed by
+// active connections before a user is reset is dropped, and after is kept.
+func (s *ResetSchedule) reset(ctx context.Context) error {
+	keys := []string{}
+	if err := s.up.Range(ctx, func(k string, _ Traffic) {
+		keys = append(keys, k)
+	}); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := s.up.ResetTraffic(ctx, k); err != nil {
+			return fmt.Errorf("reset traffic of user %v error: %w", k, err)
+		}
+	}
+	return nil
+}
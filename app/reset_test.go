@@ -0,0 +1,79 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+func TestResetSchedulePeriodStart(t *testing.T) {
+	for _, v := range []struct {
+		Day   int
+		Time  time.Time
+		Start time.Time
+	}{
+		{Day: 1, Time: time.Date(2022, 3, 15, 12, 0, 0, 0, time.UTC), Start: time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{Day: 1, Time: time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC), Start: time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{Day: 15, Time: time.Date(2022, 3, 14, 23, 59, 0, 0, time.UTC), Start: time.Date(2022, 2, 15, 0, 0, 0, 0, time.UTC)},
+		{Day: 15, Time: time.Date(2022, 1, 10, 0, 0, 0, 0, time.UTC), Start: time.Date(2021, 12, 15, 0, 0, 0, 0, time.UTC)},
+		// months without the day reset on their last day
+		{Day: 31, Time: time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC), Start: time.Date(2022, 2, 28, 0, 0, 0, 0, time.UTC)},
+		{Day: 31, Time: time.Date(2022, 4, 30, 1, 0, 0, 0, time.UTC), Start: time.Date(2022, 4, 30, 0, 0, 0, 0, time.UTC)},
+		{Day: 31, Time: time.Date(2022, 3, 31, 0, 0, 0, 0, time.UTC), Start: time.Date(2022, 3, 31, 0, 0, 0, 0, time.UTC)},
+	} {
+		s := &ResetSchedule{Day: v.Day}
+		if start := s.periodStart(v.Time); !start.Equal(v.Start) {
+			t.Errorf("period start of day %v at %v error: got %v, want %v", v.Day, v.Time, start, v.Start)
+		}
+	}
+}
+
+func TestResetSchedule(t *testing.T) {
+	u := &MemoryUpstream{}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := utils.ByteSliceToString(key[:])
+	if err := u.AddKey(context.Background(), k); err != nil {
+		t.Fatalf("add key error: %v", err)
+	}
+
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	newSchedule := func() *ResetSchedule {
+		s := &ResetSchedule{Day: 1}
+		if err := s.Provision(u, storage, zap.NewNop()); err != nil {
+			t.Fatalf("provision error: %v", err)
+		}
+		return s
+	}
+	check := func(s *ResetSchedule, now time.Time, up, down int64) {
+		t.Helper()
+		if err := s.check(context.Background(), now); err != nil {
+			t.Fatalf("check at %v error: %v", now, err)
+		}
+		if nr, nw, err := u.GetTraffic(context.Background(), k); err != nil || nr != up || nw != down {
+			t.Errorf("traffic at %v error: got %v, %v, %v, want %v, %v", now, nr, nw, err, up, down)
+		}
+	}
+
+	s := newSchedule()
+	u.Consume(context.Background(), k, ProtocolTCP, 1, 2)
+	// the first period is recorded without a reset
+	check(s, time.Date(2022, 3, 15, 0, 0, 0, 0, time.UTC), 1, 2)
+	check(s, time.Date(2022, 3, 31, 23, 59, 0, 0, time.UTC), 1, 2)
+	check(s, time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC), 0, 0)
+
+	// a restart in the same period does not reset again
+	u.Consume(context.Background(), k, ProtocolTCP, 1, 2)
+	s = newSchedule()
+	check(s, time.Date(2022, 4, 1, 0, 1, 0, 0, time.UTC), 1, 2)
+
+	// a restart after the start of a period resets it
+	s = newSchedule()
+	check(s, time.Date(2022, 5, 3, 0, 0, 0, 0, time.UTC), 0, 0)
+}
@@ -0,0 +1,57 @@
+package app
+
+import (
+	"fmt"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+// KeyScheme selects the scheme which derives trojan headers from passwords
+// of Add and Del, registered by trojan.RegisterKeyScheme. Users are stored by
+// their headers, so the users of an upstream stay valid only with the scheme
+// which added them.
+type KeyScheme struct {
+	// Scheme is the name of the scheme, default is sha224 of trojan.
+	Scheme string `json:"key_scheme,omitempty"`
+
+	fn trojan.KeyFunc
+}
+
+// Provision looks up the scheme.
+func (k *KeyScheme) Provision() error {
+	if k.Scheme == "" {
+		return nil
+	}
+	fn, ok := trojan.LookupKeyScheme(k.Scheme)
+	if !ok {
+		return fmt.Errorf("unknown key_scheme: %v", k.Scheme)
+	}
+	k.fn = fn
+	return nil
+}
+
+// GenKey derives the trojan header of the password by the scheme.
+func (k *KeyScheme) GenKey(s string, key []byte) {
+	if k.fn == nil {
+		trojan.GenKey(s, key)
+		return
+	}
+	k.fn(s, key)
+}
+
+// KeyGenerator is an Upstream which derives trojan headers from passwords
+// by its own scheme.
+type KeyGenerator interface {
+	// GenKey is ...
+	GenKey(string, []byte)
+}
+
+// GenKey derives the trojan header of the password by the scheme of the
+// upstream, so users added by headers match users added by passwords.
+func GenKey(up Upstream, s string, key []byte) {
+	if kg, ok := up.(KeyGenerator); ok {
+		kg.GenKey(s, key)
+		return
+	}
+	trojan.GenKey(s, key)
+}
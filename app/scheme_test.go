@@ -0,0 +1,69 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+// genSaltedKey is a scheme of trojan headers of a fork, which salts passwords.
+func genSaltedKey(s string, key []byte) {
+	hash := sha256.Sum224([]byte("salt:" + s))
+	hex.Encode(key, hash[:])
+}
+
+func init() {
+	trojan.RegisterKeyScheme("salted", genSaltedKey)
+}
+
+func TestKeyScheme(t *testing.T) {
+	standard, salted := [trojan.HeaderLen]byte{}, [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", standard[:])
+	genSaltedKey("test1234", salted[:])
+
+	for _, v := range []struct {
+		Scheme string
+		Key    []byte
+		Other  []byte
+	}{
+		{Scheme: "", Key: standard[:], Other: salted[:]},
+		{Scheme: trojan.DefaultKeyScheme, Key: standard[:], Other: salted[:]},
+		{Scheme: "salted", Key: salted[:], Other: standard[:]},
+	} {
+		u := &MemoryUpstream{KeyScheme: KeyScheme{Scheme: v.Scheme}}
+		if err := u.KeyScheme.Provision(); err != nil {
+			t.Fatalf("provision key scheme %v error: %v", v.Scheme, err)
+		}
+		if err := u.Add(context.Background(), "test1234"); err != nil {
+			t.Fatalf("add user error: %v", err)
+		}
+		if ok, _ := u.Validate(context.Background(), utils.ByteSliceToString(v.Key)); !ok {
+			t.Errorf("user of key scheme %q is not valid", v.Scheme)
+		}
+		if ok, _ := u.Validate(context.Background(), utils.ByteSliceToString(v.Other)); ok {
+			t.Errorf("user of another key scheme is valid for %q", v.Scheme)
+		}
+
+		// the key of a password is derived by the scheme of the upstream
+		key := [trojan.HeaderLen]byte{}
+		GenKey(&MultiUpstream{primary: u}, "test1234", key[:])
+		if string(key[:]) != string(v.Key) {
+			t.Errorf("gen key of key scheme %q error: got %s, want %s", v.Scheme, key[:], v.Key)
+		}
+
+		if err := u.Del(context.Background(), "test1234"); err != nil {
+			t.Fatalf("delete user error: %v", err)
+		}
+		if n, _ := u.Count(context.Background()); n != 0 {
+			t.Errorf("user of key scheme %q is not deleted", v.Scheme)
+		}
+	}
+
+	if err := (&KeyScheme{Scheme: "unknown"}).Provision(); err == nil {
+		t.Errorf("provision unknown key scheme")
+	}
+}
@@ -0,0 +1,102 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+// UpstreamStep is a step of TestUpstream.
+type UpstreamStep struct {
+	// Name is the name of the step, like ping, add, validate, del and has.
+	Name string `json:"name"`
+	// Took is the time taken by the step.
+	Took string `json:"took"`
+	// Error is the error of the step, empty if it succeeded.
+	Error string `json:"error,omitempty"`
+}
+
+// TestUpstream checks the upstream works before going live. It pings the
+// upstream, and does Add, Validate and Del of the password, and checks the
+// user is deleted. If the password is empty, a random throwaway one is
+// used. If the user of the password exists, it is only validated, and is
+// neither added nor deleted. It returns the steps done in order, and the
+// error of the last one if it failed.
+func TestUpstream(ctx context.Context, up Upstream, password string) ([]UpstreamStep, error) {
+	steps := []UpstreamStep{}
+	// step runs fn as the step of the name
+	step := func(name string, fn func() error) error {
+		start := time.Now()
+		err := fn()
+		s := UpstreamStep{Name: name, Took: time.Since(start).String()}
+		if err != nil {
+			s.Error = err.Error()
+		}
+		steps = append(steps, s)
+		return err
+	}
+
+	if password == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return steps, fmt.Errorf("generate password error: %w", err)
+		}
+		password = hex.EncodeToString(b)
+	}
+	key := [trojan.HeaderLen]byte{}
+	GenKey(up, password, key[:])
+	k := utils.ByteSliceToString(key[:])
+
+	if err := step("ping", func() error { return up.Ping(ctx) }); err != nil {
+		return steps, err
+	}
+	exists := false
+	if err := step("has", func() (err error) {
+		exists, err = up.Has(ctx, k)
+		return
+	}); err != nil {
+		return steps, err
+	}
+	// validate checks the user is valid
+	validate := func() error {
+		ok, err := up.Validate(ctx, k)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("user is not valid")
+		}
+		return nil
+	}
+	if exists {
+		return steps, step("validate", validate)
+	}
+
+	if err := step("add", func() error { return up.Add(ctx, password) }); err != nil {
+		return steps, err
+	}
+	if err := step("validate", validate); err != nil {
+		// the user is deleted anyway
+		up.Del(ctx, password)
+		return steps, err
+	}
+	if err := step("del", func() error { return up.Del(ctx, password) }); err != nil {
+		return steps, err
+	}
+	return steps, step("has", func() error {
+		ok, err := up.Has(ctx, k)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return errors.New("user is not deleted")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,70 @@
+package app
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+// invalidUpstream is an Upstream which validates no user.
+type invalidUpstream struct {
+	*MemoryUpstream
+}
+
+// Validate is ...
+func (invalidUpstream) Validate(ctx context.Context, k string) (bool, error) {
+	return false, nil
+}
+
+func TestTestUpstream(t *testing.T) {
+	// names returns the names of the steps
+	names := func(steps []UpstreamStep) string {
+		ss := []string{}
+		for _, v := range steps {
+			ss = append(ss, v.Name)
+		}
+		return strings.Join(ss, " ")
+	}
+
+	up := &MemoryUpstream{}
+	steps, err := TestUpstream(context.Background(), up, "")
+	if err != nil || names(steps) != "ping has add validate del has" {
+		t.Errorf("test upstream error: %v, %v", names(steps), err)
+	}
+	if n, _ := up.Count(context.Background()); n != 0 {
+		t.Errorf("throwaway user is not deleted")
+	}
+
+	// an existing user is only validated
+	if err := up.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	steps, err = TestUpstream(context.Background(), up, "test1234")
+	if err != nil || names(steps) != "ping has validate" {
+		t.Errorf("test upstream of an existing user error: %v, %v", names(steps), err)
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	if ok, _ := up.Has(context.Background(), utils.ByteSliceToString(key[:])); !ok {
+		t.Errorf("existing user is deleted")
+	}
+	if err := up.SetEnabled(context.Background(), utils.ByteSliceToString(key[:]), false); err != nil {
+		t.Fatalf("disable user error: %v", err)
+	}
+	if _, err := TestUpstream(context.Background(), up, "test1234"); err == nil {
+		t.Errorf("test upstream of a disabled user without error")
+	}
+
+	// the user is deleted if it fails to validate
+	invalid := invalidUpstream{MemoryUpstream: &MemoryUpstream{}}
+	steps, err = TestUpstream(context.Background(), invalid, "")
+	if err == nil || names(steps) != "ping has add validate" || steps[3].Error == "" {
+		t.Errorf("test invalid upstream error: %v, %v", names(steps), err)
+	}
+	if n, _ := invalid.Count(context.Background()); n != 0 {
+		t.Errorf("throwaway user of invalid upstream is not deleted")
+	}
+}
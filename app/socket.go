@@ -0,0 +1,50 @@
+package app
+
+import (
+	"net"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// defaultKeepAlive is ...
+const defaultKeepAlive = 30 * time.Second
+
+// SocketOptions sets options of TCP sockets of clients and destinations.
+// Connections which are not TCP, such as streams of http2, are skipped.
+type SocketOptions struct {
+	// NoDelay disables Nagle's algorithm for interactive traffic, default is true.
+	NoDelay *bool `json:"tcp_nodelay,omitempty"`
+	// KeepAlive is the period of TCP keepalive, default is 30s,
+	// negative disables keepalive.
+	KeepAlive caddy.Duration `json:"tcp_keepalive,omitempty"`
+}
+
+// Apply sets the options to the TCP socket of c, which may be wrapped by
+// TLS. A nil *SocketOptions does nothing.
+func (o *SocketOptions) Apply(c net.Conn) {
+	if o == nil {
+		return
+	}
+	for {
+		switch cc := c.(type) {
+		case *net.TCPConn:
+			cc.SetNoDelay(o.NoDelay == nil || *o.NoDelay)
+			if o.KeepAlive < 0 {
+				cc.SetKeepAlive(false)
+				return
+			}
+			period := time.Duration(o.KeepAlive)
+			if period == 0 {
+				period = defaultKeepAlive
+			}
+			cc.SetKeepAlive(true)
+			cc.SetKeepAlivePeriod(period)
+			return
+		case interface{ NetConn() net.Conn }:
+			c = cc.NetConn()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package app
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+// sockopt returns an int option of the socket of c.
+func sockopt(t *testing.T, c *net.TCPConn, level, opt int) int {
+	t.Helper()
+
+	rc, err := c.SyscallConn()
+	if err != nil {
+		t.Fatalf("syscall conn error: %v", err)
+	}
+	v, er := 0, error(nil)
+	if err := rc.Control(func(fd uintptr) {
+		v, er = syscall.GetsockoptInt(int(fd), level, opt)
+	}); err != nil {
+		t.Fatalf("control error: %v", err)
+	}
+	if er != nil {
+		t.Fatalf("getsockopt error: %v", er)
+	}
+	return v
+}
+
+func TestSocketOptions(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer ln.Close()
+
+	off := false
+	for _, v := range []struct {
+		Name    string
+		Options *SocketOptions
+		// Wrap wraps the TCP connection.
+		Wrap      func(net.Conn) net.Conn
+		NoDelay   int
+		KeepAlive int
+		// Idle is the keepalive period in seconds.
+		Idle int
+	}{
+		{Name: "default", Options: &SocketOptions{}, NoDelay: 1, KeepAlive: 1, Idle: 30},
+		{Name: "wrapped", Options: &SocketOptions{KeepAlive: caddy.Duration(10 * time.Second)}, Wrap: func(c net.Conn) net.Conn {
+			return utils.NewRawConn(c, []byte("GET"))
+		}, NoDelay: 1, KeepAlive: 1, Idle: 10},
+		{Name: "off", Options: &SocketOptions{NoDelay: &off, KeepAlive: -1}, NoDelay: 0, KeepAlive: 0},
+	} {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("dial error: %v", err)
+		}
+		tc := c.(*net.TCPConn)
+		// the opposite of the options
+		tc.SetNoDelay(v.NoDelay == 0)
+		tc.SetKeepAlive(v.KeepAlive == 0)
+
+		if v.Wrap != nil {
+			c = v.Wrap(c)
+		}
+		v.Options.Apply(c)
+
+		if got := sockopt(t, tc, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); (got != 0) != (v.NoDelay != 0) {
+			t.Errorf("tcp_nodelay of %v error: got %v, want %v", v.Name, got, v.NoDelay)
+		}
+		if got := sockopt(t, tc, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); (got != 0) != (v.KeepAlive != 0) {
+			t.Errorf("tcp_keepalive of %v error: got %v, want %v", v.Name, got, v.KeepAlive)
+		}
+		if v.Idle != 0 {
+			if got := sockopt(t, tc, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); got != v.Idle {
+				t.Errorf("tcp_keepalive period of %v error: got %v, want %v", v.Name, got, v.Idle)
+			}
+		}
+		c.Close()
+	}
+
+	// connections which are not TCP are skipped
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	(&SocketOptions{}).Apply(c1)
+	(*SocketOptions)(nil).Apply(c1)
+}
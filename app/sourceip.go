@@ -0,0 +1,39 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ErrSourceIPNotBound is ...
+var ErrSourceIPNotBound = errors.New("source ip is not bound to the host")
+
+// interfaceAddrs returns addresses of interfaces of the host.
+var interfaceAddrs = net.InterfaceAddrs
+
+// checkSourceIP checks ip is an address of an interface of the host, so
+// connections can be dialed from it. nil is the default route.
+func checkSourceIP(ip net.IP) error {
+	if ip == nil {
+		return nil
+	}
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return fmt.Errorf("list interface addresses error: %w", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %v", ErrSourceIPNotBound, ip)
+}
+
+// sourceIPString is the stored form of ip, empty for nil.
+func sourceIPString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
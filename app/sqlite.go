@@ -0,0 +1,692 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+
+	// register sqlite driver
+	_ "modernc.org/sqlite"
+
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+func init() {
+	caddy.RegisterModule(SQLiteUpstream{})
+}
+
+// SQLiteUpstream is ...
+type SQLiteUpstream struct {
+	// Path is ...
+	Path string `json:"path,omitempty"`
+	// FlushInterval is ...
+	FlushInterval caddy.Duration `json:"flush_interval,omitempty"`
+	KeyScheme
+
+	db *sql.DB
+	lg *zap.Logger
+
+	// pending traffic which is not flushed to database
+	pt *pendingTraffic
+
+	closed chan struct{}
+	wg     *sync.WaitGroup
+}
+
+// CaddyModule is ...
+func (SQLiteUpstream) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "trojan.upstreams.sqlite",
+		New: func() caddy.Module { return new(SQLiteUpstream) },
+	}
+}
+
+// Provision is ...
+func (u *SQLiteUpstream) Provision(ctx caddy.Context) error {
+	if err := u.KeyScheme.Provision(); err != nil {
+		return err
+	}
+	if u.Path == "" {
+		return errors.New("sqlite database path is not configured")
+	}
+	if u.FlushInterval == 0 {
+		u.FlushInterval = caddy.Duration(5 * time.Second)
+	}
+	u.lg = ctx.Logger(u)
+
+	db, err := sql.Open("sqlite", u.Path)
+	if err != nil {
+		return err
+	}
+	// sqlite only allows one writer at a time
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS users(key TEXT PRIMARY KEY, up INTEGER NOT NULL DEFAULT 0, down INTEGER NOT NULL DEFAULT 0)"); err != nil {
+		db.Close()
+		return fmt.Errorf("create users table error: %w", err)
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return fmt.Errorf("migrate users table error: %w", err)
+	}
+	// one row of the traffic of all users
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS total(id INTEGER PRIMARY KEY CHECK (id = 0), up INTEGER NOT NULL DEFAULT 0, down INTEGER NOT NULL DEFAULT 0, up_udp INTEGER NOT NULL DEFAULT 0, down_udp INTEGER NOT NULL DEFAULT 0)"); err != nil {
+		db.Close()
+		return fmt.Errorf("create total table error: %w", err)
+	}
+	if _, err := db.Exec("INSERT OR IGNORE INTO total(id) VALUES(0)"); err != nil {
+		db.Close()
+		return fmt.Errorf("create total table error: %w", err)
+	}
+	u.db = db
+	u.pt = &pendingTraffic{}
+	u.closed = make(chan struct{})
+	u.wg = &sync.WaitGroup{}
+
+	u.wg.Add(1)
+	go u.loop()
+
+	return nil
+}
+
+// columns added to users table after the first release
+var columns = []struct {
+	Name       string
+	Definition string
+}{
+	{Name: "quota", Definition: "INTEGER NOT NULL DEFAULT 0"},
+	{Name: "enabled", Definition: "INTEGER NOT NULL DEFAULT 1"},
+	{Name: "rate_limit", Definition: "INTEGER NOT NULL DEFAULT 0"},
+	// unix seconds, 0 if never seen
+	{Name: "last_seen", Definition: "INTEGER NOT NULL DEFAULT 0"},
+	// JSON, empty if there is no label
+	{Name: "labels", Definition: "TEXT NOT NULL DEFAULT ''"},
+	// parts of up and down relayed by UDP
+	{Name: "up_udp", Definition: "INTEGER NOT NULL DEFAULT 0"},
+	{Name: "down_udp", Definition: "INTEGER NOT NULL DEFAULT 0"},
+	// unix seconds, 0 if never expires
+	{Name: "expires_at", Definition: "INTEGER NOT NULL DEFAULT 0"},
+	// 1 if quota_exceeded event is fired since quota is set or traffic is reset
+	{Name: "quota_notified", Definition: "INTEGER NOT NULL DEFAULT 0"},
+	// empty for the default route
+	{Name: "source_ip", Definition: "TEXT NOT NULL DEFAULT ''"},
+	// separated by commas, empty for all
+	{Name: "allowed_cidrs", Definition: "TEXT NOT NULL DEFAULT ''"},
+}
+
+// migrate adds missing columns to users table created by older versions.
+func migrate(db *sql.DB) error {
+	rows, err := db.Query("PRAGMA table_info(users)")
+	if err != nil {
+		return err
+	}
+	exists := map[string]bool{}
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			typ       string
+			notnull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notnull, &dfltValue, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		exists[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, v := range columns {
+		if exists[v.Name] {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE users ADD COLUMN %s %s", v.Name, v.Definition)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Cleanup is ...
+func (u *SQLiteUpstream) Cleanup() error {
+	if u.closed == nil {
+		// provision failed
+		return nil
+	}
+	close(u.closed)
+	u.wg.Wait()
+	if err := u.Flush(); err != nil {
+		u.lg.Error(fmt.Sprintf("flush traffic error: %v", err))
+	}
+	return u.db.Close()
+}
+
+// loop is ...
+func (u *SQLiteUpstream) loop() {
+	defer u.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(u.FlushInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-u.closed:
+			return
+		case <-ticker.C:
+			if err := u.Flush(); err != nil {
+				u.lg.Error(fmt.Sprintf("flush traffic error: %v", err))
+			}
+		}
+	}
+}
+
+// Flush writes accumulated traffic to database.
+func (u *SQLiteUpstream) Flush() error {
+	u.pt.flush.Lock()
+	defer u.pt.flush.Unlock()
+
+	mm := u.pt.take()
+
+	if len(mm) == 0 {
+		return nil
+	}
+
+	crossed := map[string]Traffic{}
+	err := func() error {
+		tx, err := u.db.Begin()
+		if err != nil {
+			return err
+		}
+		total := Traffic{}
+		for k, v := range mm {
+			res, err := tx.Exec("UPDATE users SET up = up + ?, down = down + ?, up_udp = up_udp + ?, down_udp = down_udp + ?, last_seen = MAX(last_seen, ?) WHERE key = ?", v.Up, v.Down, v.UpUDP, v.DownUDP, unixSeconds(v.LastSeen), k)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			if n, err := res.RowsAffected(); err == nil && n > 0 {
+				total.merge(v)
+			}
+			res, err = tx.Exec("UPDATE users SET quota_notified = 1 WHERE key = ? AND quota > 0 AND up + down >= quota AND quota_notified = 0", k)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			if n, err := res.RowsAffected(); err != nil || n == 0 {
+				continue
+			}
+			traffic := Traffic{QuotaNotified: true}
+			if err := tx.QueryRow("SELECT up, down, quota FROM users WHERE key = ?", k).Scan(&traffic.Up, &traffic.Down, &traffic.Quota); err != nil {
+				tx.Rollback()
+				return err
+			}
+			crossed[k] = traffic
+		}
+		if _, err := tx.Exec("UPDATE total SET up = up + ?, down = down + ?, up_udp = up_udp + ?, down_udp = down_udp + ? WHERE id = 0", total.Up, total.Down, total.UpUDP, total.DownUDP); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		// put traffic back and retry next time
+		for k, v := range mm {
+			u.pt.add(k, v)
+		}
+		return err
+	}
+	for k, v := range crossed {
+		emitQuotaExceeded(k, v)
+	}
+	return nil
+}
+
+// AddKey is ...
+func (u *SQLiteUpstream) AddKey(ctx context.Context, k string) error {
+	key := base64.StdEncoding.EncodeToString(utils.StringToByteSlice(k))
+	_, err := u.db.ExecContext(ctx, "INSERT OR IGNORE INTO users(key, up, down) VALUES(?, 0, 0)", key)
+	return err
+}
+
+// Add is ...
+func (u *SQLiteUpstream) Add(ctx context.Context, s string) error {
+	b := [trojan.HeaderLen]byte{}
+	u.GenKey(s, b[:])
+	return u.AddKey(ctx, utils.ByteSliceToString(b[:]))
+}
+
+// DelKey is ...
+func (u *SQLiteUpstream) DelKey(ctx context.Context, k string) error {
+	key := base64.StdEncoding.EncodeToString(utils.StringToByteSlice(k))
+	u.pt.flush.Lock()
+	defer u.pt.flush.Unlock()
+	u.pt.del(key)
+	_, err := u.db.ExecContext(ctx, "DELETE FROM users WHERE key = ?", key)
+	return err
+}
+
+// AddKeys is ...
+func (u *SQLiteUpstream) AddKeys(ctx context.Context, keys []string) error {
+	return u.batch(ctx, "INSERT OR IGNORE INTO users(key, up, down) VALUES(?, 0, 0)", keys)
+}
+
+// DelKeys is ...
+func (u *SQLiteUpstream) DelKeys(ctx context.Context, keys []string) error {
+	u.pt.flush.Lock()
+	defer u.pt.flush.Unlock()
+	for _, k := range keys {
+		u.pt.del(base64.StdEncoding.EncodeToString(utils.StringToByteSlice(k)))
+	}
+	return u.batch(ctx, "DELETE FROM users WHERE key = ?", keys)
+}
+
+// batch executes query with every key in a transaction.
+func (u *SQLiteUpstream) batch(ctx context.Context, query string, keys []string) error {
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, k := range keys {
+		if _, err := stmt.ExecContext(ctx, base64.StdEncoding.EncodeToString(utils.StringToByteSlice(k))); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Del is ...
+func (u *SQLiteUpstream) Del(ctx context.Context, s string) error {
+	b := [trojan.HeaderLen]byte{}
+	u.GenKey(s, b[:])
+	return u.DelKey(ctx, utils.ByteSliceToString(b[:]))
+}
+
+// Range is ...
+func (u *SQLiteUpstream) Range(ctx context.Context, fn func(k string, traffic Traffic)) error {
+	rows, err := u.db.QueryContext(ctx, "SELECT key, up, down, up_udp, down_udp, quota, enabled, rate_limit, last_seen, labels, expires_at, source_ip, allowed_cidrs FROM users")
+	if err != nil {
+		return fmt.Errorf("load users error: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		k, traffic, sec, labels, expires, cidrs := "", Traffic{}, int64(0), "", int64(0), ""
+		if err := rows.Scan(&k, &traffic.Up, &traffic.Down, &traffic.UpUDP, &traffic.DownUDP, &traffic.Quota, &traffic.Enabled, &traffic.RateLimit, &sec, &labels, &expires, &traffic.SourceIP, &cidrs); err != nil {
+			return fmt.Errorf("load user error: %w", err)
+		}
+		if sec > 0 {
+			traffic.LastSeen = time.Unix(sec, 0)
+		}
+		if expires > 0 {
+			traffic.ExpiresAt = time.Unix(expires, 0)
+		}
+		if traffic.Labels, err = parseLabels(labels); err != nil {
+			return fmt.Errorf("load user %v error: %w", k, err)
+		}
+		traffic.AllowedCIDRs = splitAllowedCIDRs(cidrs)
+		traffic.merge(u.pt.get(k))
+		fn(k, traffic)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("load users error: %w", err)
+	}
+	return nil
+}
+
+// ListKeys is ...
+func (u *SQLiteUpstream) ListKeys(ctx context.Context) ([]string, error) {
+	rows, err := u.db.QueryContext(ctx, "SELECT key FROM users")
+	if err != nil {
+		return nil, fmt.Errorf("load users error: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		k := ""
+		if err := rows.Scan(&k); err != nil {
+			return nil, fmt.Errorf("load user error: %w", err)
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("load users error: %w", err)
+	}
+	return keys, nil
+}
+
+// Validate is ...
+func (u *SQLiteUpstream) Validate(ctx context.Context, k string) (bool, error) {
+	k = normalizeKey(k)
+	enabled, expires := false, int64(0)
+	if err := u.db.QueryRowContext(ctx, "SELECT enabled, expires_at FROM users WHERE key = ?", k).Scan(&enabled, &expires); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, fmt.Errorf("validate user error: %w", err)
+	}
+	if expires > 0 && time.Now().Unix() >= expires {
+		return false, nil
+	}
+	return enabled, nil
+}
+
+// Has is ...
+func (u *SQLiteUpstream) Has(ctx context.Context, k string) (bool, error) {
+	k = normalizeKey(k)
+	n := 0
+	if err := u.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE key = ?", k).Scan(&n); err != nil {
+		return false, fmt.Errorf("find user error: %w", err)
+	}
+	return n > 0, nil
+}
+
+// Consume is ...
+func (u *SQLiteUpstream) Consume(ctx context.Context, k string, proto Protocol, nr, nw int64) error {
+	k = normalizeKey(k)
+	u.pt.add(k, consumed(proto, nr, nw))
+	return nil
+}
+
+// GetTraffic is ...
+func (u *SQLiteUpstream) GetTraffic(ctx context.Context, k string) (int64, int64, error) {
+	k = normalizeKey(k)
+
+	traffic := Traffic{}
+	if err := u.db.QueryRowContext(ctx, "SELECT up, down FROM users WHERE key = ?", k).Scan(&traffic.Up, &traffic.Down); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, 0, ErrUserNotFound
+		}
+		return 0, 0, err
+	}
+
+	pending := u.pt.get(k)
+	return traffic.Up + pending.Up, traffic.Down + pending.Down, nil
+}
+
+// TotalTraffic is ...
+func (u *SQLiteUpstream) TotalTraffic(ctx context.Context) (int64, int64, error) {
+	// held, so traffic being flushed is counted once
+	u.pt.flush.Lock()
+	defer u.pt.flush.Unlock()
+
+	total := Traffic{}
+	if err := u.db.QueryRowContext(ctx, "SELECT up, down FROM total WHERE id = 0").Scan(&total.Up, &total.Down); err != nil {
+		return 0, 0, fmt.Errorf("load total traffic error: %w", err)
+	}
+	total.merge(u.pt.sum())
+	return total.Up, total.Down, nil
+}
+
+// ResetTraffic is ...
+func (u *SQLiteUpstream) ResetTraffic(ctx context.Context, k string) error {
+	k = normalizeKey(k)
+	u.pt.flush.Lock()
+	defer u.pt.flush.Unlock()
+	u.pt.del(k)
+	_, err := u.db.ExecContext(ctx, "UPDATE users SET up = 0, down = 0, up_udp = 0, down_udp = 0, quota_notified = 0 WHERE key = ?", k)
+	return err
+}
+
+// SetQuota is ...
+func (u *SQLiteUpstream) SetQuota(ctx context.Context, k string, n int64) error {
+	k = normalizeKey(k)
+	return u.exec(ctx, "UPDATE users SET quota = ?, quota_notified = 0 WHERE key = ?", n, k)
+}
+
+// set is ...
+func (u *SQLiteUpstream) set(ctx context.Context, k, column string, v interface{}) error {
+	return u.exec(ctx, fmt.Sprintf("UPDATE users SET %s = ? WHERE key = ?", column), v, k)
+}
+
+// exec runs an update of a user, and returns ErrUserNotFound if no user is updated.
+func (u *SQLiteUpstream) exec(ctx context.Context, query string, args ...interface{}) error {
+	res, err := u.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// QuotaExceeded is ...
+func (u *SQLiteUpstream) QuotaExceeded(ctx context.Context, k string) bool {
+	k = normalizeKey(k)
+
+	traffic := Traffic{}
+	if err := u.db.QueryRowContext(ctx, "SELECT up, down, quota FROM users WHERE key = ?", k).Scan(&traffic.Up, &traffic.Down, &traffic.Quota); err != nil {
+		u.lg.Error(fmt.Sprintf("load user error: %v", err))
+		return false
+	}
+
+	pending := u.pt.get(k)
+	traffic.Up += pending.Up
+	traffic.Down += pending.Down
+	return traffic.QuotaExceeded()
+}
+
+// SetEnabled is ...
+func (u *SQLiteUpstream) SetEnabled(ctx context.Context, k string, enabled bool) error {
+	k = normalizeKey(k)
+	return u.set(ctx, k, "enabled", enabled)
+}
+
+// Count is ...
+func (u *SQLiteUpstream) Count(ctx context.Context) (int, error) {
+	n := 0
+	err := u.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users").Scan(&n)
+	return n, err
+}
+
+// SetRateLimit is ...
+func (u *SQLiteUpstream) SetRateLimit(ctx context.Context, k string, n int64) error {
+	k = normalizeKey(k)
+	return u.set(ctx, k, "rate_limit", n)
+}
+
+// GetRateLimit is ...
+func (u *SQLiteUpstream) GetRateLimit(ctx context.Context, k string) (int64, error) {
+	k = normalizeKey(k)
+
+	n := int64(0)
+	if err := u.db.QueryRowContext(ctx, "SELECT rate_limit FROM users WHERE key = ?", k).Scan(&n); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrUserNotFound
+		}
+		return 0, err
+	}
+	return n, nil
+}
+
+// GetLastSeen is ...
+func (u *SQLiteUpstream) GetLastSeen(ctx context.Context, k string) (time.Time, error) {
+	k = normalizeKey(k)
+
+	sec := int64(0)
+	if err := u.db.QueryRowContext(ctx, "SELECT last_seen FROM users WHERE key = ?", k).Scan(&sec); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return time.Time{}, ErrUserNotFound
+		}
+		return time.Time{}, err
+	}
+
+	traffic := Traffic{}
+	if sec > 0 {
+		traffic.LastSeen = time.Unix(sec, 0)
+	}
+	traffic.merge(u.pt.get(k))
+	return traffic.LastSeen, nil
+}
+
+// SetLabels is ...
+func (u *SQLiteUpstream) SetLabels(ctx context.Context, k string, labels map[string]string) error {
+	k = normalizeKey(k)
+
+	v := ""
+	if len(labels) > 0 {
+		b, err := json.Marshal(labels)
+		if err != nil {
+			return err
+		}
+		v = string(b)
+	}
+	return u.set(ctx, k, "labels", v)
+}
+
+// GetLabels is ...
+func (u *SQLiteUpstream) GetLabels(ctx context.Context, k string) (map[string]string, error) {
+	k = normalizeKey(k)
+
+	s := ""
+	if err := u.db.QueryRowContext(ctx, "SELECT labels FROM users WHERE key = ?", k).Scan(&s); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return parseLabels(s)
+}
+
+// SetExpiry is ...
+func (u *SQLiteUpstream) SetExpiry(ctx context.Context, k string, t time.Time) error {
+	k = normalizeKey(k)
+	return u.set(ctx, k, "expires_at", unixSeconds(t))
+}
+
+// SetSourceIP is ...
+func (u *SQLiteUpstream) SetSourceIP(ctx context.Context, k string, ip net.IP) error {
+	if err := checkSourceIP(ip); err != nil {
+		return err
+	}
+
+	k = normalizeKey(k)
+	return u.set(ctx, k, "source_ip", sourceIPString(ip))
+}
+
+// GetSourceIP is ...
+func (u *SQLiteUpstream) GetSourceIP(ctx context.Context, k string) (net.IP, error) {
+	k = normalizeKey(k)
+
+	s := ""
+	if err := u.db.QueryRowContext(ctx, "SELECT source_ip FROM users WHERE key = ?", k).Scan(&s); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return net.ParseIP(s), nil
+}
+
+// SetAllowedCIDRs is ...
+func (u *SQLiteUpstream) SetAllowedCIDRs(ctx context.Context, k string, cidrs []string) error {
+	cidrs, err := parseAllowedCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+
+	k = normalizeKey(k)
+	return u.set(ctx, k, "allowed_cidrs", allowedCIDRsString(cidrs))
+}
+
+// GetAllowedCIDRs is ...
+func (u *SQLiteUpstream) GetAllowedCIDRs(ctx context.Context, k string) ([]string, error) {
+	k = normalizeKey(k)
+
+	s := ""
+	if err := u.db.QueryRowContext(ctx, "SELECT allowed_cidrs FROM users WHERE key = ?", k).Scan(&s); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return splitAllowedCIDRs(s), nil
+}
+
+// Ping is ...
+func (u *SQLiteUpstream) Ping(ctx context.Context) error {
+	return u.db.PingContext(ctx)
+}
+
+// unixSeconds converts t to unix seconds, 0 for the zero time.
+func unixSeconds(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// UnmarshalCaddyfile is ...
+func (u *SQLiteUpstream) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.Next() {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		u.Path = d.Val()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		subdirective := d.Val()
+		switch subdirective {
+		case "path":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.Path = d.Val()
+		case "flush_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parse flush_interval error: %v", err)
+			}
+			u.FlushInterval = caddy.Duration(dur)
+		case "key_scheme":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.Scheme = d.Val()
+		default:
+			return d.Errf("unknown sqlite subdirective: %v", subdirective)
+		}
+	}
+	if u.Path == "" {
+		return d.Err("sqlite database path is required")
+	}
+	return nil
+}
+
+var (
+	_ Upstream              = (*SQLiteUpstream)(nil)
+	_ KeyGenerator          = (*SQLiteUpstream)(nil)
+	_ caddy.Provisioner     = (*SQLiteUpstream)(nil)
+	_ caddy.CleanerUpper    = (*SQLiteUpstream)(nil)
+	_ caddyfile.Unmarshaler = (*SQLiteUpstream)(nil)
+)
@@ -0,0 +1,183 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+// newSQLiteUpstream provisions a SQLiteUpstream of database at path.
+func newSQLiteUpstream(t *testing.T, path string) *SQLiteUpstream {
+	u := &SQLiteUpstream{Path: path}
+	if err := u.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatalf("provision sqlite upstream error: %v", err)
+	}
+	t.Cleanup(func() { u.Cleanup() })
+	return u
+}
+
+func TestSQLiteUpstreamMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+
+	// users table of the first release
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("open database error: %v", err)
+	}
+	if _, err := db.Exec("CREATE TABLE users(key TEXT PRIMARY KEY, up INTEGER NOT NULL DEFAULT 0, down INTEGER NOT NULL DEFAULT 0)"); err != nil {
+		t.Fatalf("create users table error: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO users(key, up, down) VALUES(?, 1, 2)", base64.StdEncoding.EncodeToString(key[:])); err != nil {
+		t.Fatalf("insert user error: %v", err)
+	}
+	db.Close()
+
+	u := newSQLiteUpstream(t, path)
+	for _, v := range columns {
+		n := 0
+		if err := u.db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('users') WHERE name = ?", v.Name).Scan(&n); err != nil || n != 1 {
+			t.Errorf("migrate column %v error: %v", v.Name, err)
+		}
+	}
+	if err := migrate(u.db); err != nil {
+		t.Errorf("migrate twice error: %v", err)
+	}
+
+	// users of older versions are enabled
+	if ok, err := u.Validate(context.Background(), utils.ByteSliceToString(key[:])); err != nil || !ok {
+		t.Errorf("validate user of old table error")
+	}
+	if up, down, err := u.GetTraffic(context.Background(), utils.ByteSliceToString(key[:])); err != nil || up != 1 || down != 2 {
+		t.Errorf("get traffic error: up %v, down %v, error %v", up, down, err)
+	}
+}
+
+func TestSQLiteUpstreamValidate(t *testing.T) {
+	u := newSQLiteUpstream(t, filepath.Join(t.TempDir(), "users.db"))
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	if ok, err := u.Validate(context.Background(), utils.ByteSliceToString(key[:])); err != nil || ok {
+		t.Errorf("validate missing user")
+	}
+
+	if err := u.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	if ok, err := u.Validate(context.Background(), utils.ByteSliceToString(key[:])); err != nil || !ok {
+		t.Errorf("validate user error")
+	}
+	if err := u.SetEnabled(context.Background(), utils.ByteSliceToString(key[:]), false); err != nil {
+		t.Fatalf("disable user error: %v", err)
+	}
+	if ok, err := u.Validate(context.Background(), utils.ByteSliceToString(key[:])); err != nil || ok {
+		t.Errorf("validate disabled user")
+	}
+	if err := u.SetEnabled(context.Background(), utils.ByteSliceToString(key[:]), true); err != nil {
+		t.Fatalf("enable user error: %v", err)
+	}
+	if ok, err := u.Validate(context.Background(), utils.ByteSliceToString(key[:])); err != nil || !ok {
+		t.Errorf("validate enabled user error")
+	}
+}
+
+func TestSQLiteUpstreamFlush(t *testing.T) {
+	u := newSQLiteUpstream(t, filepath.Join(t.TempDir(), "users.db"))
+	if err := u.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	u.Consume(context.Background(), utils.ByteSliceToString(key[:]), ProtocolTCP, 1, 2)
+
+	check := func(stage string, wantUp, wantDown int64) {
+		up, down, err := u.GetTraffic(context.Background(), utils.ByteSliceToString(key[:]))
+		if err != nil {
+			t.Fatalf("get traffic %v error: %v", stage, err)
+		}
+		if up != wantUp || down != wantDown {
+			t.Errorf("get traffic %v error: up %v, down %v", stage, up, down)
+		}
+	}
+
+	// make flush fail, pending traffic is put back
+	if _, err := u.db.Exec("CREATE TRIGGER fail BEFORE UPDATE ON users BEGIN SELECT RAISE(ABORT, 'fail'); END"); err != nil {
+		t.Fatalf("create trigger error: %v", err)
+	}
+	if err := u.Flush(); err == nil {
+		t.Fatalf("flush with failing trigger")
+	}
+	check("after failed flush", 1, 2)
+
+	if _, err := u.db.Exec("DROP TRIGGER fail"); err != nil {
+		t.Fatalf("drop trigger error: %v", err)
+	}
+	u.Consume(context.Background(), utils.ByteSliceToString(key[:]), ProtocolTCP, 1, 2)
+	if err := u.Flush(); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+	check("after flush", 2, 4)
+
+	up, down := int64(0), int64(0)
+	if err := u.db.QueryRow("SELECT up, down FROM users WHERE key = ?", base64.StdEncoding.EncodeToString(key[:])).Scan(&up, &down); err != nil || up != 2 || down != 4 {
+		t.Errorf("flushed traffic error: up %v, down %v, error %v", up, down, err)
+	}
+}
+
+func TestSQLiteUpstreamBatch(t *testing.T) {
+	testBatch(t, newSQLiteUpstream(t, filepath.Join(t.TempDir(), "users.db")))
+}
+
+func TestSQLiteUpstreamLabels(t *testing.T) {
+	testLabels(t, newSQLiteUpstream(t, filepath.Join(t.TempDir(), "users.db")))
+}
+
+func TestSQLiteUpstreamProtocol(t *testing.T) {
+	testProtocol(t, newSQLiteUpstream(t, filepath.Join(t.TempDir(), "users.db")))
+}
+
+func TestSQLiteUpstreamTotalTraffic(t *testing.T) {
+	testTotalTraffic(t, newSQLiteUpstream(t, filepath.Join(t.TempDir(), "users.db")))
+}
+
+func TestSQLiteUpstreamExpiry(t *testing.T) {
+	testExpiry(t, newSQLiteUpstream(t, filepath.Join(t.TempDir(), "users.db")))
+}
+
+func TestSQLiteUpstreamHas(t *testing.T) {
+	testHas(t, newSQLiteUpstream(t, filepath.Join(t.TempDir(), "users.db")))
+}
+
+func TestSQLiteUpstreamSourceIP(t *testing.T) {
+	testSourceIP(t, newSQLiteUpstream(t, filepath.Join(t.TempDir(), "users.db")))
+}
+
+func TestSQLiteUpstreamAllowedCIDRs(t *testing.T) {
+	testAllowedCIDRs(t, newSQLiteUpstream(t, filepath.Join(t.TempDir(), "users.db")))
+}
+
+func TestSQLiteUpstreamListKeys(t *testing.T) {
+	testListKeys(t, newSQLiteUpstream(t, filepath.Join(t.TempDir(), "users.db")))
+}
+
+func TestSQLiteUpstreamQuotaEvent(t *testing.T) {
+	testQuotaEvent(t, newSQLiteUpstream(t, filepath.Join(t.TempDir(), "users.db")))
+}
+
+func TestSQLiteUpstreamPing(t *testing.T) {
+	u := newSQLiteUpstream(t, filepath.Join(t.TempDir(), "users.db"))
+	if err := u.Ping(context.Background()); err != nil {
+		t.Errorf("ping sqlite upstream error: %v", err)
+	}
+}
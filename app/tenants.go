@@ -0,0 +1,65 @@
+package app
+
+import (
+	"strings"
+)
+
+// Tenant is the upstream of the users of a server name, and the limiters
+// of rate limits of the users.
+type Tenant struct {
+	// Upstream is ...
+	Upstream Upstream
+	// Limiters is ...
+	Limiters *Limiters
+}
+
+// Tenants routes connections to tenants by the server name, so that each
+// tenant has its own users and traffic.
+type Tenants struct {
+	// Strict rejects a connection of a server name of no tenant, instead of
+	// using the default upstream.
+	Strict bool
+
+	mm map[string]Tenant
+}
+
+// Get returns the tenant of the server name, which is an exact name, or
+// *.example.com for all subdomains, where the longer one is matched first.
+// The tenant is zero if no tenant matches, and false is returned if the
+// connection should be rejected then. A nil Tenants has no tenant.
+func (ts *Tenants) Get(name string) (Tenant, bool) {
+	if ts == nil || len(ts.mm) == 0 {
+		return Tenant{}, true
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return Tenant{}, !ts.Strict
+	}
+	if t, ok := ts.mm[name]; ok {
+		return t, true
+	}
+	for i := strings.IndexByte(name, '.'); i >= 0; i = strings.IndexByte(name, '.') {
+		name = name[i+1:]
+		if t, ok := ts.mm["*."+name]; ok {
+			return t, true
+		}
+	}
+	return Tenant{}, !ts.Strict
+}
+
+// Len is ...
+func (ts *Tenants) Len() int {
+	if ts == nil {
+		return 0
+	}
+	return len(ts.mm)
+}
+
+// Add adds the tenant of the server name of up, of which users have the
+// default rate limit of rateLimit.
+func (ts *Tenants) Add(name string, up Upstream, rateLimit int64) {
+	if ts.mm == nil {
+		ts.mm = make(map[string]Tenant)
+	}
+	ts.mm[strings.ToLower(name)] = Tenant{Upstream: up, Limiters: &Limiters{Default: rateLimit, up: up}}
+}
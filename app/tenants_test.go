@@ -0,0 +1,56 @@
+package app
+
+import (
+	"testing"
+)
+
+func TestTenantsGet(t *testing.T) {
+	site, wildcard, sub := &MemoryUpstream{}, &MemoryUpstream{}, &MemoryUpstream{}
+	ts := &Tenants{}
+	ts.Add("example.com", site, 0)
+	ts.Add("*.example.org", wildcard, 0)
+	ts.Add("*.sub.example.org", sub, 1024)
+
+	for _, v := range []struct {
+		Name string
+		Up   Upstream
+	}{
+		{Name: "example.com", Up: site},
+		{Name: "EXAMPLE.com.", Up: site},
+		{Name: "www.example.org", Up: wildcard},
+		{Name: "a.b.example.org", Up: wildcard},
+		{Name: "www.sub.example.org", Up: sub},
+		{Name: "example.org"},
+		{Name: "www.example.com"},
+		{Name: ""},
+	} {
+		tn, ok := ts.Get(v.Name)
+		if !ok {
+			t.Errorf("tenant of %q is rejected", v.Name)
+		}
+		if tn.Upstream != v.Up {
+			t.Errorf("tenant of %q error: %v", v.Name, tn.Upstream)
+		}
+	}
+	if tn, _ := ts.Get("www.sub.example.org"); tn.Limiters.Default != 1024 {
+		t.Errorf("rate limit of tenant error: %v", tn.Limiters.Default)
+	}
+
+	ts.Strict = true
+	for _, name := range []string{"www.example.com", ""} {
+		if _, ok := ts.Get(name); ok {
+			t.Errorf("tenant of %q is not rejected", name)
+		}
+	}
+	if _, ok := ts.Get("example.com"); !ok {
+		t.Errorf("tenant of example.com is rejected")
+	}
+
+	// strict takes no effect without tenants
+	if _, ok := (&Tenants{Strict: true}).Get("example.com"); !ok {
+		t.Errorf("reject server name without tenants")
+	}
+	if _, ok := (*Tenants)(nil).Get("example.com"); !ok {
+		t.Errorf("reject server name of nil tenants")
+	}
+}
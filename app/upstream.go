@@ -2,13 +2,25 @@ package app
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/certmagic"
 	"go.uber.org/zap"
 
@@ -22,29 +34,206 @@ func init() {
 }
 
 // Upstream is ...
+//
+// An Upstream of background work, like flushing traffic, or of open handles
+// implements caddy.CleanerUpper, of which Cleanup stops the work, flushes
+// the pending traffic and closes the handles, so nothing is left of it
+// after a config reload. Caddy calls Cleanup after a failed Provision as
+// well, so it must handle an upstream which is partly provisioned. Members
+// of composite upstreams, like MultiUpstream, are cleaned up by caddy.
 type Upstream interface {
-	// Add is ...
-	Add(string) error
-	// AddKey is ...
-	AddKey(string) error
-	// Del is ...
-	Del(string) error
-	// DelKey is ...
-	DelKey(string) error
-	// Range is ...
-	Range(func(string, int64, int64))
-	// Validate is ...
-	Validate(string) bool
-	// Consume is ...
-	Consume(string, int64, int64) error
+	// Add adds a user by the plaintext password.
+	Add(context.Context, string) error
+	// AddKey adds a user by the 56-byte trojan header, which is the
+	// hex of sha224 of the password. Use AddHexKey to check it first.
+	AddKey(context.Context, string) error
+	// Del deletes a user by the plaintext password.
+	Del(context.Context, string) error
+	// DelKey deletes a user by the 56-byte trojan header.
+	DelKey(context.Context, string) error
+	// AddKeys adds users by 56-byte trojan headers in a batch.
+	AddKeys(context.Context, []string) error
+	// DelKeys deletes users by 56-byte trojan headers in a batch.
+	DelKeys(context.Context, []string) error
+	// Range calls fn with the traffic of every user. Whether fn sees all
+	// users at one point in time depends on the upstream, MemoryUpstream
+	// does, and CaddyUpstream does with RangeSnapshot.
+	Range(context.Context, func(string, Traffic)) error
+	// ListKeys returns the keys of all users, as Range calls fn with,
+	// without loading their traffic, which is much cheaper than Range to
+	// enumerate users or check they exist.
+	ListKeys(context.Context) ([]string, error)
+	// Validate reports whether the user is valid. An unknown or disabled
+	// user is not an error, the error is only for failures of the upstream.
+	Validate(context.Context, string) (bool, error)
+	// Has reports whether the user exists, whether or not it is disabled,
+	// expired or over quota. Validate is the check of connections, Has is
+	// for management of users.
+	Has(context.Context, string) (bool, error)
+	// Consume adds the traffic relayed by the protocol to the user.
+	Consume(context.Context, string, Protocol, int64, int64) error
+	// GetTraffic is ...
+	GetTraffic(context.Context, string) (int64, int64, error)
+	// TotalTraffic returns the up and down traffic relayed for all users,
+	// which is not decreased by ResetTraffic or Del. It is counted since
+	// the users are loaded by MemoryUpstream and FileUpstream, and is kept
+	// in the backing store by other upstreams. Traffic not flushed yet is
+	// included, which may be of users deleted before the flush, so it may
+	// be a little more than the traffic written to users.
+	TotalTraffic(context.Context) (int64, int64, error)
+	// ResetTraffic is ...
+	ResetTraffic(context.Context, string) error
+	// SetQuota is ...
+	SetQuota(context.Context, string, int64) error
+	// QuotaExceeded is ...
+	QuotaExceeded(context.Context, string) bool
+	// SetEnabled is ...
+	SetEnabled(context.Context, string, bool) error
+	// Count is ...
+	Count(context.Context) (int, error)
+	// SetRateLimit sets the rate limit of the user in bytes per second,
+	// which applies from the next connection of the user without a reload.
+	// 0 is the rate_limit of the app, which is unlimited if not set.
+	SetRateLimit(context.Context, string, int64) error
+	// GetRateLimit is ...
+	GetRateLimit(context.Context, string) (int64, error)
+	// GetLastSeen is ...
+	GetLastSeen(context.Context, string) (time.Time, error)
+	// SetLabels replaces the labels of the user, nil clears them.
+	SetLabels(context.Context, string, map[string]string) error
+	// GetLabels returns the labels of the user, nil if there is no label.
+	GetLabels(context.Context, string) (map[string]string, error)
+	// SetExpiry sets the time the user expires, after which the user is not
+	// valid. The zero time means never.
+	SetExpiry(context.Context, string, time.Time) error
+	// SetSourceIP sets the address connections of the user are dialed from,
+	// which must be bound to the host. nil is the default route.
+	SetSourceIP(context.Context, string, net.IP) error
+	// GetSourceIP returns the address connections of the user are dialed
+	// from, nil for the default route.
+	GetSourceIP(context.Context, string) (net.IP, error)
+	// SetAllowedCIDRs sets the networks clients of the user must connect
+	// from, as CIDRs or addresses of IPv4 and IPv6. nil allows all.
+	SetAllowedCIDRs(context.Context, string, []string) error
+	// GetAllowedCIDRs returns the networks clients of the user must
+	// connect from, nil for all.
+	GetAllowedCIDRs(context.Context, string) ([]string, error)
+	// Ping checks the backing store of the upstream is reachable.
+	Ping(context.Context) error
+}
+
+// ErrUserNotFound is ...
+var ErrUserNotFound = errors.New("user not found")
+
+// AddHexKey adds a user by the hex of sha224 of the password, which is
+// the password used by other trojan servers. Unlike AddKey, the key is
+// checked and converted to lower case.
+func AddHexKey(ctx context.Context, up Upstream, s string) error {
+	key := [trojan.HeaderLen]byte{}
+	if err := trojan.ParseHexKey(s, key[:]); err != nil {
+		return err
+	}
+	return up.AddKey(ctx, string(key[:]))
 }
 
 // MemoryUpstream is ...
+//
+// Users are sharded by key, and the Traffic of a user is only read and
+// written under the lock of its shard, so a Consume is applied wholly:
+// Range, GetTraffic and Snapshot see either all or none of its Up and Down,
+// and see every Consume which returns before they start.
 type MemoryUpstream struct {
+	// SnapshotPath is the path of a JSON file, which users are saved
+	// to on Cleanup and loaded from on Provision.
+	SnapshotPath string `json:"snapshot_path,omitempty"`
+	// SnapshotInterval is the interval of saving users to SnapshotPath,
+	// 0 means only saving on Cleanup.
+	SnapshotInterval caddy.Duration `json:"snapshot_interval,omitempty"`
+	// Users is the passwords of users added on Provision.
+	Users []string `json:"users,omitempty"`
+	// Keys is the hex keys of users added on Provision.
+	Keys []string `json:"keys,omitempty"`
+	// UsersFile is the path of a file of passwords of users, one per line,
+	// which are added on Provision and loaded again on SIGHUP. Users removed
+	// from the file are deleted.
+	UsersFile string `json:"users_file,omitempty"`
+	// UsersEnv is the name of an environment variable of passwords of users,
+	// one per line, which are added as UsersFile.
+	UsersEnv string `json:"users_env,omitempty"`
+	KeyScheme
+
+	// *memoryUsers, shared by MemoryUpstreams of the same SnapshotPath
+	users unsafe.Pointer
+
+	lg     *zap.Logger
+	closed chan struct{}
+	wg     *sync.WaitGroup
+}
+
+// memoryShards is the number of shards of MemoryUpstream, so that
+// Consume of different users does not contend on one lock.
+const memoryShards = 256
+
+// memoryShard is ...
+// mm is allocated when the first user is added to the shard, so a
+// MemoryUpstream is usable before or without Provision.
+type memoryShard struct {
 	mu sync.RWMutex
 	mm map[string]Traffic
 }
 
+// memoryPool keeps users of MemoryUpstreams with SnapshotPath across
+// config reloads. The new config is provisioned before the old one is
+// cleaned up, so loading the snapshot again would lose changes made
+// after it was loaded.
+var memoryPool = caddy.NewUsagePool()
+
+// memoryUsers is ...
+type memoryUsers struct {
+	// traffic of all users, first for 64-bit alignment of atomic
+	up, down int64
+
+	shards [memoryShards]memoryShard
+
+	// keys loaded from UsersFile and UsersEnv
+	fileMu   sync.Mutex
+	fileKeys map[string]struct{}
+}
+
+// Destruct is ...
+func (*memoryUsers) Destruct() error {
+	return nil
+}
+
+// state returns the users of MemoryUpstream, a MemoryUpstream which
+// is not provisioned has its own users.
+func (u *MemoryUpstream) state() *memoryUsers {
+	if p := atomic.LoadPointer(&u.users); p != nil {
+		return (*memoryUsers)(p)
+	}
+	atomic.CompareAndSwapPointer(&u.users, nil, unsafe.Pointer(&memoryUsers{}))
+	return (*memoryUsers)(atomic.LoadPointer(&u.users))
+}
+
+// shard is ...
+func (u *MemoryUpstream) shard(k string) *memoryShard {
+	return u.state().shard(k)
+}
+
+// shard returns the shard of the key by FNV-1a hash.
+func (u *memoryUsers) shard(k string) *memoryShard {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+	h := uint32(offset32)
+	for i := 0; i < len(k); i++ {
+		h ^= uint32(k[i])
+		h *= prime32
+	}
+	return &u.shards[h%memoryShards]
+}
+
 // CaddyModule is ...
 func (MemoryUpstream) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
@@ -53,87 +242,640 @@ func (MemoryUpstream) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
+// Provision is ...
+func (u *MemoryUpstream) Provision(ctx caddy.Context) error {
+	if err := u.KeyScheme.Provision(); err != nil {
+		return err
+	}
+	u.lg = ctx.Logger(u)
+	if u.SnapshotPath != "" {
+		v, _, err := memoryPool.LoadOrNew(u.SnapshotPath, func() (caddy.Destructor, error) {
+			users := &memoryUsers{}
+			return users, users.load(u.SnapshotPath)
+		})
+		if err != nil {
+			return fmt.Errorf("load snapshot error: %w", err)
+		}
+		atomic.StorePointer(&u.users, unsafe.Pointer(v.(*memoryUsers)))
+	}
+	// released on Cleanup, even if provision fails below
+	if u.SnapshotPath != "" || u.UsersFile != "" {
+		u.closed = make(chan struct{})
+		u.wg = &sync.WaitGroup{}
+	}
+
+	for _, v := range u.Users {
+		u.Add(ctx, v)
+	}
+	for _, v := range u.Keys {
+		if err := AddHexKey(ctx, u, v); err != nil {
+			return err
+		}
+	}
+	if u.UsersFile != "" || u.UsersEnv != "" {
+		if _, err := u.loadUsers(ctx); err != nil {
+			return err
+		}
+	}
+
+	if u.SnapshotPath != "" && u.SnapshotInterval > 0 {
+		u.wg.Add(1)
+		go u.loop()
+	}
+	if u.UsersFile != "" {
+		u.wg.Add(1)
+		go u.watchUsers(notifyUsers())
+	}
+	return nil
+}
+
+// Cleanup is ...
+func (u *MemoryUpstream) Cleanup() error {
+	if u.closed == nil {
+		return nil
+	}
+	close(u.closed)
+	u.wg.Wait()
+	if u.SnapshotPath == "" {
+		return nil
+	}
+	err := u.Snapshot()
+	memoryPool.Delete(u.SnapshotPath)
+	return err
+}
+
+// loop is ...
+func (u *MemoryUpstream) loop() {
+	defer u.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(u.SnapshotInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-u.closed:
+			return
+		case <-ticker.C:
+			if err := u.Snapshot(); err != nil {
+				u.lg.Error(fmt.Sprintf("save snapshot error: %v", err))
+			}
+		}
+	}
+}
+
+// load reads users from a snapshot, a missing file is not an error.
+func (u *memoryUsers) load(name string) error {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	mm := map[string]Traffic{}
+	if err := json.Unmarshal(b, &mm); err != nil {
+		return err
+	}
+	for k, v := range mm {
+		s := u.shard(k)
+		s.mu.Lock()
+		if s.mm == nil {
+			s.mm = make(map[string]Traffic)
+		}
+		s.mm[k] = v
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// Snapshot saves all users to SnapshotPath. The file is replaced
+// atomically, so a crash never leaves a corrupted snapshot.
+func (u *MemoryUpstream) Snapshot() error {
+	mm := map[string]Traffic{}
+	users := u.state()
+	for i := range users.shards {
+		s := &users.shards[i]
+		s.mu.RLock()
+		for k, v := range s.mm {
+			mm[k] = v
+		}
+		s.mu.RUnlock()
+	}
+	b, err := json.Marshal(mm)
+	if err != nil {
+		return err
+	}
+	return writeFile(u.SnapshotPath, b)
+}
+
+// writeFile replaces the file of name with b atomically.
+func writeFile(name string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
 // AddKey is ...
-func (u *MemoryUpstream) AddKey(k string) error {
+func (u *MemoryUpstream) AddKey(ctx context.Context, k string) error {
 	key := base64.StdEncoding.EncodeToString(utils.StringToByteSlice(k))
-	u.mu.Lock()
-	u.mm[key] = Traffic{
-		Up:   0,
-		Down: 0,
+	s := u.shard(key)
+	s.mu.Lock()
+	if s.mm == nil {
+		s.mm = make(map[string]Traffic)
+	}
+	// keep traffic of an existing user, like other upstreams
+	if _, ok := s.mm[key]; !ok {
+		s.mm[key] = Traffic{
+			Up:      0,
+			Down:    0,
+			Enabled: true,
+		}
 	}
-	u.mu.Unlock()
+	s.mu.Unlock()
 	return nil
 }
 
 // Add is ...
-func (u *MemoryUpstream) Add(s string) error {
+func (u *MemoryUpstream) Add(ctx context.Context, s string) error {
 	b := [trojan.HeaderLen]byte{}
-	trojan.GenKey(s, b[:])
-	return u.AddKey(utils.ByteSliceToString(b[:]))
+	u.GenKey(s, b[:])
+	return u.AddKey(ctx, utils.ByteSliceToString(b[:]))
 }
 
 // DelKey is ...
-func (u *MemoryUpstream) DelKey(k string) error {
+func (u *MemoryUpstream) DelKey(ctx context.Context, k string) error {
 	key := base64.StdEncoding.EncodeToString(utils.StringToByteSlice(k))
-	u.mu.Lock()
-	delete(u.mm, key)
-	u.mu.Unlock()
+	s := u.shard(key)
+	s.mu.Lock()
+	delete(s.mm, key)
+	s.mu.Unlock()
+	return nil
+}
+
+// AddKeys is ...
+func (u *MemoryUpstream) AddKeys(ctx context.Context, keys []string) error {
+	for s, keys := range u.group(keys) {
+		s.mu.Lock()
+		if s.mm == nil {
+			s.mm = make(map[string]Traffic)
+		}
+		for _, key := range keys {
+			if _, ok := s.mm[key]; !ok {
+				s.mm[key] = Traffic{
+					Up:      0,
+					Down:    0,
+					Enabled: true,
+				}
+			}
+		}
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// DelKeys is ...
+func (u *MemoryUpstream) DelKeys(ctx context.Context, keys []string) error {
+	for s, keys := range u.group(keys) {
+		s.mu.Lock()
+		for _, key := range keys {
+			delete(s.mm, key)
+		}
+		s.mu.Unlock()
+	}
 	return nil
 }
 
+// group encodes the keys and groups them by shard, so a shard is locked
+// once for a batch.
+func (u *MemoryUpstream) group(keys []string) map[*memoryShard][]string {
+	users := u.state()
+	mm := make(map[*memoryShard][]string)
+	for _, k := range keys {
+		key := base64.StdEncoding.EncodeToString(utils.StringToByteSlice(k))
+		s := users.shard(key)
+		mm[s] = append(mm[s], key)
+	}
+	return mm
+}
+
 // Del is ...
-func (u *MemoryUpstream) Del(s string) error {
+func (u *MemoryUpstream) Del(ctx context.Context, s string) error {
 	b := [trojan.HeaderLen]byte{}
-	trojan.GenKey(s, b[:])
-	return u.DelKey(utils.ByteSliceToString(b[:]))
+	u.GenKey(s, b[:])
+	return u.DelKey(ctx, utils.ByteSliceToString(b[:]))
 }
 
 // Range is ...
-func (u *MemoryUpstream) Range(fn func(string, int64, int64)) {
-	u.mu.RLock()
-	for k, v := range u.mm {
-		fn(k, v.Up, v.Down)
+// Users are copied under the locks of all shards, which is a snapshot of
+// one point in time, and fn is called after the locks are released, so a
+// slow fn does not block Consume and fn may modify the upstream.
+func (u *MemoryUpstream) Range(ctx context.Context, fn func(k string, traffic Traffic)) error {
+	type user struct {
+		k       string
+		traffic Traffic
+	}
+
+	users := u.state()
+	for i := range users.shards {
+		users.shards[i].mu.RLock()
+	}
+	n := 0
+	for i := range users.shards {
+		n += len(users.shards[i].mm)
 	}
-	u.mu.RUnlock()
+	list := make([]user, 0, n)
+	for i := range users.shards {
+		for k, v := range users.shards[i].mm {
+			list = append(list, user{k: k, traffic: v})
+		}
+	}
+	for i := range users.shards {
+		users.shards[i].mu.RUnlock()
+	}
+
+	for _, v := range list {
+		fn(v.k, v.traffic)
+	}
+	return nil
+}
+
+// ListKeys returns a snapshot of the keys of users.
+func (u *MemoryUpstream) ListKeys(ctx context.Context) ([]string, error) {
+	users := u.state()
+	keys := []string{}
+	for i := range users.shards {
+		s := &users.shards[i]
+		s.mu.RLock()
+		for k := range s.mm {
+			keys = append(keys, k)
+		}
+		s.mu.RUnlock()
+	}
+	return keys, nil
 }
 
 // Validate is ...
-func (u *MemoryUpstream) Validate(k string) bool {
-	// base64.StdEncoding.EncodeToString(hex.Encode(sha256.Sum224([]byte("Test1234"))))
-	const AuthLen = 76
-	if len(k) != AuthLen {
-		k = base64.StdEncoding.EncodeToString(utils.StringToByteSlice(k))
+func (u *MemoryUpstream) Validate(ctx context.Context, k string) (bool, error) {
+	k = normalizeKey(k)
+	s := u.shard(k)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	// a map lookup compares the key with memequal, which returns at
+	// the first different byte, so compare with every key of the shard
+	// in constant time instead
+	ok, now := 0, time.Now()
+	for key, traffic := range s.mm {
+		if subtle.ConstantTimeCompare(utils.StringToByteSlice(key), utils.StringToByteSlice(k)) == 1 && traffic.Enabled && !traffic.Expired(now) {
+			ok = 1
+		}
 	}
-	u.mu.RLock()
-	_, ok := u.mm[k]
-	u.mu.RUnlock()
-	return ok
+	return ok == 1, nil
+}
+
+// Has is ...
+func (u *MemoryUpstream) Has(ctx context.Context, k string) (bool, error) {
+	k = normalizeKey(k)
+	s := u.shard(k)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.mm[k]
+	return ok, nil
 }
 
 // Consume is ...
-func (u *MemoryUpstream) Consume(k string, nr, nw int64) error {
-	// base64.StdEncoding.EncodeToString(hex.Encode(sha256.Sum224([]byte("Test1234"))))
-	const AuthLen = 76
-	if len(k) != AuthLen {
-		k = base64.StdEncoding.EncodeToString(utils.StringToByteSlice(k))
-	}
-	u.mu.Lock()
-	traffic := u.mm[k]
-	traffic.Up += nr
-	traffic.Down += nw
-	u.mm[k] = traffic
-	u.mu.Unlock()
+func (u *MemoryUpstream) Consume(ctx context.Context, k string, proto Protocol, nr, nw int64) error {
+	k = normalizeKey(k)
+	s := u.shard(k)
+	s.mu.Lock()
+	// keep traffic of an existing user only, a user deleted during
+	// the relay should not come back
+	traffic, ok := s.mm[k]
+	crossed := false
+	if ok {
+		traffic.merge(consumed(proto, nr, nw))
+		crossed = traffic.crossQuota()
+		s.mm[k] = traffic
+	}
+	s.mu.Unlock()
+	if ok {
+		users := u.state()
+		atomic.AddInt64(&users.up, nr)
+		atomic.AddInt64(&users.down, nw)
+	}
+	if crossed {
+		emitQuotaExceeded(k, traffic)
+	}
+	return nil
+}
+
+// GetTraffic is ...
+func (u *MemoryUpstream) GetTraffic(ctx context.Context, k string) (int64, int64, error) {
+	k = normalizeKey(k)
+	s := u.shard(k)
+	s.mu.RLock()
+	traffic, ok := s.mm[k]
+	s.mu.RUnlock()
+	if !ok {
+		return 0, 0, ErrUserNotFound
+	}
+	return traffic.Up, traffic.Down, nil
+}
+
+// TotalTraffic is ...
+func (u *MemoryUpstream) TotalTraffic(ctx context.Context) (int64, int64, error) {
+	users := u.state()
+	return atomic.LoadInt64(&users.up), atomic.LoadInt64(&users.down), nil
+}
+
+// ResetTraffic is ...
+func (u *MemoryUpstream) ResetTraffic(ctx context.Context, k string) error {
+	k = normalizeKey(k)
+	s := u.shard(k)
+	s.mu.Lock()
+	if traffic, ok := s.mm[k]; ok {
+		traffic.Up, traffic.UpUDP = 0, 0
+		traffic.Down, traffic.DownUDP = 0, 0
+		traffic.QuotaNotified = false
+		s.mm[k] = traffic
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// SetQuota is ...
+func (u *MemoryUpstream) SetQuota(ctx context.Context, k string, n int64) error {
+	k = normalizeKey(k)
+	s := u.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	traffic, ok := s.mm[k]
+	if !ok {
+		return ErrUserNotFound
+	}
+	traffic.Quota, traffic.QuotaNotified = n, false
+	s.mm[k] = traffic
+	return nil
+}
+
+// QuotaExceeded is ...
+func (u *MemoryUpstream) QuotaExceeded(ctx context.Context, k string) bool {
+	k = normalizeKey(k)
+	s := u.shard(k)
+	s.mu.RLock()
+	traffic := s.mm[k]
+	s.mu.RUnlock()
+	return traffic.QuotaExceeded()
+}
+
+// SetEnabled is ...
+func (u *MemoryUpstream) SetEnabled(ctx context.Context, k string, enabled bool) error {
+	k = normalizeKey(k)
+	s := u.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	traffic, ok := s.mm[k]
+	if !ok {
+		return ErrUserNotFound
+	}
+	traffic.Enabled = enabled
+	s.mm[k] = traffic
+	return nil
+}
+
+// Count is ...
+func (u *MemoryUpstream) Count(ctx context.Context) (int, error) {
+	n := 0
+	users := u.state()
+	for i := range users.shards {
+		s := &users.shards[i]
+		s.mu.RLock()
+		n += len(s.mm)
+		s.mu.RUnlock()
+	}
+	return n, nil
+}
+
+// SetRateLimit is ...
+func (u *MemoryUpstream) SetRateLimit(ctx context.Context, k string, n int64) error {
+	k = normalizeKey(k)
+	s := u.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	traffic, ok := s.mm[k]
+	if !ok {
+		return ErrUserNotFound
+	}
+	traffic.RateLimit = n
+	s.mm[k] = traffic
+	return nil
+}
+
+// GetRateLimit is ...
+func (u *MemoryUpstream) GetRateLimit(ctx context.Context, k string) (int64, error) {
+	k = normalizeKey(k)
+	s := u.shard(k)
+	s.mu.RLock()
+	traffic, ok := s.mm[k]
+	s.mu.RUnlock()
+	if !ok {
+		return 0, ErrUserNotFound
+	}
+	return traffic.RateLimit, nil
+}
+
+// GetLastSeen is ...
+func (u *MemoryUpstream) GetLastSeen(ctx context.Context, k string) (time.Time, error) {
+	k = normalizeKey(k)
+	s := u.shard(k)
+	s.mu.RLock()
+	traffic, ok := s.mm[k]
+	s.mu.RUnlock()
+	if !ok {
+		return time.Time{}, ErrUserNotFound
+	}
+	return traffic.LastSeen, nil
+}
+
+// SetLabels is ...
+func (u *MemoryUpstream) SetLabels(ctx context.Context, k string, labels map[string]string) error {
+	k = normalizeKey(k)
+	s := u.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	traffic, ok := s.mm[k]
+	if !ok {
+		return ErrUserNotFound
+	}
+	// a copy, so the caller can not modify labels without the lock
+	traffic.Labels = copyLabels(labels)
+	s.mm[k] = traffic
+	return nil
+}
+
+// GetLabels is ...
+func (u *MemoryUpstream) GetLabels(ctx context.Context, k string) (map[string]string, error) {
+	k = normalizeKey(k)
+	s := u.shard(k)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	traffic, ok := s.mm[k]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return copyLabels(traffic.Labels), nil
+}
+
+// SetExpiry is ...
+func (u *MemoryUpstream) SetExpiry(ctx context.Context, k string, t time.Time) error {
+	k = normalizeKey(k)
+	s := u.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	traffic, ok := s.mm[k]
+	if !ok {
+		return ErrUserNotFound
+	}
+	traffic.ExpiresAt = t
+	s.mm[k] = traffic
+	return nil
+}
+
+// SetSourceIP is ...
+func (u *MemoryUpstream) SetSourceIP(ctx context.Context, k string, ip net.IP) error {
+	if err := checkSourceIP(ip); err != nil {
+		return err
+	}
+
+	k = normalizeKey(k)
+	s := u.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	traffic, ok := s.mm[k]
+	if !ok {
+		return ErrUserNotFound
+	}
+	traffic.SourceIP = sourceIPString(ip)
+	s.mm[k] = traffic
+	return nil
+}
+
+// GetSourceIP is ...
+func (u *MemoryUpstream) GetSourceIP(ctx context.Context, k string) (net.IP, error) {
+	k = normalizeKey(k)
+	s := u.shard(k)
+	s.mu.RLock()
+	traffic, ok := s.mm[k]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return net.ParseIP(traffic.SourceIP), nil
+}
+
+// SetAllowedCIDRs is ...
+func (u *MemoryUpstream) SetAllowedCIDRs(ctx context.Context, k string, cidrs []string) error {
+	cidrs, err := parseAllowedCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+
+	k = normalizeKey(k)
+	s := u.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	traffic, ok := s.mm[k]
+	if !ok {
+		return ErrUserNotFound
+	}
+	traffic.AllowedCIDRs = cidrs
+	s.mm[k] = traffic
+	return nil
+}
+
+// GetAllowedCIDRs is ...
+func (u *MemoryUpstream) GetAllowedCIDRs(ctx context.Context, k string) ([]string, error) {
+	k = normalizeKey(k)
+	s := u.shard(k)
+	s.mu.RLock()
+	traffic, ok := s.mm[k]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return traffic.AllowedCIDRs, nil
+}
+
+// Ping always succeeds, as users are in memory.
+func (u *MemoryUpstream) Ping(ctx context.Context) error {
 	return nil
 }
 
 // CaddyUpstream is ...
 type CaddyUpstream struct {
-	// Prefix is ...
-	Prefix string `json:"-,omitempty"`
+	// Prefix is the storage prefix of user keys, default is trojan/.
+	Prefix string `json:"prefix,omitempty"`
+	// FlushInterval is the interval of writing accumulated traffic to storage, default is 30s.
+	FlushInterval caddy.Duration `json:"flush_interval,omitempty"`
+	// CacheSize is the number of valid users cached in memory, so Validate
+	// does not go to storage for each connection. 0 disables the cache.
+	CacheSize int `json:"cache_size,omitempty"`
+	// CacheTTL is the time a valid user is cached, default is 1m.
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+	// RetryAttempts is the number of attempts of writing the traffic of a
+	// user to storage in a flush, with exponential backoff, default is 3.
+	// Traffic which fails all attempts is kept in memory for the next flush.
+	// A lock which times out is not retried.
+	RetryAttempts int `json:"retry_attempts,omitempty"`
+	// LockTimeout is the max time of acquiring the lock of a user in storage,
+	// default is 10s, so a stuck distributed lock does not block flushes.
+	// Traffic of a user which is not locked is kept in memory for the next
+	// flush, and the other users are flushed.
+	LockTimeout caddy.Duration `json:"lock_timeout,omitempty"`
+	// RangeSnapshot makes Range read all users before calling fn, with
+	// flushes held, so fn sees the users of one point in time. It is one
+	// read if Storage is a BatchStorage. Otherwise users are read one by
+	// one while fn is called, and a user may be seen before or after a
+	// flush of the others.
+	RangeSnapshot bool `json:"range_snapshot,omitempty"`
+	// Encoding is the encoding of records of users in storage, json or
+	// binary, default is json. binary is much smaller and faster to marshal
+	// for each flush. Records of both are read, and a record is written in
+	// Encoding the next time it is updated, so it can be changed anytime.
+	Encoding string `json:"encoding,omitempty"`
+	KeyScheme
 	// Storage is ...
 	Storage certmagic.Storage `json:"-,omitempty"`
 	// Logger is ...
 	Logger *zap.Logger `json:"-,omitempty"`
+
+	// *pendingTraffic, traffic which is not flushed to storage
+	pt unsafe.Pointer
+
+	cache *validationCache
+
+	closed chan struct{}
+	wg     *sync.WaitGroup
 }
 
 // CaddyModule is ...
@@ -146,126 +888,997 @@ func (CaddyUpstream) CaddyModule() caddy.ModuleInfo {
 
 // Provision is ...
 func (u *CaddyUpstream) Provision(ctx caddy.Context) error {
-	u.Prefix = "trojan/"
-	u.Storage = ctx.Storage()
+	if err := u.KeyScheme.Provision(); err != nil {
+		return err
+	}
+	if err := u.normalizePrefix(); err != nil {
+		return err
+	}
+	if err := checkEncoding(u.Encoding); err != nil {
+		return err
+	}
+	if u.FlushInterval == 0 {
+		u.FlushInterval = caddy.Duration(30 * time.Second)
+	}
+	if u.CacheSize < 0 {
+		return errors.New("cache_size must not be negative")
+	}
+	if u.RetryAttempts < 0 {
+		return errors.New("retry_attempts must not be negative")
+	}
+	if u.RetryAttempts == 0 {
+		u.RetryAttempts = defaultRetryAttempts
+	}
+	if u.LockTimeout < 0 {
+		return errors.New("lock_timeout must not be negative")
+	}
+	if u.LockTimeout == 0 {
+		u.LockTimeout = caddy.Duration(defaultLockTimeout)
+	}
+	if u.CacheSize > 0 {
+		if u.CacheTTL == 0 {
+			u.CacheTTL = caddy.Duration(time.Minute)
+		}
+		u.cache = newValidationCache(u.CacheSize, time.Duration(u.CacheTTL))
+	}
+	// a storage set before Provision is kept, as of users outside a config
+	if u.Storage == nil {
+		u.Storage = ctx.Storage()
+	}
 	u.Logger = ctx.Logger(u)
+	u.closed = make(chan struct{})
+	u.wg = &sync.WaitGroup{}
+
+	u.wg.Add(1)
+	go u.loop()
+
+	return nil
+}
+
+// Cleanup is ...
+func (u *CaddyUpstream) Cleanup() error {
+	if u.closed == nil {
+		// provision failed
+		return nil
+	}
+	close(u.closed)
+	u.wg.Wait()
+	return u.Flush()
+}
+
+// loop is ...
+func (u *CaddyUpstream) loop() {
+	defer u.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(u.FlushInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-u.closed:
+			return
+		case <-ticker.C:
+			if err := u.Flush(); err != nil {
+				u.Logger.Error(fmt.Sprintf("flush traffic error: %v", err))
+			}
+		}
+	}
+}
+
+// Flush writes accumulated traffic to storage, one Store for each user.
+// The traffic of a user whose lock is not acquired within LockTimeout is
+// kept in memory for the next flush, and the other users are flushed. An
+// error of storage stops the flush, as storage is down for all users.
+func (u *CaddyUpstream) Flush() error {
+	ctx := context.Background()
+	keys := u.state().keys()
+
+	var lockErr error
+	buffered := 0
+	for i, k := range keys {
+		crossed, total := false, Traffic{}
+		err := u.retry(func() (err error) {
+			crossed, total, err = u.flushKey(ctx, k)
+			return err
+		})
+		switch {
+		case err == nil:
+			if crossed {
+				emitQuotaExceeded(strings.TrimPrefix(k, u.Prefix), total)
+			}
+		case errors.Is(err, ErrUserNotFound):
+		case isLockTimeout(err):
+			// only the lock of this user is stuck
+			if lockErr == nil {
+				lockErr = err
+			}
+			buffered++
+		default:
+			// storage is down, do not try each user
+			buffered += len(keys) - i
+			u.Logger.Warn(fmt.Sprintf("buffer traffic of %v users in memory until the next flush: %v", buffered, err))
+			return err
+		}
+	}
+	if lockErr != nil {
+		u.Logger.Warn(fmt.Sprintf("buffer traffic of %v users in memory until the next flush: %v", buffered, lockErr))
+	}
+	if err := u.retry(func() error { return u.flushTotal(ctx) }); err != nil {
+		// kept for the next flush
+		return fmt.Errorf("flush total traffic error: %w", err)
+	}
+	return lockErr
+}
+
+// flushKey writes the pending traffic of the user, and reports whether it
+// crosses the quota. The traffic is taken after the lock of the user is
+// acquired, with pt.flush held until it is written, so it is counted once
+// by TotalTraffic and is never written back after a reset.
+func (u *CaddyUpstream) flushKey(ctx context.Context, k string) (crossed bool, total Traffic, err error) {
+	if err := u.lock(ctx, k); err != nil {
+		return false, Traffic{}, err
+	}
+	defer u.Storage.Unlock(ctx, k)
+
+	pt := u.state()
+	pt.flush.Lock()
+	defer pt.flush.Unlock()
+	v, ok := pt.takeKey(k)
+	if !ok {
+		// reset, deleted or flushed meanwhile
+		return false, Traffic{}, nil
+	}
+	err = u.updateLocked(ctx, k, func(traffic *Traffic) {
+		traffic.merge(v)
+		crossed, total = traffic.crossQuota(), *traffic
+	})
+	switch {
+	case err == nil:
+		pt.total.merge(v)
+	case errors.Is(err, ErrUserNotFound):
+		// traffic of a deleted user is dropped
+	default:
+		// put traffic back and retry next time
+		pt.add(k, v)
+	}
+	return crossed, total, err
+}
+
+// totalKey returns the storage key of the traffic of all users, which is
+// next to Prefix, so it is not listed as a user.
+func (u *CaddyUpstream) totalKey() string {
+	return strings.TrimSuffix(u.Prefix, "/") + ".total"
+}
+
+// flushTotal adds the traffic written to users to the total of all users
+// in storage, with its lock acquired before pt.flush as flushKey does.
+func (u *CaddyUpstream) flushTotal(ctx context.Context) error {
+	pt := u.state()
+	pt.flush.Lock()
+	empty := pt.total.Up == 0 && pt.total.Down == 0
+	pt.flush.Unlock()
+	if empty {
+		return nil
+	}
+
+	k := u.totalKey()
+	if err := u.lock(ctx, k); err != nil {
+		return err
+	}
+	defer u.Storage.Unlock(ctx, k)
+
+	pt.flush.Lock()
+	defer pt.flush.Unlock()
+	total, err := u.stored(ctx, k)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return err
+	}
+	total.merge(pt.total)
+
+	b, err := marshalTraffic(u.Encoding, &total)
+	if err != nil {
+		return err
+	}
+	if err := u.Storage.Store(ctx, k, b); err != nil {
+		return err
+	}
+	pt.total = Traffic{}
+	return nil
+}
+
+// defaultRetryAttempts is ...
+const defaultRetryAttempts = 3
+
+// retryBackoff is the wait before the second attempt, which is doubled
+// for each attempt after.
+const retryBackoff = 100 * time.Millisecond
+
+// retry calls fn until it succeeds, the user is not found, a lock times out,
+// or RetryAttempts is reached, a CaddyUpstream which is not provisioned
+// tries once. A lock which is not acquired within LockTimeout is stuck, and
+// waiting for it again only delays the others.
+func (u *CaddyUpstream) retry(fn func() error) error {
+	backoff := retryBackoff
+	for i := 1; ; i++ {
+		err := fn()
+		if err == nil || errors.Is(err, ErrUserNotFound) || isLockTimeout(err) || i >= u.RetryAttempts {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// state returns pending traffic, a CaddyUpstream which is not
+// provisioned has its own pending traffic.
+func (u *CaddyUpstream) state() *pendingTraffic {
+	if p := atomic.LoadPointer(&u.pt); p != nil {
+		return (*pendingTraffic)(p)
+	}
+	atomic.CompareAndSwapPointer(&u.pt, nil, unsafe.Pointer(&pendingTraffic{}))
+	return (*pendingTraffic)(atomic.LoadPointer(&u.pt))
+}
+
+// pending returns pending traffic of the user.
+func (u *CaddyUpstream) pending(k string) Traffic {
+	return u.state().get(k)
+}
+
+// normalizePrefix checks the prefix ends with a separator and cleans it,
+// so that keys of different prefixes never collide.
+func (u *CaddyUpstream) normalizePrefix() error {
+	if u.Prefix == "" {
+		u.Prefix = "trojan/"
+		return nil
+	}
+	if !strings.HasSuffix(u.Prefix, "/") {
+		return fmt.Errorf("prefix %v must end with /", u.Prefix)
+	}
+	prefix := strings.TrimPrefix(path.Clean("/"+u.Prefix), "/")
+	if prefix == "" {
+		return fmt.Errorf("prefix %v is the root of storage", u.Prefix)
+	}
+	u.Prefix = prefix + "/"
 	return nil
 }
 
 // AddKey is ...
-func (u *CaddyUpstream) AddKey(k string) error {
-	key := u.Prefix + base64.StdEncoding.EncodeToString(utils.StringToByteSlice(k))
-	if u.Storage.Exists(context.Background(), key) {
+func (u *CaddyUpstream) AddKey(ctx context.Context, k string) error {
+	return u.addKey(ctx, u.Prefix+base64.StdEncoding.EncodeToString(utils.StringToByteSlice(k)))
+}
+
+// addKey is ...
+func (u *CaddyUpstream) addKey(ctx context.Context, key string) error {
+	u.cache.del(key)
+	if u.Storage.Exists(ctx, key) {
 		return nil
 	}
 	traffic := Traffic{
-		Up:   0,
-		Down: 0,
+		Up:      0,
+		Down:    0,
+		Enabled: true,
 	}
-	b, err := json.Marshal(&traffic)
+	b, err := marshalTraffic(u.Encoding, &traffic)
 	if err != nil {
 		return err
 	}
-	return u.Storage.Store(context.Background(), key, b)
+	return u.Storage.Store(ctx, key, b)
 }
 
 // Add is ...
-func (u *CaddyUpstream) Add(s string) error {
+func (u *CaddyUpstream) Add(ctx context.Context, s string) error {
 	b := [trojan.HeaderLen]byte{}
-	trojan.GenKey(s, b[:])
-	return u.AddKey(utils.ByteSliceToString(b[:]))
+	u.GenKey(s, b[:])
+	return u.AddKey(ctx, utils.ByteSliceToString(b[:]))
 }
 
 // DelKey is ...
-func (u *CaddyUpstream) DelKey(k string) error {
+func (u *CaddyUpstream) DelKey(ctx context.Context, k string) error {
 	key := u.Prefix + base64.StdEncoding.EncodeToString(utils.StringToByteSlice(k))
-	if !u.Storage.Exists(context.Background(), key) {
+	pt := u.state()
+	pt.flush.Lock()
+	defer pt.flush.Unlock()
+	return u.delKey(ctx, key)
+}
+
+// delKey is ...
+// It must be called with pt.flush held.
+func (u *CaddyUpstream) delKey(ctx context.Context, key string) error {
+	u.state().del(key)
+	defer u.cache.del(key)
+	if !u.Storage.Exists(ctx, key) {
 		return nil
 	}
-	return u.Storage.Delete(context.Background(), key)
+	return u.Storage.Delete(ctx, key)
+}
+
+// batchWorkers is the number of concurrent storage operations of a batch.
+const batchWorkers = 16
+
+// batch calls fn with every key by batchWorkers goroutines, and returns
+// the first error.
+func batch(keys []string, fn func(string) error) error {
+	ch := make(chan string)
+	errCh := make(chan error, batchWorkers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < batchWorkers && i < len(keys); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range ch {
+				if err := fn(k); err != nil {
+					select {
+					case errCh <- err:
+					default:
+					}
+				}
+			}
+		}()
+	}
+	for _, k := range keys {
+		ch <- k
+	}
+	close(ch)
+	wg.Wait()
+
+	select {
+	case err := <-errCh:
+		return err
+	default:
+		return nil
+	}
+}
+
+// AddKeys is ...
+// Storage has no batch operations, so keys are added concurrently.
+func (u *CaddyUpstream) AddKeys(ctx context.Context, keys []string) error {
+	return batch(keys, func(k string) error {
+		return u.addKey(ctx, u.Prefix+base64.StdEncoding.EncodeToString(utils.StringToByteSlice(k)))
+	})
+}
+
+// DelKeys is ...
+func (u *CaddyUpstream) DelKeys(ctx context.Context, keys []string) error {
+	pt := u.state()
+	pt.flush.Lock()
+	defer pt.flush.Unlock()
+	return batch(keys, func(k string) error {
+		return u.delKey(ctx, u.Prefix+base64.StdEncoding.EncodeToString(utils.StringToByteSlice(k)))
+	})
 }
 
 // Del is ...
-func (u *CaddyUpstream) Del(s string) error {
+func (u *CaddyUpstream) Del(ctx context.Context, s string) error {
 	b := [trojan.HeaderLen]byte{}
-	trojan.GenKey(s, b[:])
-	return u.DelKey(utils.ByteSliceToString(b[:]))
+	u.GenKey(s, b[:])
+	return u.DelKey(ctx, utils.ByteSliceToString(b[:]))
 }
 
-// Range is ...
-func (u *CaddyUpstream) Range(fn func(k string, up, down int64)) {
-	// base64.StdEncoding.EncodeToString(hex.Encode(sha256.Sum224([]byte("Test1234"))))
-	const AuthLen = 76
+// BatchStorage is a certmagic.Storage which loads many keys in one read.
+// Keys which do not exist are missing in the result.
+type BatchStorage interface {
+	LoadMany(ctx context.Context, keys []string) (map[string][]byte, error)
+}
 
-	keys, err := u.Storage.List(context.Background(), u.Prefix, false)
+// Range is ...
+func (u *CaddyUpstream) Range(ctx context.Context, fn func(k string, traffic Traffic)) error {
+	if u.RangeSnapshot {
+		return u.rangeSnapshot(ctx, fn)
+	}
+	keys, err := u.Storage.List(ctx, u.Prefix, false)
 	if err != nil {
-		return
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("list users error: %w", err)
 	}
 
-	traffic := Traffic{}
 	for _, k := range keys {
-		b, err := u.Storage.Load(context.Background(), k)
+		b, err := u.Storage.Load(ctx, k)
 		if err != nil {
-			u.Logger.Error(fmt.Sprintf("load user error: %v", err))
-			continue
+			// deleted after listed
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return fmt.Errorf("load user %v error: %w", k, err)
+		}
+		traffic := Traffic{}
+		if err := unmarshalTraffic(b, &traffic); err != nil {
+			return fmt.Errorf("load user %v error: %w", k, err)
+		}
+		traffic.merge(u.pending(k))
+		fn(strings.TrimPrefix(k, u.Prefix), traffic)
+	}
+
+	return nil
+}
+
+// ListKeys lists the keys of users in storage without loading them, so a key
+// deleted after it is listed may be returned.
+func (u *CaddyUpstream) ListKeys(ctx context.Context) ([]string, error) {
+	keys, err := u.Storage.List(ctx, u.Prefix, false)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return []string{}, nil
 		}
-		if err := json.Unmarshal(b, &traffic); err != nil {
-			u.Logger.Error(fmt.Sprintf("load user error: %v", err))
+		return nil, fmt.Errorf("list users error: %w", err)
+	}
+	for i, k := range keys {
+		keys[i] = strings.TrimPrefix(k, u.Prefix)
+	}
+	return keys, nil
+}
+
+// rangeSnapshot reads all users and their pending traffic with flushes
+// held, and calls fn after.
+func (u *CaddyUpstream) rangeSnapshot(ctx context.Context, fn func(k string, traffic Traffic)) error {
+	pt := u.state()
+	pt.flush.Lock()
+	keys, err := u.Storage.List(ctx, u.Prefix, false)
+	if err != nil {
+		pt.flush.Unlock()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("list users error: %w", err)
+	}
+	values, err := u.loadMany(ctx, keys)
+	pending := pt.all()
+	pt.flush.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		b, ok := values[k]
+		if !ok {
+			// deleted after listed
 			continue
 		}
-		fn(strings.TrimPrefix(k, u.Prefix), traffic.Up, traffic.Down)
+		traffic := Traffic{}
+		if err := unmarshalTraffic(b, &traffic); err != nil {
+			return fmt.Errorf("load user %v error: %w", k, err)
+		}
+		traffic.merge(pending[k])
+		fn(strings.TrimPrefix(k, u.Prefix), traffic)
+	}
+	return nil
+}
+
+// loadMany loads the keys from storage, in one read if it is a BatchStorage.
+func (u *CaddyUpstream) loadMany(ctx context.Context, keys []string) (map[string][]byte, error) {
+	if bs, ok := u.Storage.(BatchStorage); ok {
+		values, err := bs.LoadMany(ctx, keys)
+		if err != nil {
+			return nil, fmt.Errorf("load users error: %w", err)
+		}
+		return values, nil
 	}
+	values := make(map[string][]byte, len(keys))
+	for _, k := range keys {
+		b, err := u.Storage.Load(ctx, k)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("load user %v error: %w", k, err)
+		}
+		values[k] = b
+	}
+	return values, nil
+}
+
+// load is ...
+func (u *CaddyUpstream) load(ctx context.Context, k string) (Traffic, error) {
+	traffic, err := u.stored(ctx, k)
+	if err != nil {
+		return traffic, err
+	}
+
+	traffic.merge(u.pending(k))
+	return traffic, nil
+}
+
+// stored loads the user from storage, without pending traffic.
+func (u *CaddyUpstream) stored(ctx context.Context, k string) (Traffic, error) {
+	traffic := Traffic{}
+
+	b, err := u.Storage.Load(ctx, k)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return traffic, ErrUserNotFound
+		}
+		return traffic, err
+	}
+
+	err = unmarshalTraffic(b, &traffic)
+	return traffic, err
+}
+
+// defaultLockTimeout is ...
+const defaultLockTimeout = 10 * time.Second
+
+// lock acquires the lock of the user in storage within LockTimeout, a
+// CaddyUpstream which is not provisioned waits for defaultLockTimeout.
+func (u *CaddyUpstream) lock(ctx context.Context, k string) error {
+	timeout := time.Duration(u.LockTimeout)
+	if timeout <= 0 {
+		timeout = defaultLockTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := u.Storage.Lock(ctx, k); err != nil {
+		return fmt.Errorf("lock user %v error: %w", k, err)
+	}
+	return nil
+}
 
-	return
+// isLockTimeout reports whether err is of a lock which is not acquired
+// within LockTimeout.
+func isLockTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// update is ...
+func (u *CaddyUpstream) update(ctx context.Context, k string, fn func(*Traffic)) error {
+	if err := u.lock(ctx, k); err != nil {
+		return err
+	}
+	defer u.Storage.Unlock(ctx, k)
+	return u.updateLocked(ctx, k, fn)
+}
+
+// updateLocked is update of a user whose lock is held.
+func (u *CaddyUpstream) updateLocked(ctx context.Context, k string, fn func(*Traffic)) error {
+	traffic, err := u.stored(ctx, k)
+	if err != nil {
+		return err
+	}
+
+	fn(&traffic)
+
+	b, err := marshalTraffic(u.Encoding, &traffic)
+	if err != nil {
+		return err
+	}
+
+	return u.Storage.Store(ctx, k, b)
 }
 
 // Validate is ...
-func (u *CaddyUpstream) Validate(k string) bool {
-	// base64.StdEncoding.EncodeToString(hex.Encode(sha256.Sum224([]byte("Test1234"))))
-	const AuthLen = 76
-	if len(k) == AuthLen {
-		k = u.Prefix + k
-	} else {
-		k = u.Prefix + base64.StdEncoding.EncodeToString(utils.StringToByteSlice(k))
+func (u *CaddyUpstream) Validate(ctx context.Context, k string) (bool, error) {
+	k = u.Prefix + normalizeKey(k)
+	if u.cache.get(k) {
+		return true, nil
 	}
-	return u.Storage.Exists(context.Background(), k)
+
+	traffic, err := u.load(ctx, k)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	valid := traffic.Enabled && !traffic.Expired(time.Now())
+	// only valid users are cached, so unknown keys can not evict them,
+	// and a user is not cached after it expires
+	if valid {
+		u.cache.setUntil(k, traffic.ExpiresAt)
+	}
+	return valid, nil
 }
 
-// Consume is ...
-func (u *CaddyUpstream) Consume(k string, nr, nw int64) error {
-	// base64.StdEncoding.EncodeToString(hex.Encode(sha256.Sum224([]byte("Test1234"))))
-	const AuthLen = 76
-	if len(k) == AuthLen {
-		k = u.Prefix + k
-	} else {
-		k = u.Prefix + base64.StdEncoding.EncodeToString(utils.StringToByteSlice(k))
+// Has is ...
+func (u *CaddyUpstream) Has(ctx context.Context, k string) (bool, error) {
+	k = u.Prefix + normalizeKey(k)
+	if _, err := u.stored(ctx, k); err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			return false, nil
+		}
+		return false, err
 	}
+	return true, nil
+}
+
+// CacheStats returns the number of hits and misses of the validation cache.
+func (u *CaddyUpstream) CacheStats() (hits, misses uint64) {
+	return u.cache.stats()
+}
+
+// Consume is ...
+func (u *CaddyUpstream) Consume(ctx context.Context, k string, proto Protocol, nr, nw int64) error {
+	k = u.Prefix + normalizeKey(k)
+
+	u.state().add(k, consumed(proto, nr, nw))
+	return nil
+}
 
-	u.Storage.Lock(context.Background(), k)
-	defer u.Storage.Unlock(context.Background(), k)
+// GetTraffic is ...
+func (u *CaddyUpstream) GetTraffic(ctx context.Context, k string) (int64, int64, error) {
+	k = u.Prefix + normalizeKey(k)
 
-	b, err := u.Storage.Load(context.Background(), k)
+	traffic, err := u.load(ctx, k)
 	if err != nil {
+		return 0, 0, err
+	}
+	return traffic.Up, traffic.Down, nil
+}
+
+// TotalTraffic is ...
+// The total is read from one record of storage, which is written once for
+// each flush, so it does not read every user.
+func (u *CaddyUpstream) TotalTraffic(ctx context.Context) (int64, int64, error) {
+	pt := u.state()
+	// held, so traffic being flushed is counted once
+	pt.flush.Lock()
+	defer pt.flush.Unlock()
+
+	total, err := u.stored(ctx, u.totalKey())
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return 0, 0, fmt.Errorf("load total traffic error: %w", err)
+	}
+	total.merge(pt.total)
+	total.merge(pt.sum())
+	return total.Up, total.Down, nil
+}
+
+// ResetTraffic is ...
+func (u *CaddyUpstream) ResetTraffic(ctx context.Context, k string) error {
+	k = u.Prefix + normalizeKey(k)
+
+	// the lock of the user first, as flushKey does
+	if err := u.lock(ctx, k); err != nil {
 		return err
 	}
+	defer u.Storage.Unlock(ctx, k)
 
-	traffic := Traffic{}
-	if err := json.Unmarshal(b, &traffic); err != nil {
+	pt := u.state()
+	pt.flush.Lock()
+	defer pt.flush.Unlock()
+	pt.del(k)
+
+	err := u.updateLocked(ctx, k, func(traffic *Traffic) {
+		traffic.Up, traffic.UpUDP = 0, 0
+		traffic.Down, traffic.DownUDP = 0, 0
+		traffic.QuotaNotified = false
+	})
+	if errors.Is(err, ErrUserNotFound) {
+		return nil
+	}
+	return err
+}
+
+// SetQuota is ...
+func (u *CaddyUpstream) SetQuota(ctx context.Context, k string, n int64) error {
+	k = u.Prefix + normalizeKey(k)
+
+	return u.update(ctx, k, func(traffic *Traffic) {
+		traffic.Quota, traffic.QuotaNotified = n, false
+	})
+}
+
+// QuotaExceeded is ...
+func (u *CaddyUpstream) QuotaExceeded(ctx context.Context, k string) bool {
+	k = u.Prefix + normalizeKey(k)
+
+	traffic, err := u.load(ctx, k)
+	if err != nil {
+		u.Logger.Error(fmt.Sprintf("load user error: %v", err))
+		return false
+	}
+	return traffic.QuotaExceeded()
+}
+
+// SetEnabled is ...
+func (u *CaddyUpstream) SetEnabled(ctx context.Context, k string, enabled bool) error {
+	k = u.Prefix + normalizeKey(k)
+
+	// after updated, so a concurrent Validate can not cache the old state
+	defer u.cache.del(k)
+	return u.update(ctx, k, func(traffic *Traffic) {
+		traffic.Enabled = enabled
+	})
+}
+
+// Count is ...
+func (u *CaddyUpstream) Count(ctx context.Context) (int, error) {
+	keys, err := u.Storage.List(ctx, u.Prefix, false)
+	if err != nil {
+		// no user is added yet
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("list users error: %w", err)
+	}
+	return len(keys), nil
+}
+
+// SetRateLimit is ...
+func (u *CaddyUpstream) SetRateLimit(ctx context.Context, k string, n int64) error {
+	k = u.Prefix + normalizeKey(k)
+
+	return u.update(ctx, k, func(traffic *Traffic) {
+		traffic.RateLimit = n
+	})
+}
+
+// GetRateLimit is ...
+func (u *CaddyUpstream) GetRateLimit(ctx context.Context, k string) (int64, error) {
+	k = u.Prefix + normalizeKey(k)
+
+	traffic, err := u.load(ctx, k)
+	if err != nil {
+		return 0, err
+	}
+	return traffic.RateLimit, nil
+}
+
+// UnmarshalCaddyfile is ...
+func (u *MemoryUpstream) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.Next() {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		subdirective := d.Val()
+		switch subdirective {
+		case "snapshot_path":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.SnapshotPath = d.Val()
+		case "snapshot_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parse snapshot_interval error: %v", err)
+			}
+			u.SnapshotInterval = caddy.Duration(dur)
+		case "users":
+			args := d.RemainingArgs()
+			if len(args) < 1 {
+				return d.ArgErr()
+			}
+			u.Users = append(u.Users, args...)
+		case "keys":
+			args := d.RemainingArgs()
+			if len(args) < 1 {
+				return d.ArgErr()
+			}
+			key := [trojan.HeaderLen]byte{}
+			for _, v := range args {
+				if err := trojan.ParseHexKey(v, key[:]); err != nil {
+					return d.Err(err.Error())
+				}
+			}
+			u.Keys = append(u.Keys, args...)
+		case "users_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.UsersFile = d.Val()
+		case "users_env":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.UsersEnv = d.Val()
+		case "key_scheme":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.Scheme = d.Val()
+		default:
+			return d.Errf("unknown memory subdirective: %v", subdirective)
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile is ...
+func (u *CaddyUpstream) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.Next() {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		subdirective := d.Val()
+		switch subdirective {
+		case "prefix":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.Prefix = d.Val()
+		case "flush_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parse flush_interval error: %v", err)
+			}
+			u.FlushInterval = caddy.Duration(dur)
+		case "cache_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("parse cache_size error: %v", err)
+			}
+			u.CacheSize = n
+		case "cache_ttl":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parse cache_ttl error: %v", err)
+			}
+			u.CacheTTL = caddy.Duration(dur)
+		case "retry_attempts":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("parse retry_attempts error: %v", err)
+			}
+			u.RetryAttempts = n
+		case "lock_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parse lock_timeout error: %v", err)
+			}
+			if dur <= 0 {
+				return d.Errf("invalid lock_timeout: %v", d.Val())
+			}
+			u.LockTimeout = caddy.Duration(dur)
+		case "range_snapshot":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			u.RangeSnapshot = true
+		case "encoding":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if err := checkEncoding(d.Val()); err != nil {
+				return d.Errf("parse encoding error: %v", err)
+			}
+			u.Encoding = d.Val()
+		case "key_scheme":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.Scheme = d.Val()
+		default:
+			return d.Errf("unknown caddy subdirective: %v", subdirective)
+		}
+	}
+	return nil
+}
+
+// GetLastSeen is ...
+func (u *CaddyUpstream) GetLastSeen(ctx context.Context, k string) (time.Time, error) {
+	k = u.Prefix + normalizeKey(k)
+
+	traffic, err := u.load(ctx, k)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return traffic.LastSeen, nil
+}
+
+// SetLabels is ...
+func (u *CaddyUpstream) SetLabels(ctx context.Context, k string, labels map[string]string) error {
+	k = u.Prefix + normalizeKey(k)
+
+	return u.update(ctx, k, func(traffic *Traffic) {
+		traffic.Labels = copyLabels(labels)
+	})
+}
+
+// GetLabels is ...
+func (u *CaddyUpstream) GetLabels(ctx context.Context, k string) (map[string]string, error) {
+	k = u.Prefix + normalizeKey(k)
+
+	traffic, err := u.stored(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+	return traffic.Labels, nil
+}
+
+// SetExpiry is ...
+func (u *CaddyUpstream) SetExpiry(ctx context.Context, k string, t time.Time) error {
+	k = u.Prefix + normalizeKey(k)
+
+	// after updated, so a concurrent Validate can not cache the old state
+	defer u.cache.del(k)
+	return u.update(ctx, k, func(traffic *Traffic) {
+		traffic.ExpiresAt = t
+	})
+}
+
+// SetSourceIP is ...
+func (u *CaddyUpstream) SetSourceIP(ctx context.Context, k string, ip net.IP) error {
+	if err := checkSourceIP(ip); err != nil {
 		return err
 	}
 
-	traffic.Up += nr
-	traffic.Down += nw
+	k = u.Prefix + normalizeKey(k)
 
-	b, err = json.Marshal(&traffic)
+	return u.update(ctx, k, func(traffic *Traffic) {
+		traffic.SourceIP = sourceIPString(ip)
+	})
+}
+
+// GetSourceIP is ...
+func (u *CaddyUpstream) GetSourceIP(ctx context.Context, k string) (net.IP, error) {
+	k = u.Prefix + normalizeKey(k)
+
+	traffic, err := u.stored(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+	return net.ParseIP(traffic.SourceIP), nil
+}
+
+// SetAllowedCIDRs is ...
+func (u *CaddyUpstream) SetAllowedCIDRs(ctx context.Context, k string, cidrs []string) error {
+	cidrs, err := parseAllowedCIDRs(cidrs)
 	if err != nil {
 		return err
 	}
 
-	return u.Storage.Store(context.Background(), k, b)
+	k = u.Prefix + normalizeKey(k)
+
+	return u.update(ctx, k, func(traffic *Traffic) {
+		traffic.AllowedCIDRs = cidrs
+	})
+}
+
+// GetAllowedCIDRs is ...
+func (u *CaddyUpstream) GetAllowedCIDRs(ctx context.Context, k string) ([]string, error) {
+	k = u.Prefix + normalizeKey(k)
+
+	traffic, err := u.stored(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+	return traffic.AllowedCIDRs, nil
+}
+
+// pingKey is the sentinel key checked by Ping of CaddyUpstream.
+const pingKey = ".ping"
+
+// Ping stats a sentinel key, which does not need to exist. Exists of
+// storage hides errors, so Stat is used.
+func (u *CaddyUpstream) Ping(ctx context.Context) error {
+	if _, err := u.Storage.Stat(ctx, u.Prefix+pingKey); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("stat storage error: %w", err)
+	}
+	return nil
 }
 
 var (
-	_ Upstream = (*CaddyUpstream)(nil)
-	_ Upstream = (*MemoryUpstream)(nil)
+	_ Upstream              = (*CaddyUpstream)(nil)
+	_ KeyGenerator          = (*CaddyUpstream)(nil)
+	_ Upstream              = (*MemoryUpstream)(nil)
+	_ KeyGenerator          = (*MemoryUpstream)(nil)
+	_ caddy.Provisioner     = (*CaddyUpstream)(nil)
+	_ caddy.CleanerUpper    = (*CaddyUpstream)(nil)
+	_ caddy.Provisioner     = (*MemoryUpstream)(nil)
+	_ caddy.CleanerUpper    = (*MemoryUpstream)(nil)
+	_ caddyfile.Unmarshaler = (*CaddyUpstream)(nil)
+	_ caddyfile.Unmarshaler = (*MemoryUpstream)(nil)
 )
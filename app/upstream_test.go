@@ -0,0 +1,1614 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+func TestMemoryUpstreamValidatePartialKey(t *testing.T) {
+	u := &MemoryUpstream{}
+	if err := u.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	if ok, err := u.Validate(context.Background(), utils.ByteSliceToString(key[:])); err != nil || !ok {
+		t.Fatalf("validate user error: %s", key[:])
+	}
+
+	for _, n := range []int{0, 1, trojan.HeaderLen / 2, trojan.HeaderLen - 1} {
+		b := key
+		for i := n; i < trojan.HeaderLen; i++ {
+			b[i] ^= 0x01
+		}
+		if ok, err := u.Validate(context.Background(), utils.ByteSliceToString(b[:])); err != nil || ok {
+			t.Errorf("validate partially correct key with %v correct bytes", n)
+		}
+		if ok, err := u.Validate(context.Background(), utils.ByteSliceToString(key[:n])); err != nil || ok {
+			t.Errorf("validate truncated key with %v bytes", n)
+		}
+	}
+}
+
+func TestMemoryUpstreamProvision(t *testing.T) {
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := utils.ByteSliceToString(key[:])
+
+	// shards are allocated by the first user, with or without Provision
+	for _, v := range []struct {
+		Name      string
+		Provision bool
+	}{
+		{Name: "provisioned", Provision: true},
+		{Name: "not provisioned"},
+	} {
+		u := &MemoryUpstream{}
+		if v.Provision {
+			if err := u.Provision(caddy.Context{Context: context.Background()}); err != nil {
+				t.Fatalf("provision error: %v", err)
+			}
+		}
+		if err := u.SetQuota(context.Background(), k, 1); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("set quota of %v upstream without users error: %v", v.Name, err)
+		}
+		if err := u.Add(context.Background(), "test1234"); err != nil {
+			t.Fatalf("add user to %v upstream error: %v", v.Name, err)
+		}
+		if ok, err := u.Validate(context.Background(), k); !ok || err != nil {
+			t.Errorf("validate user of %v upstream error: %v, %v", v.Name, ok, err)
+		}
+		if err := u.Cleanup(); err != nil {
+			t.Errorf("cleanup %v upstream error: %v", v.Name, err)
+		}
+	}
+}
+
+func TestCaddyUpstreamPrefix(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+
+	u1 := &CaddyUpstream{Prefix: "trojan/a/", Storage: storage, Logger: zap.NewNop()}
+	u2 := &CaddyUpstream{Prefix: "/trojan//b/", Storage: storage, Logger: zap.NewNop()}
+	for _, u := range []*CaddyUpstream{u1, u2} {
+		if err := u.normalizePrefix(); err != nil {
+			t.Fatalf("normalize prefix error: %v", err)
+		}
+	}
+	if u2.Prefix != "trojan/b/" {
+		t.Errorf("normalize prefix error: %v", u2.Prefix)
+	}
+
+	if err := u1.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	if ok, err := u1.Validate(context.Background(), utils.ByteSliceToString(key[:])); err != nil || !ok {
+		t.Errorf("validate user error with prefix %v", u1.Prefix)
+	}
+	if ok, err := u2.Validate(context.Background(), utils.ByteSliceToString(key[:])); err != nil || ok {
+		t.Errorf("validate user of prefix %v with prefix %v", u1.Prefix, u2.Prefix)
+	}
+	if n, err := u2.Count(context.Background()); err != nil || n != 0 {
+		t.Errorf("count users error: got %v, %v, want 0", n, err)
+	}
+	u2.Range(context.Background(), func(k string, traffic Traffic) {
+		t.Errorf("range user of prefix %v with prefix %v", u1.Prefix, u2.Prefix)
+	})
+
+	for _, prefix := range []string{"trojan", "/", "../"} {
+		u := &CaddyUpstream{Prefix: prefix}
+		if err := u.normalizePrefix(); err == nil {
+			t.Errorf("normalize invalid prefix %v: got %v", prefix, u.Prefix)
+		}
+	}
+}
+
+func TestCaddyUpstreamFlush(t *testing.T) {
+	u := &CaddyUpstream{Storage: &certmagic.FileStorage{Path: t.TempDir()}, Logger: zap.NewNop()}
+	if err := u.normalizePrefix(); err != nil {
+		t.Fatalf("normalize prefix error: %v", err)
+	}
+	if err := u.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	for i := 0; i < 10; i++ {
+		u.Consume(context.Background(), utils.ByteSliceToString(key[:]), ProtocolTCP, 1, 2)
+	}
+
+	check := func(stage string) {
+		up, down, err := u.GetTraffic(context.Background(), utils.ByteSliceToString(key[:]))
+		if err != nil {
+			t.Fatalf("get traffic %v error: %v", stage, err)
+		}
+		if up != 10 || down != 20 {
+			t.Errorf("get traffic %v error: up %v, down %v", stage, up, down)
+		}
+	}
+	check("before flush")
+	if err := u.Flush(); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+	check("after flush")
+}
+
+// lockErrorStorage is a certmagic.Storage which fails to lock.
+type lockErrorStorage struct {
+	*certmagic.FileStorage
+}
+
+// Lock is ...
+func (lockErrorStorage) Lock(ctx context.Context, name string) error {
+	return errors.New("lock error")
+}
+
+// flakyStorage is a certmagic.Storage which fails to store a number of times.
+type flakyStorage struct {
+	*certmagic.FileStorage
+	failures int32
+}
+
+// Store is ...
+func (s *flakyStorage) Store(ctx context.Context, key string, value []byte) error {
+	if atomic.AddInt32(&s.failures, -1) >= 0 {
+		return errors.New("storage is unavailable")
+	}
+	return s.FileStorage.Store(ctx, key, value)
+}
+
+func TestCaddyUpstreamFlushRetry(t *testing.T) {
+	storage := &flakyStorage{FileStorage: &certmagic.FileStorage{Path: t.TempDir()}}
+	u := &CaddyUpstream{Storage: storage, Logger: zap.NewNop(), RetryAttempts: 3}
+	if err := u.normalizePrefix(); err != nil {
+		t.Fatalf("normalize prefix error: %v", err)
+	}
+	if err := u.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := utils.ByteSliceToString(key[:])
+
+	check := func(when string, up, down int64) {
+		t.Helper()
+		if nr, nw, err := u.GetTraffic(context.Background(), k); err != nil || nr != up || nw != down {
+			t.Errorf("traffic %v error: got %v, %v, %v, want %v, %v", when, nr, nw, err, up, down)
+		}
+	}
+
+	// a blip shorter than the attempts is retried in the flush
+	atomic.StoreInt32(&storage.failures, 2)
+	u.Consume(context.Background(), k, ProtocolTCP, 1, 2)
+	if err := u.Flush(); err != nil {
+		t.Fatalf("flush with retry error: %v", err)
+	}
+	if n := len(u.state().take()); n != 0 {
+		t.Errorf("traffic is pending after retried: %v users", n)
+	}
+	check("after retried", 1, 2)
+
+	// an outage longer than the attempts keeps the traffic in memory
+	atomic.StoreInt32(&storage.failures, 3)
+	u.Consume(context.Background(), k, ProtocolTCP, 3, 4)
+	if err := u.Flush(); err == nil {
+		t.Fatalf("flush during outage")
+	}
+	check("during outage", 4, 6)
+	u.Consume(context.Background(), k, ProtocolTCP, 5, 6)
+	if err := u.Flush(); err != nil {
+		t.Fatalf("flush after outage error: %v", err)
+	}
+	stored, err := u.stored(context.Background(), u.Prefix+base64.StdEncoding.EncodeToString(key[:]))
+	if err != nil || stored.Up != 9 || stored.Down != 12 {
+		t.Errorf("stored traffic after outage error: %+v, %v", stored, err)
+	}
+}
+
+func TestCaddyUpstreamLockError(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	u := &CaddyUpstream{Storage: storage, Logger: zap.NewNop()}
+	if err := u.normalizePrefix(); err != nil {
+		t.Fatalf("normalize prefix error: %v", err)
+	}
+	if err := u.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	u.Storage = lockErrorStorage{FileStorage: storage}
+	if err := u.SetQuota(context.Background(), utils.ByteSliceToString(key[:]), 1); err == nil {
+		t.Errorf("set quota without lock")
+	}
+}
+
+// stuckStorage is a certmagic.Storage whose locks are held by others
+// forever.
+type stuckStorage struct {
+	*certmagic.FileStorage
+}
+
+// Lock is ...
+func (stuckStorage) Lock(ctx context.Context, name string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestCaddyUpstreamLockTimeout(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	u := &CaddyUpstream{Storage: storage, Logger: zap.NewNop(), RetryAttempts: 1, LockTimeout: caddy.Duration(50 * time.Millisecond)}
+	if err := u.normalizePrefix(); err != nil {
+		t.Fatalf("normalize prefix error: %v", err)
+	}
+	if err := u.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := utils.ByteSliceToString(key[:])
+
+	u.Storage = stuckStorage{FileStorage: storage}
+	u.Consume(context.Background(), k, ProtocolTCP, 1, 2)
+	flushed := make(chan error, 1)
+	go func() { flushed <- u.Flush() }()
+	select {
+	case err := <-flushed:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("flush with a stuck lock error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("flush is blocked by a stuck lock")
+	}
+
+	// the traffic is buffered until the lock is released
+	u.Consume(context.Background(), k, ProtocolTCP, 3, 4)
+	if up, down, err := u.GetTraffic(context.Background(), k); err != nil || up != 4 || down != 6 {
+		t.Errorf("buffered traffic error: %v, %v, %v", up, down, err)
+	}
+	u.Storage = storage
+	if err := u.Flush(); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+	stored, err := u.stored(context.Background(), u.Prefix+base64.StdEncoding.EncodeToString(key[:]))
+	if err != nil || stored.Up != 4 || stored.Down != 6 {
+		t.Errorf("stored traffic error: %+v, %v", stored, err)
+	}
+}
+
+// stuckKeyStorage is a certmagic.Storage of which the lock of one key is
+// held by others forever, and locked is closed once it is waited for.
+type stuckKeyStorage struct {
+	*certmagic.FileStorage
+	key    string
+	locked chan struct{}
+	once   sync.Once
+}
+
+// Lock is ...
+func (s *stuckKeyStorage) Lock(ctx context.Context, name string) error {
+	if name != s.key {
+		return s.FileStorage.Lock(ctx, name)
+	}
+	s.once.Do(func() { close(s.locked) })
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestCaddyUpstreamLockTimeoutOfOneUser(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	u := &CaddyUpstream{Storage: storage, Logger: zap.NewNop(), RetryAttempts: 3, LockTimeout: caddy.Duration(time.Second)}
+	if err := u.normalizePrefix(); err != nil {
+		t.Fatalf("normalize prefix error: %v", err)
+	}
+	keys := [2]string{}
+	for i, v := range []string{"test1234", "test5678"} {
+		if err := u.Add(context.Background(), v); err != nil {
+			t.Fatalf("add user error: %v", err)
+		}
+		key := [trojan.HeaderLen]byte{}
+		trojan.GenKey(v, key[:])
+		keys[i] = utils.ByteSliceToString(key[:])
+		u.Consume(context.Background(), keys[i], ProtocolTCP, 1, 2)
+	}
+
+	// only the lock of the first user is stuck
+	stuck := &stuckKeyStorage{FileStorage: storage, key: u.Prefix + normalizeKey(keys[0]), locked: make(chan struct{})}
+	u.Storage = stuck
+	start := time.Now()
+	flushed := make(chan error, 1)
+	go func() { flushed <- u.Flush() }()
+
+	// the flush waiting for the lock does not block others
+	<-stuck.locked
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if up, down, err := u.TotalTraffic(context.Background()); err != nil || up != 2 || down != 4 {
+			t.Errorf("total traffic during flush error: %v, %v, %v", up, down, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatalf("total traffic is blocked by a stuck lock")
+	}
+
+	if err := <-flushed; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("flush with a stuck lock error: %v", err)
+	}
+	// a lock which times out is not retried
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("flush with a stuck lock takes %v", d)
+	}
+
+	// the other user is flushed in the same pass, and the stuck one is buffered
+	stored, err := u.stored(context.Background(), u.Prefix+normalizeKey(keys[1]))
+	if err != nil || stored.Up != 1 || stored.Down != 2 {
+		t.Errorf("stored traffic of other user error: %+v, %v", stored, err)
+	}
+	if v := u.pending(u.Prefix + normalizeKey(keys[0])); v.Up != 1 || v.Down != 2 {
+		t.Errorf("buffered traffic of stuck user error: %+v", v)
+	}
+	if up, down, err := u.TotalTraffic(context.Background()); err != nil || up != 2 || down != 4 {
+		t.Errorf("total traffic after flush error: %v, %v, %v", up, down, err)
+	}
+}
+
+// statErrorStorage is a certmagic.Storage which is not reachable.
+type statErrorStorage struct {
+	*certmagic.FileStorage
+}
+
+// Stat is ...
+func (statErrorStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	return certmagic.KeyInfo{}, errors.New("connection refused")
+}
+
+func TestUpstreamPing(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	u := &CaddyUpstream{Storage: storage, Logger: zap.NewNop()}
+	if err := u.normalizePrefix(); err != nil {
+		t.Fatalf("normalize prefix error: %v", err)
+	}
+	// the sentinel key does not exist
+	if err := u.Ping(context.Background()); err != nil {
+		t.Errorf("ping caddy upstream error: %v", err)
+	}
+	u.Storage = statErrorStorage{FileStorage: storage}
+	if err := u.Ping(context.Background()); err == nil {
+		t.Errorf("ping unreachable storage")
+	}
+
+	if err := (&MemoryUpstream{}).Ping(context.Background()); err != nil {
+		t.Errorf("ping memory upstream error: %v", err)
+	}
+}
+
+// listErrorStorage is a certmagic.Storage which fails to list.
+type listErrorStorage struct {
+	*certmagic.FileStorage
+}
+
+// List is ...
+func (listErrorStorage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	return nil, errors.New("list error")
+}
+
+func TestCaddyUpstreamRangeError(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	u := &CaddyUpstream{Storage: storage, Logger: zap.NewNop()}
+	if err := u.normalizePrefix(); err != nil {
+		t.Fatalf("normalize prefix error: %v", err)
+	}
+	if err := u.Range(context.Background(), func(k string, traffic Traffic) {}); err != nil {
+		t.Errorf("range empty storage error: %v", err)
+	}
+
+	u.Storage = listErrorStorage{FileStorage: storage}
+	if err := u.Range(context.Background(), func(k string, traffic Traffic) {}); err == nil {
+		t.Errorf("range without error when storage fails")
+	}
+}
+
+func TestCaddyUpstreamCount(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	u := &CaddyUpstream{Storage: storage, Logger: zap.NewNop()}
+	if err := u.normalizePrefix(); err != nil {
+		t.Fatalf("normalize prefix error: %v", err)
+	}
+	// the prefix does not exist before the first user
+	if n, err := u.Count(context.Background()); err != nil || n != 0 {
+		t.Errorf("count empty storage error: %v, %v", n, err)
+	}
+	if err := u.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	if n, err := u.Count(context.Background()); err != nil || n != 1 {
+		t.Errorf("count users error: %v, %v", n, err)
+	}
+
+	u.Storage = listErrorStorage{FileStorage: storage}
+	if _, err := u.Count(context.Background()); err == nil {
+		t.Errorf("count without error when storage fails")
+	}
+}
+
+func TestMemoryUpstreamRangeConsume(t *testing.T) {
+	u := &MemoryUpstream{}
+	if err := u.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	// fn is called without locks, so it may consume
+	n := 0
+	if err := u.Range(context.Background(), func(k string, traffic Traffic) {
+		n++
+		u.Consume(context.Background(), k, ProtocolTCP, 1, 2)
+	}); err != nil || n != 1 {
+		t.Fatalf("range error: %v, %v", n, err)
+	}
+	if err := u.Range(context.Background(), func(k string, traffic Traffic) {
+		if traffic.Up != 1 || traffic.Down != 2 {
+			t.Errorf("range traffic error: %v, %v", traffic.Up, traffic.Down)
+		}
+	}); err != nil {
+		t.Errorf("range error: %v", err)
+	}
+}
+
+// batchStorage is a BatchStorage which fails to load keys one by one.
+type batchStorage struct {
+	loadErrorStorage
+	reads int
+}
+
+// LoadMany is ...
+func (s *batchStorage) LoadMany(ctx context.Context, keys []string) (map[string][]byte, error) {
+	s.reads++
+	mm := map[string][]byte{}
+	for _, k := range keys {
+		b, err := s.FileStorage.Load(ctx, k)
+		if err != nil {
+			continue
+		}
+		mm[k] = b
+	}
+	return mm, nil
+}
+
+func TestCaddyUpstreamRangeSnapshot(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	u := &CaddyUpstream{Storage: storage, Logger: zap.NewNop(), RangeSnapshot: true}
+	if err := u.normalizePrefix(); err != nil {
+		t.Fatalf("normalize prefix error: %v", err)
+	}
+	for _, v := range []string{"test1234", "test5678"} {
+		if err := u.Add(context.Background(), v); err != nil {
+			t.Fatalf("add user error: %v", err)
+		}
+		key := [trojan.HeaderLen]byte{}
+		trojan.GenKey(v, key[:])
+		u.Consume(context.Background(), utils.ByteSliceToString(key[:]), ProtocolTCP, 1, 2)
+	}
+
+	// check ranges the users with pending traffic
+	check := func() {
+		n := 0
+		if err := u.Range(context.Background(), func(k string, traffic Traffic) {
+			n++
+			if traffic.Up != 1 || traffic.Down != 2 {
+				t.Errorf("range traffic error: %v, %v", traffic.Up, traffic.Down)
+			}
+		}); err != nil || n != 2 {
+			t.Errorf("range error: %v, %v", n, err)
+		}
+	}
+	check()
+
+	bs := &batchStorage{loadErrorStorage: loadErrorStorage{FileStorage: storage}}
+	u.Storage = bs
+	check()
+	if bs.reads != 1 {
+		t.Errorf("batch reads error: %v", bs.reads)
+	}
+}
+
+// loadErrorStorage is a certmagic.Storage which fails to load.
+type loadErrorStorage struct {
+	*certmagic.FileStorage
+}
+
+// Load is ...
+func (loadErrorStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	return nil, errors.New("load error")
+}
+
+func TestCaddyUpstreamValidateError(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	u := &CaddyUpstream{Storage: storage, Logger: zap.NewNop()}
+	if err := u.normalizePrefix(); err != nil {
+		t.Fatalf("normalize prefix error: %v", err)
+	}
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	if ok, err := u.Validate(context.Background(), utils.ByteSliceToString(key[:])); err != nil || ok {
+		t.Errorf("validate unknown user error: %v, %v", ok, err)
+	}
+
+	if err := u.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	u.Storage = loadErrorStorage{FileStorage: storage}
+	if ok, err := u.Validate(context.Background(), utils.ByteSliceToString(key[:])); err == nil || ok {
+		t.Errorf("validate without error when storage fails: %v, %v", ok, err)
+	}
+}
+
+func TestCaddyUpstreamCache(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	u := &CaddyUpstream{Storage: storage, Logger: zap.NewNop(), cache: newValidationCache(8, time.Hour)}
+	if err := u.normalizePrefix(); err != nil {
+		t.Fatalf("normalize prefix error: %v", err)
+	}
+	if err := u.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	if ok, err := u.Validate(context.Background(), utils.ByteSliceToString(key[:])); err != nil || !ok {
+		t.Fatalf("validate user error: %v, %v", ok, err)
+	}
+	// cached, not loaded from storage
+	u.Storage = loadErrorStorage{FileStorage: storage}
+	if ok, err := u.Validate(context.Background(), utils.ByteSliceToString(key[:])); err != nil || !ok {
+		t.Errorf("validate cached user error: %v, %v", ok, err)
+	}
+	if hits, misses := u.CacheStats(); hits != 1 || misses != 1 {
+		t.Errorf("cache stats error: hits %v, misses %v", hits, misses)
+	}
+
+	u.Storage = storage
+	if err := u.Del(context.Background(), "test1234"); err != nil {
+		t.Fatalf("delete user error: %v", err)
+	}
+	if ok, err := u.Validate(context.Background(), utils.ByteSliceToString(key[:])); err != nil || ok {
+		t.Errorf("validate deleted user error: %v, %v", ok, err)
+	}
+}
+
+// blockingStorage is a certmagic.Storage which blocks the first Lock
+// until released.
+type blockingStorage struct {
+	*certmagic.FileStorage
+	n       int32
+	locked  chan struct{}
+	release chan struct{}
+}
+
+// Lock is ...
+func (s *blockingStorage) Lock(ctx context.Context, name string) error {
+	if atomic.AddInt32(&s.n, 1) == 1 {
+		close(s.locked)
+		<-s.release
+	}
+	return s.FileStorage.Lock(ctx, name)
+}
+
+func TestCaddyUpstreamResetDuringFlush(t *testing.T) {
+	storage := &blockingStorage{
+		FileStorage: &certmagic.FileStorage{Path: t.TempDir()},
+		locked:      make(chan struct{}),
+		release:     make(chan struct{}),
+	}
+	u := &CaddyUpstream{Storage: storage.FileStorage, Logger: zap.NewNop()}
+	if err := u.normalizePrefix(); err != nil {
+		t.Fatalf("normalize prefix error: %v", err)
+	}
+	if err := u.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	u.Consume(context.Background(), utils.ByteSliceToString(key[:]), ProtocolTCP, 1, 2)
+
+	u.Storage = storage
+	flushed := make(chan error, 1)
+	go func() { flushed <- u.Flush() }()
+	<-storage.locked
+
+	reset := make(chan error, 1)
+	go func() { reset <- u.ResetTraffic(context.Background(), utils.ByteSliceToString(key[:])) }()
+	// give ResetTraffic time to run ahead of the blocked flush
+	time.Sleep(50 * time.Millisecond)
+	close(storage.release)
+	if err := <-flushed; err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+	if err := <-reset; err != nil {
+		t.Fatalf("reset traffic error: %v", err)
+	}
+
+	if up, down, err := u.GetTraffic(context.Background(), utils.ByteSliceToString(key[:])); err != nil || up != 0 || down != 0 {
+		t.Errorf("traffic before reset survives: up %v, down %v, error %v", up, down, err)
+	}
+}
+
+func BenchmarkMemoryUpstreamConsume(b *testing.B) {
+	u := &MemoryUpstream{}
+
+	keys := make([]string, 1024)
+	for i := range keys {
+		key := [trojan.HeaderLen]byte{}
+		trojan.GenKey(fmt.Sprintf("test%v", i), key[:])
+		keys[i] = string(key[:])
+		u.AddKey(context.Background(), keys[i])
+	}
+
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			u.Consume(context.Background(), keys[i%len(keys)], ProtocolTCP, 1, 1)
+		}
+	})
+}
+
+func TestMemoryUpstreamSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+
+	u := &MemoryUpstream{SnapshotPath: path}
+	if err := u.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	u.Consume(context.Background(), utils.ByteSliceToString(key[:]), ProtocolTCP, 1, 2)
+	if err := u.Snapshot(); err != nil {
+		t.Fatalf("save snapshot error: %v", err)
+	}
+
+	u = &MemoryUpstream{SnapshotPath: path}
+	if err := u.state().load(path); err != nil {
+		t.Fatalf("load snapshot error: %v", err)
+	}
+	if ok, err := u.Validate(context.Background(), utils.ByteSliceToString(key[:])); err != nil || !ok {
+		t.Errorf("validate user error after loading snapshot")
+	}
+	if up, down, err := u.GetTraffic(context.Background(), utils.ByteSliceToString(key[:])); err != nil || up != 1 || down != 2 {
+		t.Errorf("get traffic error: up %v, down %v, error %v", up, down, err)
+	}
+
+	u = &MemoryUpstream{SnapshotPath: filepath.Join(t.TempDir(), "missing.json")}
+	if err := u.state().load(u.SnapshotPath); err != nil {
+		t.Errorf("load missing snapshot error: %v", err)
+	}
+}
+
+func TestMemoryUpstreamReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	ctx := caddy.Context{Context: context.Background()}
+
+	u1 := &MemoryUpstream{SnapshotPath: path}
+	if err := u1.Provision(ctx); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	if err := u1.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+
+	// the new config is provisioned before the old one is cleaned up
+	u2 := &MemoryUpstream{SnapshotPath: path}
+	if err := u2.Provision(ctx); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	u1.Consume(context.Background(), utils.ByteSliceToString(key[:]), ProtocolTCP, 1, 2)
+	if err := u1.Cleanup(); err != nil {
+		t.Fatalf("cleanup error: %v", err)
+	}
+	if err := u2.Add(context.Background(), "test5678"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	if err := u2.Cleanup(); err != nil {
+		t.Fatalf("cleanup error: %v", err)
+	}
+
+	u3 := &MemoryUpstream{SnapshotPath: path}
+	if err := u3.Provision(ctx); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	defer u3.Cleanup()
+	if up, down, err := u3.GetTraffic(context.Background(), utils.ByteSliceToString(key[:])); err != nil || up != 1 || down != 2 {
+		t.Errorf("get traffic after reload error: up %v, down %v, error %v", up, down, err)
+	}
+	if n, _ := u3.Count(context.Background()); n != 2 {
+		t.Errorf("count users after reload error: got %v, want 2", n)
+	}
+}
+
+func TestMemoryUpstreamUsersFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte("test1234\r\n\n  test5678  \n"), 0o600); err != nil {
+		t.Fatalf("write users file error: %v", err)
+	}
+	t.Setenv("TROJAN_TEST_USERS", "envpass1\nenvpass2")
+
+	// valid reports whether the password is of a user
+	u := &MemoryUpstream{Users: []string{"config12"}, UsersFile: path, UsersEnv: "TROJAN_TEST_USERS"}
+	valid := func(s string) bool {
+		key := [trojan.HeaderLen]byte{}
+		trojan.GenKey(s, key[:])
+		ok, err := u.Validate(context.Background(), utils.ByteSliceToString(key[:]))
+		if err != nil {
+			t.Fatalf("validate user error: %v", err)
+		}
+		return ok
+	}
+	if err := u.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	defer u.Cleanup()
+	for _, v := range []string{"config12", "test1234", "test5678", "envpass1", "envpass2"} {
+		if !valid(v) {
+			t.Errorf("user of %v is not added", v)
+		}
+	}
+
+	// users removed from the file are deleted, unless they are of Users
+	if err := os.WriteFile(path, []byte("test5678\nconfig12\ntest9999\n"), 0o600); err != nil {
+		t.Fatalf("write users file error: %v", err)
+	}
+	if n, err := u.loadUsers(context.Background()); n != 5 || err != nil {
+		t.Fatalf("reload users error: %v, %v", n, err)
+	}
+	for v, ok := range map[string]bool{"test1234": false, "test5678": true, "test9999": true, "config12": true, "envpass1": true} {
+		if valid(v) != ok {
+			t.Errorf("user of %v after reload: want %v", v, ok)
+		}
+	}
+
+	// the users are kept if the file is missing
+	os.Remove(path)
+	if _, err := u.loadUsers(context.Background()); err == nil {
+		t.Errorf("reload missing users file")
+	}
+	if !valid("test9999") {
+		t.Errorf("user is deleted by a failed reload")
+	}
+
+	for _, v := range []*MemoryUpstream{{UsersFile: path}, {UsersEnv: "TROJAN_TEST_MISSING"}} {
+		if err := v.Provision(caddy.Context{Context: context.Background()}); err == nil {
+			t.Errorf("provision of missing users: %+v", v)
+		}
+		v.Cleanup()
+	}
+}
+
+func TestMemoryUpstreamLastSeen(t *testing.T) {
+	u := &MemoryUpstream{}
+	if err := u.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+
+	if ts, err := u.GetLastSeen(context.Background(), utils.ByteSliceToString(key[:])); err != nil || !ts.IsZero() {
+		t.Errorf("last seen of new user error: %v, %v", ts, err)
+	}
+	u.Consume(context.Background(), utils.ByteSliceToString(key[:]), ProtocolTCP, 1, 1)
+	if ts, err := u.GetLastSeen(context.Background(), utils.ByteSliceToString(key[:])); err != nil || ts.IsZero() {
+		t.Errorf("last seen after consume error: %v, %v", ts, err)
+	}
+
+	// records stored before LastSeen was introduced
+	traffic := Traffic{}
+	if err := json.Unmarshal([]byte(`{"up":1,"down":2}`), &traffic); err != nil {
+		t.Fatalf("unmarshal traffic error: %v", err)
+	}
+	if !traffic.LastSeen.IsZero() {
+		t.Errorf("last seen of old record error: %v", traffic.LastSeen)
+	}
+}
+
+func TestAddHexKey(t *testing.T) {
+	u := &MemoryUpstream{}
+	// hex of sha224 of "abc"
+	if err := AddHexKey(context.Background(), u, "23097D223405D8228642A477BDA255B32AADBCE4BDA0B3F7E36C9DA7"); err != nil {
+		t.Fatalf("add hex key error: %v", err)
+	}
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("abc", key[:])
+	if ok, err := u.Validate(context.Background(), utils.ByteSliceToString(key[:])); err != nil || !ok {
+		t.Errorf("validate user added by hex key error")
+	}
+	if err := AddHexKey(context.Background(), u, "abc"); err == nil {
+		t.Errorf("add invalid hex key")
+	}
+}
+
+func TestMemoryUpstreamQuota(t *testing.T) {
+	u := &MemoryUpstream{}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	if err := u.SetQuota(context.Background(), utils.ByteSliceToString(key[:]), 1); err != ErrUserNotFound {
+		t.Errorf("set quota of missing user error: %v", err)
+	}
+
+	if err := u.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	u.Consume(context.Background(), utils.ByteSliceToString(key[:]), ProtocolTCP, 10, 10)
+	if u.QuotaExceeded(context.Background(), utils.ByteSliceToString(key[:])) {
+		t.Errorf("quota of user without quota is exceeded")
+	}
+
+	if err := u.SetQuota(context.Background(), utils.ByteSliceToString(key[:]), 30); err != nil {
+		t.Fatalf("set quota error: %v", err)
+	}
+	if u.QuotaExceeded(context.Background(), utils.ByteSliceToString(key[:])) {
+		t.Errorf("quota is exceeded before consuming past it")
+	}
+	u.Consume(context.Background(), utils.ByteSliceToString(key[:]), ProtocolTCP, 5, 5)
+	if !u.QuotaExceeded(context.Background(), utils.ByteSliceToString(key[:])) {
+		t.Errorf("quota is not exceeded after consuming past it")
+	}
+
+	if err := u.ResetTraffic(context.Background(), utils.ByteSliceToString(key[:])); err != nil {
+		t.Fatalf("reset traffic error: %v", err)
+	}
+	if u.QuotaExceeded(context.Background(), utils.ByteSliceToString(key[:])) {
+		t.Errorf("quota is exceeded after reset")
+	}
+}
+
+func TestMemoryUpstreamSetEnabled(t *testing.T) {
+	u := &MemoryUpstream{}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	if err := u.SetEnabled(context.Background(), utils.ByteSliceToString(key[:]), false); err != ErrUserNotFound {
+		t.Errorf("disable missing user error: %v", err)
+	}
+
+	if err := u.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	if err := u.SetEnabled(context.Background(), utils.ByteSliceToString(key[:]), false); err != nil {
+		t.Fatalf("disable user error: %v", err)
+	}
+	if ok, err := u.Validate(context.Background(), utils.ByteSliceToString(key[:])); err != nil || ok {
+		t.Errorf("validate disabled user")
+	}
+	if err := u.SetEnabled(context.Background(), utils.ByteSliceToString(key[:]), true); err != nil {
+		t.Fatalf("enable user error: %v", err)
+	}
+	if ok, err := u.Validate(context.Background(), utils.ByteSliceToString(key[:])); err != nil || !ok {
+		t.Errorf("validate enabled user error")
+	}
+}
+
+func TestTrafficUnmarshalJSON(t *testing.T) {
+	for _, v := range []struct {
+		Data    string
+		Enabled bool
+	}{
+		// records stored before Enabled was introduced
+		{Data: `{"up":1,"down":2}`, Enabled: true},
+		{Data: `{"up":1,"down":2,"enabled":true}`, Enabled: true},
+		{Data: `{"up":1,"down":2,"enabled":false}`, Enabled: false},
+	} {
+		traffic := Traffic{}
+		if err := json.Unmarshal([]byte(v.Data), &traffic); err != nil {
+			t.Fatalf("unmarshal traffic %v error: %v", v.Data, err)
+		}
+		if traffic.Enabled != v.Enabled || traffic.Up != 1 || traffic.Down != 2 {
+			t.Errorf("unmarshal traffic %v error: %+v", v.Data, traffic)
+		}
+	}
+}
+
+func TestMemoryUpstreamConsumeDeleted(t *testing.T) {
+	u := &MemoryUpstream{}
+	if err := u.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+
+	// the user is deleted during the relay
+	if err := u.Del(context.Background(), "test1234"); err != nil {
+		t.Fatalf("delete user error: %v", err)
+	}
+	u.Consume(context.Background(), utils.ByteSliceToString(key[:]), ProtocolTCP, 1, 2)
+	if n, _ := u.Count(context.Background()); n != 0 {
+		t.Errorf("consume recreates deleted user")
+	}
+
+	if err := u.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	if ok, err := u.Validate(context.Background(), utils.ByteSliceToString(key[:])); err != nil || !ok {
+		t.Errorf("validate user added again error")
+	}
+}
+
+// testBatch adds and deletes users of u in batches.
+func testBatch(t *testing.T, u Upstream) {
+	keys := make([]string, 0, 100)
+	for i := 0; i < cap(keys); i++ {
+		key := [trojan.HeaderLen]byte{}
+		trojan.GenKey(fmt.Sprintf("test%d", i), key[:])
+		keys = append(keys, string(key[:]))
+	}
+
+	if err := u.AddKeys(context.Background(), keys); err != nil {
+		t.Fatalf("add keys error: %v", err)
+	}
+	if n, err := u.Count(context.Background()); err != nil || n != len(keys) {
+		t.Errorf("count users error: got %v, %v, want %v", n, err, len(keys))
+	}
+	// existing users are kept
+	if err := u.AddKeys(context.Background(), keys[:10]); err != nil {
+		t.Fatalf("add existing keys error: %v", err)
+	}
+	if err := u.DelKeys(context.Background(), keys[:50]); err != nil {
+		t.Fatalf("delete keys error: %v", err)
+	}
+	if n, err := u.Count(context.Background()); err != nil || n != len(keys)-50 {
+		t.Errorf("count users error: got %v, %v, want %v", n, err, len(keys)-50)
+	}
+	for i, k := range keys {
+		if ok, err := u.Validate(context.Background(), k); err != nil || ok != (i >= 50) {
+			t.Errorf("validate user %v error: %v, %v", i, ok, err)
+		}
+	}
+}
+
+func TestMemoryUpstreamBatch(t *testing.T) {
+	testBatch(t, &MemoryUpstream{})
+}
+
+func TestCaddyUpstreamBatch(t *testing.T) {
+	u := &CaddyUpstream{Storage: &certmagic.FileStorage{Path: t.TempDir()}, Logger: zap.NewNop()}
+	if err := u.normalizePrefix(); err != nil {
+		t.Fatalf("normalize prefix error: %v", err)
+	}
+	testBatch(t, u)
+}
+
+// testLabels sets and gets labels of a user of u, which are cleared
+// when the user is deleted.
+func testLabels(t *testing.T, u Upstream) {
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := utils.ByteSliceToString(key[:])
+
+	labels := map[string]string{"name": "test", "email": "test@example.com"}
+	if err := u.SetLabels(context.Background(), k, labels); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("set labels of unknown user error: %v", err)
+	}
+	if err := u.AddKey(context.Background(), k); err != nil {
+		t.Fatalf("add key error: %v", err)
+	}
+	if v, err := u.GetLabels(context.Background(), k); err != nil || v != nil {
+		t.Errorf("get labels error: %v, %v", v, err)
+	}
+	if err := u.SetLabels(context.Background(), k, labels); err != nil {
+		t.Fatalf("set labels error: %v", err)
+	}
+	labels["name"] = "modified"
+	if v, err := u.GetLabels(context.Background(), k); err != nil || len(v) != 2 || v["name"] != "test" || v["email"] != "test@example.com" {
+		t.Errorf("get labels error: %v, %v", v, err)
+	}
+	// a user added again keeps its labels
+	if err := u.AddKey(context.Background(), k); err != nil {
+		t.Fatalf("add key error: %v", err)
+	}
+	if v, err := u.GetLabels(context.Background(), k); err != nil || len(v) != 2 {
+		t.Errorf("get labels of user added again error: %v, %v", v, err)
+	}
+
+	if err := u.DelKey(context.Background(), k); err != nil {
+		t.Fatalf("delete key error: %v", err)
+	}
+	if _, err := u.GetLabels(context.Background(), k); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("get labels of deleted user error: %v", err)
+	}
+	if err := u.AddKey(context.Background(), k); err != nil {
+		t.Fatalf("add key error: %v", err)
+	}
+	if v, err := u.GetLabels(context.Background(), k); err != nil || v != nil {
+		t.Errorf("get labels of user added after deleted error: %v, %v", v, err)
+	}
+}
+
+// testExpiry sets expiry of users of u, and checks that expired users are
+// not valid and are deleted by the janitor.
+func testExpiry(t *testing.T, u Upstream) {
+	key, other := [trojan.HeaderLen]byte{}, [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	trojan.GenKey("abcd1234", other[:])
+	k, o := utils.ByteSliceToString(key[:]), utils.ByteSliceToString(other[:])
+
+	if err := u.SetExpiry(context.Background(), k, time.Now()); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("set expiry of unknown user error: %v", err)
+	}
+	for _, v := range []string{k, o} {
+		if err := u.AddKey(context.Background(), v); err != nil {
+			t.Fatalf("add key error: %v", err)
+		}
+	}
+	validate := func(k string, want bool) {
+		t.Helper()
+		if ok, err := u.Validate(context.Background(), k); err != nil || ok != want {
+			t.Errorf("validate user error: got %v, %v, want %v", ok, err, want)
+		}
+	}
+
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := u.SetExpiry(context.Background(), k, expires); err != nil {
+		t.Fatalf("set expiry error: %v", err)
+	}
+	validate(k, true)
+	found := false
+	u.Range(context.Background(), func(key string, traffic Traffic) {
+		if key == base64.StdEncoding.EncodeToString([]byte(k)) {
+			found = traffic.ExpiresAt.Equal(expires)
+		}
+	})
+	if !found {
+		t.Errorf("range expiry error")
+	}
+
+	// an expired user is not valid, even if it exists
+	if err := u.SetExpiry(context.Background(), k, time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("set expiry error: %v", err)
+	}
+	validate(k, false)
+	validate(o, true)
+
+	// the zero time never expires
+	if err := u.SetExpiry(context.Background(), k, time.Time{}); err != nil {
+		t.Fatalf("set expiry error: %v", err)
+	}
+	validate(k, true)
+
+	if err := u.SetExpiry(context.Background(), k, time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("set expiry error: %v", err)
+	}
+	j := &expiryJanitor{up: u, lg: zap.NewNop()}
+	if err := j.sweep(context.Background(), time.Now()); err != nil {
+		t.Fatalf("delete expired users error: %v", err)
+	}
+	if _, _, err := u.GetTraffic(context.Background(), k); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expired user is not deleted: %v", err)
+	}
+	if _, _, err := u.GetTraffic(context.Background(), o); err != nil {
+		t.Errorf("user without expiry is deleted: %v", err)
+	}
+}
+
+// testHas checks a disabled or expired user of u exists, though it is not
+// valid.
+func testHas(t *testing.T, u Upstream) {
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := utils.ByteSliceToString(key[:])
+	has := func(k string, want bool) {
+		t.Helper()
+		if ok, err := u.Has(context.Background(), k); err != nil || ok != want {
+			t.Errorf("has user error: got %v, %v, want %v", ok, err, want)
+		}
+	}
+
+	has(k, false)
+	if err := u.AddKey(context.Background(), k); err != nil {
+		t.Fatalf("add key error: %v", err)
+	}
+	has(k, true)
+	has(base64.StdEncoding.EncodeToString(key[:]), true)
+
+	if err := u.SetEnabled(context.Background(), k, false); err != nil {
+		t.Fatalf("set enabled error: %v", err)
+	}
+	if err := u.SetExpiry(context.Background(), k, time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("set expiry error: %v", err)
+	}
+	if ok, _ := u.Validate(context.Background(), k); ok {
+		t.Errorf("disabled user is valid")
+	}
+	has(k, true)
+
+	if err := u.DelKey(context.Background(), k); err != nil {
+		t.Fatalf("delete key error: %v", err)
+	}
+	has(k, false)
+}
+
+// testSourceIP sets and gets the source ip of a user of u, which must be
+// bound to the host.
+func testSourceIP(t *testing.T, u Upstream) {
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := utils.ByteSliceToString(key[:])
+
+	if err := u.SetSourceIP(context.Background(), k, net.IPv4(127, 0, 0, 1)); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("set source ip of unknown user error: %v", err)
+	}
+	if _, err := u.GetSourceIP(context.Background(), k); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("get source ip of unknown user error: %v", err)
+	}
+	if err := u.AddKey(context.Background(), k); err != nil {
+		t.Fatalf("add key error: %v", err)
+	}
+	if ip, err := u.GetSourceIP(context.Background(), k); err != nil || ip != nil {
+		t.Errorf("get default source ip error: %v, %v", ip, err)
+	}
+
+	if err := u.SetSourceIP(context.Background(), k, net.IPv4(127, 0, 0, 1)); err != nil {
+		t.Fatalf("set source ip error: %v", err)
+	}
+	if ip, err := u.GetSourceIP(context.Background(), k); err != nil || !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("get source ip error: %v, %v", ip, err)
+	}
+	found := false
+	u.Range(context.Background(), func(key string, traffic Traffic) {
+		found = traffic.SourceIP == "127.0.0.1"
+	})
+	if !found {
+		t.Errorf("range source ip error")
+	}
+
+	// TEST-NET-1 is not bound to the host
+	if err := u.SetSourceIP(context.Background(), k, net.IPv4(192, 0, 2, 1)); !errors.Is(err, ErrSourceIPNotBound) {
+		t.Errorf("set unbound source ip error: %v", err)
+	}
+	if err := u.SetSourceIP(context.Background(), k, nil); err != nil {
+		t.Fatalf("clear source ip error: %v", err)
+	}
+	if ip, err := u.GetSourceIP(context.Background(), k); err != nil || ip != nil {
+		t.Errorf("get cleared source ip error: %v, %v", ip, err)
+	}
+}
+
+// testAllowedCIDRs sets and gets the allowed networks of a user of u, which
+// are stored in the canonical form.
+func testAllowedCIDRs(t *testing.T, u Upstream) {
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := utils.ByteSliceToString(key[:])
+
+	if err := u.SetAllowedCIDRs(context.Background(), k, []string{"10.0.0.0/8"}); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("set allowed cidrs of unknown user error: %v", err)
+	}
+	if _, err := u.GetAllowedCIDRs(context.Background(), k); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("get allowed cidrs of unknown user error: %v", err)
+	}
+	if err := u.AddKey(context.Background(), k); err != nil {
+		t.Fatalf("add key error: %v", err)
+	}
+	if cidrs, err := u.GetAllowedCIDRs(context.Background(), k); err != nil || cidrs != nil {
+		t.Errorf("get default allowed cidrs error: %v, %v", cidrs, err)
+	}
+
+	want := []string{"10.0.0.0/8", "2001:db8::/32", "192.0.2.1/32"}
+	if err := u.SetAllowedCIDRs(context.Background(), k, []string{"10.1.2.3/8", "2001:DB8::/32", "192.0.2.1"}); err != nil {
+		t.Fatalf("set allowed cidrs error: %v", err)
+	}
+	if cidrs, err := u.GetAllowedCIDRs(context.Background(), k); err != nil || !reflect.DeepEqual(cidrs, want) {
+		t.Errorf("get allowed cidrs error: %v, %v", cidrs, err)
+	}
+	found := false
+	u.Range(context.Background(), func(key string, traffic Traffic) {
+		found = reflect.DeepEqual(traffic.AllowedCIDRs, want)
+	})
+	if !found {
+		t.Errorf("range allowed cidrs error")
+	}
+
+	if err := u.SetAllowedCIDRs(context.Background(), k, []string{"10.0.0.0/33"}); !errors.Is(err, ErrInvalidCIDR) {
+		t.Errorf("set invalid allowed cidr error: %v", err)
+	}
+	if err := u.SetAllowedCIDRs(context.Background(), k, nil); err != nil {
+		t.Fatalf("clear allowed cidrs error: %v", err)
+	}
+	if cidrs, err := u.GetAllowedCIDRs(context.Background(), k); err != nil || cidrs != nil {
+		t.Errorf("get cleared allowed cidrs error: %v, %v", cidrs, err)
+	}
+}
+
+// testListKeys checks ListKeys returns the keys of users as Range does.
+func testListKeys(t *testing.T, u Upstream) {
+	keys, err := u.ListKeys(context.Background())
+	if err != nil || len(keys) != 0 {
+		t.Fatalf("list keys of no user error: %v, %v", keys, err)
+	}
+	for _, v := range []string{"test1234", "test5678", "test9012"} {
+		if err := u.Add(context.Background(), v); err != nil {
+			t.Fatalf("add user error: %v", err)
+		}
+	}
+	// consumed traffic is not a user, like the total of CaddyUpstream
+	u.Range(context.Background(), func(k string, _ Traffic) {
+		u.Consume(context.Background(), k, ProtocolTCP, 1, 1)
+	})
+
+	want := []string{}
+	u.Range(context.Background(), func(k string, _ Traffic) { want = append(want, k) })
+	keys, err = u.ListKeys(context.Background())
+	if err != nil {
+		t.Fatalf("list keys error: %v", err)
+	}
+	sort.Strings(want)
+	sort.Strings(keys)
+	if len(want) != 3 || !reflect.DeepEqual(keys, want) {
+		t.Errorf("list keys error: got %v, want %v", keys, want)
+	}
+}
+
+// testQuotaEvent checks EventQuotaExceeded is fired once for each crossing
+// of the quota.
+func testQuotaEvent(t *testing.T, u Upstream) {
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := utils.ByteSliceToString(key[:])
+	if err := u.AddKey(context.Background(), k); err != nil {
+		t.Fatalf("add key error: %v", err)
+	}
+	if err := u.SetQuota(context.Background(), k, 100); err != nil {
+		t.Fatalf("set quota error: %v", err)
+	}
+
+	events := []Event{}
+	off := GlobalEvents.On(func(ev Event) {
+		if ev.Name == EventQuotaExceeded && ev.Data["key"] == base64.StdEncoding.EncodeToString(key[:]) {
+			events = append(events, ev)
+		}
+	})
+	defer off()
+
+	consume := func(nr, nw int64) {
+		t.Helper()
+		if err := u.Consume(context.Background(), k, ProtocolTCP, nr, nw); err != nil {
+			t.Fatalf("consume error: %v", err)
+		}
+		if f, ok := u.(interface{ Flush() error }); ok {
+			if err := f.Flush(); err != nil {
+				t.Fatalf("flush error: %v", err)
+			}
+		}
+	}
+	check := func(when string, n int) {
+		t.Helper()
+		if len(events) != n {
+			t.Fatalf("quota event %v error: got %v events, want %v", when, len(events), n)
+		}
+	}
+
+	consume(30, 30)
+	check("below quota", 0)
+	consume(30, 30)
+	check("crossing quota", 1)
+	if ev := events[0]; ev.Data["up"] != int64(60) || ev.Data["down"] != int64(60) || ev.Data["quota"] != int64(100) {
+		t.Errorf("quota event error: %v", ev.Data)
+	}
+	consume(10, 10)
+	check("exceeding quota", 1)
+
+	// a new quota is crossed again
+	if err := u.SetQuota(context.Background(), k, 200); err != nil {
+		t.Fatalf("set quota error: %v", err)
+	}
+	consume(30, 30)
+	check("crossing new quota", 2)
+
+	// traffic is reset for a new period
+	if err := u.ResetTraffic(context.Background(), k); err != nil {
+		t.Fatalf("reset traffic error: %v", err)
+	}
+	consume(50, 50)
+	check("below quota after reset", 2)
+	consume(50, 50)
+	check("crossing quota after reset", 3)
+}
+
+// testProtocol consumes traffic of TCP and UDP, and checks the breakdown
+// reported by Range before and after flushed.
+func testProtocol(t *testing.T, u Upstream) {
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := utils.ByteSliceToString(key[:])
+	if err := u.AddKey(context.Background(), k); err != nil {
+		t.Fatalf("add key error: %v", err)
+	}
+
+	check := func(when string, want Traffic) {
+		t.Helper()
+		n := 0
+		if err := u.Range(context.Background(), func(_ string, traffic Traffic) {
+			n++
+			if traffic.Up != want.Up || traffic.Down != want.Down || traffic.UpUDP != want.UpUDP || traffic.DownUDP != want.DownUDP {
+				t.Errorf("traffic %v error: got %+v, want %+v", when, traffic, want)
+			}
+			if traffic.UpTCP()+traffic.UpUDP != traffic.Up || traffic.DownTCP()+traffic.DownUDP != traffic.Down {
+				t.Errorf("traffic %v error: %+v", when, traffic)
+			}
+		}); err != nil || n != 1 {
+			t.Fatalf("range users %v error: %v, %v users", when, err, n)
+		}
+	}
+
+	u.Consume(context.Background(), k, ProtocolTCP, 1, 2)
+	u.Consume(context.Background(), k, ProtocolUDP, 3, 4)
+	check("before flushed", Traffic{Up: 4, Down: 6, UpUDP: 3, DownUDP: 4})
+	if f, ok := u.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			t.Fatalf("flush error: %v", err)
+		}
+	}
+	check("after flushed", Traffic{Up: 4, Down: 6, UpUDP: 3, DownUDP: 4})
+	if up, down, err := u.GetTraffic(context.Background(), k); err != nil || up != 4 || down != 6 {
+		t.Errorf("get traffic error: %v, %v, %v", up, down, err)
+	}
+
+	if err := u.ResetTraffic(context.Background(), k); err != nil {
+		t.Fatalf("reset traffic error: %v", err)
+	}
+	check("after reset", Traffic{})
+}
+
+// testTotalTraffic consumes traffic of two users, and checks the total
+// is kept after flushed, reset and deleted, and excludes unknown users.
+func testTotalTraffic(t *testing.T, u Upstream) {
+	keys := []string{}
+	for _, password := range []string{"test1234", "test5678"} {
+		key := [trojan.HeaderLen]byte{}
+		trojan.GenKey(password, key[:])
+		keys = append(keys, string(key[:]))
+	}
+	if err := u.AddKeys(context.Background(), keys); err != nil {
+		t.Fatalf("add keys error: %v", err)
+	}
+
+	flush := func() {
+		t.Helper()
+		if f, ok := u.(interface{ Flush() error }); ok {
+			if err := f.Flush(); err != nil {
+				t.Fatalf("flush error: %v", err)
+			}
+		}
+	}
+	check := func(when string, up, down int64) {
+		t.Helper()
+		nr, nw, err := u.TotalTraffic(context.Background())
+		if err != nil || nr != up || nw != down {
+			t.Errorf("total traffic %v error: %v, %v, %v", when, nr, nw, err)
+		}
+	}
+
+	check("of no traffic", 0, 0)
+	u.Consume(context.Background(), keys[0], ProtocolTCP, 1, 2)
+	u.Consume(context.Background(), keys[1], ProtocolUDP, 3, 4)
+	check("before flushed", 4, 6)
+	flush()
+	check("after flushed", 4, 6)
+	u.Consume(context.Background(), keys[0], ProtocolTCP, 10, 20)
+	check("of flushed and pending", 14, 26)
+	flush()
+
+	if err := u.ResetTraffic(context.Background(), keys[0]); err != nil {
+		t.Fatalf("reset traffic error: %v", err)
+	}
+	check("after reset", 14, 26)
+	if err := u.DelKey(context.Background(), keys[1]); err != nil {
+		t.Fatalf("del key error: %v", err)
+	}
+	check("after deleted", 14, 26)
+
+	// traffic of an unknown user is dropped by the flush at the latest
+	unknown := [trojan.HeaderLen]byte{}
+	trojan.GenKey("unknown", unknown[:])
+	u.Consume(context.Background(), string(unknown[:]), ProtocolTCP, 100, 200)
+	flush()
+	check("of unknown user", 14, 26)
+}
+
+func TestMemoryUpstreamProtocol(t *testing.T) {
+	testProtocol(t, &MemoryUpstream{})
+}
+
+func TestCaddyUpstreamProtocol(t *testing.T) {
+	u := &CaddyUpstream{Storage: &certmagic.FileStorage{Path: t.TempDir()}, Logger: zap.NewNop()}
+	if err := u.normalizePrefix(); err != nil {
+		t.Fatalf("normalize prefix error: %v", err)
+	}
+	testProtocol(t, u)
+}
+
+func TestMemoryUpstreamTotalTraffic(t *testing.T) {
+	testTotalTraffic(t, &MemoryUpstream{})
+}
+
+func TestCaddyUpstreamTotalTraffic(t *testing.T) {
+	u := &CaddyUpstream{Storage: &certmagic.FileStorage{Path: t.TempDir()}, Logger: zap.NewNop()}
+	if err := u.normalizePrefix(); err != nil {
+		t.Fatalf("normalize prefix error: %v", err)
+	}
+	testTotalTraffic(t, u)
+
+	// the total is not a user
+	if n, err := u.Count(context.Background()); err != nil || n != 1 {
+		t.Errorf("count users error: %v, %v", n, err)
+	}
+}
+
+func TestMemoryUpstreamLabels(t *testing.T) {
+	testLabels(t, &MemoryUpstream{})
+}
+
+func TestCaddyUpstreamLabels(t *testing.T) {
+	u := &CaddyUpstream{Storage: &certmagic.FileStorage{Path: t.TempDir()}, Logger: zap.NewNop()}
+	if err := u.normalizePrefix(); err != nil {
+		t.Fatalf("normalize prefix error: %v", err)
+	}
+	testLabels(t, u)
+}
+
+func TestMemoryUpstreamExpiry(t *testing.T) {
+	testExpiry(t, &MemoryUpstream{})
+}
+
+func TestCaddyUpstreamExpiry(t *testing.T) {
+	u := &CaddyUpstream{Storage: &certmagic.FileStorage{Path: t.TempDir()}, Logger: zap.NewNop()}
+	if err := u.normalizePrefix(); err != nil {
+		t.Fatalf("normalize prefix error: %v", err)
+	}
+	// an expired user is not valid even if it is cached
+	u.cache = newValidationCache(16, time.Hour)
+	testExpiry(t, u)
+}
+
+func TestMemoryUpstreamHas(t *testing.T) {
+	testHas(t, &MemoryUpstream{})
+}
+
+func TestCaddyUpstreamHas(t *testing.T) {
+	u := &CaddyUpstream{Storage: &certmagic.FileStorage{Path: t.TempDir()}, Logger: zap.NewNop()}
+	if err := u.normalizePrefix(); err != nil {
+		t.Fatalf("normalize prefix error: %v", err)
+	}
+	testHas(t, u)
+}
+
+func TestMemoryUpstreamSourceIP(t *testing.T) {
+	testSourceIP(t, &MemoryUpstream{})
+}
+
+func TestCaddyUpstreamSourceIP(t *testing.T) {
+	u := &CaddyUpstream{Storage: &certmagic.FileStorage{Path: t.TempDir()}, Logger: zap.NewNop()}
+	if err := u.normalizePrefix(); err != nil {
+		t.Fatalf("normalize prefix error: %v", err)
+	}
+	testSourceIP(t, u)
+}
+
+func TestMemoryUpstreamAllowedCIDRs(t *testing.T) {
+	testAllowedCIDRs(t, &MemoryUpstream{})
+}
+
+func TestCaddyUpstreamAllowedCIDRs(t *testing.T) {
+	u := &CaddyUpstream{Storage: &certmagic.FileStorage{Path: t.TempDir()}, Logger: zap.NewNop()}
+	if err := u.normalizePrefix(); err != nil {
+		t.Fatalf("normalize prefix error: %v", err)
+	}
+	testAllowedCIDRs(t, u)
+}
+
+func TestMemoryUpstreamListKeys(t *testing.T) {
+	testListKeys(t, &MemoryUpstream{})
+}
+
+func TestCaddyUpstreamListKeys(t *testing.T) {
+	u := &CaddyUpstream{Storage: &certmagic.FileStorage{Path: t.TempDir()}, Logger: zap.NewNop()}
+	if err := u.normalizePrefix(); err != nil {
+		t.Fatalf("normalize prefix error: %v", err)
+	}
+	testListKeys(t, u)
+}
+
+func TestMemoryUpstreamQuotaEvent(t *testing.T) {
+	testQuotaEvent(t, &MemoryUpstream{})
+}
+
+func TestCaddyUpstreamQuotaEvent(t *testing.T) {
+	u := &CaddyUpstream{Storage: &certmagic.FileStorage{Path: t.TempDir()}, Logger: zap.NewNop()}
+	if err := u.normalizePrefix(); err != nil {
+		t.Fatalf("normalize prefix error: %v", err)
+	}
+	testQuotaEvent(t, u)
+}
+
+func TestMemoryUpstreamConcurrentConsume(t *testing.T) {
+	u := &MemoryUpstream{}
+	if err := u.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := utils.ByteSliceToString(key[:])
+
+	const goroutines, times = 32, 1000
+
+	done := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		defer close(errCh)
+		last := int64(0)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			err := u.Range(context.Background(), func(_ string, traffic Traffic) {
+				up, down := traffic.Up, traffic.Down
+				// each Consume adds 1 up and 2 down, which are seen together
+				if down != 2*up || up < last {
+					select {
+					case errCh <- fmt.Errorf("inconsistent traffic: up %v, down %v, last up %v", up, down, last):
+					default:
+					}
+				}
+				last = up
+			})
+			if err != nil {
+				errCh <- err
+				return
+			}
+		}
+	}()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < times; j++ {
+				u.Consume(context.Background(), k, ProtocolTCP, 1, 2)
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	if err := <-errCh; err != nil {
+		t.Error(err)
+	}
+
+	if up, down, err := u.GetTraffic(context.Background(), k); err != nil || up != goroutines*times || down != 2*goroutines*times {
+		t.Errorf("get traffic error: up %v, down %v, error %v", up, down, err)
+	}
+}
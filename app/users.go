@@ -0,0 +1,120 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+// parseUsers returns the passwords of s, one per line, of which spaces
+// around are trimmed and empty lines are skipped.
+func parseUsers(s string) []string {
+	users := []string{}
+	for _, v := range strings.Split(s, "\n") {
+		if v = strings.TrimSpace(v); v != "" {
+			users = append(users, v)
+		}
+	}
+	return users
+}
+
+// readUsers returns the passwords of UsersFile and UsersEnv. An env which
+// is not set is an error, as is a file which is missing.
+func (u *MemoryUpstream) readUsers() ([]string, error) {
+	users := []string{}
+	if u.UsersEnv != "" {
+		s, ok := os.LookupEnv(u.UsersEnv)
+		if !ok {
+			return nil, fmt.Errorf("users_env %v is not set", u.UsersEnv)
+		}
+		users = append(users, parseUsers(s)...)
+	}
+	if u.UsersFile != "" {
+		b, err := os.ReadFile(u.UsersFile)
+		if err != nil {
+			return nil, fmt.Errorf("read users_file error: %w", err)
+		}
+		users = append(users, parseUsers(string(b))...)
+	}
+	return users, nil
+}
+
+// loadUsers adds the users of UsersFile and UsersEnv, and deletes those
+// loaded before which are not in them anymore, unless they are of Users or
+// Keys. The passwords are never logged.
+func (u *MemoryUpstream) loadUsers(ctx context.Context) (int, error) {
+	users, err := u.readUsers()
+	if err != nil {
+		return 0, err
+	}
+
+	key := [trojan.HeaderLen]byte{}
+	keys := make(map[string]struct{}, len(users))
+	for _, v := range users {
+		u.GenKey(v, key[:])
+		keys[string(key[:])] = struct{}{}
+	}
+	// keys of the config, which are kept
+	kept := make(map[string]struct{}, len(u.Users)+len(u.Keys))
+	for _, v := range u.Users {
+		u.GenKey(v, key[:])
+		kept[string(key[:])] = struct{}{}
+	}
+	for _, v := range u.Keys {
+		if trojan.ParseHexKey(v, key[:]) == nil {
+			kept[string(key[:])] = struct{}{}
+		}
+	}
+
+	state := u.state()
+	state.fileMu.Lock()
+	defer state.fileMu.Unlock()
+	for k := range keys {
+		if err := u.AddKey(ctx, k); err != nil {
+			return 0, err
+		}
+	}
+	for k := range state.fileKeys {
+		_, ok := keys[k]
+		_, keep := kept[k]
+		if !ok && !keep {
+			u.DelKey(ctx, k)
+		}
+	}
+	state.fileKeys = keys
+	return len(keys), nil
+}
+
+// notifyUsers returns the channel of SIGHUP of watchUsers, which is
+// notified before Provision returns, so a SIGHUP never kills the process.
+func notifyUsers() chan os.Signal {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	return ch
+}
+
+// watchUsers loads the users again on SIGHUP of ch, until the upstream is
+// cleaned up. The users are kept if the file fails to be read.
+func (u *MemoryUpstream) watchUsers(ch chan os.Signal) {
+	defer u.wg.Done()
+	defer signal.Stop(ch)
+
+	for {
+		select {
+		case <-u.closed:
+			return
+		case <-ch:
+			n, err := u.loadUsers(context.Background())
+			if err != nil {
+				u.lg.Error(fmt.Sprintf("reload users error: %v", err))
+				continue
+			}
+			u.lg.Info(fmt.Sprintf("reload %v users of users_file", n))
+		}
+	}
+}
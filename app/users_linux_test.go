@@ -0,0 +1,48 @@
+package app
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+func TestMemoryUpstreamUsersFileSIGHUP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte("test1234\n"), 0o600); err != nil {
+		t.Fatalf("write users file error: %v", err)
+	}
+	u := &MemoryUpstream{UsersFile: path}
+	if err := u.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	defer u.Cleanup()
+
+	if err := os.WriteFile(path, []byte("test5678\n"), 0o600); err != nil {
+		t.Fatalf("write users file error: %v", err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatalf("send SIGHUP error: %v", err)
+	}
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test5678", key[:])
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if ok, _ := u.Validate(context.Background(), utils.ByteSliceToString(key[:])); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("users file is not reloaded by SIGHUP")
+		}
+	}
+	if n, _ := u.Count(context.Background()); n != 1 {
+		t.Errorf("count users after SIGHUP error: %v", n)
+	}
+}
@@ -1,11 +1,15 @@
 package handler
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -34,11 +38,64 @@ type Handler struct {
 	WebSocket bool `json:"websocket,omitempty"`
 	Connect   bool `json:"connect_method,omitempty"`
 	Verbose   bool `json:"verbose,omitempty"`
+	// WebSocketPath is the path of websocket requests, websocket requests of
+	// other paths are passed to the next handler. Empty means any path.
+	WebSocketPath string `json:"websocket_path,omitempty"`
+	// MaxConnections is the max number of live connections of a user, 0 means no limit.
+	MaxConnections int32 `json:"max_connections,omitempty"`
+	// OutboundProxyProtocol sends a PROXY protocol v2 header of the address of
+	// the client to TCP destinations, before relaying.
+	OutboundProxyProtocol bool `json:"outbound_proxy_protocol,omitempty"`
+	// HeaderTimeout is the time of reading the trojan header and the request
+	// of a websocket connection, default is 10s. A negative value disables it.
+	HeaderTimeout caddy.Duration `json:"header_timeout,omitempty"`
+	// ClientCertAuth authorizes a client presenting a certificate of a user,
+	// whatever the password of the trojan header is. The password of the
+	// user is the hex of the SHA256 fingerprint of the certificate.
+	ClientCertAuth bool `json:"client_cert_auth,omitempty"`
+	// StreamPath is the path of trojan over a stream of http2 or http3, which
+	// carries trojan in the body of a POST request and of its response.
+	StreamPath string `json:"stream_path,omitempty"`
+	// GRPCService is the service name of trojan over grpc, which carries
+	// trojan in the bidirectional stream of /{service}/Tun, as trojan-go does.
+	GRPCService string `json:"grpc_service,omitempty"`
+	// AccountingOff records no traffic of users, for privacy, which skips
+	// Consume of the upstream, so users are listed with zero traffic, and
+	// quotas do not apply. Users are still validated, and rate limited.
+	AccountingOff bool `json:"accounting_off,omitempty"`
+	// Mux accepts the mux of trojan-go, which multiplexes connections of
+	// the client over one connection by smux, of which every connection is
+	// a relay of the same user.
+	Mux bool `json:"mux,omitempty"`
+	app.DomainFilter
+	app.SocketOptions
 
 	// Upstream is ...
 	Upstream app.Upstream `json:"-,omitempty"`
 	// Proxy is ...
 	Proxy app.Proxy `json:"-,omitempty"`
+	// Limiters is ...
+	Limiters *app.Limiters `json:"-,omitempty"`
+	// Tenants is ...
+	Tenants *app.Tenants `json:"-,omitempty"`
+	// Connections is ...
+	Connections *app.Connections `json:"-,omitempty"`
+	// Replays is ...
+	Replays *app.Replays `json:"-,omitempty"`
+	// AuthLimiter is ...
+	AuthLimiter *app.AuthLimiter `json:"-,omitempty"`
+	// Metrics is ...
+	Metrics *app.Metrics `json:"-,omitempty"`
+	// Relays is ...
+	Relays *app.Relays `json:"-,omitempty"`
+	// Accounting is ...
+	Accounting *app.Accounting `json:"-,omitempty"`
+	// AccessLog is ...
+	AccessLog *app.AccessLog `json:"-,omitempty"`
+	// AuthFailures is ...
+	AuthFailures *app.AuthFailureLogger `json:"-,omitempty"`
+	// Buffers is ...
+	Buffers *trojan.BufferPool `json:"-,omitempty"`
 	// Logger is ...
 	Logger *zap.Logger `json:"-,omitempty"`
 	// Upgrader is ...
@@ -56,6 +113,21 @@ func (Handler) CaddyModule() caddy.ModuleInfo {
 // Provision implements caddy.Provisioner.
 func (m *Handler) Provision(ctx caddy.Context) error {
 	m.Logger = ctx.Logger(m)
+	if m.WebSocketPath != "" && !strings.HasPrefix(m.WebSocketPath, "/") {
+		return fmt.Errorf("websocket path must start with /: %v", m.WebSocketPath)
+	}
+	if m.StreamPath != "" && !strings.HasPrefix(m.StreamPath, "/") {
+		return fmt.Errorf("stream path must start with /: %v", m.StreamPath)
+	}
+	if strings.Contains(m.GRPCService, "/") {
+		return fmt.Errorf("grpc service must not contain /: %v", m.GRPCService)
+	}
+	if m.HeaderTimeout == 0 {
+		m.HeaderTimeout = caddy.Duration(trojan.DefaultHeaderTimeout)
+	}
+	if err := m.DomainFilter.Provision(); err != nil {
+		return err
+	}
 	if !ctx.AppIsConfigured(app.CaddyAppID) {
 		return errors.New("trojan is not configured")
 	}
@@ -63,9 +135,24 @@ func (m *Handler) Provision(ctx caddy.Context) error {
 	if err != nil {
 		return err
 	}
+	off := app.AccountingOff()
 	app := mod.(*app.App)
 	m.Upstream = app.Upstream()
 	m.Proxy = app.Proxy()
+	m.Limiters = app.Limiters()
+	m.Tenants = app.Tenants()
+	m.Connections = app.Connections()
+	m.Replays = app.Replays()
+	m.AuthLimiter = app.AuthLimiter()
+	m.Metrics = app.Metrics()
+	m.Relays = app.Relays()
+	m.Accounting = app.Accounting()
+	if m.AccountingOff {
+		m.Accounting = off
+	}
+	m.AccessLog = app.AccessLog()
+	m.AuthFailures = app.AuthFailureLog().Logger(m.Logger)
+	m.Buffers = app.Buffers()
 	return nil
 }
 
@@ -82,31 +169,61 @@ func (m *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 			return next.ServeHTTP(w, r)
 		}
 		auth := strings.TrimPrefix(r.Header.Get("Proxy-Authorization"), "Basic ")
-		if len(auth) != AuthLen {
+		if len(auth) != AuthLen && !(m.ClientCertAuth && r.TLS != nil && len(r.TLS.PeerCertificates) > 0) {
+			return next.ServeHTTP(w, r)
+		}
+		if !m.AuthLimiter.Allow(r.RemoteAddr) {
+			m.Metrics.Reject(app.ResultBanned)
 			return next.ServeHTTP(w, r)
 		}
-		if ok := m.Upstream.Validate(auth); !ok {
+		t, ok := m.tenant(r)
+		if !ok {
 			return next.ServeHTTP(w, r)
 		}
-		if m.Verbose {
-			m.Logger.Info(fmt.Sprintf("handle trojan http%d from %v", r.ProtoMajor, r.RemoteAddr))
+		key, ok, err := m.validate(r, t.Upstream, auth)
+		if err != nil {
+			// not an unknown user, let the client retry later
+			m.Metrics.Reject(app.ResultUpstreamError)
+			m.Logger.Error(fmt.Sprintf("validate user error: %v", err))
+			return caddyhttp.Error(http.StatusServiceUnavailable, err)
+		}
+		if !ok {
+			m.Metrics.Reject(app.ResultAuthFailed)
+			m.AuthLimiter.Fail(r.RemoteAddr)
+			m.AuthFailures.Log(r.RemoteAddr, app.AuthFailureUnknownKey)
+			return next.ServeHTTP(w, r)
 		}
+		m.AuthLimiter.Succeed(r.RemoteAddr)
 
-		nr, nw, err := m.Proxy.Handle(r.Body, NewFlushWriter(w))
-		if err != nil {
-			m.Logger.Error(fmt.Sprintf("handle http%d error: %v", r.ProtoMajor, err))
+		c := &streamConn{Reader: r.Body, Writer: NewFlushWriter(w), Closer: r.Body}
+		err = m.relay(r, t, key, c, fmt.Sprintf("http%d", r.ProtoMajor), nil)
+		if errors.Is(err, errReplay) {
+			return next.ServeHTTP(w, r)
 		}
-		m.Upstream.Consume(auth, nr, nw)
-		return nil
+		return err
 	}
 
 	// handle websocket
-	if m.WebSocket && websocket.IsWebSocketUpgrade(r) {
+	if m.WebSocket && websocket.IsWebSocketUpgrade(r) && (m.WebSocketPath == "" || r.URL.Path == m.WebSocketPath) {
+		// a banned address is served as a web server without upgrade
+		if !m.AuthLimiter.Allow(r.RemoteAddr) {
+			m.Metrics.Reject(app.ResultBanned)
+			return next.ServeHTTP(w, r)
+		}
+		t, ok := m.tenant(r)
+		if !ok {
+			return next.ServeHTTP(w, r)
+		}
 		conn, err := m.Upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			return err
 		}
 
+		m.SocketOptions.Apply(conn.UnderlyingConn())
+		// a client stalled in the header is closed at the deadline
+		if m.HeaderTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(time.Duration(m.HeaderTimeout)))
+		}
 		c := websocket.NewConn(conn)
 		defer c.Close()
 
@@ -115,21 +232,268 @@ func (m *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 			m.Logger.Error(fmt.Sprintf("read trojan header error: %v", err))
 			return nil
 		}
-		if ok := m.Upstream.Validate(utils.ByteSliceToString(b[:trojan.HeaderLen])); !ok {
+		if err := trojan.CheckHeader(b[:]); err != nil {
+			m.Logger.Error(fmt.Sprintf("read trojan header error: %v", err))
+			m.AuthFailures.Log(r.RemoteAddr, app.AuthFailureBadHeader)
 			return nil
 		}
-		if m.Verbose {
-			m.Logger.Info(fmt.Sprintf("handle trojan websocket.Conn from %v", r.RemoteAddr))
+		key, ok, err := m.authorize(r, t.Upstream, b[:])
+		if err != nil || !ok {
+			return nil
 		}
+		// a rejection is logged, and the connection is upgraded already
+		m.relay(r, t, key, c, "websocket", func() { conn.SetReadDeadline(time.Time{}) })
+		return nil
+	}
 
-		nr, nw, err := m.Proxy.Handle(io.Reader(c), io.Writer(c))
-		if err != nil {
-			m.Logger.Error(fmt.Sprintf("handle websocket error: %v", err))
+	// handle trojan over a stream of http2/http3, as the body of a request
+	// and of its response
+	if m.StreamPath != "" && r.ProtoMajor >= 2 && r.Method == http.MethodPost && r.URL.Path == m.StreamPath {
+		return m.serveStream(w, r, next, false)
+	}
+	// handle trojan over grpc, as the Tun stream of trojan-go and v2ray
+	if m.GRPCService != "" && r.ProtoMajor == 2 && r.Method == http.MethodPost && r.URL.Path == "/"+m.GRPCService+"/Tun" &&
+		strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		return m.serveStream(w, r, next, true)
+	}
+	return next.ServeHTTP(w, r)
+}
+
+// serveStream serves trojan over the body of r and the response, which are
+// framed as messages of grpc if grpc is true. A request which is not of a
+// valid user is passed to next, with the body read again.
+func (m *Handler) serveStream(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, grpc bool) error {
+	if !m.AuthLimiter.Allow(r.RemoteAddr) {
+		m.Metrics.Reject(app.ResultBanned)
+		return next.ServeHTTP(w, r)
+	}
+	t, ok := m.tenant(r)
+	if !ok {
+		return next.ServeHTTP(w, r)
+	}
+
+	body := &peekReader{Reader: r.Body, peeked: &bytes.Buffer{}}
+	var rd io.Reader = body
+	if grpc {
+		rd = &grpcReader{Reader: body}
+	}
+	// rewind hands the request to next with the body read
+	rewind := func() error {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{Reader: io.MultiReader(body.peeked, r.Body), Closer: r.Body}
+		return next.ServeHTTP(w, r)
+	}
+
+	b := [trojan.HeaderLen + 2]byte{}
+	if _, err := io.ReadFull(rd, b[:]); err != nil {
+		return rewind()
+	}
+	if err := trojan.CheckHeader(b[:]); err != nil {
+		m.AuthFailures.Log(r.RemoteAddr, app.AuthFailureBadHeader)
+		return rewind()
+	}
+	key, ok, err := m.authorize(r, t.Upstream, b[:])
+	if err != nil {
+		// not an unknown user, let the client retry later
+		return caddyhttp.Error(http.StatusServiceUnavailable, err)
+	}
+	if !ok {
+		return rewind()
+	}
+	body.peeked = nil
+
+	if grpc {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+	}
+	w.WriteHeader(http.StatusOK)
+	fw := NewFlushWriter(w)
+	fw.Flusher.Flush()
+
+	c := &streamConn{Reader: rd, Writer: fw, Closer: r.Body}
+	if grpc {
+		c.Writer = &grpcWriter{Writer: fw}
+	}
+	name := fmt.Sprintf("http%d stream", r.ProtoMajor)
+	if grpc {
+		name = "grpc stream"
+	}
+	// a rejection is logged, and the response is written already
+	m.relay(r, t, key, c, name, nil)
+	if grpc {
+		w.Header().Set("Grpc-Status", "0")
+	}
+	return nil
+}
+
+// authorize checks the trojan header b, which has passed trojan.CheckHeader,
+// and returns the key of the valid user of up. The error is only of up.
+func (m *Handler) authorize(r *http.Request, up app.Upstream, b []byte) (string, bool, error) {
+	key, ok, err := m.validate(r, up, utils.ByteSliceToString(b[:trojan.HeaderLen]))
+	if err != nil {
+		m.Metrics.Reject(app.ResultUpstreamError)
+		m.Logger.Error(fmt.Sprintf("validate user error: %v", err))
+		return "", false, err
+	}
+	if !ok {
+		m.Metrics.Reject(app.ResultAuthFailed)
+		m.AuthLimiter.Fail(r.RemoteAddr)
+		m.AuthFailures.Log(r.RemoteAddr, app.AuthFailureUnknownKey)
+		return "", false, nil
+	}
+	m.AuthLimiter.Succeed(r.RemoteAddr)
+	return key, true, nil
+}
+
+// errReplay is the rejection of relay of a replayed header, of which a
+// CONNECT request is passed to the next handler, as of a prober.
+var errReplay = errors.New("replay")
+
+// relay relays the trojan request of the user of key of the tenant over c,
+// whose header is read. parsed is called once the request is read, if not nil.
+// A rejected request is logged, and returns errReplay or a caddyhttp.Error
+// of the status of the rejection, for a response which is not written yet.
+func (m *Handler) relay(r *http.Request, t app.Tenant, key string, c io.ReadWriteCloser, name string, parsed func()) error {
+	if !m.Replays.Check(key, r.RemoteAddr) {
+		m.Metrics.Reject(app.ResultReplay)
+		m.Logger.Info(fmt.Sprintf("reject trojan %v from %v: replay", name, r.RemoteAddr))
+		return errReplay
+	}
+	allowed, err := app.SourceAllowed(r.Context(), t.Upstream, key, r.RemoteAddr)
+	if err != nil {
+		m.Metrics.Reject(app.ResultUpstreamError)
+		m.Logger.Error(fmt.Sprintf("get allowed cidrs error: %v", err))
+		return caddyhttp.Error(http.StatusServiceUnavailable, err)
+	}
+	if !allowed {
+		m.Metrics.Reject(app.ResultSourceNotAllowed)
+		m.AuthFailures.Log(r.RemoteAddr, app.AuthFailureSourceNotAllowed)
+		m.Logger.Info(fmt.Sprintf("reject trojan %v from %v: source not allowed", name, r.RemoteAddr))
+		return caddyhttp.Error(http.StatusForbidden, errors.New("source not allowed"))
+	}
+	if !m.Accounting.Off() && t.Upstream.QuotaExceeded(r.Context(), key) {
+		m.Metrics.Reject(app.ResultQuotaExceeded)
+		m.Logger.Info(fmt.Sprintf("reject trojan %v from %v: quota exceeded", name, r.RemoteAddr))
+		return caddyhttp.Error(http.StatusForbidden, errors.New("quota exceeded"))
+	}
+	if !m.Connections.Acquire(key, m.MaxConnections) {
+		m.Metrics.Reject(app.ResultTooManyConnections)
+		m.Logger.Info(fmt.Sprintf("reject trojan %v from %v: too many connections", name, r.RemoteAddr))
+		return caddyhttp.Error(http.StatusTooManyRequests, errors.New("too many connections"))
+	}
+	defer m.Connections.Release(key)
+	done, ok := m.Relays.Add(key, c)
+	if !ok {
+		return caddyhttp.Error(http.StatusServiceUnavailable, errors.New("trojan is stopping"))
+	}
+	defer done()
+	m.Metrics.Open()
+	defer m.Metrics.Close()
+	if m.Verbose {
+		m.Logger.Info(fmt.Sprintf("handle trojan %v from %v", name, r.RemoteAddr))
+	}
+
+	lim := t.Limiters.Get(r.Context(), key)
+	start, req := time.Now(), &trojan.Request{Buffers: m.Buffers, Setup: m.SocketOptions.Apply}
+	req.Filter = m.filter(r, req)
+	req.Source, req.ProxyProtocol, req.Mux = remoteAddr(r), m.OutboundProxyProtocol, m.Mux
+	req.Parsed = parsed
+	req.LocalIP, _ = t.Upstream.GetSourceIP(r.Context(), key)
+	meter := m.Accounting.Start(t.Upstream, key)
+	req.Progress = func(nr, nw int64) { meter.Add(app.ProtocolOf(req), nr, nw) }
+	nr, nw, err := m.Proxy.Handle(utils.NewRateLimitReader(c, lim), utils.NewRateLimitWriter(c, lim), req)
+	switch {
+	case err == nil:
+	case errors.Is(err, trojan.ErrShortRequest):
+		// the client is gone before the request, like a prober
+		m.Logger.Debug(fmt.Sprintf("handle %v error: %v", name, err))
+	default:
+		m.Logger.Error(fmt.Sprintf("handle %v error: %v", name, err))
+	}
+	// the request context is done once the client is gone, but traffic should still be recorded
+	meter.Close(app.ProtocolOf(req), nr, nw)
+	m.consumeMetrics(key, nr, nw)
+	m.AccessLog.Log(m.Logger, key, req, nr, nw, start, err)
+	return nil
+}
+
+// consumeMetrics records traffic of the user of key in metrics, with no
+// user if accounting is off.
+func (m *Handler) consumeMetrics(key string, nr, nw int64) {
+	if m.Accounting.Off() {
+		m.Metrics.ConsumeTotal(nr, nw)
+		return
+	}
+	m.Metrics.Consume(key, nr, nw)
+}
+
+// validate validates the user of the key of up, or the user of the client
+// certificate of r first with ClientCertAuth, and returns the canonical key
+// of the valid user, whichever the form of the key is.
+func (m *Handler) validate(r *http.Request, up app.Upstream, key string) (string, bool, error) {
+	if m.ClientCertAuth {
+		if k, found := app.CertKey(up, r.TLS); found {
+			k, ok, err := app.Lookup(r.Context(), up, k)
+			if err != nil || ok {
+				return k, ok, err
+			}
 		}
-		m.Upstream.Consume(utils.ByteSliceToString(b[:trojan.HeaderLen]), nr, nw)
+	}
+	return app.Lookup(r.Context(), up, key)
+}
+
+// tenant returns the tenant of the server name of r, which is the server
+// name of TLS, or the host of r for requests other than CONNECT, of which
+// the host is the destination. A request of no tenant is of Upstream and
+// Limiters, and false is returned if it should be rejected.
+func (m *Handler) tenant(r *http.Request) (app.Tenant, bool) {
+	name := ""
+	if r.TLS != nil {
+		name = r.TLS.ServerName
+	}
+	if name == "" && r.Method != http.MethodConnect {
+		name = r.Host
+		if host, _, err := net.SplitHostPort(r.Host); err == nil {
+			name = host
+		}
+	}
+	t, ok := m.Tenants.Get(name)
+	if t.Upstream == nil {
+		t = app.Tenant{Upstream: m.Upstream, Limiters: m.Limiters}
+	}
+	return t, ok
+}
+
+// remoteAddr returns the address of the client of r, nil if it is not
+// an address of TCP.
+func remoteAddr(r *http.Request) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
 		return nil
 	}
-	return next.ServeHTTP(w, r)
+	return addr
+}
+
+// filter returns the Filter of the trojan request of r, which sets the
+// destination to placeholders of r before it is checked, so
+// {trojan.dest_host}, {trojan.dest_port} and {trojan.command} are
+// populated before any decision on the destination.
+func (m *Handler) filter(r *http.Request, req *trojan.Request) func(net.Addr) error {
+	repl, _ := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	return func(addr net.Addr) error {
+		if repl != nil {
+			host, port, err := net.SplitHostPort(addr.String())
+			if err != nil {
+				host, port = addr.String(), ""
+			}
+			repl.Set("trojan.dest_host", host)
+			repl.Set("trojan.dest_port", port)
+			repl.Set("trojan.command", req.CommandName())
+		}
+		return m.DomainFilter.Check(addr)
+	}
 }
 
 // UnmarshalCaddyfile unmarshals Caddyfile tokens into h.
@@ -149,6 +513,37 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return d.Err("only one websocket is not allowed")
 			}
 			h.WebSocket = true
+			if d.NextArg() {
+				if !strings.HasPrefix(d.Val(), "/") {
+					return d.Errf("websocket path must start with /: %v", d.Val())
+				}
+				h.WebSocketPath = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "stream":
+			if h.StreamPath != "" {
+				return d.Err("only one stream is allowed")
+			}
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if !strings.HasPrefix(d.Val(), "/") {
+				return d.Errf("stream path must start with /: %v", d.Val())
+			}
+			h.StreamPath = d.Val()
+		case "grpc":
+			if h.GRPCService != "" {
+				return d.Err("only one grpc is allowed")
+			}
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if strings.Contains(d.Val(), "/") {
+				return d.Errf("grpc service must not contain /: %v", d.Val())
+			}
+			h.GRPCService = d.Val()
 		case "connect_method":
 			if h.Connect {
 				return d.Err("only one connect_method is not allowed")
@@ -159,6 +554,123 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return d.Err("only one verbose is not allowed")
 			}
 			h.Verbose = true
+		case "max_connections":
+			if h.MaxConnections != 0 {
+				return d.Err("only one max_connections is allowed")
+			}
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.ParseInt(d.Val(), 10, 32)
+			if err != nil {
+				return d.Errf("invalid max_connections: %v", err)
+			}
+			if n < 0 {
+				return d.Err("negative max_connections is not allowed")
+			}
+			h.MaxConnections = int32(n)
+		case "allow_domains":
+			args := d.RemainingArgs()
+			if len(args) < 1 {
+				return d.ArgErr()
+			}
+			h.AllowDomains = append(h.AllowDomains, args...)
+		case "block_domains":
+			args := d.RemainingArgs()
+			if len(args) < 1 {
+				return d.ArgErr()
+			}
+			h.BlockDomains = append(h.BlockDomains, args...)
+		case "blocked_ports":
+			args := d.RemainingArgs()
+			if len(args) < 1 {
+				return d.ArgErr()
+			}
+			// off blocks port 0 only, instead of DefaultBlockedPorts
+			if len(args) == 1 && args[0] == "off" {
+				h.BlockedPorts = append(h.BlockedPorts, 0)
+				continue
+			}
+			for _, arg := range args {
+				n, err := strconv.ParseUint(arg, 10, 16)
+				if err != nil {
+					return d.Errf("invalid blocked_ports: %v", err)
+				}
+				h.BlockedPorts = append(h.BlockedPorts, int(n))
+			}
+		case "outbound_proxy_protocol":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			h.OutboundProxyProtocol = true
+		case "client_cert_auth":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			h.ClientCertAuth = true
+		case "mux":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			h.Mux = true
+		case "accounting":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch d.Val() {
+			case "on":
+				h.AccountingOff = false
+			case "off":
+				h.AccountingOff = true
+			default:
+				return d.Errf("accounting must be on or off: %v", d.Val())
+			}
+		case "header_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if d.Val() == "off" {
+				h.HeaderTimeout = -1
+				break
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parse header_timeout error: %v", err)
+			}
+			if dur <= 0 {
+				return d.Errf("invalid header_timeout: %v", d.Val())
+			}
+			h.HeaderTimeout = caddy.Duration(dur)
+		case "tcp_nodelay":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch d.Val() {
+			case "on":
+				noDelay := true
+				h.NoDelay = &noDelay
+			case "off":
+				noDelay := false
+				h.NoDelay = &noDelay
+			default:
+				return d.Errf("tcp_nodelay must be on or off: %v", d.Val())
+			}
+		case "tcp_keepalive":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if d.Val() == "off" {
+				h.KeepAlive = -1
+				break
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parse tcp_keepalive error: %v", err)
+			}
+			if dur <= 0 {
+				return d.Err("tcp_keepalive must be positive, or off")
+			}
+			h.KeepAlive = caddy.Duration(dur)
 		}
 	}
 	return nil
@@ -0,0 +1,395 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/app"
+	"github.com/imgk/caddy-trojan/socks"
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+func TestUnmarshalCaddyfileWebSocket(t *testing.T) {
+	for _, v := range []struct {
+		Input string
+		Path  string
+	}{
+		{Input: `trojan {
+			websocket
+		}`, Path: ""},
+		{Input: `trojan {
+			websocket /ws
+		}`, Path: "/ws"},
+	} {
+		h := &Handler{}
+		if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(v.Input)); err != nil {
+			t.Errorf("parse caddyfile %v error: %v", v.Input, err)
+			continue
+		}
+		if !h.WebSocket || h.WebSocketPath != v.Path {
+			t.Errorf("parse caddyfile %v error: got %v, %v", v.Input, h.WebSocket, h.WebSocketPath)
+		}
+	}
+
+	for _, input := range []string{
+		`trojan {
+			websocket ws
+		}`,
+		`trojan {
+			websocket /ws /ws2
+		}`,
+	} {
+		if err := (&Handler{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("parse invalid caddyfile %v", input)
+		}
+	}
+}
+
+func TestUnmarshalCaddyfileSocketOptions(t *testing.T) {
+	h := &Handler{}
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`trojan {
+		tcp_nodelay off
+		tcp_keepalive 10s
+	}`)); err != nil {
+		t.Fatalf("parse caddyfile error: %v", err)
+	}
+	if h.NoDelay == nil || *h.NoDelay || h.KeepAlive != caddy.Duration(10*time.Second) {
+		t.Errorf("parse caddyfile error: got %v, %v", h.NoDelay, h.KeepAlive)
+	}
+
+	h = &Handler{}
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`trojan {
+		tcp_keepalive off
+	}`)); err != nil || h.KeepAlive >= 0 {
+		t.Errorf("parse caddyfile of tcp_keepalive off error: %v, %v", h.KeepAlive, err)
+	}
+
+	for _, input := range []string{
+		`trojan {
+			tcp_nodelay yes
+		}`,
+		`trojan {
+			tcp_keepalive 0s
+		}`,
+		`trojan {
+			tcp_keepalive
+		}`,
+	} {
+		if err := (&Handler{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("parse invalid caddyfile %v", input)
+		}
+	}
+}
+
+func TestUnmarshalCaddyfileOutboundProxyProtocol(t *testing.T) {
+	h := &Handler{}
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`trojan {
+		outbound_proxy_protocol
+	}`)); err != nil || !h.OutboundProxyProtocol {
+		t.Errorf("parse caddyfile error: %v, %v", h.OutboundProxyProtocol, err)
+	}
+	if err := (&Handler{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser(`trojan {
+		outbound_proxy_protocol v2
+	}`)); err == nil {
+		t.Errorf("parse invalid caddyfile")
+	}
+}
+
+func TestUnmarshalCaddyfileStream(t *testing.T) {
+	h := &Handler{}
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`trojan {
+		stream /tunnel
+		grpc example.Tunnel
+	}`)); err != nil || h.StreamPath != "/tunnel" || h.GRPCService != "example.Tunnel" {
+		t.Errorf("parse caddyfile error: %v, %v, %v", h.StreamPath, h.GRPCService, err)
+	}
+	for _, input := range []string{"stream", "stream tunnel", "stream /a\nstream /b", "grpc", "grpc example/Tunnel"} {
+		if err := (&Handler{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser("trojan {\n" + input + "\n}")); err == nil {
+			t.Errorf("parse invalid caddyfile %v", input)
+		}
+	}
+}
+
+func TestUnmarshalCaddyfileClientCertAuth(t *testing.T) {
+	h := &Handler{}
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`trojan {
+		client_cert_auth
+	}`)); err != nil || !h.ClientCertAuth {
+		t.Errorf("parse caddyfile error: %v, %v", h.ClientCertAuth, err)
+	}
+	if err := (&Handler{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser(`trojan {
+		client_cert_auth on
+	}`)); err == nil {
+		t.Errorf("parse invalid caddyfile")
+	}
+}
+
+func TestUnmarshalCaddyfileMux(t *testing.T) {
+	h := &Handler{}
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`trojan {
+		mux
+	}`)); err != nil || !h.Mux {
+		t.Errorf("parse caddyfile error: %v, %v", h.Mux, err)
+	}
+	if err := (&Handler{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser(`trojan {
+		mux on
+	}`)); err == nil {
+		t.Errorf("parse invalid caddyfile")
+	}
+}
+
+func TestUnmarshalCaddyfileBlockedPorts(t *testing.T) {
+	for _, v := range []struct {
+		Input string
+		Ports []int
+	}{
+		{Input: "blocked_ports 25 465\nblocked_ports 587", Ports: []int{25, 465, 587}},
+		{Input: "blocked_ports off", Ports: []int{0}},
+	} {
+		h := &Handler{}
+		if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser("trojan {\n" + v.Input + "\n}")); err != nil || !reflect.DeepEqual(h.BlockedPorts, v.Ports) {
+			t.Errorf("parse %q error: %v, %v", v.Input, h.BlockedPorts, err)
+		}
+	}
+	for _, input := range []string{"blocked_ports", "blocked_ports 65536", "blocked_ports smtp"} {
+		if err := (&Handler{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser("trojan {\n" + input + "\n}")); err == nil {
+			t.Errorf("parse invalid caddyfile %v", input)
+		}
+	}
+}
+
+func TestUnmarshalCaddyfileHeaderTimeout(t *testing.T) {
+	for _, v := range []struct {
+		Input   string
+		Timeout caddy.Duration
+	}{
+		{Input: "header_timeout 5s", Timeout: caddy.Duration(5 * time.Second)},
+		{Input: "header_timeout off", Timeout: -1},
+	} {
+		h := &Handler{}
+		if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser("trojan {\n" + v.Input + "\n}")); err != nil || h.HeaderTimeout != v.Timeout {
+			t.Errorf("parse %v error: %v, %v", v.Input, h.HeaderTimeout, err)
+		}
+	}
+	for _, input := range []string{"header_timeout", "header_timeout 0s", "header_timeout forever"} {
+		if err := (&Handler{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser("trojan {\n" + input + "\n}")); err == nil {
+			t.Errorf("parse invalid caddyfile %v", input)
+		}
+	}
+}
+
+func TestValidateClientCert(t *testing.T) {
+	cert := &x509.Certificate{Raw: []byte("certificate")}
+	up := &app.MemoryUpstream{}
+	if err := up.Add(context.Background(), app.CertPassword(cert)); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	certKey := [trojan.HeaderLen]byte{}
+	trojan.GenKey(app.CertPassword(cert), certKey[:])
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	for _, v := range []struct {
+		Enabled bool
+		Key     string
+		Valid   bool
+	}{
+		// the canonical key of the user of the certificate
+		{Enabled: true, Key: app.CanonicalKey(utils.ByteSliceToString(certKey[:])), Valid: true},
+		{Enabled: false, Key: "", Valid: false},
+	} {
+		m := &Handler{Upstream: up, ClientCertAuth: v.Enabled}
+		k, ok, err := m.validate(r, m.Upstream, utils.ByteSliceToString(key[:]))
+		if err != nil || ok != v.Valid || k != v.Key {
+			t.Errorf("validate with client_cert_auth %v error: %v, %q, %v", v.Enabled, ok, k, err)
+		}
+	}
+}
+
+func TestHandlerTenant(t *testing.T) {
+	def, tenant := &app.MemoryUpstream{}, &app.MemoryUpstream{}
+	m := &Handler{Upstream: def, Tenants: &app.Tenants{}}
+	m.Tenants.Add("*.example.com", tenant, 0)
+
+	for _, v := range []struct {
+		Name   string
+		Method string
+		Host   string
+		Server string
+		Up     app.Upstream
+	}{
+		{Name: "sni", Method: http.MethodConnect, Host: "example.org:443", Server: "www.example.com", Up: tenant},
+		{Name: "host", Method: http.MethodGet, Host: "www.example.com:8443", Up: tenant},
+		{Name: "connect host", Method: http.MethodConnect, Host: "www.example.com:443", Up: def},
+		{Name: "other", Method: http.MethodGet, Host: "example.org", Up: def},
+	} {
+		r := httptest.NewRequest(v.Method, "/", nil)
+		r.Host = v.Host
+		if v.Server != "" {
+			r.TLS = &tls.ConnectionState{ServerName: v.Server}
+		}
+		tn, ok := m.tenant(r)
+		if !ok || tn.Upstream != v.Up {
+			t.Errorf("%v: tenant error: %v, %v", v.Name, tn.Upstream, ok)
+		}
+	}
+}
+
+func TestServeConnect(t *testing.T) {
+	up := &app.MemoryUpstream{}
+	if err := up.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := utils.ByteSliceToString(key[:])
+
+	m := &Handler{Connect: true, Upstream: up, Proxy: echo{}, Replays: &app.Replays{Window: time.Minute}, Logger: zap.NewNop()}
+	// serve serves a CONNECT request of the user from addr, and reports
+	// whether it is passed to the next handler
+	serve := func(addr string) (*httptest.ResponseRecorder, bool, error) {
+		r := httptest.NewRequest(http.MethodConnect, "https://example.com", strings.NewReader("hello"))
+		r.ProtoMajor, r.RemoteAddr = 2, addr
+		r.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString(key[:]))
+		w, passed := httptest.NewRecorder(), false
+		err := m.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			passed = true
+			return nil
+		}))
+		return w, passed, err
+	}
+
+	if w, passed, err := serve("192.0.2.1:1000"); err != nil || passed || w.Body.String() != "hello" {
+		t.Errorf("relay error: %q, %v, %v", w.Body.String(), passed, err)
+	}
+	// a replay is served as a web server
+	if _, passed, err := serve("198.51.100.1:1000"); err != nil || !passed {
+		t.Errorf("replay error: %v, %v", passed, err)
+	}
+	// other rejections are of a status
+	if err := up.SetQuota(context.Background(), k, 1); err != nil {
+		t.Fatalf("set quota error: %v", err)
+	}
+	up.Consume(context.Background(), k, app.ProtocolTCP, 1, 1)
+	_, passed, err := serve("192.0.2.1:1001")
+	herr := caddyhttp.HandlerError{}
+	if !errors.As(err, &herr) || herr.StatusCode != http.StatusForbidden || passed {
+		t.Errorf("quota exceeded error: %v, %v", passed, err)
+	}
+}
+
+func TestWebSocketPath(t *testing.T) {
+	m := &Handler{WebSocket: true, WebSocketPath: "/ws"}
+
+	for _, v := range []struct {
+		Path string
+		Next bool
+	}{
+		{Path: "/", Next: true},
+		{Path: "/ws/", Next: true},
+		{Path: "/wss", Next: true},
+		// a recorder can not be hijacked, so the upgrade fails
+		{Path: "/ws", Next: false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, v.Path, nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-WebSocket-Version", "13")
+		r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+		next := false
+		err := m.ServeHTTP(httptest.NewRecorder(), r, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			next = true
+			return nil
+		}))
+		if next != v.Next {
+			t.Errorf("websocket request of path %v error: next %v, error %v", v.Path, next, err)
+		}
+	}
+}
+
+func TestFilterPlaceholders(t *testing.T) {
+	h := &Handler{}
+	h.BlockDomains = []string{"blocked.example"}
+	if err := h.DomainFilter.Provision(); err != nil {
+		t.Fatalf("provision domain filter error: %v", err)
+	}
+
+	repl := caddy.NewReplacer()
+	r := httptest.NewRequest(http.MethodConnect, "https://example.com", nil)
+	r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+
+	for _, v := range []struct {
+		Host    string
+		Command byte
+		Name    string
+		Blocked bool
+	}{
+		{Host: "allowed.example", Command: trojan.CmdConnect, Name: "CONNECT"},
+		{Host: "blocked.example", Command: trojan.CmdAssociate, Name: "UDP", Blocked: true},
+	} {
+		addr, err := socks.ParseAddr(append([]byte{socks.AddrTypeDomain, byte(len(v.Host))}, append([]byte(v.Host), 0x01, 0xbb)...))
+		if err != nil {
+			t.Fatalf("parse addr error: %v", err)
+		}
+		req := &trojan.Request{Command: v.Command}
+		err = h.filter(r, req)(addr)
+		if (err != nil) != v.Blocked {
+			t.Errorf("filter %v error: %v", v.Host, err)
+		}
+		// placeholders are set before the destination is checked
+		for key, want := range map[string]string{
+			"trojan.dest_host": v.Host,
+			"trojan.dest_port": "443",
+			"trojan.command":   v.Name,
+		} {
+			if got, _ := repl.GetString(key); got != want {
+				t.Errorf("placeholder %v of %v error: got %v, want %v", key, v.Host, got, want)
+			}
+		}
+	}
+
+	// a request without replacer is only checked
+	req := &trojan.Request{Command: trojan.CmdConnect}
+	addr, _ := socks.ParseAddr([]byte{socks.AddrTypeIPv4, 127, 0, 0, 1, 0, 80})
+	if err := h.filter(httptest.NewRequest(http.MethodConnect, "https://example.com", nil), req)(addr); err != nil {
+		t.Errorf("filter without replacer error: %v", err)
+	}
+}
+
+func TestUnmarshalCaddyfileAccounting(t *testing.T) {
+	for _, v := range []struct {
+		Input string
+		Off   bool
+	}{
+		{Input: "accounting off", Off: true},
+		{Input: "accounting on", Off: false},
+	} {
+		h := &Handler{}
+		if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser("trojan {\n" + v.Input + "\n}")); err != nil || h.AccountingOff != v.Off {
+			t.Errorf("parse %v error: %v, %v", v.Input, h.AccountingOff, err)
+		}
+	}
+	for _, input := range []string{"accounting", "accounting none"} {
+		if err := (&Handler{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser("trojan {\n" + input + "\n}")); err == nil {
+			t.Errorf("parse invalid caddyfile %v", input)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxGRPCMessage is the max size of a message of grpc, which is the
+// default of grpc-go.
+const maxGRPCMessage = 4 << 20
+
+// errInvalidHunk is ...
+var errInvalidHunk = errors.New("invalid grpc hunk")
+
+// streamConn is a stream of trojan over the body of a request and of its response.
+type streamConn struct {
+	io.Reader
+	io.Writer
+	io.Closer
+}
+
+// peekReader records the bytes read while peeked is not nil, so they can
+// be read again by the next handler.
+type peekReader struct {
+	io.Reader
+	peeked *bytes.Buffer
+}
+
+// Read is ...
+func (r *peekReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if r.peeked != nil {
+		r.peeked.Write(b[:n])
+	}
+	return n, err
+}
+
+// grpcReader reads the data of messages of grpc, which are the Hunk of
+// trojan-go and v2ray, message Hunk { bytes data = 1; }.
+type grpcReader struct {
+	io.Reader
+	// the data of the current message not read yet
+	data []byte
+	buf  []byte
+}
+
+// Read is ...
+func (r *grpcReader) Read(b []byte) (int, error) {
+	for len(r.data) == 0 {
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// next reads the next message.
+func (r *grpcReader) next() error {
+	// compressed flag and length of the message
+	hdr := [5]byte{}
+	if _, err := io.ReadFull(r.Reader, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != 0 {
+		return fmt.Errorf("%w: compressed message", errInvalidHunk)
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > maxGRPCMessage {
+		return fmt.Errorf("%w: message of %v bytes", errInvalidHunk, n)
+	}
+	if cap(r.buf) < int(n) {
+		r.buf = make([]byte, n)
+	}
+	msg := r.buf[:n]
+	if _, err := io.ReadFull(r.Reader, msg); err != nil {
+		if errors.Is(err, io.EOF) {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if len(msg) == 0 {
+		// a Hunk of empty data
+		return nil
+	}
+
+	// field 1 of wire type 2
+	if msg[0] != 0x0a {
+		return fmt.Errorf("%w: field %x", errInvalidHunk, msg[0])
+	}
+	size, nr := binary.Uvarint(msg[1:])
+	if nr <= 0 || size != uint64(len(msg)-1-nr) {
+		return fmt.Errorf("%w: length of data", errInvalidHunk)
+	}
+	r.data = msg[1+nr:]
+	return nil
+}
+
+// grpcWriter writes b as the data of a message of grpc for each Write.
+type grpcWriter struct {
+	io.Writer
+	buf []byte
+}
+
+// Write is ...
+func (w *grpcWriter) Write(b []byte) (int, error) {
+	size := [binary.MaxVarintLen64]byte{}
+	nr := binary.PutUvarint(size[:], uint64(len(b)))
+
+	w.buf = append(w.buf[:0], 0, 0, 0, 0, 0, 0x0a)
+	binary.BigEndian.PutUint32(w.buf[1:5], uint32(1+nr+len(b)))
+	w.buf = append(w.buf, size[:nr]...)
+	w.buf = append(w.buf, b...)
+	if _, err := w.Writer.Write(w.buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
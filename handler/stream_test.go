@@ -0,0 +1,217 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+
+	"github.com/imgk/caddy-trojan/app"
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+func TestGRPCHunk(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := &grpcWriter{Writer: buf}
+	for _, v := range []string{"hello", "", "trojan"} {
+		if n, err := w.Write([]byte(v)); err != nil || n != len(v) {
+			t.Fatalf("write hunk error: %v, %v", n, err)
+		}
+	}
+	// a Hunk of 5 bytes is a message of 7 bytes
+	if !bytes.HasPrefix(buf.Bytes(), []byte{0, 0, 0, 0, 7, 0x0a, 5, 'h'}) {
+		t.Errorf("hunk error: %x", buf.Bytes())
+	}
+	b, err := io.ReadAll(&grpcReader{Reader: buf})
+	if err != nil || string(b) != "hellotrojan" {
+		t.Errorf("read hunks error: %q, %v", b, err)
+	}
+
+	for _, v := range [][]byte{
+		// compressed
+		{1, 0, 0, 0, 2, 0x0a, 0},
+		// field 2
+		{0, 0, 0, 0, 2, 0x12, 0},
+		// length of data exceeds the message
+		{0, 0, 0, 0, 2, 0x0a, 1},
+		// too large
+		{0, 0xff, 0, 0, 0},
+	} {
+		if _, err := io.ReadAll(&grpcReader{Reader: bytes.NewReader(v)}); err == nil {
+			t.Errorf("read invalid hunk %x without error", v)
+		}
+	}
+}
+
+// echo is an app.Proxy which echoes the request after the header.
+type echo struct{}
+
+// Handle is ...
+func (echo) Handle(r io.Reader, w io.Writer, req *trojan.Request) (int64, int64, error) {
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, 0, err
+	}
+	n, err := w.Write(b)
+	return 5, int64(n), err
+}
+
+// Close is ...
+func (echo) Close() error {
+	return nil
+}
+
+func TestServeStream(t *testing.T) {
+	up := &app.MemoryUpstream{}
+	if err := up.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	m := &Handler{StreamPath: "/tunnel", GRPCService: "example.Tunnel", Upstream: up, Proxy: echo{}, Logger: zap.NewNop()}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := m.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			// the site reads the body read by trojan
+			b, _ := io.ReadAll(r.Body)
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write(b)
+			return nil
+		}))
+		if err != nil {
+			t.Errorf("serve http error: %v", err)
+		}
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	for _, v := range []struct {
+		Name     string
+		Path     string
+		Password string
+		GRPC     bool
+		Status   int
+	}{
+		{Name: "stream", Path: "/tunnel", Password: "test1234", Status: http.StatusOK},
+		{Name: "grpc", Path: "/example.Tunnel/Tun", Password: "test1234", GRPC: true, Status: http.StatusOK},
+		{Name: "unknown user", Path: "/tunnel", Password: "test5678", Status: http.StatusNotFound},
+		{Name: "other path", Path: "/", Password: "test1234", Status: http.StatusNotFound},
+	} {
+		header := make([]byte, trojan.HeaderLen, trojan.HeaderLen+7)
+		trojan.GenKey(v.Password, header)
+		header = append(header, "\r\nhello"...)
+		body := &bytes.Buffer{}
+		if v.GRPC {
+			(&grpcWriter{Writer: body}).Write(header[:10])
+			(&grpcWriter{Writer: body}).Write(header[10:])
+		} else {
+			body.Write(header)
+		}
+
+		r, err := http.NewRequest(http.MethodPost, srv.URL+v.Path, body)
+		if err != nil {
+			t.Fatalf("new request error: %v", err)
+		}
+		if v.GRPC {
+			r.Header.Set("Content-Type", "application/grpc")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		resp, err := srv.Client().Do(r.WithContext(ctx))
+		if err != nil {
+			t.Fatalf("%v: do request error: %v", v.Name, err)
+		}
+		defer resp.Body.Close()
+		if resp.ProtoMajor != 2 || resp.StatusCode != v.Status {
+			t.Fatalf("%v: response error: http%d, %v", v.Name, resp.ProtoMajor, resp.StatusCode)
+		}
+
+		var rd io.Reader = resp.Body
+		if v.GRPC {
+			rd = &grpcReader{Reader: resp.Body}
+		}
+		b, err := io.ReadAll(rd)
+		if err != nil {
+			t.Fatalf("%v: read response error: %v", v.Name, err)
+		}
+		switch {
+		case v.Status == http.StatusNotFound:
+			// the site gets the whole body
+			if string(b) != string(header) {
+				t.Errorf("%v: body of the site error: %q", v.Name, b)
+			}
+		case string(b) != "hello":
+			t.Errorf("%v: relay error: %q", v.Name, b)
+		}
+		if v.GRPC && resp.Trailer.Get("Grpc-Status") != "0" {
+			t.Errorf("%v: grpc status error: %v", v.Name, resp.Trailer)
+		}
+	}
+}
+
+func TestServeStreamAccountingOff(t *testing.T) {
+	up := &app.MemoryUpstream{}
+	if err := up.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	k := utils.ByteSliceToString(key[:])
+
+	m := &Handler{StreamPath: "/tunnel", Upstream: up, Proxy: echo{}, Logger: zap.NewNop()}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			w.WriteHeader(http.StatusNotFound)
+			return nil
+		}))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	// relay relays hello of the user and returns the reply
+	relay := func() string {
+		body := append(append([]byte{}, key[:]...), "\r\nhello"...)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		r, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/tunnel", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("new request error: %v", err)
+		}
+		resp, err := srv.Client().Do(r)
+		if err != nil {
+			t.Fatalf("do request error: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	if b := relay(); b != "hello" {
+		t.Fatalf("relay error: %q", b)
+	}
+	if up, down, err := up.GetTraffic(context.Background(), k); up != 5 || down != 5 || err != nil {
+		t.Errorf("traffic of accounting on error: %v, %v, %v", up, down, err)
+	}
+
+	// the user is relayed without traffic, whatever the quota is
+	m.AccountingOff, m.Accounting = true, app.AccountingOff()
+	if err := up.SetQuota(context.Background(), k, 10); err != nil {
+		t.Fatalf("set quota error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if b := relay(); b != "hello" {
+			t.Fatalf("relay of accounting off error: %q", b)
+		}
+	}
+	if up, down, err := up.GetTraffic(context.Background(), k); up != 5 || down != 5 || err != nil {
+		t.Errorf("traffic of accounting off error: %v, %v, %v", up, down, err)
+	}
+}
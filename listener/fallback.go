@@ -0,0 +1,110 @@
+package listener
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/imgk/caddy-trojan/app"
+)
+
+const (
+	// FallbackPolicyHTTP hands connections matching no fallback to the caddy http server.
+	FallbackPolicyHTTP = "http"
+	// FallbackPolicyReset resets connections matching no fallback.
+	FallbackPolicyReset = "reset"
+)
+
+// FallbackRoute relays connections failed in validation to Backends, if the
+// server name of TLS matches Hosts. Clients without a server name, such as
+// probers of a bare IP, match no route.
+type FallbackRoute struct {
+	// Hosts is the list of server names of the route, like www.example.com,
+	// or *.example.com for all subdomains.
+	Hosts []string `json:"hosts"`
+	// Backends is the list of addresses of the route, which are dialed in
+	// order until one is connected.
+	Backends []string `json:"backends"`
+
+	filter app.DomainFilter
+}
+
+// Provision is ...
+func (r *FallbackRoute) Provision() error {
+	if len(r.Hosts) == 0 {
+		return errors.New("hosts of fallback is not configured")
+	}
+	if len(r.Backends) == 0 {
+		return errors.New("backends of fallback is not configured")
+	}
+	r.filter = app.DomainFilter{AllowDomains: r.Hosts}
+	if err := r.filter.Provision(); err != nil {
+		return fmt.Errorf("parse hosts of fallback error: %w", err)
+	}
+	return nil
+}
+
+// Match returns true if the server name matches Hosts.
+func (r *FallbackRoute) Match(name string) bool {
+	return name != "" && r.filter.Allowed(name)
+}
+
+// serverName returns the server name sent by the client in TLS, or an
+// empty string if there is none.
+func serverName(c net.Conn) string {
+	if cs := connectionState(c); cs != nil {
+		return cs.ServerName
+	}
+	return ""
+}
+
+// connectionState returns the state of TLS of the net.Conn, or nil if it
+// is not a connection of TLS.
+func connectionState(c net.Conn) *tls.ConnectionState {
+	for {
+		switch cc := c.(type) {
+		case *tls.Conn:
+			cs := cc.ConnectionState()
+			return &cs
+		case interface{ NetConn() net.Conn }:
+			c = cc.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// reset closes the net.Conn with a RST, like a port of no service. The
+// TCP connection is closed as it is, without an alert of TLS.
+func reset(c net.Conn) {
+	for {
+		if tc, ok := c.(*net.TCPConn); ok {
+			tc.SetLinger(0)
+			break
+		}
+		cc, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		c = cc.NetConn()
+	}
+	c.Close()
+}
+
+// jitter returns a random duration between min and max, and min if max is
+// not greater than min. It reads crypto/rand, as the sequence of math/rand
+// is the same of every start of Go 1.18.
+func jitter(min, max time.Duration) time.Duration {
+	if max <= min {
+		return min
+	}
+	b := [8]byte{}
+	if _, err := rand.Read(b[:]); err != nil {
+		return min
+	}
+	return min + time.Duration(binary.LittleEndian.Uint64(b[:])%uint64(max-min+1))
+}
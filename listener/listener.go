@@ -1,11 +1,14 @@
 package listener
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -21,15 +24,72 @@ func init() {
 	caddy.RegisterModule(ListenerWrapper{})
 }
 
-// ListenerWrapper implements an TLS wrapper that it accept connections
-// from clients and check the connection with pre-defined password
-// and aead cipher defined by go-shadowsocks2, and return a normal page if
-// failed.
+// ListenerWrapper is a listener wrapper after the TLS wrapper, so trojan
+// and normal HTTPS share one port. It peeks the trojan header of every
+// connection and relays connections of valid users, and other connections
+// are handed to the caddy http server with the peeked bytes, or to
+// Fallbacks and Fallback if set.
 type ListenerWrapper struct {
+	// Fallback is the address of a backend which receives connections
+	// failed in validation, instead of the caddy http server.
+	Fallback string `json:"fallback,omitempty"`
+	// Fallbacks is the list of routes of server names, which are checked in
+	// order before Fallback.
+	Fallbacks []FallbackRoute `json:"fallbacks,omitempty"`
+	// FallbackPolicy is the policy of connections matching no route if
+	// Fallback is not set, which is http or reset, default is http.
+	FallbackPolicy string `json:"fallback_policy,omitempty"`
+	// FallbackJitterMin and FallbackJitterMax delay connections failed in
+	// validation by a random duration between them, before they are handed
+	// to a fallback, so the timing of the response to an invalid header
+	// varies as that of a real backend. 0 (default) means no delay.
+	FallbackJitterMin caddy.Duration `json:"fallback_jitter_min,omitempty"`
+	FallbackJitterMax caddy.Duration `json:"fallback_jitter_max,omitempty"`
+	// MaxConnections is the max number of live connections of a user, 0 means no limit.
+	MaxConnections int32 `json:"max_connections,omitempty"`
+	// OutboundProxyProtocol sends a PROXY protocol v2 header of the address of
+	// the client to TCP destinations, before relaying.
+	OutboundProxyProtocol bool `json:"outbound_proxy_protocol,omitempty"`
+	// HeaderTimeout is the time of reading the trojan header and the request,
+	// including the TLS handshake, default is 10s. A negative value disables it.
+	HeaderTimeout caddy.Duration `json:"header_timeout,omitempty"`
+	// ClientCertAuth authorizes a client presenting a certificate of a user,
+	// whatever the password of the trojan header is. The password of the
+	// user is the hex of the SHA256 fingerprint of the certificate.
+	ClientCertAuth bool `json:"client_cert_auth,omitempty"`
+	// Mux accepts the mux of trojan-go, which multiplexes connections of
+	// the client over one connection by smux, of which every connection is
+	// a relay of the same user.
+	Mux bool `json:"mux,omitempty"`
+	app.DomainFilter
+	app.SocketOptions
+
 	// Upstream is ...
 	Upstream app.Upstream `json:"-,omitempty"`
 	// Proxy is ...
 	Proxy app.Proxy `json:"-,omitempty"`
+	// Limiters is ...
+	Limiters *app.Limiters `json:"-,omitempty"`
+	// Tenants is ...
+	Tenants *app.Tenants `json:"-,omitempty"`
+	// Connections is ...
+	Connections *app.Connections `json:"-,omitempty"`
+	// Replays is ...
+	Replays *app.Replays `json:"-,omitempty"`
+	// AuthLimiter is ...
+	AuthLimiter *app.AuthLimiter `json:"-,omitempty"`
+	// Metrics is ...
+	Metrics *app.Metrics `json:"-,omitempty"`
+	// Relays is ...
+	Relays *app.Relays `json:"-,omitempty"`
+	// Accounting is ...
+	Accounting *app.Accounting `json:"-,omitempty"`
+	// AccessLog is ...
+	AccessLog *app.AccessLog `json:"-,omitempty"`
+	// AuthFailures is ...
+	AuthFailures *app.AuthFailureLogger `json:"-,omitempty"`
+	// Buffers is ...
+	Buffers *trojan.BufferPool `json:"-,omitempty"`
 	// Logger is ...
 	Logger *zap.Logger `json:"-,omitempty"`
 }
@@ -45,6 +105,25 @@ func (ListenerWrapper) CaddyModule() caddy.ModuleInfo {
 // Provision implements caddy.Provisioner.
 func (m *ListenerWrapper) Provision(ctx caddy.Context) error {
 	m.Logger = ctx.Logger(m)
+	if m.HeaderTimeout == 0 {
+		m.HeaderTimeout = caddy.Duration(trojan.DefaultHeaderTimeout)
+	}
+	if err := m.DomainFilter.Provision(); err != nil {
+		return err
+	}
+	for i := range m.Fallbacks {
+		if err := m.Fallbacks[i].Provision(); err != nil {
+			return err
+		}
+	}
+	switch m.FallbackPolicy {
+	case "", FallbackPolicyHTTP, FallbackPolicyReset:
+	default:
+		return fmt.Errorf("invalid fallback_policy: %v", m.FallbackPolicy)
+	}
+	if m.FallbackJitterMin < 0 || m.FallbackJitterMax < m.FallbackJitterMin {
+		return fmt.Errorf("invalid fallback_jitter: %v %v", time.Duration(m.FallbackJitterMin), time.Duration(m.FallbackJitterMax))
+	}
 	if !ctx.AppIsConfigured(app.CaddyAppID) {
 		return errors.New("trojan is not configured")
 	}
@@ -55,18 +134,228 @@ func (m *ListenerWrapper) Provision(ctx caddy.Context) error {
 	app := mod.(*app.App)
 	m.Upstream = app.Upstream()
 	m.Proxy = app.Proxy()
+	m.Limiters = app.Limiters()
+	m.Tenants = app.Tenants()
+	m.Connections = app.Connections()
+	m.Replays = app.Replays()
+	m.AuthLimiter = app.AuthLimiter()
+	m.Metrics = app.Metrics()
+	m.Relays = app.Relays()
+	m.Accounting = app.Accounting()
+	m.AccessLog = app.AccessLog()
+	m.AuthFailures = app.AuthFailureLog().Logger(m.Logger)
+	m.Buffers = app.Buffers()
 	return nil
 }
 
 // WrapListener implements caddy.ListenWrapper
 func (m *ListenerWrapper) WrapListener(l net.Listener) net.Listener {
 	ln := NewListener(l, m.Upstream, m.Proxy, m.Logger)
+	ln.Fallback = m.Fallback
+	ln.Fallbacks = m.Fallbacks
+	ln.FallbackPolicy = m.FallbackPolicy
+	ln.FallbackJitterMin = time.Duration(m.FallbackJitterMin)
+	ln.FallbackJitterMax = time.Duration(m.FallbackJitterMax)
+	ln.Limiters = m.Limiters
+	ln.Tenants = m.Tenants
+	ln.Connections = m.Connections
+	ln.Replays = m.Replays
+	ln.AuthLimiter = m.AuthLimiter
+	ln.Metrics = m.Metrics
+	ln.Relays = m.Relays
+	ln.Accounting = m.Accounting
+	ln.AccessLog = m.AccessLog
+	ln.AuthFailures = m.AuthFailures
+	ln.Buffers = m.Buffers
+	ln.MaxConnections = m.MaxConnections
+	ln.OutboundProxyProtocol = m.OutboundProxyProtocol
+	ln.ClientCertAuth = m.ClientCertAuth
+	ln.Mux = m.Mux
+	if m.HeaderTimeout > 0 {
+		ln.HeaderTimeout = time.Duration(m.HeaderTimeout)
+	}
+	ln.DomainFilter = &m.DomainFilter
+	ln.SocketOptions = &m.SocketOptions
 	go ln.loop()
 	return ln
 }
 
 // UnmarshalCaddyfile unmarshals Caddyfile tokens into h.
-func (*ListenerWrapper) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+func (m *ListenerWrapper) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.Next() {
+		return d.ArgErr()
+	}
+	args := d.RemainingArgs()
+	if len(args) > 0 {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		subdirective := d.Val()
+		switch subdirective {
+		case "fallback":
+			args := d.RemainingArgs()
+			if len(args) < 1 {
+				return d.ArgErr()
+			}
+			route := FallbackRoute{Backends: args}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "hosts":
+					hosts := d.RemainingArgs()
+					if len(hosts) < 1 {
+						return d.ArgErr()
+					}
+					route.Hosts = append(route.Hosts, hosts...)
+				default:
+					return d.Errf("unknown fallback subdirective: %v", d.Val())
+				}
+			}
+			if len(route.Hosts) > 0 {
+				m.Fallbacks = append(m.Fallbacks, route)
+				break
+			}
+			if m.Fallback != "" {
+				return d.Err("only one fallback without hosts is allowed")
+			}
+			if len(args) > 1 {
+				return d.Err("fallback without hosts has only one backend")
+			}
+			m.Fallback = args[0]
+		case "fallback_jitter":
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			// fallback_jitter <max> or fallback_jitter <min> <max>
+			durations := make([]caddy.Duration, len(args))
+			for i, arg := range args {
+				v, err := caddy.ParseDuration(arg)
+				if err != nil {
+					return d.Errf("invalid fallback_jitter: %v", err)
+				}
+				durations[i] = caddy.Duration(v)
+			}
+			m.FallbackJitterMax = durations[len(durations)-1]
+			if len(durations) == 2 {
+				m.FallbackJitterMin = durations[0]
+			}
+		case "fallback_policy":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch d.Val() {
+			case FallbackPolicyHTTP, FallbackPolicyReset:
+				m.FallbackPolicy = d.Val()
+			default:
+				return d.Errf("fallback_policy must be http or reset: %v", d.Val())
+			}
+		case "max_connections":
+			if m.MaxConnections != 0 {
+				return d.Err("only one max_connections is allowed")
+			}
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.ParseInt(d.Val(), 10, 32)
+			if err != nil {
+				return d.Errf("invalid max_connections: %v", err)
+			}
+			if n < 0 {
+				return d.Err("negative max_connections is not allowed")
+			}
+			m.MaxConnections = int32(n)
+		case "allow_domains":
+			args := d.RemainingArgs()
+			if len(args) < 1 {
+				return d.ArgErr()
+			}
+			m.AllowDomains = append(m.AllowDomains, args...)
+		case "block_domains":
+			args := d.RemainingArgs()
+			if len(args) < 1 {
+				return d.ArgErr()
+			}
+			m.BlockDomains = append(m.BlockDomains, args...)
+		case "blocked_ports":
+			args := d.RemainingArgs()
+			if len(args) < 1 {
+				return d.ArgErr()
+			}
+			// off blocks port 0 only, instead of DefaultBlockedPorts
+			if len(args) == 1 && args[0] == "off" {
+				m.BlockedPorts = append(m.BlockedPorts, 0)
+				continue
+			}
+			for _, arg := range args {
+				n, err := strconv.ParseUint(arg, 10, 16)
+				if err != nil {
+					return d.Errf("invalid blocked_ports: %v", err)
+				}
+				m.BlockedPorts = append(m.BlockedPorts, int(n))
+			}
+		case "outbound_proxy_protocol":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.OutboundProxyProtocol = true
+		case "client_cert_auth":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.ClientCertAuth = true
+		case "mux":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Mux = true
+		case "header_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if d.Val() == "off" {
+				m.HeaderTimeout = -1
+				break
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parse header_timeout error: %v", err)
+			}
+			if dur <= 0 {
+				return d.Errf("invalid header_timeout: %v", d.Val())
+			}
+			m.HeaderTimeout = caddy.Duration(dur)
+		case "tcp_nodelay":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch d.Val() {
+			case "on":
+				noDelay := true
+				m.NoDelay = &noDelay
+			case "off":
+				noDelay := false
+				m.NoDelay = &noDelay
+			default:
+				return d.Errf("tcp_nodelay must be on or off: %v", d.Val())
+			}
+		case "tcp_keepalive":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if d.Val() == "off" {
+				m.KeepAlive = -1
+				break
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parse tcp_keepalive error: %v", err)
+			}
+			if dur <= 0 {
+				return d.Err("tcp_keepalive must be positive, or off")
+			}
+			m.KeepAlive = caddy.Duration(dur)
+		}
+	}
 	return nil
 }
 
@@ -80,6 +369,28 @@ var (
 // Listener is ...
 type Listener struct {
 	Verbose bool `json:"verbose,omitempty"`
+	// Fallback is ...
+	Fallback string `json:"fallback,omitempty"`
+	// Fallbacks is the list of provisioned routes, which are checked in order
+	// before Fallback.
+	Fallbacks []FallbackRoute `json:"fallbacks,omitempty"`
+	// FallbackPolicy is ...
+	FallbackPolicy string `json:"fallback_policy,omitempty"`
+	// FallbackJitterMin is ...
+	FallbackJitterMin time.Duration
+	// FallbackJitterMax is ...
+	FallbackJitterMax time.Duration
+	// MaxConnections is ...
+	MaxConnections int32 `json:"max_connections,omitempty"`
+	// OutboundProxyProtocol is ...
+	OutboundProxyProtocol bool `json:"outbound_proxy_protocol,omitempty"`
+	// HeaderTimeout is the time of reading the trojan header and the request,
+	// 0 means no timeout.
+	HeaderTimeout time.Duration
+	// ClientCertAuth is ...
+	ClientCertAuth bool
+	// Mux is ...
+	Mux bool
 
 	// Listener is ...
 	net.Listener
@@ -87,6 +398,32 @@ type Listener struct {
 	Upstream app.Upstream
 	// Proxy is ...
 	Proxy app.Proxy
+	// Limiters is ...
+	Limiters *app.Limiters
+	// Tenants is ...
+	Tenants *app.Tenants
+	// Connections is ...
+	Connections *app.Connections
+	// Replays is ...
+	Replays *app.Replays
+	// AuthLimiter is ...
+	AuthLimiter *app.AuthLimiter
+	// Metrics is ...
+	Metrics *app.Metrics
+	// Relays is ...
+	Relays *app.Relays
+	// Accounting is ...
+	Accounting *app.Accounting
+	// AccessLog is ...
+	AccessLog *app.AccessLog
+	// AuthFailures is ...
+	AuthFailures *app.AuthFailureLogger
+	// Buffers is ...
+	Buffers *trojan.BufferPool
+	// DomainFilter is ...
+	DomainFilter *app.DomainFilter
+	// SocketOptions is ...
+	SocketOptions *app.SocketOptions
 	// Logger is ...
 	Logger *zap.Logger
 
@@ -94,6 +431,9 @@ type Listener struct {
 	conns chan net.Conn
 	// close channel
 	closed chan struct{}
+	// cancel pending upstream operations on close
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // NewListener is ...
@@ -106,6 +446,7 @@ func NewListener(ln net.Listener, up app.Upstream, px app.Proxy, logger *zap.Log
 		conns:    make(chan net.Conn, 8),
 		closed:   make(chan struct{}),
 	}
+	l.ctx, l.cancel = context.WithCancel(context.Background())
 	return l
 }
 
@@ -126,8 +467,10 @@ func (l *Listener) Close() error {
 		return nil
 	default:
 		close(l.closed)
+		l.cancel()
 	}
-	return nil
+	// stop accepting, so new clients reach the listener of the new config
+	return l.Listener.Close()
 }
 
 // loop is ...
@@ -145,6 +488,18 @@ func (l *Listener) loop() {
 		}
 
 		go func(c net.Conn, lg *zap.Logger, up app.Upstream) {
+			// a banned address is served as a web server without validation
+			if !l.AuthLimiter.Allow(c.RemoteAddr().String()) {
+				l.Metrics.Reject(app.ResultBanned)
+				l.fallback(c)
+				return
+			}
+			// a client stalled in the header is closed at the deadline,
+			// which is cleared by fallback or once the request is read
+			if l.HeaderTimeout > 0 {
+				c.SetReadDeadline(time.Now().Add(l.HeaderTimeout))
+			}
+
 			b := make([]byte, trojan.HeaderLen+2)
 			for n := 0; n < trojan.HeaderLen+2; n += 1 {
 				nr, err := c.Read(b[n : n+1])
@@ -162,36 +517,243 @@ func (l *Listener) loop() {
 				}
 				// mimic nginx
 				if b[n] == 0x0a && n < trojan.HeaderLen+1 {
-					select {
-					case <-l.closed:
-						c.Close()
-					default:
-						l.conns <- utils.RewindConn(c, b[:n+1])
-					}
+					l.fallback(utils.RewindConn(c, b[:n+1]))
 					return
 				}
 			}
 
+			if err := trojan.CheckHeader(b); err != nil {
+				lg.Debug(fmt.Sprintf("fallback net.Conn from %v: %v", c.RemoteAddr(), err))
+				l.AuthFailures.Log(c.RemoteAddr().String(), app.AuthFailureBadHeader)
+				l.fallback(utils.RewindConn(c, b))
+				return
+			}
+
+			// a server name of no tenant uses Upstream and Limiters
+			t, ok := l.Tenants.Get(serverName(c))
+			if !ok {
+				lg.Debug(fmt.Sprintf("fallback net.Conn from %v: no tenant", c.RemoteAddr()))
+				l.fallback(utils.RewindConn(c, b))
+				return
+			}
+			lims := l.Limiters
+			if t.Upstream != nil {
+				up, lims = t.Upstream, t.Limiters
+			}
+
 			// check the net.Conn
-			if ok := up.Validate(utils.ByteSliceToString(b[:trojan.HeaderLen])); !ok {
-				select {
-				case <-l.closed:
-					c.Close()
-				default:
-					l.conns <- utils.RewindConn(c, b)
-				}
+			key, ok, err := l.validate(c, up, utils.ByteSliceToString(b[:trojan.HeaderLen]))
+			if err != nil {
+				// the key may be valid, so close the net.Conn for the client
+				// to retry instead of handing the trojan header to fallback
+				l.Metrics.Reject(app.ResultUpstreamError)
+				lg.Error(fmt.Sprintf("validate user error: %v", err))
+				c.Close()
+				return
+			}
+			if !ok {
+				l.Metrics.Reject(app.ResultAuthFailed)
+				l.AuthLimiter.Fail(c.RemoteAddr().String())
+				l.AuthFailures.Log(c.RemoteAddr().String(), app.AuthFailureUnknownKey)
+				l.fallback(utils.RewindConn(c, b))
+				return
+			}
+			l.AuthLimiter.Succeed(c.RemoteAddr().String())
+			// a replayer is a prober, so it is handed to fallback as well
+			if !l.Replays.Check(key, c.RemoteAddr().String()) {
+				l.Metrics.Reject(app.ResultReplay)
+				lg.Info(fmt.Sprintf("reject trojan net.Conn from %v: replay", c.RemoteAddr()))
+				l.fallback(utils.RewindConn(c, b))
+				return
+			}
+			// an unsupported command, like 0x02 BIND, is never relayed, and
+			// is handed to fallback as a prober
+			cmd := [1]byte{}
+			if _, err := io.ReadFull(c, cmd[:]); err != nil {
+				lg.Debug(fmt.Sprintf("read command error: %v", err))
+				c.Close()
+				return
+			}
+			if !trojan.CommandSupported(cmd[0], l.Mux) {
+				l.Metrics.Reject(app.ResultBadCommand)
+				lg.Info(fmt.Sprintf("fallback trojan net.Conn from %v: command %#02x error: %v", c.RemoteAddr(), cmd[0], trojan.ErrBadCommand))
+				l.fallback(utils.RewindConn(c, append(b, cmd[0])))
 				return
 			}
 			defer c.Close()
+			allowed, err := app.SourceAllowed(l.ctx, up, key, c.RemoteAddr().String())
+			if err != nil {
+				l.Metrics.Reject(app.ResultUpstreamError)
+				lg.Error(fmt.Sprintf("get allowed cidrs error: %v", err))
+				return
+			}
+			if !allowed {
+				l.Metrics.Reject(app.ResultSourceNotAllowed)
+				l.AuthFailures.Log(c.RemoteAddr().String(), app.AuthFailureSourceNotAllowed)
+				lg.Info(fmt.Sprintf("reject trojan net.Conn from %v: source not allowed", c.RemoteAddr()))
+				return
+			}
+			if up.QuotaExceeded(l.ctx, key) {
+				l.Metrics.Reject(app.ResultQuotaExceeded)
+				lg.Info(fmt.Sprintf("reject trojan net.Conn from %v: quota exceeded", c.RemoteAddr()))
+				return
+			}
+			if !l.Connections.Acquire(key, l.MaxConnections) {
+				l.Metrics.Reject(app.ResultTooManyConnections)
+				lg.Info(fmt.Sprintf("reject trojan net.Conn from %v: too many connections", c.RemoteAddr()))
+				return
+			}
+			defer l.Connections.Release(key)
+			done, ok := l.Relays.Add(key, c)
+			if !ok {
+				return
+			}
+			defer done()
+			l.Metrics.Open()
+			defer l.Metrics.Close()
 			if l.Verbose {
 				lg.Info(fmt.Sprintf("handle trojan net.Conn from %v", c.RemoteAddr()))
 			}
 
-			nr, nw, err := l.Proxy.Handle(io.Reader(c), io.Writer(c))
-			if err != nil {
+			lim := lims.Get(l.ctx, key)
+			l.SocketOptions.Apply(c)
+			start, req := time.Now(), &trojan.Request{Filter: l.DomainFilter.Check, Buffers: l.Buffers, Setup: l.SocketOptions.Apply}
+			req.Source, req.ProxyProtocol = c.RemoteAddr(), l.OutboundProxyProtocol
+			req.Mux = l.Mux
+			req.Parsed = func() { c.SetReadDeadline(time.Time{}) }
+			// a user without a source ip, or of an upstream error, uses the default route
+			req.LocalIP, _ = up.GetSourceIP(l.ctx, key)
+			meter := l.Accounting.Start(up, key)
+			req.Progress = func(nr, nw int64) { meter.Add(app.ProtocolOf(req), nr, nw) }
+			// the command is read again by the proxy
+			r := utils.RewindConn(c, cmd[:])
+			nr, nw, err := l.Proxy.Handle(utils.NewRateLimitReader(r, lim), utils.NewRateLimitWriter(c, lim), req)
+			switch {
+			case err == nil:
+			case errors.Is(err, trojan.ErrShortRequest):
+				// the client is gone before the request, like a prober
+				lg.Debug(fmt.Sprintf("handle net.Conn error: %v", err))
+			default:
 				lg.Error(fmt.Sprintf("handle net.Conn error: %v", err))
 			}
-			up.Consume(utils.ByteSliceToString(b[:trojan.HeaderLen]), nr, nw)
+			// record traffic even if the listener is closed meanwhile
+			meter.Close(app.ProtocolOf(req), nr, nw)
+			l.Metrics.Consume(key, nr, nw)
+			l.AccessLog.Log(lg, key, req, nr, nw, start, err)
 		}(conn, l.Logger, l.Upstream)
 	}
 }
+
+// validate validates the user of the trojan header, or the user of the
+// client certificate first with ClientCertAuth, and returns the canonical
+// key of the valid user.
+func (l *Listener) validate(c net.Conn, up app.Upstream, key string) (string, bool, error) {
+	if l.ClientCertAuth {
+		if k, found := app.CertKey(up, connectionState(c)); found {
+			k, ok, err := app.Lookup(l.ctx, up, k)
+			if err != nil || ok {
+				return k, ok, err
+			}
+		}
+	}
+	return app.Lookup(l.ctx, up, key)
+}
+
+// fallbackDialTimeout is the timeout of connecting to the fallback backend.
+const fallbackDialTimeout = 10 * time.Second
+
+// fallback hands the net.Conn to the backend of the first route matching
+// the server name, or to Fallback, so the server looks like a normal web
+// server to probers. If neither is found, it is handed to caddy http server,
+// or reset by FallbackPolicy. Either is done after the jitter, if any.
+func (l *Listener) fallback(c net.Conn) {
+	// the deadline is of the trojan header only
+	c.SetReadDeadline(time.Time{})
+	if l.FallbackJitterMax > 0 {
+		timer := time.NewTimer(jitter(l.FallbackJitterMin, l.FallbackJitterMax))
+		select {
+		case <-l.closed:
+			timer.Stop()
+			c.Close()
+			return
+		case <-timer.C:
+		}
+	}
+	backends := l.backends(c)
+	if len(backends) == 0 {
+		if l.FallbackPolicy == FallbackPolicyReset {
+			reset(c)
+			return
+		}
+		select {
+		case <-l.closed:
+			c.Close()
+		default:
+			l.conns <- c
+		}
+		return
+	}
+
+	defer c.Close()
+
+	rc, backend, err := l.dialFallback(backends)
+	if err != nil {
+		l.Logger.Error(fmt.Sprintf("dial fallback %v error: %v", backend, err))
+		return
+	}
+	defer rc.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(rc, c)
+		if cw, ok := rc.(interface {
+			CloseWrite() error
+		}); ok {
+			cw.CloseWrite()
+		}
+		errCh <- err
+	}()
+
+	if _, err := io.Copy(c, rc); err != nil {
+		l.Logger.Error(fmt.Sprintf("relay fallback %v error: %v", backend, err))
+	}
+	// the backend is done, stop reading from the client
+	c.Close()
+	if err := <-errCh; err != nil && !errors.Is(err, net.ErrClosed) {
+		l.Logger.Error(fmt.Sprintf("relay fallback %v error: %v", backend, err))
+	}
+}
+
+// backends returns the backends of the first route matching the server
+// name of the net.Conn, or Fallback.
+func (l *Listener) backends(c net.Conn) []string {
+	if len(l.Fallbacks) > 0 {
+		name := serverName(c)
+		for i := range l.Fallbacks {
+			if l.Fallbacks[i].Match(name) {
+				return l.Fallbacks[i].Backends
+			}
+		}
+	}
+	if l.Fallback == "" {
+		return nil
+	}
+	return []string{l.Fallback}
+}
+
+// dialFallback dials the backends in order, and returns the first connected
+// one, or the error of the last one.
+func (l *Listener) dialFallback(backends []string) (net.Conn, string, error) {
+	var err error
+	for i, backend := range backends {
+		var rc net.Conn
+		rc, err = net.DialTimeout("tcp", backend, fallbackDialTimeout)
+		if err == nil {
+			return rc, backend, nil
+		}
+		if i < len(backends)-1 {
+			l.Logger.Debug(fmt.Sprintf("dial fallback %v error: %v", backend, err))
+		}
+	}
+	return nil, backends[len(backends)-1], err
+}
@@ -0,0 +1,1073 @@
+package listener
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/imgk/caddy-trojan/app"
+	"github.com/imgk/caddy-trojan/socks"
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+// handled is an app.Proxy which reports handled connections.
+type handled chan struct{}
+
+// Handle is ...
+func (p handled) Handle(r io.Reader, w io.Writer, req *trojan.Request) (int64, int64, error) {
+	p <- struct{}{}
+	return 0, 0, nil
+}
+
+// Close is ...
+func (handled) Close() error {
+	return nil
+}
+
+func TestListenerQuotaExceeded(t *testing.T) {
+	up := &app.MemoryUpstream{}
+	if err := up.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	if err := up.SetQuota(context.Background(), utils.ByteSliceToString(key[:]), 16); err != nil {
+		t.Fatalf("set quota error: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	px := make(handled, 1)
+	l := NewListener(ln, up, px, zap.NewNop())
+	go l.loop()
+	defer l.Close()
+
+	// dial sends the trojan header and reports whether the proxy handles it
+	dial := func() bool {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("dial error: %v", err)
+		}
+		defer c.Close()
+		if _, err := c.Write(append(key[:], '\r', '\n', trojan.CmdConnect)); err != nil {
+			t.Fatalf("write header error: %v", err)
+		}
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("connection is not closed: %v", err)
+		}
+		select {
+		case <-px:
+			return true
+		default:
+			return false
+		}
+	}
+
+	if !dial() {
+		t.Errorf("reject user below quota")
+	}
+	up.Consume(context.Background(), utils.ByteSliceToString(key[:]), app.ProtocolTCP, 10, 10)
+	if dial() {
+		t.Errorf("accept user exceeding quota")
+	}
+}
+
+func TestListenerFallback(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		c, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		c.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		c.Close()
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	l := NewListener(ln, &app.MemoryUpstream{}, make(handled, 1), zap.NewNop())
+	l.Fallback = backend.Addr().String()
+	go l.loop()
+	defer l.Close()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("GET / HTTP/1.1\r\n")); err != nil {
+		t.Fatalf("write request error: %v", err)
+	}
+
+	// the client keeps its side open, the connection is closed by the listener
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	b, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatalf("read response error: %v", err)
+	}
+	if string(b) != "HTTP/1.1 400 Bad Request\r\n\r\n" {
+		t.Errorf("read response error: %q", b)
+	}
+}
+
+func TestListenerFallbackJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if d := jitter(time.Millisecond, 2*time.Millisecond); d < time.Millisecond || d > 2*time.Millisecond {
+			t.Fatalf("jitter out of range: %v", d)
+		}
+	}
+	if d := jitter(time.Millisecond, 0); d != time.Millisecond {
+		t.Errorf("jitter of no range error: %v", d)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	l := NewListener(ln, &app.MemoryUpstream{}, make(handled, 1), zap.NewNop())
+	l.FallbackPolicy = FallbackPolicyReset
+	l.FallbackJitterMin, l.FallbackJitterMax = 200*time.Millisecond, 300*time.Millisecond
+	go l.loop()
+	defer l.Close()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer c.Close()
+	start := time.Now()
+	if _, err := c.Write([]byte("GET / HTTP/1.1\r\n")); err != nil {
+		t.Fatalf("write request error: %v", err)
+	}
+
+	// the connection is reset after the jitter
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(c); err == nil {
+		t.Errorf("connection is not reset")
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("fallback without jitter: %v", d)
+	}
+}
+
+func TestListenerInvalidCRLF(t *testing.T) {
+	up := &app.MemoryUpstream{}
+	if err := up.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	prefix := make([]byte, trojan.HeaderLen, trojan.HeaderLen+2)
+	trojan.GenKey("test1234", prefix)
+	prefix = append(prefix, '\r', '\r')
+
+	// the backend echoes the prefix
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		c, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		b := make([]byte, len(prefix))
+		if _, err := io.ReadFull(c, b); err != nil {
+			return
+		}
+		c.Write(b)
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	px := make(handled, 1)
+	l := NewListener(ln, up, px, zap.NewNop())
+	l.Fallback = backend.Addr().String()
+	go l.loop()
+	defer l.Close()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Write(prefix); err != nil {
+		t.Fatalf("write header error: %v", err)
+	}
+
+	// a valid key without 0x0d 0x0a is not a trojan header
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	b, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatalf("read response error: %v", err)
+	}
+	if string(b) != string(prefix) {
+		t.Errorf("read response error: %q", b)
+	}
+	select {
+	case <-px:
+		t.Errorf("handle header without 0x0d 0x0a")
+	default:
+	}
+}
+
+func TestListenerBadCommand(t *testing.T) {
+	up := &app.MemoryUpstream{}
+	if err := up.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	// 0x02 BIND of a valid user
+	req := make([]byte, trojan.HeaderLen)
+	trojan.GenKey("test1234", req)
+	req = append(req, '\r', '\n', 0x02, socks.AddrTypeIPv4, 127, 0, 0, 1, 0, 80, '\r', '\n')
+
+	// the backend echoes the request
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		c, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		b := make([]byte, len(req))
+		if _, err := io.ReadFull(c, b); err != nil {
+			return
+		}
+		c.Write(b)
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	px := make(handled, 1)
+	l := NewListener(ln, up, px, zap.NewNop())
+	l.Fallback = backend.Addr().String()
+	go l.loop()
+	defer l.Close()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Write(req); err != nil {
+		t.Fatalf("write request error: %v", err)
+	}
+
+	// the request is handed to fallback, and never to the proxy
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	b, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatalf("read response error: %v", err)
+	}
+	if string(b) != string(req) {
+		t.Errorf("read response error: %q", b)
+	}
+	select {
+	case <-px:
+		t.Errorf("handle request of bad command")
+	default:
+	}
+}
+
+// failing is an app.Upstream which fails to validate users.
+type failing struct {
+	*app.MemoryUpstream
+}
+
+// Validate is ...
+func (failing) Validate(ctx context.Context, k string) (bool, error) {
+	return false, errors.New("storage is down")
+}
+
+func TestListenerUpstreamError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	px := make(handled, 1)
+	l := NewListener(ln, failing{MemoryUpstream: &app.MemoryUpstream{}}, px, zap.NewNop())
+	go l.loop()
+	defer l.Close()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer c.Close()
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	if _, err := c.Write(append(key[:], '\r', '\n')); err != nil {
+		t.Fatalf("write header error: %v", err)
+	}
+
+	// closed, instead of handed to the caddy http server
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("connection is not closed: %v", err)
+	}
+	select {
+	case conn := <-l.conns:
+		conn.Close()
+		t.Errorf("fallback with upstream error")
+	default:
+	}
+	select {
+	case <-px:
+		t.Errorf("handle with upstream error")
+	default:
+	}
+}
+
+// direct is an app.Proxy which relays to destinations directly.
+type direct struct{}
+
+// Handle is ...
+func (p direct) Handle(r io.Reader, w io.Writer, req *trojan.Request) (int64, int64, error) {
+	return trojan.HandleRequest(r, w, p, req)
+}
+
+// Dial is ...
+func (direct) Dial(network, addr string) (net.Conn, error) {
+	return net.Dial(network, addr)
+}
+
+// ListenPacket is ...
+func (direct) ListenPacket(network, addr string) (net.PacketConn, error) {
+	return net.ListenPacket(network, addr)
+}
+
+// Close is ...
+func (direct) Close() error {
+	return nil
+}
+
+func TestListenerPayloadWithHeader(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		c, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil {
+			return
+		}
+		c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: " + fmt.Sprint(len(r.URL.Path)) + "\r\n\r\n" + r.URL.Path))
+	}()
+
+	up := &app.MemoryUpstream{}
+	if err := up.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	l := NewListener(ln, up, direct{}, zap.NewNop())
+	go l.loop()
+	defer l.Close()
+
+	addr, err := socks.ResolveAddr(backend.Addr())
+	if err != nil {
+		t.Fatalf("resolve addr error: %v", err)
+	}
+	b := make([]byte, trojan.HeaderLen, 256)
+	trojan.GenKey("test1234", b)
+	b = append(b, '\r', '\n', trojan.CmdConnect)
+	b = addr.AppendTo(b)
+	b = append(b, '\r', '\n')
+	b = append(b, "GET /hello HTTP/1.1\r\nHost: example.com\r\n\r\n"...)
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer c.Close()
+	// the header and the first request in one segment
+	if _, err := c.Write(b); err != nil {
+		t.Fatalf("write request error: %v", err)
+	}
+
+	c.SetReadDeadline(time.Now().Add(time.Second * 5))
+	res, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatalf("read response error: %v", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil || string(body) != "/hello" {
+		t.Errorf("read response error: %q, %v", body, err)
+	}
+}
+
+func TestListenerAccept(t *testing.T) {
+	up := &app.MemoryUpstream{}
+	if err := up.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	px := make(handled, 1)
+	l := NewListener(ln, up, px, zap.NewNop())
+	go l.loop()
+
+	// the caddy http server accepts connections which are not trojan
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	unknown := make([]byte, trojan.HeaderLen, trojan.HeaderLen+2)
+	trojan.GenKey("unknown", unknown)
+	unknown = append(unknown, '\r', '\n')
+
+	for _, v := range []struct {
+		Name    string
+		Request string
+		Status  int
+		Body    string
+	}{
+		{
+			// 0x0a before the end of the header
+			Name:    "short request line",
+			Request: "GET /hello HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			Status:  http.StatusOK,
+			Body:    "/hello",
+		},
+		{
+			// the header is read without 0x0d 0x0a
+			Name:    "long request line",
+			Request: "GET /" + strings.Repeat("a", 64) + " HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			Status:  http.StatusOK,
+			Body:    "/" + strings.Repeat("a", 64),
+		},
+		{
+			// a header of an unknown user is served as a bad request
+			Name:    "unknown user",
+			Request: string(unknown),
+			Status:  http.StatusBadRequest,
+		},
+	} {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("dial error: %v", err)
+		}
+		if _, err := c.Write([]byte(v.Request)); err != nil {
+			t.Fatalf("write request of %v error: %v", v.Name, err)
+		}
+
+		c.SetReadDeadline(time.Now().Add(time.Second * 5))
+		res, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			c.Close()
+			t.Errorf("read response of %v error: %v", v.Name, err)
+			continue
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		c.Close()
+		if res.StatusCode != v.Status {
+			t.Errorf("read response of %v error: got status %v, want %v", v.Name, res.StatusCode, v.Status)
+		}
+		if v.Body != "" && (err != nil || string(body) != v.Body) {
+			t.Errorf("read response of %v error: got %q, %v, want %q", v.Name, body, err, v.Body)
+		}
+	}
+	select {
+	case <-px:
+		t.Errorf("handle connection which is not trojan")
+	default:
+	}
+}
+
+func TestListenerReplay(t *testing.T) {
+	up := &app.MemoryUpstream{}
+	if err := up.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	px := make(handled, 1)
+	l := NewListener(ln, up, px, zap.NewNop())
+	l.Replays = &app.Replays{Window: time.Minute}
+	// the user is connected from another address
+	l.Replays.Check(utils.ByteSliceToString(key[:]), "192.0.2.1:1000")
+	go l.loop()
+	defer l.Close()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer c.Close()
+	header := append(key[:], '\r', '\n')
+	if _, err := c.Write(header); err != nil {
+		t.Fatalf("write header error: %v", err)
+	}
+
+	// the replay is handed to the http server with the header
+	timer := time.AfterFunc(time.Second, func() { l.Close() })
+	defer timer.Stop()
+	rc, err := l.Accept()
+	if err != nil {
+		t.Fatalf("replay is not handed to the http server: %v", err)
+	}
+	defer rc.Close()
+	b := make([]byte, len(header))
+	if _, err := io.ReadFull(rc, b); err != nil || string(b) != string(header) {
+		t.Errorf("read header error: %q, %v", b, err)
+	}
+	select {
+	case <-px:
+		t.Errorf("replay is handled")
+	default:
+	}
+}
+
+func TestListenerAuthLimit(t *testing.T) {
+	up := &app.MemoryUpstream{}
+	if err := up.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	bad := [trojan.HeaderLen]byte{}
+	trojan.GenKey("bad12345", bad[:])
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	px := make(handled, 1)
+	l := NewListener(ln, up, px, zap.NewNop())
+	l.AuthLimiter = &app.AuthLimiter{MaxFailures: 1}
+	if err := l.AuthLimiter.Provision(); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	go l.loop()
+	defer l.Close()
+	timer := time.AfterFunc(5*time.Second, func() { l.Close() })
+	defer timer.Stop()
+
+	for _, k := range [][trojan.HeaderLen]byte{bad, key} {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("dial error: %v", err)
+		}
+		defer c.Close()
+		header := append(k[:], '\r', '\n')
+		if _, err := c.Write(header); err != nil {
+			t.Fatalf("write header error: %v", err)
+		}
+
+		// both the unknown user and the user of the banned address are
+		// handed to the http server
+		rc, err := l.Accept()
+		if err != nil {
+			t.Fatalf("connection is not handed to the http server: %v", err)
+		}
+		defer rc.Close()
+		b := make([]byte, len(header))
+		if _, err := io.ReadFull(rc, b); err != nil || string(b) != string(header) {
+			t.Errorf("read header error: %q, %v", b, err)
+		}
+	}
+	select {
+	case <-px:
+		t.Errorf("user of the banned address is handled")
+	default:
+	}
+}
+
+func TestListenerAuthFailureLog(t *testing.T) {
+	bad := [trojan.HeaderLen]byte{}
+	trojan.GenKey("bad12345", bad[:])
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	core, logs := observer.New(zapcore.WarnLevel)
+	l := NewListener(ln, &app.MemoryUpstream{}, make(handled, 1), zap.NewNop())
+	l.AuthFailures = (&app.AuthFailureLog{First: 10}).Logger(zap.New(core))
+	go l.loop()
+	defer l.Close()
+	timer := time.AfterFunc(5*time.Second, func() { l.Close() })
+	defer timer.Stop()
+
+	for _, header := range []string{
+		string(bad[:]) + "\r\n",
+		strings.Repeat("x", trojan.HeaderLen+2),
+	} {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("dial error: %v", err)
+		}
+		defer c.Close()
+		if _, err := c.Write([]byte(header)); err != nil {
+			t.Fatalf("write header error: %v", err)
+		}
+		rc, err := l.Accept()
+		if err != nil {
+			t.Fatalf("connection is not handed to the http server: %v", err)
+		}
+		rc.Close()
+	}
+
+	entries := logs.AllUntimed()
+	if len(entries) != 2 {
+		t.Fatalf("logged %v auth failures, want 2", len(entries))
+	}
+	for i, reason := range []string{app.AuthFailureUnknownKey, app.AuthFailureBadHeader} {
+		if fields := entries[i].ContextMap(); fields["source_ip"] != "127.0.0.1" || fields["reason"] != reason {
+			t.Errorf("auth failure %v error: %v", i, fields)
+		}
+	}
+}
+
+func TestListenerHeaderTimeout(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		c, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	up := &app.MemoryUpstream{}
+	if err := up.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	l := NewListener(ln, up, direct{}, zap.NewNop())
+	l.HeaderTimeout = 200 * time.Millisecond
+	go l.loop()
+	defer l.Close()
+
+	addr, err := socks.ResolveAddr(backend.Addr())
+	if err != nil {
+		t.Fatalf("resolve addr error: %v", err)
+	}
+	b := make([]byte, trojan.HeaderLen, 256)
+	trojan.GenKey("test1234", b)
+	b = append(b, '\r', '\n', trojan.CmdConnect)
+	b = addr.AppendTo(b)
+	b = append(b, '\r', '\n')
+
+	for _, n := range []int{
+		// stalled in the trojan header
+		10,
+		// stalled in the address of the request
+		trojan.HeaderLen + 2 + 2,
+	} {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("dial error: %v", err)
+		}
+		defer c.Close()
+		// every byte is sent slowly, within the timeout
+		for i := 0; i < n; i++ {
+			if _, err := c.Write(b[i : i+1]); err != nil {
+				t.Fatalf("write header error: %v", err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		c.SetReadDeadline(time.Now().Add(time.Second * 5))
+		if _, err := c.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+			t.Errorf("stalled client of %v bytes is not closed: %v", n, err)
+		}
+	}
+
+	// the deadline is cleared once the request is read
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Write(b); err != nil {
+		t.Fatalf("write request error: %v", err)
+	}
+	time.Sleep(2 * l.HeaderTimeout)
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatalf("write payload error: %v", err)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second * 5))
+	payload := make([]byte, 5)
+	if _, err := io.ReadFull(c, payload); err != nil || string(payload) != "hello" {
+		t.Errorf("relay after the timeout error: %q, %v", payload, err)
+	}
+}
+
+// tlsConfig returns a config of a self-signed certificate.
+func tlsConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key error: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"www.example.com"},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate error: %v", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert}, PrivateKey: key}},
+	}
+}
+
+func TestListenerFallbackRoutes(t *testing.T) {
+	// backend returns a backend which replies its name
+	backend := func(name string) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen error: %v", err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				c.Write([]byte(name))
+				c.Close()
+			}
+		}()
+		return ln.Addr().String()
+	}
+	// a closed port comes first, so the next backend is dialed
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	closed.Close()
+	routes := []FallbackRoute{
+		{Hosts: []string{"*.example.com"}, Backends: []string{closed.Addr().String(), backend("site")}},
+	}
+	for i := range routes {
+		if err := routes[i].Provision(); err != nil {
+			t.Fatalf("provision fallback error: %v", err)
+		}
+	}
+
+	for _, v := range []struct {
+		Name     string
+		Fallback string
+		Policy   string
+		Server   string
+		Response string
+	}{
+		{Name: "sni", Fallback: backend("default"), Server: "www.example.com", Response: "site"},
+		{Name: "bare ip", Fallback: backend("default"), Response: "default"},
+		{Name: "other sni", Fallback: backend("default"), Server: "example.org", Response: "default"},
+		{Name: "reset", Policy: FallbackPolicyReset},
+	} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen error: %v", err)
+		}
+		l := NewListener(tls.NewListener(ln, tlsConfig(t)), &app.MemoryUpstream{}, make(handled, 1), zap.NewNop())
+		l.Fallback, l.Fallbacks, l.FallbackPolicy = v.Fallback, routes, v.Policy
+		go l.loop()
+		defer l.Close()
+
+		c, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: v.Server, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("%v: dial error: %v", v.Name, err)
+		}
+		defer c.Close()
+		if _, err := c.Write([]byte("GET / HTTP/1.1\r\n")); err != nil {
+			t.Fatalf("%v: write request error: %v", v.Name, err)
+		}
+		c.SetReadDeadline(time.Now().Add(time.Second * 5))
+		b, err := io.ReadAll(c)
+		if v.Response == "" {
+			if err == nil {
+				t.Errorf("%v: connection is not reset: %q", v.Name, b)
+			}
+			continue
+		}
+		if err != nil || string(b) != v.Response {
+			t.Errorf("%v: read response error: %q, %v", v.Name, b, err)
+		}
+	}
+}
+
+func TestUnmarshalCaddyfileFallback(t *testing.T) {
+	m := &ListenerWrapper{}
+	d := caddyfile.NewTestDispenser(`trojan {
+		fallback 127.0.0.1:8080
+		fallback 127.0.0.1:8081 127.0.0.1:8082 {
+			hosts www.example.com *.example.org
+		}
+		fallback_policy reset
+		fallback_jitter 10ms 50ms
+	}`)
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if m.FallbackJitterMin != caddy.Duration(10*time.Millisecond) || m.FallbackJitterMax != caddy.Duration(50*time.Millisecond) {
+		t.Errorf("unmarshal fallback_jitter error: %v, %v", m.FallbackJitterMin, m.FallbackJitterMax)
+	}
+	if m.Fallback != "127.0.0.1:8080" || m.FallbackPolicy != FallbackPolicyReset {
+		t.Errorf("unmarshal fallback error: %v, %v", m.Fallback, m.FallbackPolicy)
+	}
+	if len(m.Fallbacks) != 1 || len(m.Fallbacks[0].Hosts) != 2 || len(m.Fallbacks[0].Backends) != 2 {
+		t.Errorf("unmarshal fallbacks error: %v", m.Fallbacks)
+	}
+
+	for _, v := range []string{
+		"trojan {\n fallback 127.0.0.1:8080\n fallback 127.0.0.1:8081\n}",
+		"trojan {\n fallback 127.0.0.1:8080 127.0.0.1:8081\n}",
+		"trojan {\n fallback 127.0.0.1:8080 {\n hosts\n }\n}",
+		"trojan {\n fallback_policy drop\n}",
+		"trojan {\n fallback_jitter\n}",
+		"trojan {\n fallback_jitter 1ms 2ms 3ms\n}",
+		"trojan {\n fallback_jitter soon\n}",
+	} {
+		if err := (&ListenerWrapper{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser(v)); err == nil {
+			t.Errorf("unmarshal %q: no error", v)
+		}
+	}
+}
+
+func TestListenerClientCertAuth(t *testing.T) {
+	config := tlsConfig(t)
+	config.ClientAuth = tls.RequestClientCert
+	cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("parse certificate error: %v", err)
+	}
+	up := &app.MemoryUpstream{}
+	if err := up.Add(context.Background(), app.CertPassword(cert)); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+
+	// the password of the header is of no user
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+	for _, v := range []struct {
+		Name    string
+		Enabled bool
+		Cert    bool
+		Handled bool
+	}{
+		{Name: "cert", Enabled: true, Cert: true, Handled: true},
+		{Name: "no cert", Enabled: true},
+		{Name: "disabled", Cert: true},
+	} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen error: %v", err)
+		}
+		px := make(handled, 1)
+		l := NewListener(tls.NewListener(ln, config), up, px, zap.NewNop())
+		l.ClientCertAuth = v.Enabled
+		go l.loop()
+		defer l.Close()
+
+		cfg := &tls.Config{InsecureSkipVerify: true}
+		if v.Cert {
+			cfg.Certificates = config.Certificates
+		}
+		c, err := tls.Dial("tcp", ln.Addr().String(), cfg)
+		if err != nil {
+			t.Fatalf("%v: dial error: %v", v.Name, err)
+		}
+		defer c.Close()
+		if _, err := c.Write(append(key[:], '\r', '\n', trojan.CmdConnect)); err != nil {
+			t.Fatalf("%v: write header error: %v", v.Name, err)
+		}
+
+		var ok bool
+		select {
+		case <-px:
+			ok = true
+		case conn := <-l.conns:
+			conn.Close()
+		case <-time.After(time.Second * 5):
+			t.Fatalf("%v: connection is neither handled nor handed to fallback", v.Name)
+		}
+		if ok != v.Handled {
+			t.Errorf("%v: handled error: %v", v.Name, ok)
+		}
+	}
+}
+
+func TestListenerTenants(t *testing.T) {
+	tenant := &app.MemoryUpstream{}
+	if err := tenant.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+
+	for _, v := range []struct {
+		Name    string
+		Server  string
+		Strict  bool
+		Handled bool
+	}{
+		{Name: "tenant", Server: "www.example.com", Handled: true},
+		{Name: "default", Server: "example.org"},
+		{Name: "strict", Server: "example.org", Strict: true},
+	} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen error: %v", err)
+		}
+		px := make(handled, 1)
+		// the user is of the tenant only
+		l := NewListener(tls.NewListener(ln, tlsConfig(t)), &app.MemoryUpstream{}, px, zap.NewNop())
+		l.Tenants = &app.Tenants{Strict: v.Strict}
+		l.Tenants.Add("*.example.com", tenant, 0)
+		go l.loop()
+		defer l.Close()
+
+		c, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: v.Server, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("%v: dial error: %v", v.Name, err)
+		}
+		defer c.Close()
+		if _, err := c.Write(append(key[:], '\r', '\n', trojan.CmdConnect)); err != nil {
+			t.Fatalf("%v: write header error: %v", v.Name, err)
+		}
+
+		var ok bool
+		select {
+		case <-px:
+			ok = true
+		case conn := <-l.conns:
+			conn.Close()
+		case <-time.After(time.Second * 5):
+			t.Fatalf("%v: connection is neither handled nor handed to fallback", v.Name)
+		}
+		if ok != v.Handled {
+			t.Errorf("%v: handled error: %v", v.Name, ok)
+		}
+	}
+}
+
+func TestListenerAllowedCIDRs(t *testing.T) {
+	up := &app.MemoryUpstream{}
+	if err := up.Add(context.Background(), "test1234"); err != nil {
+		t.Fatalf("add user error: %v", err)
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("test1234", key[:])
+
+	for _, v := range []struct {
+		Name    string
+		Network string
+		Address string
+		CIDRs   []string
+		Handled bool
+	}{
+		{Name: "ipv4 allowed", Network: "tcp4", Address: "127.0.0.1:0", CIDRs: []string{"127.0.0.0/8"}, Handled: true},
+		{Name: "ipv4 not allowed", Network: "tcp4", Address: "127.0.0.1:0", CIDRs: []string{"10.0.0.0/8", "::1"}},
+		{Name: "ipv6 allowed", Network: "tcp6", Address: "[::1]:0", CIDRs: []string{"10.0.0.0/8", "::1"}, Handled: true},
+		{Name: "ipv6 not allowed", Network: "tcp6", Address: "[::1]:0", CIDRs: []string{"127.0.0.0/8", "2001:db8::/32"}},
+		{Name: "all allowed", Network: "tcp4", Address: "127.0.0.1:0", Handled: true},
+	} {
+		if err := up.SetAllowedCIDRs(context.Background(), utils.ByteSliceToString(key[:]), v.CIDRs); err != nil {
+			t.Fatalf("%v: set allowed cidrs error: %v", v.Name, err)
+		}
+		ln, err := net.Listen(v.Network, v.Address)
+		if err != nil {
+			t.Logf("%v: listen error: %v", v.Name, err)
+			continue
+		}
+		px := make(handled, 1)
+		l := NewListener(ln, up, px, zap.NewNop())
+		go l.loop()
+		defer l.Close()
+
+		c, err := net.Dial(v.Network, ln.Addr().String())
+		if err != nil {
+			t.Fatalf("%v: dial error: %v", v.Name, err)
+		}
+		defer c.Close()
+		if _, err := c.Write(append(key[:], '\r', '\n', trojan.CmdConnect)); err != nil {
+			t.Fatalf("%v: write header error: %v", v.Name, err)
+		}
+		// a rejected connection is closed without handing it to fallback
+		c.SetReadDeadline(time.Now().Add(time.Second * 5))
+		if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("%v: connection is not closed: %v", v.Name, err)
+		}
+		ok := false
+		select {
+		case <-px:
+			ok = true
+		default:
+		}
+		if ok != v.Handled {
+			t.Errorf("%v: handled error: %v", v.Name, ok)
+		}
+	}
+}
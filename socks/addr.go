@@ -37,7 +37,7 @@ func (*Addr) Network() string {
 	return "socks"
 }
 
-// String is ...
+// String returns host:port for dialing, an IPv6 host is bracketed.
 func (addr *Addr) String() string {
 	switch addr.data[0] {
 	case AddrTypeIPv4:
@@ -46,6 +46,10 @@ func (addr *Addr) String() string {
 		return net.JoinHostPort(host, port)
 	case AddrTypeDomain:
 		host := string(addr.data[2 : 2+addr.data[1]])
+		// an IPv6 literal sent as a domain may be bracketed already
+		if len(host) > 2 && host[0] == '[' && host[len(host)-1] == ']' {
+			host = host[1 : len(host)-1]
+		}
 		port := strconv.Itoa(int(addr.data[2+addr.data[1]])<<8 | int(addr.data[2+addr.data[1]+1]))
 		return net.JoinHostPort(host, port)
 	case AddrTypeIPv6:
@@ -99,6 +103,9 @@ func ReadAddrBuffer(conn io.Reader, addr []byte) (*Addr, error) {
 
 		return &Addr{data: addr[:n]}, nil
 	case AddrTypeDomain:
+		if addr[1] == 0 {
+			return nil, ErrInvalidAddrLen
+		}
 		n := 1 + 1 + int(addr[1]) + 2
 		_, err := io.ReadFull(conn, addr[2:n])
 		if err != nil {
@@ -134,6 +141,9 @@ func ParseAddr(addr []byte) (*Addr, error) {
 
 		return &Addr{data: addr[:n]}, nil
 	case AddrTypeDomain:
+		if addr[1] == 0 {
+			return nil, ErrInvalidAddrLen
+		}
 		n := 1 + 1 + int(addr[1]) + 2
 		if len(addr) < n {
 			return nil, ErrInvalidAddrLen
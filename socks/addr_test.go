@@ -0,0 +1,127 @@
+package socks
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+// domainAddr returns the socks address of the domain and the port.
+func domainAddr(host string, port uint16) []byte {
+	b := []byte{AddrTypeDomain, byte(len(host))}
+	b = append(b, host...)
+	return append(b, byte(port>>8), byte(port))
+}
+
+func TestAddr(t *testing.T) {
+	for _, v := range []struct {
+		Name string
+		Data []byte
+		Addr string
+		// IP is the address resolved without DNS, nil for domains.
+		IP net.IP
+	}{
+		{
+			Name: "ipv4",
+			Data: []byte{AddrTypeIPv4, 127, 0, 0, 1, 0x01, 0xbb},
+			Addr: "127.0.0.1:443",
+			IP:   net.IPv4(127, 0, 0, 1),
+		},
+		{
+			Name: "ipv6 loopback",
+			Data: []byte{AddrTypeIPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x01, 0xbb},
+			Addr: "[::1]:443",
+			IP:   net.IPv6loopback,
+		},
+		{
+			Name: "ipv6",
+			Data: []byte{AddrTypeIPv6, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x00, 0x50},
+			Addr: "[2001:db8::1]:80",
+			IP:   net.ParseIP("2001:db8::1"),
+		},
+		{
+			Name: "domain",
+			Data: domainAddr("example.com", 8080),
+			Addr: "example.com:8080",
+		},
+		{
+			// 例子.测试
+			Name: "punycode domain",
+			Data: domainAddr("xn--fsqu00a.xn--0zwm56d", 443),
+			Addr: "xn--fsqu00a.xn--0zwm56d:443",
+		},
+		{
+			Name: "ipv6 literal domain",
+			Data: domainAddr("2001:db8::1", 53),
+			Addr: "[2001:db8::1]:53",
+		},
+		{
+			Name: "bracketed ipv6 literal domain",
+			Data: domainAddr("[2001:db8::1]", 53),
+			Addr: "[2001:db8::1]:53",
+		},
+	} {
+		// the address is followed by the payload
+		data := append(append([]byte{}, v.Data...), 0x0d, 0x0a)
+
+		addr, err := ReadAddr(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("read addr of %v error: %v", v.Name, err)
+			continue
+		}
+		if addr.String() != v.Addr || addr.Len() != len(v.Data) || !bytes.Equal(addr.Bytes(), v.Data) {
+			t.Errorf("read addr of %v error: got %v of %v bytes, want %v", v.Name, addr, addr.Len(), v.Addr)
+		}
+		if _, port, err := net.SplitHostPort(addr.String()); err != nil || port == "" {
+			t.Errorf("split addr %v of %v error: %v", addr, v.Name, err)
+		}
+
+		addr, err = ParseAddr(data)
+		if err != nil {
+			t.Errorf("parse addr of %v error: %v", v.Name, err)
+			continue
+		}
+		if addr.String() != v.Addr || addr.Len() != len(v.Data) {
+			t.Errorf("parse addr of %v error: got %v of %v bytes, want %v", v.Name, addr, addr.Len(), v.Addr)
+		}
+
+		if v.IP == nil {
+			continue
+		}
+		tcpAddr, err := ResolveTCPAddr(addr)
+		if err != nil || !tcpAddr.IP.Equal(v.IP) || tcpAddr.String() != v.Addr {
+			t.Errorf("resolve tcp addr of %v error: got %v, %v", v.Name, tcpAddr, err)
+		}
+		udpAddr, err := ResolveUDPAddr(addr)
+		if err != nil || !udpAddr.IP.Equal(v.IP) || udpAddr.String() != v.Addr {
+			t.Errorf("resolve udp addr of %v error: got %v, %v", v.Name, udpAddr, err)
+		}
+		// the address type of an IP is kept when converted back
+		back, err := ResolveAddr(tcpAddr)
+		if err != nil || !bytes.Equal(back.Bytes(), v.Data) {
+			t.Errorf("resolve addr %v of %v error: got %x, %v", tcpAddr, v.Name, back.Bytes(), err)
+		}
+	}
+}
+
+func TestAddrInvalid(t *testing.T) {
+	for _, v := range []struct {
+		Name string
+		Data []byte
+		Err  error
+	}{
+		{Name: "unknown type", Data: []byte{0x02, 127, 0, 0, 1, 0, 80}, Err: ErrInvalidAddrType},
+		{Name: "empty domain", Data: []byte{AddrTypeDomain, 0, 0, 80, 0, 0}, Err: ErrInvalidAddrLen},
+		{Name: "short ipv4", Data: []byte{AddrTypeIPv4, 127, 0, 0, 1, 0}, Err: ErrInvalidAddrLen},
+		{Name: "short ipv6", Data: []byte{AddrTypeIPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0}, Err: ErrInvalidAddrLen},
+		{Name: "short domain", Data: []byte{AddrTypeDomain, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0, 80}, Err: ErrInvalidAddrLen},
+	} {
+		if _, err := ParseAddr(v.Data); !errors.Is(err, v.Err) {
+			t.Errorf("parse addr of %v error: got %v, want %v", v.Name, err, v.Err)
+		}
+		if _, err := ReadAddr(bytes.NewReader(v.Data)); err == nil {
+			t.Errorf("read invalid addr of %v", v.Name)
+		}
+	}
+}
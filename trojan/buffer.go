@@ -0,0 +1,53 @@
+package trojan
+
+import "sync"
+
+// DefaultBufferSize is the default size of buffers of TCP relays.
+const DefaultBufferSize = 32 * 1024
+
+// BufferPool is a pool of buffers of the same size, which are shared by
+// TCP relays, so a relay does not allocate its buffers. A nil *BufferPool
+// is the pool of DefaultBufferSize.
+type BufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// NewBufferPool returns a pool of buffers of size bytes.
+func NewBufferPool(size int) *BufferPool {
+	p := &BufferPool{size: size}
+	p.pool.New = func() interface{} {
+		// a pointer, so Put does not allocate for the slice header
+		b := make([]byte, size)
+		return &b
+	}
+	return p
+}
+
+// defaultBuffers is ...
+var defaultBuffers = NewBufferPool(DefaultBufferSize)
+
+// Size returns the size of buffers.
+func (p *BufferPool) Size() int {
+	if p == nil {
+		return defaultBuffers.size
+	}
+	return p.size
+}
+
+// Get is ...
+func (p *BufferPool) Get() *[]byte {
+	if p == nil {
+		return defaultBuffers.Get()
+	}
+	return p.pool.Get().(*[]byte)
+}
+
+// Put is ...
+func (p *BufferPool) Put(b *[]byte) {
+	if p == nil {
+		defaultBuffers.Put(b)
+		return
+	}
+	p.pool.Put(b)
+}
@@ -0,0 +1,53 @@
+package trojan
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	for _, v := range []struct {
+		Pool *BufferPool
+		Size int
+	}{
+		{Pool: nil, Size: DefaultBufferSize},
+		{Pool: NewBufferPool(128 * 1024), Size: 128 * 1024},
+	} {
+		if n := v.Pool.Size(); n != v.Size {
+			t.Errorf("size of pool error: got %v, want %v", n, v.Size)
+		}
+		b := v.Pool.Get()
+		if len(*b) != v.Size {
+			t.Errorf("size of buffer error: got %v, want %v", len(*b), v.Size)
+		}
+		v.Pool.Put(b)
+	}
+}
+
+// BenchmarkCopyBuffer compares relays allocating buffers with relays
+// sharing buffers of a pool.
+func BenchmarkCopyBuffer(b *testing.B) {
+	data := make([]byte, 256*1024)
+
+	b.Run("alloc", func(b *testing.B) {
+		b.ReportAllocs()
+		r := bytes.NewReader(data)
+		for i := 0; i < b.N; i++ {
+			r.Reset(data)
+			buf := make([]byte, DefaultBufferSize)
+			copyBuffer(io.Discard, r, buf, nil)
+		}
+	})
+
+	b.Run("pool", func(b *testing.B) {
+		b.ReportAllocs()
+		r, bp := bytes.NewReader(data), NewBufferPool(DefaultBufferSize)
+		for i := 0; i < b.N; i++ {
+			r.Reset(data)
+			buf := bp.Get()
+			copyBuffer(io.Discard, r, *buf, nil)
+			bp.Put(buf)
+		}
+	})
+}
@@ -0,0 +1,311 @@
+package trojan
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/imgk/caddy-trojan/socks"
+)
+
+// CmdMux is the command of trojan-go, of which the connection carries
+// streams multiplexed by smux after the request, of the address MUX_CONN.
+// Each stream starts with a request of the command and the address,
+// without the header and 0x0d 0x0a, as simplesocks of trojan-go.
+const CmdMux = 0x7f
+
+// frames of smux v1, which trojan-go uses
+const (
+	smuxVersion = 1
+
+	smuxSYN = 0
+	smuxFIN = 1
+	smuxPSH = 2
+	smuxNOP = 3
+
+	// smuxHeaderLen is the version, the command, the length of the data
+	// and the stream id, in little endian.
+	smuxHeaderLen = 8
+	// smuxMaxFrame is the max bytes of data of a frame written, as the
+	// default of smux.
+	smuxMaxFrame = 32768
+	// smuxMaxBuffer is the max bytes received and not read by streams of a
+	// connection, after which frames are not read, as the default of smux.
+	smuxMaxBuffer = 4 << 20
+	// smuxMaxStreams is the max number of live streams of a connection.
+	smuxMaxStreams = 1024
+)
+
+// ErrInvalidMux is a frame of smux which is not of version 1, or of an
+// unknown command.
+var ErrInvalidMux = errors.New("invalid mux frame")
+
+// muxSession is the streams of a connection of CmdMux.
+type muxSession struct {
+	w   io.Writer
+	wmu sync.Mutex
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	streams  map[uint32]*muxStream
+	buffered int
+	closed   bool
+}
+
+// muxStream is a stream of smux, which is relayed as a trojan request.
+type muxStream struct {
+	s  *muxSession
+	id uint32
+
+	// guarded by s.mu
+	cond    *sync.Cond
+	buf     bytes.Buffer
+	fin     bool
+	finSent bool
+	// the connection of the destination
+	rc net.Conn
+}
+
+// handleMux relays the streams of r and w, each as a request of req, and
+// returns the bytes of all of them once r is done and all are relayed.
+func handleMux(r io.Reader, w io.Writer, d Dialer, req *Request) (int64, int64, error) {
+	s := &muxSession{w: w, streams: make(map[uint32]*muxStream)}
+	s.cond = sync.NewCond(&s.mu)
+
+	nr, nw := int64(0), int64(0)
+	wg := sync.WaitGroup{}
+	err := s.read(r, func(st *muxStream) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer st.close()
+			n, m, _ := st.serve(d, req)
+			atomic.AddInt64(&nr, n)
+			atomic.AddInt64(&nw, m)
+		}()
+	})
+
+	s.mu.Lock()
+	s.closed = true
+	for _, st := range s.streams {
+		st.fin = true
+		st.cond.Broadcast()
+		st.stop()
+	}
+	s.mu.Unlock()
+	wg.Wait()
+
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nr, nw, err
+	}
+	return nr, nw, nil
+}
+
+// read reads frames of r until it fails, and calls fn with new streams.
+func (s *muxSession) read(r io.Reader, fn func(*muxStream)) error {
+	hdr := [smuxHeaderLen]byte{}
+	buf := make([]byte, 1<<16)
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return err
+		}
+		if hdr[0] != smuxVersion {
+			return fmt.Errorf("version %v error: %w", hdr[0], ErrInvalidMux)
+		}
+		n, id := int(binary.LittleEndian.Uint16(hdr[2:])), binary.LittleEndian.Uint32(hdr[4:])
+
+		switch hdr[1] {
+		case smuxNOP:
+		case smuxSYN:
+			s.mu.Lock()
+			_, ok := s.streams[id]
+			full := len(s.streams) >= smuxMaxStreams
+			if !ok && !full {
+				st := &muxStream{s: s, id: id}
+				st.cond = sync.NewCond(&s.mu)
+				s.streams[id] = st
+				fn(st)
+			}
+			s.mu.Unlock()
+			if full {
+				s.writeFrame(smuxFIN, id, nil)
+			}
+		case smuxFIN:
+			s.mu.Lock()
+			if st, ok := s.streams[id]; ok {
+				st.fin = true
+				st.cond.Broadcast()
+			}
+			s.mu.Unlock()
+		case smuxPSH:
+			if _, err := io.ReadFull(r, buf[:n]); err != nil {
+				return err
+			}
+
+			s.mu.Lock()
+			for s.buffered >= smuxMaxBuffer {
+				s.cond.Wait()
+			}
+			// data of a stream which is closed is dropped, as smux does
+			if st, ok := s.streams[id]; ok && !st.fin {
+				st.buf.Write(buf[:n])
+				s.buffered += n
+				st.cond.Broadcast()
+			}
+			s.mu.Unlock()
+			continue
+		default:
+			return fmt.Errorf("command %v error: %w", hdr[1], ErrInvalidMux)
+		}
+		// data of other frames is ignored
+		if n > 0 {
+			if _, err := io.ReadFull(r, buf[:n]); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// writeFrame writes a frame of the stream of id.
+func (s *muxSession) writeFrame(cmd byte, id uint32, b []byte) error {
+	hdr := [smuxHeaderLen]byte{smuxVersion, cmd}
+	binary.LittleEndian.PutUint16(hdr[2:], uint16(len(b)))
+	binary.LittleEndian.PutUint32(hdr[4:], id)
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if _, err := writeFull(s.w, hdr[:]); err != nil {
+		return err
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	_, err := writeFull(s.w, b)
+	return err
+}
+
+// serve relays the request of the stream, as a request of req.
+func (st *muxStream) serve(d Dialer, req *Request) (int64, int64, error) {
+	b := [1 + socks.MaxAddrLen]byte{}
+	if _, err := io.ReadFull(st, b[:1]); err != nil {
+		return 0, 0, readError(err)
+	}
+	addr, err := socks.ReadAddrBuffer(st, b[1:])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	sub := &Request{
+		Command: b[0], Addr: addr, Filter: req.Filter, Buffers: req.Buffers,
+		Source: req.Source, ProxyProtocol: req.ProxyProtocol, LocalIP: req.LocalIP, Progress: req.Progress,
+	}
+	sub.Setup = func(rc net.Conn) {
+		if req.Setup != nil {
+			req.Setup(rc)
+		}
+		st.s.mu.Lock()
+		st.rc = rc
+		if st.s.closed {
+			st.stop()
+		}
+		st.s.mu.Unlock()
+	}
+	switch b[0] {
+	case CmdConnect:
+		if sub.Filter != nil {
+			if err := sub.Filter(addr); err != nil {
+				return 0, 0, err
+			}
+		}
+		return handleTCP(st, st, addr, d, sub)
+	case CmdAssociate:
+		return handleUDP(st, st, time.Minute*10, d, sub.Filter, sub.Progress)
+	default:
+		return 0, 0, fmt.Errorf("command %#02x error: %w", b[0], ErrBadCommand)
+	}
+}
+
+// stop stops reading the destination once the connection is done, after
+// which it is relayed until it is idle, as a relay of a client which
+// half-closes it. It must be called with s.mu held.
+func (st *muxStream) stop() {
+	if st.rc != nil {
+		st.rc.SetReadDeadline(time.Now())
+	}
+}
+
+// Read reads data of the stream, and returns io.EOF after the stream or
+// the connection is closed by the client.
+func (st *muxStream) Read(b []byte) (int, error) {
+	s := st.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for st.buf.Len() == 0 && !st.fin {
+		st.cond.Wait()
+	}
+	if st.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	n, _ := st.buf.Read(b)
+	s.buffered -= n
+	s.cond.Broadcast()
+	return n, nil
+}
+
+// Write writes b in frames of smuxMaxFrame.
+func (st *muxStream) Write(b []byte) (int, error) {
+	s := st.s
+	s.mu.Lock()
+	closed := st.finSent
+	s.mu.Unlock()
+	if closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	n := 0
+	for len(b) > 0 {
+		m := len(b)
+		if m > smuxMaxFrame {
+			m = smuxMaxFrame
+		}
+		if err := s.writeFrame(smuxPSH, st.id, b[:m]); err != nil {
+			return n, err
+		}
+		n, b = n+m, b[m:]
+	}
+	return n, nil
+}
+
+// CloseWrite sends FIN of the stream, after which the client can not write
+// to the stream, as smux closes a stream of FIN.
+func (st *muxStream) CloseWrite() error {
+	s := st.s
+	s.mu.Lock()
+	sent := st.finSent
+	st.finSent = true
+	s.mu.Unlock()
+	if sent {
+		return nil
+	}
+	return s.writeFrame(smuxFIN, st.id, nil)
+}
+
+// close closes the stream once it is relayed, and drops data not read.
+func (st *muxStream) close() {
+	st.CloseWrite()
+
+	s := st.s
+	s.mu.Lock()
+	delete(s.streams, st.id)
+	s.buffered -= st.buf.Len()
+	st.buf.Reset()
+	st.fin = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
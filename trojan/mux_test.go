@@ -0,0 +1,169 @@
+package trojan
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/imgk/caddy-trojan/socks"
+)
+
+// smuxFrame is a frame of smux v1.
+func smuxFrame(cmd byte, id uint32, b []byte) []byte {
+	hdr := [smuxHeaderLen]byte{smuxVersion, cmd}
+	binary.LittleEndian.PutUint16(hdr[2:], uint16(len(b)))
+	binary.LittleEndian.PutUint32(hdr[4:], id)
+	return append(hdr[:], b...)
+}
+
+// muxRequest is the request of CmdMux of trojan-go.
+func muxRequest() []byte {
+	b := append([]byte{CmdMux, socks.AddrTypeDomain, 8}, "MUX_CONN"...)
+	return append(b, 0, 0, 0x0d, 0x0a)
+}
+
+// echoServer echoes connections until they are half-closed.
+func echoServer(t *testing.T) *socks.Addr {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen tcp error: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	addr, err := socks.ResolveAddr(ln.Addr())
+	if err != nil {
+		t.Fatalf("resolve addr error: %v", err)
+	}
+	return addr
+}
+
+func TestHandleMux(t *testing.T) {
+	addr := echoServer(t)
+	c, s := tcpPair(t)
+	defer c.Close()
+	defer s.Close()
+
+	type Result struct {
+		Up, Down int64
+		Err      error
+	}
+	progress := int64(0)
+	req := &Request{Mux: true, Progress: func(nr, nw int64) { atomic.AddInt64(&progress, nr+nw) }}
+	ch := make(chan Result, 1)
+	go func() {
+		nr, nw, err := HandleRequest(s, s, (*netDialer)(nil), req)
+		s.CloseWrite()
+		ch <- Result{Up: nr, Down: nw, Err: err}
+	}()
+
+	// two streams of the connection, with their own requests
+	b := muxRequest()
+	b = append(b, smuxFrame(smuxNOP, 0, nil)...)
+	for _, v := range []struct {
+		ID   uint32
+		Data string
+	}{{ID: 1, Data: "hello"}, {ID: 3, Data: "world!"}} {
+		b = append(b, smuxFrame(smuxSYN, v.ID, nil)...)
+		b = append(b, smuxFrame(smuxPSH, v.ID, addr.AppendTo([]byte{CmdConnect}))...)
+		b = append(b, smuxFrame(smuxPSH, v.ID, []byte(v.Data))...)
+	}
+	if _, err := c.Write(b); err != nil {
+		t.Fatalf("write mux error: %v", err)
+	}
+
+	// read reads frames into data and fin of streams until done
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, fin := map[uint32]string{}, map[uint32]bool{}
+	read := func(done func() bool) {
+		for !done() {
+			hdr := [smuxHeaderLen]byte{}
+			if _, err := io.ReadFull(c, hdr[:]); err != nil {
+				t.Fatalf("read frame error: %v", err)
+			}
+			b := make([]byte, binary.LittleEndian.Uint16(hdr[2:]))
+			if _, err := io.ReadFull(c, b); err != nil {
+				t.Fatalf("read frame error: %v", err)
+			}
+			id := binary.LittleEndian.Uint32(hdr[4:])
+			switch hdr[1] {
+			case smuxPSH:
+				data[id] += string(b)
+			case smuxFIN:
+				fin[id] = true
+			default:
+				t.Fatalf("frame of %v error: %v", id, hdr[1])
+			}
+		}
+	}
+	read(func() bool { return len(data[1]) >= 5 && len(data[3]) >= 6 })
+	if data[1] != "hello" || data[3] != "world!" || len(fin) != 0 {
+		t.Fatalf("relay mux error: %q, %v", data, fin)
+	}
+
+	// the streams are closed by FIN, and the destinations close them
+	if _, err := c.Write(append(smuxFrame(smuxFIN, 1, nil), smuxFrame(smuxFIN, 3, nil)...)); err != nil {
+		t.Fatalf("write fin error: %v", err)
+	}
+	read(func() bool { return fin[1] && fin[3] })
+	c.CloseWrite()
+
+	if _, err := io.ReadAll(c); err != nil {
+		t.Errorf("read after close error: %v", err)
+	}
+	r := <-ch
+	if r.Err != nil || r.Up != 11 || r.Down != 11 {
+		t.Errorf("handle mux error: %v, %v, %v", r.Up, r.Down, r.Err)
+	}
+	if n := atomic.LoadInt64(&progress); n != 22 {
+		t.Errorf("progress of mux error: %v", n)
+	}
+}
+
+func TestHandleMuxInvalid(t *testing.T) {
+	// CmdMux is an invalid command without Mux
+	d := &failDialer{}
+	if _, _, err := HandleRequest(bytes.NewReader(muxRequest()), io.Discard, d, &Request{}); !errors.Is(err, ErrInvalidCommand) {
+		t.Errorf("handle mux without mux error: %v", err)
+	}
+
+	for _, v := range []struct {
+		Name  string
+		Frame []byte
+	}{
+		{Name: "version 2", Frame: []byte{2, smuxSYN, 0, 0, 1, 0, 0, 0}},
+		{Name: "command", Frame: smuxFrame(0x10, 1, nil)},
+	} {
+		b := append(muxRequest(), v.Frame...)
+		if _, _, err := HandleRequest(bytes.NewReader(b), io.Discard, d, &Request{Mux: true}); !errors.Is(err, ErrInvalidMux) {
+			t.Errorf("handle mux of invalid %v error: %v", v.Name, err)
+		}
+	}
+
+	// a stream of an invalid request is closed, and the connection goes on
+	b := append(muxRequest(), smuxFrame(smuxSYN, 1, nil)...)
+	b = append(b, smuxFrame(smuxPSH, 1, []byte{0x02, socks.AddrTypeIPv4, 127, 0, 0, 1, 0, 80})...)
+	w := &bytes.Buffer{}
+	if _, _, err := HandleRequest(bytes.NewReader(b), w, d, &Request{Mux: true}); err != nil {
+		t.Errorf("handle mux of invalid stream error: %v", err)
+	}
+	if !bytes.Equal(w.Bytes(), smuxFrame(smuxFIN, 1, nil)) || d.addr != "" {
+		t.Errorf("invalid stream error: %q, %v", w.Bytes(), d.addr)
+	}
+}
@@ -0,0 +1,36 @@
+package trojan
+
+import (
+	"net"
+)
+
+// proxySignature is the signature of PROXY protocol v2.
+const proxySignature = "\r\n\r\n\x00\r\nQUIT\n"
+
+// appendProxyHeader appends the PROXY protocol v2 header of a TCP
+// connection from src to dst. If either is not a TCP address, the header
+// is of command LOCAL, which carries no address.
+func appendProxyHeader(b []byte, src, dst net.Addr) []byte {
+	b = append(b, proxySignature...)
+
+	s, ok := src.(*net.TCPAddr)
+	d, ok2 := dst.(*net.TCPAddr)
+	if !ok || !ok2 || s == nil || d == nil || s.IP.To16() == nil || d.IP.To16() == nil {
+		// version 2, command LOCAL, family UNSPEC
+		return append(b, 0x20, 0x00, 0x00, 0x00)
+	}
+
+	// version 2, command PROXY
+	if s4, d4 := s.IP.To4(), d.IP.To4(); s4 != nil && d4 != nil {
+		// TCP over IPv4
+		b = append(b, 0x21, 0x11, 0x00, 12)
+		b = append(b, s4...)
+		b = append(b, d4...)
+	} else {
+		// TCP over IPv6, IPv4 addresses are mapped
+		b = append(b, 0x21, 0x21, 0x00, 36)
+		b = append(b, s.IP.To16()...)
+		b = append(b, d.IP.To16()...)
+	}
+	return append(b, byte(s.Port>>8), byte(s.Port), byte(d.Port>>8), byte(d.Port))
+}
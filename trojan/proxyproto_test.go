@@ -0,0 +1,90 @@
+package trojan
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAppendProxyHeader(t *testing.T) {
+	sig := []byte(proxySignature)
+	for _, v := range []struct {
+		Name string
+		Src  net.Addr
+		Dst  net.Addr
+		Want []byte
+	}{
+		{
+			Name: "ipv4",
+			Src:  &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 56324},
+			Dst:  &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 443},
+			Want: append(append([]byte{}, sig...), 0x21, 0x11, 0x00, 0x0c,
+				192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb),
+		},
+		{
+			Name: "ipv6",
+			Src:  &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1},
+			Dst:  &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 2},
+			Want: append(append(append(append(append([]byte{}, sig...), 0x21, 0x21, 0x00, 0x24),
+				net.ParseIP("2001:db8::1")...), net.ParseIP("::ffff:192.0.2.1")...), 0x00, 0x01, 0x00, 0x02),
+		},
+		{
+			Name: "local",
+			Src:  nil,
+			Dst:  &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 443},
+			Want: append(append([]byte{}, sig...), 0x20, 0x00, 0x00, 0x00),
+		},
+	} {
+		if got := appendProxyHeader(nil, v.Src, v.Dst); !bytes.Equal(got, v.Want) {
+			t.Errorf("proxy header of %v error:\ngot  %x\nwant %x", v.Name, got, v.Want)
+		}
+	}
+}
+
+func TestHandleTCPProxyProtocol(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen tcp error: %v", err)
+	}
+	defer ln.Close()
+
+	src := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 56324}
+	type Result struct {
+		Header []byte
+		Want   []byte
+		Err    error
+	}
+	serverCh := make(chan Result, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			serverCh <- Result{Err: err}
+			return
+		}
+		defer c.Close()
+		want := append(appendProxyHeader(nil, src, c.LocalAddr()), "hello"...)
+		b := make([]byte, len(want))
+		_, err = io.ReadFull(c, b)
+		serverCh <- Result{Header: b, Want: want, Err: err}
+	}()
+
+	client, conn := tcpPair(t)
+	defer client.Close()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	go handleTCP(conn, conn, ln.Addr(), (*netDialer)(nil), &Request{Source: src, ProxyProtocol: true})
+
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	r := <-serverCh
+	if r.Err != nil {
+		t.Fatalf("read header error: %v", r.Err)
+	}
+	// the header is sent before the payload of the client
+	if !bytes.Equal(r.Header, r.Want) {
+		t.Errorf("header error:\ngot  %x\nwant %x", r.Header, r.Want)
+	}
+}
@@ -0,0 +1,39 @@
+package trojan
+
+import (
+	"fmt"
+	"sync"
+)
+
+// KeyFunc derives the trojan header of HeaderLen bytes from the plaintext
+// password and writes it to key.
+type KeyFunc func(s string, key []byte)
+
+// DefaultKeyScheme is the scheme of the trojan protocol, GenKey.
+const DefaultKeyScheme = "sha224"
+
+// keySchemes is the registry of schemes of trojan headers, for forks and
+// variants of the protocol which derive headers differently.
+var keySchemes = struct {
+	sync.RWMutex
+	mm map[string]KeyFunc
+}{mm: map[string]KeyFunc{DefaultKeyScheme: GenKey}}
+
+// RegisterKeyScheme registers a scheme of trojan headers, usually in init.
+// It panics if the name is registered.
+func RegisterKeyScheme(name string, fn KeyFunc) {
+	keySchemes.Lock()
+	defer keySchemes.Unlock()
+	if _, ok := keySchemes.mm[name]; ok {
+		panic(fmt.Sprintf("key scheme %v is already registered", name))
+	}
+	keySchemes.mm[name] = fn
+}
+
+// LookupKeyScheme returns the scheme of the name.
+func LookupKeyScheme(name string) (KeyFunc, bool) {
+	keySchemes.RLock()
+	fn, ok := keySchemes.mm[name]
+	keySchemes.RUnlock()
+	return fn, ok
+}
@@ -16,6 +16,10 @@ import (
 // HeaderLen is ...
 const HeaderLen = 56
 
+// DefaultHeaderTimeout is the default time of reading the trojan header
+// and the request, after which a stalled client is closed.
+const DefaultHeaderTimeout = 10 * time.Second
+
 const (
 	// CmdConnect is ...
 	CmdConnect = 1
@@ -23,12 +27,92 @@ const (
 	CmdAssociate = 3
 )
 
-// GenKey is ...
+// Errors of the parser, which are matched by errors.Is. The key of the
+// header is not checked by the parser, so an unknown key is reported by
+// the upstream instead.
+var (
+	// ErrInvalidHeaderLen is a prefix which is not of the header and 0x0d 0x0a.
+	ErrInvalidHeaderLen = errors.New("invalid header length")
+	// ErrBadCommand is a command which is not supported, see
+	// CommandSupported.
+	ErrBadCommand = errors.New("bad command")
+	// ErrInvalidCommand is ErrBadCommand.
+	//
+	// Deprecated: use ErrBadCommand.
+	ErrInvalidCommand = ErrBadCommand
+	// ErrInvalidCRLF is ...
+	ErrInvalidCRLF = errors.New("invalid 0x0d 0x0a")
+	// ErrInvalidAddress is an address of an unknown type or length, the
+	// error of socks is wrapped.
+	ErrInvalidAddress = errors.New("invalid address")
+	// ErrShortRequest is a request cut off by the client, io.EOF or
+	// io.ErrUnexpectedEOF is wrapped.
+	ErrShortRequest = errors.New("short request")
+)
+
+// parseError is an error of the kind, which wraps the cause.
+type parseError struct {
+	kind error
+	err  error
+}
+
+// Error is ...
+func (e *parseError) Error() string {
+	return fmt.Sprintf("%v: %v", e.kind, e.err)
+}
+
+// Unwrap is ...
+func (e *parseError) Unwrap() error {
+	return e.err
+}
+
+// Is is ...
+func (e *parseError) Is(target error) bool {
+	return target == e.kind
+}
+
+// readError returns the error of reading a request, which is of
+// ErrShortRequest if the client is gone.
+func readError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &parseError{kind: ErrShortRequest, err: err}
+	}
+	return err
+}
+
+// CheckHeader checks the prefix of a trojan connection, which is the
+// trojan header and 0x0d 0x0a. The header itself is checked by upstream.
+func CheckHeader(b []byte) error {
+	if len(b) != HeaderLen+2 {
+		return fmt.Errorf("%w: %v", ErrInvalidHeaderLen, len(b))
+	}
+	if b[HeaderLen] != 0x0d || b[HeaderLen+1] != 0x0a {
+		return ErrInvalidCRLF
+	}
+	return nil
+}
+
+// GenKey generates the trojan header from the plaintext password,
+// which is the lower case hex of sha224 of the password.
 func GenKey(s string, key []byte) {
 	hash := sha256.Sum224(utils.StringToByteSlice(s))
 	hex.Encode(key, hash[:])
 }
 
+// ParseHexKey checks the hex of sha224 of a password and writes the
+// trojan header to key.
+func ParseHexKey(s string, key []byte) error {
+	if len(s) != HeaderLen {
+		return fmt.Errorf("invalid hex key length: %v", len(s))
+	}
+	hash := [sha256.Size224]byte{}
+	if _, err := hex.Decode(hash[:], utils.StringToByteSlice(s)); err != nil {
+		return fmt.Errorf("invalid hex key: %w", err)
+	}
+	hex.Encode(key, hash[:])
+	return nil
+}
+
 // Handle is ...
 func Handle(r io.Reader, w io.Writer) (int64, int64, error) {
 	return HandleWithDialer(r, w, (*netDialer)(nil))
@@ -42,6 +126,13 @@ type Dialer interface {
 	ListenPacket(string, string) (net.PacketConn, error)
 }
 
+// UDPResolver is a Dialer which resolves destinations of UDP packets,
+// instead of the resolver of the OS.
+type UDPResolver interface {
+	// ResolveUDPAddr is ...
+	ResolveUDPAddr(string) (*net.UDPAddr, error)
+}
+
 type netDialer struct{}
 
 func (*netDialer) Dial(network, addr string) (net.Conn, error) {
@@ -52,43 +143,136 @@ func (*netDialer) ListenPacket(network, addr string) (net.PacketConn, error) {
 	return net.ListenPacket(network, addr)
 }
 
+// Request is the command and the destination of a trojan connection,
+// which are zero until the request is read.
+type Request struct {
+	// Command is ...
+	Command byte
+	// Addr is ...
+	Addr net.Addr
+	// Filter checks every destination before it is dialed, or a UDP packet
+	// is sent to it, and refuses the connection with the error. nil allows all.
+	Filter func(net.Addr) error
+	// Buffers is the pool of buffers of TCP relays, nil is the pool of
+	// DefaultBufferSize.
+	Buffers *BufferPool
+	// Setup is called with the connection dialed to the destination before
+	// relaying, to set socket options. nil does nothing.
+	Setup func(net.Conn)
+	// Source is the address of the client.
+	Source net.Addr
+	// ProxyProtocol sends the PROXY protocol v2 header of Source and the
+	// address of the TCP connection dialed to the destination, before
+	// relaying, for destinations which need the address of the client.
+	ProxyProtocol bool
+	// LocalIP is the address connections to destinations are dialed from,
+	// nil is the default route. It is up to the Dialer to support it.
+	LocalIP net.IP
+	// Parsed is called once the request is read, before anything is
+	// dialed, to clear the deadline of reading it. nil does nothing.
+	Parsed func()
+	// Progress is called with the bytes relayed from and to the client as
+	// they are relayed, from the goroutines of both directions, so a long
+	// relay is accounted before it is done. The bytes sum to the traffic
+	// returned by HandleRequest. nil does nothing.
+	Progress func(nr, nw int64)
+	// Mux accepts CmdMux of trojan-go, of which every stream is relayed as
+	// a request of the same Filter, Progress and other fields. CmdMux is an
+	// unsupported command without it.
+	Mux bool
+}
+
+// CommandName returns the name of the command.
+func (req *Request) CommandName() string {
+	switch req.Command {
+	case CmdConnect:
+		return "CONNECT"
+	case CmdAssociate:
+		return "UDP"
+	case CmdMux:
+		return "MUX"
+	default:
+		return ""
+	}
+}
+
+// CommandSupported reports whether cmd is served, which is CmdConnect,
+// CmdAssociate, and CmdMux with mux. Others, like 0x02 BIND of socks, are
+// never read as CONNECT, and are refused with ErrBadCommand.
+func CommandSupported(cmd byte, mux bool) bool {
+	return cmd == CmdConnect || cmd == CmdAssociate || (cmd == CmdMux && mux)
+}
+
 // HandleWithDialer is ...
 func HandleWithDialer(r io.Reader, w io.Writer, d Dialer) (int64, int64, error) {
+	return HandleRequest(r, w, d, &Request{})
+}
+
+// HandleRequest is HandleWithDialer, and records the request to req.
+// A request with an unsupported command, an invalid address or without the
+// trailing 0x0d 0x0a is refused before anything is dialed, with an error of
+// ErrBadCommand, ErrInvalidAddress or ErrInvalidCRLF, and a request
+// cut off by the client with an error of ErrShortRequest.
+// The request is read with io.ReadFull of exact lengths, so the payload sent
+// with it, even in the same segment, is left in r for the relay.
+func HandleRequest(r io.Reader, w io.Writer, d Dialer, req *Request) (int64, int64, error) {
 	b := [1 + socks.MaxAddrLen + 2]byte{}
 
 	// read command
 	if _, err := io.ReadFull(r, b[:1]); err != nil {
-		return 0, 0, fmt.Errorf("read command error: %w", err)
+		return 0, 0, fmt.Errorf("read command error: %w", readError(err))
 	}
-	if b[0] != CmdConnect && b[0] != CmdAssociate {
-		return 0, 0, errors.New("command error")
+	if !CommandSupported(b[0], req.Mux) {
+		return 0, 0, fmt.Errorf("command %#02x error: %w", b[0], ErrBadCommand)
 	}
 
 	// read address
 	addr, err := socks.ReadAddrBuffer(r, b[3:])
 	if err != nil {
-		return 0, 0, fmt.Errorf("read addr error: %w", err)
+		if errors.Is(err, socks.ErrInvalidAddrType) || errors.Is(err, socks.ErrInvalidAddrLen) {
+			return 0, 0, fmt.Errorf("read addr error: %w", &parseError{kind: ErrInvalidAddress, err: err})
+		}
+		return 0, 0, fmt.Errorf("read addr error: %w", readError(err))
 	}
+	req.Command, req.Addr = b[0], addr
 
 	// read 0x0d, 0x0a
 	if _, err := io.ReadFull(r, b[1:3]); err != nil {
-		return 0, 0, fmt.Errorf("read 0x0d 0x0a error: %w", err)
+		return 0, 0, fmt.Errorf("read 0x0d 0x0a error: %w", readError(err))
+	}
+	if b[1] != 0x0d || b[2] != 0x0a {
+		return 0, 0, fmt.Errorf("read 0x0d 0x0a error: %w", ErrInvalidCRLF)
+	}
+	if req.Parsed != nil {
+		req.Parsed()
 	}
 
 	switch b[0] {
 	case CmdConnect:
-		nr, nw, err := HandleTCP(r, w, addr, d)
+		if req.Filter != nil {
+			if err := req.Filter(addr); err != nil {
+				return 0, 0, err
+			}
+		}
+		nr, nw, err := handleTCP(r, w, addr, d, req)
 		if err != nil {
 			return nr, nw, fmt.Errorf("handle tcp error: %w", err)
 		}
 		return nr, nw, nil
 	case CmdAssociate:
-		nr, nw, err := HandleUDP(r, w, time.Minute*10, d)
+		nr, nw, err := handleUDP(r, w, time.Minute*10, d, req.Filter, req.Progress)
 		if err != nil {
 			return nr, nw, fmt.Errorf("handle udp error: %w", err)
 		}
 		return nr, nw, nil
+	case CmdMux:
+		// the address is MUX_CONN, and each stream has its own
+		nr, nw, err := handleMux(r, w, d, req)
+		if err != nil {
+			return nr, nw, fmt.Errorf("handle mux error: %w", err)
+		}
+		return nr, nw, nil
 	default:
 	}
-	return 0, 0, errors.New("command error")
+	return 0, 0, fmt.Errorf("command %#02x error: %w", b[0], ErrBadCommand)
 }
@@ -2,34 +2,30 @@ package trojan
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"os"
 	"time"
-
-	"github.com/imgk/memory-go"
 )
 
-func copyBuffer(w io.Writer, r io.Reader, buf []byte) (n int64, err error) {
+// copyBuffer copies r to w with buf until EOF, as io.CopyBuffer does. The
+// bytes of a read are written even if the read fails, such as at a read
+// deadline, and are written fully by writeFull. progress is called with
+// the bytes of each write, if not nil.
+func copyBuffer(w io.Writer, r io.Reader, buf []byte, progress func(int64)) (n int64, err error) {
 	for {
 		nr, er := r.Read(buf)
 		if nr > 0 {
-			nw, ew := w.Write(buf[0:nr])
-			if nw < 0 || nr < nw {
-				nw = 0
-				if ew == nil {
-					ew = errors.New("invalid write result")
-				}
-			}
+			nw, ew := writeFull(w, buf[0:nr])
 			n += int64(nw)
+			if progress != nil && nw > 0 {
+				progress(int64(nw))
+			}
 			if ew != nil {
 				err = ew
 				break
 			}
-			if nr != nw {
-				err = io.ErrShortWrite
-				break
-			}
 		}
 		if er != nil {
 			if !errors.Is(er, io.EOF) {
@@ -41,14 +37,98 @@ func copyBuffer(w io.Writer, r io.Reader, buf []byte) (n int64, err error) {
 	return n, err
 }
 
+// spliceChunk is the bytes of each splice between calls of progress.
+const spliceChunk = 1 << 20
+
+// copyConn copies r to w as copyBuffer does, but copies by io.Copy without
+// buf when both are TCP connections, so that the runtime splices r to w in
+// the kernel on Linux. A connection wrapped by a rate limit, a timeout or
+// TLS is not a TCP connection, and is copied with buf. With progress, a
+// splice is done in chunks of spliceChunk to report them.
+func copyConn(w io.Writer, r io.Reader, buf []byte, progress func(int64)) (int64, error) {
+	if _, ok := w.(*net.TCPConn); ok {
+		if _, ok := r.(*net.TCPConn); ok {
+			if progress == nil {
+				return io.Copy(w, r)
+			}
+			return copyChunks(w, r, progress)
+		}
+	}
+	return copyBuffer(w, r, buf, progress)
+}
+
+// copyChunks copies r to w by io.CopyN of spliceChunk until EOF, and calls
+// progress with the bytes of each chunk. io.CopyN limits r by an
+// io.LimitedReader, which is still spliced.
+func copyChunks(w io.Writer, r io.Reader, progress func(int64)) (n int64, err error) {
+	for {
+		nc, err := io.CopyN(w, r, spliceChunk)
+		n += nc
+		if nc > 0 {
+			progress(nc)
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return n, nil
+			}
+			return n, err
+		}
+	}
+}
+
+// writeFull writes all of b to w. A writer which accepts a part of b is
+// written again with the rest, even if it times out after accepting a part,
+// as a deadline for detecting stalls does on a slow connection. It fails
+// once a write accepts no byte.
+func writeFull(w io.Writer, b []byte) (n int, err error) {
+	for n < len(b) {
+		nw, ew := w.Write(b[n:])
+		if nw < 0 || nw > len(b)-n {
+			return n, errors.New("invalid write result")
+		}
+		n += nw
+		if ew != nil {
+			if ne := net.Error(nil); nw > 0 && errors.As(ew, &ne) && ne.Timeout() {
+				continue
+			}
+			return n, ew
+		}
+		if nw == 0 {
+			return n, io.ErrShortWrite
+		}
+	}
+	return n, nil
+}
+
 // HandleTCP is ...
 // trojan TCP stream
+// When one direction reads EOF, the other one is half-closed by CloseWrite
+// and the relay goes on until both directions are done.
 func HandleTCP(r io.Reader, w io.Writer, addr net.Addr, d Dialer) (int64, int64, error) {
+	return handleTCP(r, w, addr, d, &Request{})
+}
+
+// handleTCP is HandleTCP, and relays with buffers and socket options of req.
+func handleTCP(r io.Reader, w io.Writer, addr net.Addr, d Dialer, req *Request) (int64, int64, error) {
 	rc, err := d.Dial("tcp", addr.String())
 	if err != nil {
 		return 0, 0, err
 	}
 	defer rc.Close()
+	if req.Setup != nil {
+		req.Setup(rc)
+	}
+	if req.ProxyProtocol {
+		if _, err := rc.Write(appendProxyHeader(nil, req.Source, rc.RemoteAddr())); err != nil {
+			return 0, 0, fmt.Errorf("write proxy protocol header error: %w", err)
+		}
+	}
+	bp := req.Buffers
+	var up, down func(int64)
+	if req.Progress != nil {
+		up = func(n int64) { req.Progress(n, 0) }
+		down = func(n int64) { req.Progress(0, n) }
+	}
 
 	type Result struct {
 		Num int64
@@ -57,16 +137,21 @@ func HandleTCP(r io.Reader, w io.Writer, addr net.Addr, d Dialer) (int64, int64,
 
 	errCh := make(chan Result, 0)
 	go func(rc net.Conn, r io.Reader, errCh chan Result) {
-		ptr, buf := memory.Alloc[byte](32 * 1024)
-		defer memory.Free(ptr)
+		ptr := bp.Get()
+		defer bp.Put(ptr)
+		buf := *ptr
 
-		nr, err := copyBuffer(io.Writer(rc), r, buf)
+		nr, err := copyConn(io.Writer(rc), r, buf, up)
 		if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
 			if cw, ok := rc.(interface {
 				CloseWrite() error
-			}); ok {
-				cw.CloseWrite()
+			}); ok && cw.CloseWrite() == nil {
+				// the destination reads EOF, and the other direction
+				// keeps relaying until the destination closes
+				errCh <- Result{Num: nr, Err: nil}
+				return
 			}
+			// rc can not be half-closed, so stop reading rc and drain it
 			rc.SetReadDeadline(time.Now())
 			errCh <- Result{Num: nr, Err: nil}
 			return
@@ -81,10 +166,11 @@ func HandleTCP(r io.Reader, w io.Writer, addr net.Addr, d Dialer) (int64, int64,
 	}(rc, r, errCh)
 
 	nr, nw, err := func(rc net.Conn, w io.Writer, errCh chan Result) (int64, int64, error) {
-		ptr, buf := memory.Alloc[byte](32 * 1024)
-		defer memory.Free(ptr)
+		ptr := bp.Get()
+		defer bp.Put(ptr)
+		buf := *ptr
 
-		nw, err := copyBuffer(w, io.Reader(rc), buf)
+		nw, err := copyConn(w, io.Reader(rc), buf, down)
 		if err == nil {
 			if cw, ok := w.(interface {
 				CloseWrite() error
@@ -100,12 +186,17 @@ func HandleTCP(r io.Reader, w io.Writer, addr net.Addr, d Dialer) (int64, int64,
 				if r.Err == nil {
 					for {
 						rc.SetReadDeadline(time.Now().Add(time.Minute))
-						n, err := copyBuffer(w, io.Reader(rc), buf)
+						n, err := copyConn(w, io.Reader(rc), buf, down)
 						nw += n
 						if n == 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
 							break
 						}
 					}
+					if cw, ok := w.(interface {
+						CloseWrite() error
+					}); ok {
+						cw.CloseWrite()
+					}
 					return r.Num, nw, r.Err
 				}
 
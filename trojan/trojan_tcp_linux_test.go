@@ -0,0 +1,48 @@
+package trojan
+
+import (
+	"bytes"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// cpuTime is the user and system CPU time of the process.
+func cpuTime(b *testing.B) time.Duration {
+	ru := syscall.Rusage{}
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		b.Fatalf("getrusage error: %v", err)
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// BenchmarkCopyConn compares relays between TCP connections spliced by the
+// kernel with relays copied with a buffer, by throughput and CPU time of
+// the process, which includes the writer and the reader of the relay.
+func BenchmarkCopyConn(b *testing.B) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1024*1024)
+
+	for _, v := range []struct {
+		Name string
+		Copy func(w io.Writer, r io.Reader) (int64, error)
+	}{
+		{Name: "splice", Copy: func(w io.Writer, r io.Reader) (int64, error) {
+			return copyConn(w, r, nil, nil)
+		}},
+		{Name: "buffer", Copy: func(w io.Writer, r io.Reader) (int64, error) {
+			return copyBuffer(w, r, make([]byte, DefaultBufferSize), nil)
+		}},
+	} {
+		b.Run(v.Name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			start := cpuTime(b)
+			for i := 0; i < b.N; i++ {
+				if _, _, err := relayPair(b, data, v.Copy); err != nil {
+					b.Fatalf("copy error: %v", err)
+				}
+			}
+			b.ReportMetric(float64(cpuTime(b)-start)/float64(b.N), "cpu-ns/op")
+		})
+	}
+}
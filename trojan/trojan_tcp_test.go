@@ -0,0 +1,315 @@
+package trojan
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a TCP connection.
+func tcpPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen tcp error: %v", err)
+	}
+	defer ln.Close()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial tcp error: %v", err)
+	}
+	s, err := ln.Accept()
+	if err != nil {
+		c.Close()
+		t.Fatalf("accept tcp error: %v", err)
+	}
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+func TestHandleTCPHalfClose(t *testing.T) {
+	request, response := []byte("hello trojan"), bytes.Repeat([]byte("response"), 16*1024)
+
+	for _, v := range []struct {
+		Name string
+		// Server serves a connection of the destination.
+		Server func(net.Conn) error
+		// Client is the trojan client.
+		Client func(*net.TCPConn) error
+	}{
+		{
+			// the client half-closes after sending the request, and the
+			// destination responds after reading EOF
+			Name: "client",
+			Server: func(c net.Conn) error {
+				b, err := io.ReadAll(c)
+				if err != nil {
+					return err
+				}
+				if !bytes.Equal(b, request) {
+					return errors.New("request of destination mismatch")
+				}
+				// a slow destination
+				time.Sleep(100 * time.Millisecond)
+				_, err = c.Write(response)
+				return err
+			},
+			Client: func(c *net.TCPConn) error {
+				if _, err := c.Write(request); err != nil {
+					return err
+				}
+				if err := c.CloseWrite(); err != nil {
+					return err
+				}
+				b, err := io.ReadAll(c)
+				if err != nil {
+					return err
+				}
+				if !bytes.Equal(b, response) {
+					return errors.New("response of client mismatch")
+				}
+				return nil
+			},
+		},
+		{
+			// the destination half-closes after responding, and the client
+			// sends the request after reading EOF
+			Name: "destination",
+			Server: func(c net.Conn) error {
+				if _, err := c.Write(response); err != nil {
+					return err
+				}
+				if err := c.(*net.TCPConn).CloseWrite(); err != nil {
+					return err
+				}
+				b, err := io.ReadAll(c)
+				if err != nil {
+					return err
+				}
+				if !bytes.Equal(b, request) {
+					return errors.New("request of destination mismatch")
+				}
+				return nil
+			},
+			Client: func(c *net.TCPConn) error {
+				b, err := io.ReadAll(c)
+				if err != nil {
+					return err
+				}
+				if !bytes.Equal(b, response) {
+					return errors.New("response of client mismatch")
+				}
+				if _, err := c.Write(request); err != nil {
+					return err
+				}
+				return c.CloseWrite()
+			},
+		},
+	} {
+		t.Run(v.Name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("listen tcp error: %v", err)
+			}
+			defer ln.Close()
+
+			serverCh := make(chan error, 1)
+			go func() {
+				c, err := ln.Accept()
+				if err != nil {
+					serverCh <- err
+					return
+				}
+				defer c.Close()
+				serverCh <- v.Server(c)
+			}()
+
+			client, conn := tcpPair(t)
+			defer client.Close()
+			defer conn.Close()
+			// the relay must end by half-closes rather than timeouts
+			client.SetDeadline(time.Now().Add(10 * time.Second))
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+			type Result struct {
+				Nr  int64
+				Nw  int64
+				Err error
+			}
+			relayCh := make(chan Result, 1)
+			go func() {
+				nr, nw, err := HandleTCP(conn, conn, ln.Addr(), (*netDialer)(nil))
+				relayCh <- Result{Nr: nr, Nw: nw, Err: err}
+			}()
+
+			if err := v.Client(client); err != nil {
+				t.Fatalf("client error: %v", err)
+			}
+			if err := <-serverCh; err != nil {
+				t.Fatalf("destination error: %v", err)
+			}
+			r := <-relayCh
+			if r.Err != nil {
+				t.Fatalf("relay error: %v", r.Err)
+			}
+			if r.Nr != int64(len(request)) || r.Nw != int64(len(response)) {
+				t.Errorf("relay traffic error: got %v, %v, want %v, %v", r.Nr, r.Nw, len(request), len(response))
+			}
+		})
+	}
+}
+
+// timeoutError is a net.Error of a deadline.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// chunkWriter accepts at most 3 bytes of a write, and times out after
+// accepting bytes of every other write.
+type chunkWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+// Write is ...
+func (w *chunkWriter) Write(b []byte) (int, error) {
+	w.writes++
+	if len(b) > 3 {
+		b = b[:3]
+	}
+	n, _ := w.Buffer.Write(b)
+	if w.writes%2 == 0 {
+		return n, timeoutError{}
+	}
+	return n, nil
+}
+
+// slowReader returns a byte for each read, and times out with the last byte.
+type slowReader struct {
+	b []byte
+}
+
+// Read is ...
+func (r *slowReader) Read(b []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(time.Millisecond)
+	n := copy(b, r.b[:1])
+	r.b = r.b[n:]
+	if len(r.b) == 0 {
+		return n, timeoutError{}
+	}
+	return n, nil
+}
+
+func TestCopyBufferShortWrite(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10)
+
+	w := &chunkWriter{}
+	n, err := copyBuffer(w, bytes.NewReader(data), make([]byte, 16), nil)
+	if err != nil || n != int64(len(data)) || !bytes.Equal(w.Bytes(), data) {
+		t.Errorf("copy to short writer error: %v, %v, %q", n, err, w.Bytes())
+	}
+
+	// the bytes read with a timeout are written before it fails
+	w = &chunkWriter{}
+	n, err = copyBuffer(w, &slowReader{b: data[:20]}, make([]byte, 16), nil)
+	if ne := net.Error(nil); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("copy from slow reader error: %v", err)
+	}
+	if n != 20 || !bytes.Equal(w.Bytes(), data[:20]) {
+		t.Errorf("copy from slow reader error: %v, %q", n, w.Bytes())
+	}
+
+	// a writer which accepts nothing fails
+	if _, err := writeFull(writerFunc(func(b []byte) (int, error) { return 0, nil }), data); !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("write to stuck writer error: %v", err)
+	}
+	if _, err := writeFull(writerFunc(func(b []byte) (int, error) { return 0, timeoutError{} }), data); err == nil {
+		t.Errorf("write to timed out writer without error")
+	}
+}
+
+// writerFunc is an io.Writer of a function.
+type writerFunc func([]byte) (int, error)
+
+// Write is ...
+func (fn writerFunc) Write(b []byte) (int, error) {
+	return fn(b)
+}
+
+// relayPair copies data through copy from one TCP connection to another,
+// and returns the bytes read from the other end.
+func relayPair(t testing.TB, data []byte, copy func(w io.Writer, r io.Reader) (int64, error)) (int64, []byte, error) {
+	src, r := tcpPair(t)
+	w, dst := tcpPair(t)
+	defer r.Close()
+	defer dst.Close()
+
+	go func() {
+		src.Write(data)
+		src.Close()
+	}()
+	got := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(dst)
+		got <- b
+	}()
+	n, err := copy(w, r)
+	w.Close()
+	return n, <-got, err
+}
+
+func TestCopyConn(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	for _, v := range []struct {
+		Name string
+		Copy func(w io.Writer, r io.Reader) (int64, error)
+	}{
+		{Name: "tcp", Copy: func(w io.Writer, r io.Reader) (int64, error) {
+			return copyConn(w, r, nil, nil)
+		}},
+		// a wrapped reader is copied with the buffer
+		{Name: "wrapped", Copy: func(w io.Writer, r io.Reader) (int64, error) {
+			return copyConn(w, io.MultiReader(r), make([]byte, DefaultBufferSize), nil)
+		}},
+	} {
+		n, b, err := relayPair(t, data, v.Copy)
+		if err != nil {
+			t.Errorf("copy %v error: %v", v.Name, err)
+		}
+		if n != int64(len(data)) || !bytes.Equal(b, data) {
+			t.Errorf("copy %v error: copied %v bytes, read %v bytes", v.Name, n, len(b))
+		}
+	}
+
+	// progress is called while copying, and sums to the copied bytes
+	data = bytes.Repeat(data, 3)
+	for _, v := range []struct {
+		Name string
+		Wrap func(io.Reader) io.Reader
+	}{
+		{Name: "tcp", Wrap: func(r io.Reader) io.Reader { return r }},
+		{Name: "wrapped", Wrap: func(r io.Reader) io.Reader { return io.MultiReader(r) }},
+	} {
+		calls, sum := 0, int64(0)
+		n, b, err := relayPair(t, data, func(w io.Writer, r io.Reader) (int64, error) {
+			return copyConn(w, v.Wrap(r), make([]byte, DefaultBufferSize), func(n int64) {
+				calls, sum = calls+1, sum+n
+			})
+		})
+		if err != nil || n != int64(len(data)) || !bytes.Equal(b, data) {
+			t.Errorf("copy %v with progress error: copied %v bytes, read %v bytes, %v", v.Name, n, len(b), err)
+		}
+		if sum != n || calls < 3 {
+			t.Errorf("progress of %v error: %v calls of %v bytes", v.Name, calls, sum)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package trojan
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/imgk/caddy-trojan/socks"
+)
+
+// sha224 test vectors of FIPS 180-2
+var keyVectors = []struct {
+	Password string
+	Key      string
+}{
+	{Password: "", Key: "d14a028c2a3a2bc9476102bb288234c415a2b01f828ea62ac5b3e42f"},
+	{Password: "abc", Key: "23097d223405d8228642a477bda255b32aadbce4bda0b3f7e36c9da7"},
+	{Password: "abcdbcdecdefdefgefghfghighijhijkijkljklmklmnlmnomnopnopq", Key: "75388b16512776cc5dba5da1fd890150b0c6455cb4f58b1952522525"},
+}
+
+func TestGenKey(t *testing.T) {
+	for _, v := range keyVectors {
+		key := [HeaderLen]byte{}
+		GenKey(v.Password, key[:])
+		if string(key[:]) != v.Key {
+			t.Errorf("gen key of %q error: got %s, want %v", v.Password, key[:], v.Key)
+		}
+	}
+}
+
+func TestKeyScheme(t *testing.T) {
+	// the default scheme is the password of the trojan protocol
+	fn, ok := LookupKeyScheme(DefaultKeyScheme)
+	if !ok {
+		t.Fatalf("default key scheme is not registered")
+	}
+	for _, v := range keyVectors {
+		key := [HeaderLen]byte{}
+		fn(v.Password, key[:])
+		if string(key[:]) != v.Key {
+			t.Errorf("gen key of %q error: got %s, want %v", v.Password, key[:], v.Key)
+		}
+	}
+
+	if _, ok := LookupKeyScheme("unknown"); ok {
+		t.Errorf("lookup unknown key scheme")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("register key scheme %v twice", DefaultKeyScheme)
+			}
+		}()
+		RegisterKeyScheme(DefaultKeyScheme, GenKey)
+	}()
+}
+
+func TestParseHexKey(t *testing.T) {
+	for _, v := range keyVectors {
+		key := [HeaderLen]byte{}
+		if err := ParseHexKey(v.Key, key[:]); err != nil || string(key[:]) != v.Key {
+			t.Errorf("parse hex key %v error: %s, %v", v.Key, key[:], err)
+		}
+	}
+
+	// upper case is converted to the on-wire lower case
+	key := [HeaderLen]byte{}
+	if err := ParseHexKey("23097D223405D8228642A477BDA255B32AADBCE4BDA0B3F7E36C9DA7", key[:]); err != nil || string(key[:]) != keyVectors[1].Key {
+		t.Errorf("parse upper case hex key error: %s, %v", key[:], err)
+	}
+
+	for _, v := range []string{
+		"",
+		"23097d223405d8228642a477bda255b32aadbce4bda0b3f7e36c9da",
+		"23097d223405d8228642a477bda255b32aadbce4bda0b3f7e36c9dz7",
+	} {
+		if err := ParseHexKey(v, key[:]); err == nil {
+			t.Errorf("parse invalid hex key %q", v)
+		}
+	}
+}
+
+// failDialer is a Dialer which fails and records the dialed address.
+type failDialer struct {
+	addr string
+}
+
+func (d *failDialer) Dial(network, addr string) (net.Conn, error) {
+	d.addr = addr
+	return nil, errors.New("dial error")
+}
+
+func (d *failDialer) ListenPacket(network, addr string) (net.PacketConn, error) {
+	return nil, errors.New("listen packet error")
+}
+
+func TestHandleRequestFilter(t *testing.T) {
+	addr, err := socks.ResolveAddr(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80})
+	if err != nil {
+		t.Fatalf("resolve addr error: %v", err)
+	}
+	b := []byte{CmdConnect}
+	b = addr.AppendTo(b)
+	b = append(b, 0x0d, 0x0a)
+
+	errBlocked := errors.New("blocked")
+	d := &failDialer{}
+	parsed := false
+	req := &Request{Filter: func(net.Addr) error { return errBlocked }, Parsed: func() { parsed = true }}
+	if _, _, err := HandleRequest(bytes.NewReader(b), io.Discard, d, req); !errors.Is(err, errBlocked) {
+		t.Errorf("handle filtered request error: %v", err)
+	}
+	// the request is read before it is filtered
+	if !parsed {
+		t.Errorf("parsed is not called")
+	}
+	if d.addr != "" {
+		t.Errorf("dial filtered address %v", d.addr)
+	}
+	if req.Addr == nil || req.Addr.String() != "127.0.0.1:80" {
+		t.Errorf("record filtered request error: %v", req.Addr)
+	}
+
+	req = &Request{Filter: func(net.Addr) error { return nil }}
+	if _, _, err := HandleRequest(bytes.NewReader(b), io.Discard, d, req); err == nil || errors.Is(err, errBlocked) {
+		t.Errorf("handle allowed request error: %v", err)
+	}
+	if d.addr != "127.0.0.1:80" {
+		t.Errorf("dial allowed address error: %v", d.addr)
+	}
+}
+
+func TestHandleRequestAddr(t *testing.T) {
+	for _, v := range []struct {
+		Addr []byte
+		Dial string
+	}{
+		{Addr: []byte{socks.AddrTypeIPv4, 192, 0, 2, 1, 0x01, 0xbb}, Dial: "192.0.2.1:443"},
+		{Addr: []byte{socks.AddrTypeIPv6, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x01, 0xbb}, Dial: "[2001:db8::1]:443"},
+		{Addr: append(append([]byte{socks.AddrTypeDomain, 11}, "example.com"...), 0x01, 0xbb), Dial: "example.com:443"},
+		{Addr: append(append([]byte{socks.AddrTypeDomain, 23}, "xn--fsqu00a.xn--0zwm56d"...), 0x01, 0xbb), Dial: "xn--fsqu00a.xn--0zwm56d:443"},
+	} {
+		b := append([]byte{CmdConnect}, v.Addr...)
+		b = append(b, 0x0d, 0x0a)
+
+		d := &failDialer{}
+		req := &Request{}
+		HandleRequest(bytes.NewReader(b), io.Discard, d, req)
+		if d.addr != v.Dial {
+			t.Errorf("dial address error: got %v, want %v", d.addr, v.Dial)
+		}
+		if req.Addr == nil || req.Addr.String() != v.Dial {
+			t.Errorf("record request error: got %v, want %v", req.Addr, v.Dial)
+		}
+	}
+}
+
+func TestCheckHeader(t *testing.T) {
+	key := [HeaderLen + 2]byte{}
+	GenKey("test1234", key[:HeaderLen])
+	key[HeaderLen], key[HeaderLen+1] = 0x0d, 0x0a
+	if err := CheckHeader(key[:]); err != nil {
+		t.Errorf("check header error: %v", err)
+	}
+
+	for _, b := range [][]byte{
+		key[:HeaderLen],
+		append(key[:HeaderLen:HeaderLen], 0x0a, 0x0d),
+		append(key[:HeaderLen:HeaderLen], 0x0d, 0x0d),
+		append(key[:HeaderLen:HeaderLen], 0x00, 0x0a),
+	} {
+		if err := CheckHeader(b); err == nil {
+			t.Errorf("check invalid header %q", b[HeaderLen-2:])
+		}
+	}
+	if err := CheckHeader(key[:HeaderLen]); !errors.Is(err, ErrInvalidHeaderLen) {
+		t.Errorf("check short header error: %v", err)
+	}
+	if err := CheckHeader(append(key[:HeaderLen:HeaderLen], 0x0a, 0x0d)); !errors.Is(err, ErrInvalidCRLF) {
+		t.Errorf("check header without 0x0d 0x0a error: %v", err)
+	}
+}
+
+func TestHandleRequestInvalid(t *testing.T) {
+	for _, v := range []struct {
+		Name string
+		Data []byte
+		Err  error
+		Kind error
+	}{
+		{Name: "bind command", Data: []byte{0x02, socks.AddrTypeIPv4, 127, 0, 0, 1, 0, 80, 0x0d, 0x0a}, Err: ErrBadCommand, Kind: ErrBadCommand},
+		{Name: "zero command", Data: []byte{0x00, socks.AddrTypeIPv4, 127, 0, 0, 1, 0, 80, 0x0d, 0x0a}, Err: ErrBadCommand, Kind: ErrBadCommand},
+		{Name: "address type", Data: []byte{CmdConnect, 0x02, 127, 0, 0, 1, 0, 80, 0x0d, 0x0a}, Err: socks.ErrInvalidAddrType, Kind: ErrInvalidAddress},
+		{Name: "empty domain", Data: []byte{CmdConnect, socks.AddrTypeDomain, 0, 0, 80, 0x0d, 0x0a}, Err: socks.ErrInvalidAddrLen, Kind: ErrInvalidAddress},
+		{Name: "no command", Data: []byte{}, Err: io.EOF, Kind: ErrShortRequest},
+		{Name: "short address", Data: []byte{CmdConnect, socks.AddrTypeIPv6, 0, 0}, Err: io.ErrUnexpectedEOF, Kind: ErrShortRequest},
+		{Name: "short 0x0d 0x0a", Data: []byte{CmdConnect, socks.AddrTypeIPv4, 127, 0, 0, 1, 0, 80, 0x0d}, Err: io.ErrUnexpectedEOF, Kind: ErrShortRequest},
+		{Name: "no 0x0d 0x0a", Data: []byte{CmdConnect, socks.AddrTypeIPv4, 127, 0, 0, 1, 0, 80, 'G', 'E'}, Err: ErrInvalidCRLF, Kind: ErrInvalidCRLF},
+		{Name: "udp without 0x0d 0x0a", Data: []byte{CmdAssociate, socks.AddrTypeIPv4, 127, 0, 0, 1, 0, 80, 0x0a, 0x0d}, Err: ErrInvalidCRLF, Kind: ErrInvalidCRLF},
+	} {
+		d := &failDialer{}
+		_, _, err := HandleRequest(bytes.NewReader(v.Data), io.Discard, d, &Request{})
+		if !errors.Is(err, v.Err) {
+			t.Errorf("handle request of %v error: got %v, want %v", v.Name, err, v.Err)
+		}
+		if !errors.Is(err, v.Kind) {
+			t.Errorf("handle request of %v error: got %v, want kind %v", v.Name, err, v.Kind)
+		}
+		for _, kind := range []error{ErrBadCommand, ErrInvalidAddress, ErrInvalidCRLF, ErrShortRequest} {
+			if kind != v.Kind && errors.Is(err, kind) {
+				t.Errorf("handle request of %v error: %v is of %v", v.Name, err, kind)
+			}
+		}
+		if d.addr != "" {
+			t.Errorf("dial address %v of invalid request of %v", d.addr, v.Name)
+		}
+	}
+}
+
+func TestCommandSupported(t *testing.T) {
+	for cmd := 0; cmd < 256; cmd++ {
+		want := cmd == CmdConnect || cmd == CmdAssociate
+		if ok := CommandSupported(byte(cmd), false); ok != want {
+			t.Errorf("command %#02x supported: %v", cmd, ok)
+		}
+		if ok := CommandSupported(byte(cmd), true); ok != (want || cmd == CmdMux) {
+			t.Errorf("command %#02x supported of mux: %v", cmd, ok)
+		}
+	}
+	// the deprecated name is of the same error
+	if !errors.Is(ErrBadCommand, ErrInvalidCommand) {
+		t.Errorf("ErrInvalidCommand is not ErrBadCommand")
+	}
+}
+
+func FuzzHandleRequest(f *testing.F) {
+	f.Add([]byte{CmdConnect, socks.AddrTypeIPv4, 127, 0, 0, 1, 0, 80, 0x0d, 0x0a})
+	f.Add([]byte{CmdConnect, socks.AddrTypeDomain, 9, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't', 0, 80, 0x0d, 0x0a})
+	f.Add([]byte{CmdConnect, socks.AddrTypeIPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 80, 0x0d, 0x0a})
+	f.Add([]byte{CmdAssociate, socks.AddrTypeIPv4, 0, 0, 0, 0, 0, 0, 0x0d, 0x0a})
+	f.Add([]byte{0x02, socks.AddrTypeIPv4, 127, 0, 0, 1, 0, 80, 0x0d, 0x0a})
+	f.Add([]byte("GET / HTTP/1.1\r\n"))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		d := &failDialer{}
+		if _, _, err := HandleRequest(bytes.NewReader(b), io.Discard, d, &Request{}); err == nil {
+			t.Fatalf("handle request %x without error", b)
+		}
+		if d.addr == "" {
+			return
+		}
+		// only a well-formed CONNECT request is dialed
+		if b[0] != CmdConnect {
+			t.Fatalf("dial request %x of command %v", b, b[0])
+		}
+		addr, err := socks.ParseAddr(b[1:])
+		if err != nil {
+			t.Fatalf("dial request %x of invalid address: %v", b, err)
+		}
+		if n := 1 + addr.Len(); len(b) < n+2 || b[n] != 0x0d || b[n+1] != 0x0a {
+			t.Fatalf("dial request %x without 0x0d 0x0a", b)
+		}
+		if d.addr != addr.String() {
+			t.Fatalf("dial request %x of address %v, want %v", b, d.addr, addr)
+		}
+	})
+}
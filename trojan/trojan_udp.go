@@ -16,18 +16,33 @@ import (
 // HandleUDP is ...
 // [AddrType(1 byte)][Addr(max 256 byte)][Port(2 byte)][Len(2 byte)][0x0d, 0x0a][Data(max 65535 byte)]
 func HandleUDP(r io.Reader, w io.Writer, timeout time.Duration, d Dialer) (int64, int64, error) {
+	return handleUDP(r, w, timeout, d, nil, nil)
+}
+
+// handleUDP is HandleUDP, and checks the destination of packets with filter.
+// progress is called with the bytes of each packet, if not nil.
+func handleUDP(r io.Reader, w io.Writer, timeout time.Duration, d Dialer, filter func(net.Addr) error, progress func(nr, nw int64)) (int64, int64, error) {
 	rc, err := d.ListenPacket("udp", "")
 	if err != nil {
 		return 0, 0, err
 	}
 	defer rc.Close()
 
+	resolve := socks.ResolveUDPAddr
+	if rs, ok := d.(UDPResolver); ok {
+		resolve = func(addr *socks.Addr) (*net.UDPAddr, error) {
+			return rs.ResolveUDPAddr(addr.String())
+		}
+	}
+
 	type Result struct {
 		Num int64
 		Err error
 	}
 
 	errCh := make(chan Result, 0)
+	// closed when the client stops sending
+	done := make(chan struct{})
 	go func(rc net.PacketConn, r io.Reader, errCh chan Result) (nr int64, err error) {
 		defer func() {
 			if errors.Is(err, io.EOF) || errors.Is(err, os.ErrDeadlineExceeded) {
@@ -55,7 +70,13 @@ func HandleUDP(r io.Reader, w io.Writer, timeout time.Duration, d Dialer) (int64
 			l := raddr.Len()
 
 			if !bytes.Equal(bb, raddr.Bytes()) {
-				addr, er := socks.ResolveUDPAddr(raddr)
+				if filter != nil {
+					if er := filter(raddr); er != nil {
+						err = er
+						break
+					}
+				}
+				addr, er := resolve(raddr)
 				if er != nil {
 					err = er
 					break
@@ -68,9 +89,16 @@ func HandleUDP(r io.Reader, w io.Writer, timeout time.Duration, d Dialer) (int64
 				err = er
 				break
 			}
+			if b[l+2] != 0x0d || b[l+3] != 0x0a {
+				err = ErrInvalidCRLF
+				break
+			}
 
 			l += (int(b[l])<<8 | int(b[l+1]))
 			nr += int64(l) + 4
+			if progress != nil {
+				progress(int64(l)+4, 0)
+			}
 
 			buf := b[raddr.Len():l]
 			if _, er := io.ReadFull(r, buf); er != nil {
@@ -83,6 +111,7 @@ func HandleUDP(r io.Reader, w io.Writer, timeout time.Duration, d Dialer) (int64
 				break
 			}
 		}
+		close(done)
 		rc.SetReadDeadline(time.Now())
 		return
 	}(rc, r, errCh)
@@ -95,6 +124,12 @@ func HandleUDP(r io.Reader, w io.Writer, timeout time.Duration, d Dialer) (int64
 		b[socks.MaxAddrLen+3] = 0x0a
 		for {
 			rc.SetReadDeadline(time.Now().Add(timeout))
+			// do not override the deadline set when the client stops sending
+			select {
+			case <-done:
+				rc.SetReadDeadline(time.Now())
+			default:
+			}
 			n, addr, er := rc.ReadFrom(b[socks.MaxAddrLen+4:])
 			if er != nil {
 				err = er
@@ -120,8 +155,12 @@ func HandleUDP(r io.Reader, w io.Writer, timeout time.Duration, d Dialer) (int64
 				}
 			}(b[:socks.MaxAddrLen], addr.(*net.UDPAddr))
 			nw += 4 + int64(n) + l
+			if progress != nil {
+				progress(0, 4+int64(n)+l)
+			}
 
-			if _, ew := w.Write(b[socks.MaxAddrLen-l : socks.MaxAddrLen+4+n]); ew != nil {
+			// a packet written in part breaks the framing of the stream
+			if _, ew := writeFull(w, b[socks.MaxAddrLen-l:socks.MaxAddrLen+4+n]); ew != nil {
 				err = ew
 				break
 			}
@@ -0,0 +1,84 @@
+package trojan
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/imgk/caddy-trojan/socks"
+)
+
+func TestHandleUDP(t *testing.T) {
+	// udp echo server
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp error: %v", err)
+	}
+	defer pc.Close()
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(b[:n], addr)
+		}
+	}()
+
+	addr, err := socks.ResolveAddr(pc.LocalAddr())
+	if err != nil {
+		t.Fatalf("resolve addr error: %v", err)
+	}
+
+	payload := []byte("hello trojan")
+	// [Cmd][Addr][0x0d, 0x0a] [Addr][Len][0x0d, 0x0a][Data]
+	req := []byte{CmdAssociate}
+	req = addr.AppendTo(req)
+	req = append(req, 0x0d, 0x0a)
+	req = addr.AppendTo(req)
+	req = append(req, byte(len(payload)>>8), byte(len(payload)), 0x0d, 0x0a)
+	req = append(req, payload...)
+
+	r, rw := io.Pipe()
+	wr, w := io.Pipe()
+	defer rw.Close()
+
+	go func() {
+		rw.Write(req)
+	}()
+
+	type Result struct {
+		Up   int64
+		Down int64
+	}
+	done := make(chan Result, 1)
+	go func() {
+		nr, nw, _ := Handle(r, w)
+		w.Close()
+		done <- Result{Up: nr, Down: nw}
+	}()
+
+	resp := make([]byte, addr.Len()+4+len(payload))
+	if _, err := io.ReadFull(wr, resp); err != nil {
+		t.Fatalf("read response error: %v", err)
+	}
+	if !bytes.Equal(resp[:addr.Len()], addr.Bytes()) {
+		t.Errorf("response addr error: %v", resp[:addr.Len()])
+	}
+	if !bytes.Equal(resp[addr.Len()+4:], payload) {
+		t.Errorf("response payload error: %s", resp[addr.Len()+4:])
+	}
+
+	rw.Close()
+	select {
+	case res := <-done:
+		if n := int64(addr.Len() + 4 + len(payload)); res.Up != n || res.Down != n {
+			t.Errorf("traffic error: up %v, down %v, want %v", res.Up, res.Down, n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("handle udp does not return")
+	}
+}
@@ -35,6 +35,11 @@ func (c *rawConn) Read(b []byte) (int, error) {
 	return n, err
 }
 
+// NetConn returns the wrapped net.Conn.
+func (c *rawConn) NetConn() net.Conn {
+	return c.Conn
+}
+
 // CloseWrite is ...
 func (c *rawConn) CloseWrite() error {
 	if cc, ok := c.Conn.(*net.TCPConn); ok {
@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"io"
+	"time"
+)
+
+// Deadline calls a function when a single Read or Write does not finish
+// in its timeout. Unlike IdleTimer, the timeout is rolled for each
+// operation, so a peer which reads or sends a byte every few seconds
+// can not keep an operation blocked forever.
+type Deadline struct {
+	read  time.Duration
+	write time.Duration
+	rt    *time.Timer
+	wt    *time.Timer
+}
+
+// NewDeadline returns a Deadline of read and write timeouts, and 0 means no
+// timeout of the operation.
+func NewDeadline(read, write time.Duration, fn func()) *Deadline {
+	t := &Deadline{read: read, write: write}
+	if read > 0 {
+		t.rt = time.AfterFunc(read, fn)
+		t.rt.Stop()
+	}
+	if write > 0 {
+		t.wt = time.AfterFunc(write, fn)
+		t.wt.Stop()
+	}
+	return t
+}
+
+// Stop is ...
+func (t *Deadline) Stop() {
+	if t.rt != nil {
+		t.rt.Stop()
+	}
+	if t.wt != nil {
+		t.wt.Stop()
+	}
+}
+
+// Reader returns r of which every Read must finish in the read timeout.
+// It is not safe for concurrent Reads.
+func (t *Deadline) Reader(r io.Reader) io.Reader {
+	if t.rt == nil {
+		return r
+	}
+	return &deadlineReader{Reader: r, timer: t.rt, timeout: t.read}
+}
+
+// Writer returns w of which every Write must finish in the write timeout.
+// It is not safe for concurrent Writes.
+func (t *Deadline) Writer(w io.Writer) io.Writer {
+	if t.wt == nil {
+		return w
+	}
+	return &deadlineWriter{Writer: w, timer: t.wt, timeout: t.write}
+}
+
+// deadlineReader is ...
+type deadlineReader struct {
+	io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+// Read is ...
+func (r *deadlineReader) Read(b []byte) (int, error) {
+	r.timer.Reset(r.timeout)
+	n, err := r.Reader.Read(b)
+	r.timer.Stop()
+	return n, err
+}
+
+// deadlineWriter is ...
+type deadlineWriter struct {
+	io.Writer
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+// Write is ...
+func (w *deadlineWriter) Write(b []byte) (int, error) {
+	w.timer.Reset(w.timeout)
+	n, err := w.Writer.Write(b)
+	w.timer.Stop()
+	return n, err
+}
+
+// CloseWrite is ...
+func (w *deadlineWriter) CloseWrite() error {
+	if cw, ok := w.Writer.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowWriter accepts a write after a delay.
+type slowWriter time.Duration
+
+// Write is ...
+func (w slowWriter) Write(b []byte) (int, error) {
+	time.Sleep(time.Duration(w))
+	return len(b), nil
+}
+
+func TestDeadline(t *testing.T) {
+	fired := make(chan struct{}, 2)
+	d := NewDeadline(0, 100*time.Millisecond, func() { fired <- struct{}{} })
+	defer d.Stop()
+
+	// writes which finish in the timeout do not fire, even if the
+	// relay takes longer than the timeout
+	w := d.Writer(slowWriter(50 * time.Millisecond))
+	for i := 0; i < 4; i++ {
+		w.Write([]byte{0})
+	}
+	select {
+	case <-fired:
+		t.Fatalf("deadline fired on writes in the timeout")
+	default:
+	}
+
+	// a write blocked longer than the timeout fires, though it finishes
+	d.Writer(slowWriter(200 * time.Millisecond)).Write([]byte{0})
+	select {
+	case <-fired:
+	default:
+		t.Fatalf("deadline does not fire")
+	}
+
+	// the reader without a timeout is not wrapped
+	if _, ok := d.Reader(strings.NewReader("")).(*deadlineReader); ok {
+		t.Errorf("reader without timeout is wrapped")
+	}
+}
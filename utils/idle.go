@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// IdleTimer calls a function when no data flows in either direction
+// for a timeout. Every Read and Write through the timer resets it, so
+// a slow but active transfer is never treated as idle.
+type IdleTimer struct {
+	timeout time.Duration
+	last    int64
+	timer   *time.Timer
+	fn      func()
+}
+
+// NewIdleTimer is ...
+func NewIdleTimer(timeout time.Duration, fn func()) *IdleTimer {
+	t := &IdleTimer{
+		timeout: timeout,
+		last:    time.Now().UnixNano(),
+		fn:      fn,
+	}
+	t.timer = time.AfterFunc(timeout, t.check)
+	return t
+}
+
+// check is ...
+func (t *IdleTimer) check() {
+	idle := time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&t.last))
+	if idle >= t.timeout {
+		t.fn()
+		return
+	}
+	t.timer.Reset(t.timeout - idle)
+}
+
+// Touch marks the connection as active.
+func (t *IdleTimer) Touch() {
+	atomic.StoreInt64(&t.last, time.Now().UnixNano())
+}
+
+// Stop is ...
+func (t *IdleTimer) Stop() {
+	t.timer.Stop()
+}
+
+// Reader is ...
+func (t *IdleTimer) Reader(r io.Reader) io.Reader {
+	return &idleReader{Reader: r, timer: t}
+}
+
+// Writer is ...
+func (t *IdleTimer) Writer(w io.Writer) io.Writer {
+	return &idleWriter{Writer: w, timer: t}
+}
+
+// idleReader is ...
+type idleReader struct {
+	io.Reader
+	timer *IdleTimer
+}
+
+// Read is ...
+func (r *idleReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		r.timer.Touch()
+	}
+	return n, err
+}
+
+// idleWriter is ...
+type idleWriter struct {
+	io.Writer
+	timer *IdleTimer
+}
+
+// Write is ...
+func (w *idleWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	if n > 0 {
+		w.timer.Touch()
+	}
+	return n, err
+}
+
+// CloseWrite is ...
+func (w *idleWriter) CloseWrite() error {
+	if cw, ok := w.Writer.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestIdleTimer(t *testing.T) {
+	fired := make(chan struct{})
+	timer := NewIdleTimer(100*time.Millisecond, func() { close(fired) })
+	defer timer.Stop()
+
+	// a slow but active transfer is not idle
+	w := timer.Writer(io.Discard)
+	for i := 0; i < 5; i++ {
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte{0})
+		select {
+		case <-fired:
+			t.Fatalf("idle timer fired on active transfer")
+		default:
+		}
+	}
+
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatalf("idle timer does not fire")
+	}
+}
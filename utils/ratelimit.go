@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// waitN waits for n tokens, n may be larger than the burst of the limiter.
+func waitN(l *rate.Limiter, n int) error {
+	for burst := l.Burst(); n > 0; n -= burst {
+		if n < burst {
+			return l.WaitN(context.Background(), n)
+		}
+		if err := l.WaitN(context.Background(), burst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rateLimitReader is ...
+type rateLimitReader struct {
+	io.Reader
+	Limiter *rate.Limiter
+}
+
+// NewRateLimitReader is ...
+func NewRateLimitReader(r io.Reader, l *rate.Limiter) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &rateLimitReader{Reader: r, Limiter: l}
+}
+
+// Read is ...
+func (r *rateLimitReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		if er := waitN(r.Limiter, n); er != nil && err == nil {
+			err = er
+		}
+	}
+	return n, err
+}
+
+// Close closes the underlying reader if it is an io.Closer.
+func (r *rateLimitReader) Close() error {
+	if c, ok := r.Reader.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// rateLimitWriter is ...
+type rateLimitWriter struct {
+	io.Writer
+	Limiter *rate.Limiter
+}
+
+// NewRateLimitWriter is ...
+func NewRateLimitWriter(w io.Writer, l *rate.Limiter) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &rateLimitWriter{Writer: w, Limiter: l}
+}
+
+// Write is ...
+func (w *rateLimitWriter) Write(b []byte) (int, error) {
+	if err := waitN(w.Limiter, len(b)); err != nil {
+		return 0, err
+	}
+	return w.Writer.Write(b)
+}
+
+// CloseWrite is ...
+func (w *rateLimitWriter) CloseWrite() error {
+	if cw, ok := w.Writer.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package utils
 import (
 	"bytes"
 	"crypto/tls"
+	"io"
 	"net"
 	"reflect"
 	"unsafe"
@@ -18,17 +19,22 @@ func StringToByteSlice(s string) []byte {
 	return unsafe.Slice((*byte)(unsafe.Pointer(*(*uintptr)(unsafe.Pointer(&s)))), len(s))
 }
 
+// RewindConn returns a net.Conn which reads the read bytes again, so the
+// caddy http server gets the whole request. A *tls.Conn is kept as it is,
+// for the http server to get the connection state.
 func RewindConn(conn net.Conn, read []byte) net.Conn {
 	if tlsConn, ok := conn.(*tls.Conn); ok {
 		var (
 			tlsInput, _ = reflect.TypeOf(tls.Conn{}).FieldByName("input")
 			input       = (*bytes.Reader)(unsafe.Add(unsafe.Pointer(tlsConn), tlsInput.Offset))
 			remaining   = input.Len()
-			size        = int(input.Size())
+			consumed    = int(input.Size()) - remaining
 			buffered    = len(read)
 		)
-		if buffered <= size {
-			_, _ = input.Seek(0, 0)
+		// the read bytes may span several records, and only the last
+		// one is kept in the input
+		if buffered <= consumed {
+			_, _ = input.Seek(int64(consumed-buffered), io.SeekStart)
 		} else {
 			buf := make([]byte, buffered+remaining)
 			copy(buf, read)
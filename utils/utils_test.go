@@ -2,7 +2,16 @@ package utils
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestByteSliceToString(t *testing.T) {
@@ -24,3 +33,113 @@ func TestStringToByteSlice(t *testing.T) {
 		}
 	}
 }
+
+// tlsConfig returns a config of a self-signed certificate.
+func tlsConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key error: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate error: %v", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert}, PrivateKey: key}},
+	}
+}
+
+func TestRewindConn(t *testing.T) {
+	request := []byte("GET /index.html HTTP/1.1\r\nHost: localhost\r\nUser-Agent: Mozilla/5.0 (X11; Linux x86_64; rv:100.0) Gecko/20100101 Firefox/100.0\r\n\r\n")
+
+	for _, v := range []struct {
+		Name string
+		// Records are the sizes of writes of the client, each write
+		// is a tls record.
+		Records []int
+		// Peek is the number of bytes read before rewinding.
+		Peek int
+	}{
+		{Name: "one record", Records: []int{len(request)}, Peek: 58},
+		{Name: "two records", Records: []int{16, len(request) - 16}, Peek: 58},
+		{Name: "three records", Records: []int{16, 16, len(request) - 32}, Peek: 58},
+		{Name: "whole record", Records: []int{58, len(request) - 58}, Peek: 58},
+		{Name: "tcp", Peek: 58},
+	} {
+		t.Run(v.Name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("listen error: %v", err)
+			}
+			defer ln.Close()
+
+			useTLS := len(v.Records) > 0
+			config := tlsConfig(t)
+			go func() {
+				c, err := net.Dial("tcp", ln.Addr().String())
+				if err != nil {
+					return
+				}
+				if !useTLS {
+					c.Write(request)
+					c.(*net.TCPConn).CloseWrite()
+					io.Copy(io.Discard, c)
+					return
+				}
+				tc := tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+				defer tc.Close()
+				b := request
+				for _, n := range v.Records {
+					if _, err := tc.Write(b[:n]); err != nil {
+						return
+					}
+					b = b[n:]
+					// stop the records from being read together
+					time.Sleep(10 * time.Millisecond)
+				}
+				tc.CloseWrite()
+				io.Copy(io.Discard, tc)
+			}()
+
+			c, err := ln.Accept()
+			if err != nil {
+				t.Fatalf("accept error: %v", err)
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+			if useTLS {
+				c = tls.Server(c, config)
+			}
+
+			// read as the listener, one byte at a time
+			b := make([]byte, v.Peek)
+			for n := 0; n < v.Peek; {
+				nr, err := c.Read(b[n : n+1])
+				if err != nil {
+					t.Fatalf("read error: %v", err)
+				}
+				n += nr
+			}
+
+			rc := RewindConn(c, b)
+			if _, ok := rc.(*tls.Conn); ok != useTLS {
+				t.Errorf("rewind conn error: *tls.Conn is %v", ok)
+			}
+			got, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatalf("read rewound conn error: %v", err)
+			}
+			if !bytes.Equal(got, request) {
+				t.Errorf("read rewound conn error: got %q, want %q", got, request)
+			}
+		})
+	}
+}